@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdrianPrawda/movie-poll/api/database"
+	"github.com/AdrianPrawda/movie-poll/api/handler"
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/AdrianPrawda/movie-poll/config"
+)
+
+// Admin operations, either run directly on the poll database or via the admin API.
+// Implemented by *handler.Admin and *apiBackend.
+type backend interface {
+	ListPolls(ctx context.Context, req messages.ListPollsReq) (messages.ListPollsResp, error)
+	Poll(ctx context.Context, id string) (messages.AdminPollResp, error)
+	SetClosed(ctx context.Context, id string, closed bool) error
+	DeleteChain(ctx context.Context, id string) (messages.DeleteChainResp, error)
+	Purge(ctx context.Context, req messages.PurgeReq) (messages.PurgeResp, error)
+	Recount(ctx context.Context, req messages.RecountReq) (messages.RecountResp, error)
+	Export(ctx context.Context, req messages.ExportReq) (messages.PollsExport, error)
+	Import(ctx context.Context, export *messages.PollsExport) (messages.ImportResp, error)
+	Backup(ctx context.Context) (messages.BackupInfo, error)
+	ListBackups(ctx context.Context) (messages.ListBackupsResp, error)
+	CopyBackup(ctx context.Context, name string, w io.Writer) error
+	Restore(ctx context.Context, name string) (messages.RestoreResp, error)
+	Audit(ctx context.Context, req messages.AuditReq) (messages.AuditResp, error)
+}
+
+// Opens the poll database. Fails if it wasn't migrated to the current schema by the api.
+// Backups are written to and pruned from the backup directory like those of the api.
+func openDB(ctx context.Context, dsn string, backups database.Backups, log *slog.Logger) (*handler.Admin, func() error, error) {
+	cfg := config.Default().DB
+	cfg.DSN = dsn
+	db, err := database.Open(cfg, log)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := database.CheckVersion(ctx, db); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return handler.NewAdmin(db, log, backups), db.Close, nil
+}
+
+// Calls the admin API of a running api server.
+type apiBackend struct {
+	client *http.Client
+	base   string
+	token  string
+}
+
+func newAPIBackend(base string, token string) *apiBackend {
+	return &apiBackend{
+		client: &http.Client{Timeout: 2 * time.Minute},
+		base:   strings.TrimSuffix(base, "/") + "/api/admin/v1",
+		token:  token,
+	}
+}
+
+// Sends req as JSON body and decodes the response into resp. Error responses are
+// returned as *messages.Error.
+func (a *apiBackend) call(ctx context.Context, method string, path string, req any, resp any) error {
+	res, err := a.do(ctx, method, path, req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+// Sends the request, the body of successful responses has to be closed by the caller.
+func (a *apiBackend) do(ctx context.Context, method string, path string, req any) (*http.Response, error) {
+	var body io.Reader
+	if req != nil {
+		data, err := json.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	r, err := http.NewRequestWithContext(ctx, method, a.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if req != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	r.Header.Set("Authorization", "Bearer "+a.token)
+
+	res, err := a.client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		apiErr := new(messages.Error)
+		if err := json.NewDecoder(res.Body).Decode(apiErr); err != nil || apiErr.Code == "" {
+			return nil, fmt.Errorf("api answered with status %d", res.StatusCode)
+		}
+		return nil, apiErr
+	}
+	return res, nil
+}
+
+func (a *apiBackend) ListPolls(ctx context.Context, req messages.ListPollsReq) (messages.ListPollsResp, error) {
+	query := url.Values{}
+	if req.Status != "" {
+		query.Set("status", string(req.Status))
+	}
+	if req.Limit != 0 {
+		query.Set("limit", strconv.Itoa(req.Limit))
+	}
+	var resp messages.ListPollsResp
+	err := a.call(ctx, http.MethodGet, "/polls?"+query.Encode(), nil, &resp)
+	return resp, err
+}
+
+func (a *apiBackend) Poll(ctx context.Context, id string) (messages.AdminPollResp, error) {
+	var resp messages.AdminPollResp
+	err := a.call(ctx, http.MethodGet, "/polls/"+url.PathEscape(id), nil, &resp)
+	return resp, err
+}
+
+func (a *apiBackend) SetClosed(ctx context.Context, id string, closed bool) error {
+	action := "/reopen"
+	if closed {
+		action = "/close"
+	}
+	return a.call(ctx, http.MethodPost, "/polls/"+url.PathEscape(id)+action, nil, nil)
+}
+
+func (a *apiBackend) DeleteChain(ctx context.Context, id string) (messages.DeleteChainResp, error) {
+	var resp messages.DeleteChainResp
+	err := a.call(ctx, http.MethodDelete, "/chains/"+url.PathEscape(id), nil, &resp)
+	return resp, err
+}
+
+func (a *apiBackend) Purge(ctx context.Context, req messages.PurgeReq) (messages.PurgeResp, error) {
+	var resp messages.PurgeResp
+	err := a.call(ctx, http.MethodPost, "/purge", req, &resp)
+	return resp, err
+}
+
+func (a *apiBackend) Recount(ctx context.Context, req messages.RecountReq) (messages.RecountResp, error) {
+	var resp messages.RecountResp
+	err := a.call(ctx, http.MethodPost, "/recount", req, &resp)
+	return resp, err
+}
+
+func (a *apiBackend) Export(ctx context.Context, req messages.ExportReq) (messages.PollsExport, error) {
+	query := url.Values{}
+	if req.PollID != "" {
+		query.Set("poll_id", req.PollID)
+	}
+	var resp messages.PollsExport
+	err := a.call(ctx, http.MethodGet, "/export?"+query.Encode(), nil, &resp)
+	return resp, err
+}
+
+func (a *apiBackend) Import(ctx context.Context, export *messages.PollsExport) (messages.ImportResp, error) {
+	var resp messages.ImportResp
+	err := a.call(ctx, http.MethodPost, "/import", export, &resp)
+	return resp, err
+}
+
+func (a *apiBackend) Backup(ctx context.Context) (messages.BackupInfo, error) {
+	var resp messages.BackupInfo
+	err := a.call(ctx, http.MethodPost, "/backups", nil, &resp)
+	return resp, err
+}
+
+func (a *apiBackend) ListBackups(ctx context.Context) (messages.ListBackupsResp, error) {
+	var resp messages.ListBackupsResp
+	err := a.call(ctx, http.MethodGet, "/backups", nil, &resp)
+	return resp, err
+}
+
+func (a *apiBackend) CopyBackup(ctx context.Context, name string, w io.Writer) error {
+	res, err := a.do(ctx, http.MethodGet, "/backups/"+url.PathEscape(name), nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+func (a *apiBackend) Restore(ctx context.Context, name string) (messages.RestoreResp, error) {
+	var resp messages.RestoreResp
+	err := a.call(ctx, http.MethodPost, "/restore", messages.RestoreReq{Name: name}, &resp)
+	return resp, err
+}
+
+func (a *apiBackend) Audit(ctx context.Context, req messages.AuditReq) (messages.AuditResp, error) {
+	query := url.Values{}
+	if req.PollID != "" {
+		query.Set("poll_id", req.PollID)
+	}
+	if req.Action != "" {
+		query.Set("action", string(req.Action))
+	}
+	if req.Actor != "" {
+		query.Set("actor", req.Actor)
+	}
+	if !req.Since.IsZero() {
+		query.Set("since", req.Since.Format(time.RFC3339))
+	}
+	if !req.Until.IsZero() {
+		query.Set("until", req.Until.Format(time.RFC3339))
+	}
+	if req.Before != 0 {
+		query.Set("before", strconv.FormatInt(req.Before, 10))
+	}
+	if req.Limit != 0 {
+		query.Set("limit", strconv.Itoa(req.Limit))
+	}
+	var resp messages.AuditResp
+	err := a.call(ctx, http.MethodGet, "/audit?"+query.Encode(), nil, &resp)
+	return resp, err
+}
@@ -0,0 +1,588 @@
+// Admin tool for movie poll. Works directly on the poll database (-db) or via the admin API
+// of a running api server (-api). Prefer the API while the api server is running, it serves
+// cached polls for a few seconds after changes made to the database by others.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/AdrianPrawda/movie-poll/api/database"
+	"github.com/AdrianPrawda/movie-poll/api/handler"
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/AdrianPrawda/movie-poll/api/util"
+	"github.com/AdrianPrawda/movie-poll/config"
+)
+
+const usage = `Usage: moviepoll [-db DSN | -api URL -token TOKEN] [-json] <command> [arguments]
+
+Commands:
+  list [-status STATUS] [-limit N]                   list polls, newest first, STATUS is open, closed,
+                                                     concluded or deleted
+  show <poll_id>                                     show a poll with its tallies
+  close <poll_id>                                    reject further votes
+  reopen <poll_id>                                   accept votes again
+  delete-chain <poll_id>                             permanently delete all polls of the poll's chain
+  purge -older-than DURATION [-dry-run]              delete closed and concluded polls
+  recount [-dry-run]                                 fix cast votes from the stored ballots
+  export [-poll poll_id] [-o FILE]                   export all polls or a chain as JSON
+  import [-format json|csv] <FILE|->                 import an export or CSV document, polls get new ids
+  backup [-o FILE]                                   back up the poll database, -o also copies the backup to FILE
+  backups                                            list backups
+  restore <NAME>                                     replace the poll database with a backup, the replaced
+                                                     database is backed up first
+  audit [-poll poll_id] [-action A] [-actor A]       list audit events of poll mutations, newest first
+        [-since T] [-until T] [-before ID] [-limit N]
+
+Flags:
+`
+
+// Error printed by main, exits with status 2
+var errUsage = errors.New("invalid usage")
+
+type cli struct {
+	backend backend
+	json    bool
+	out     io.Writer
+}
+
+func main() {
+	fs := flag.NewFlagSet("moviepoll", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	dsn := fs.String("db", os.Getenv("MOVIEPOLL_POLLDB"), "sqlite connection string of the poll database (env MOVIEPOLL_POLLDB)")
+	api := fs.String("api", "", "base url of a running api, e.g. http://localhost:35555")
+	token := fs.String("token", os.Getenv("MOVIEPOLL_ADMINTOKEN"), "admin token of the api (env MOVIEPOLL_ADMINTOKEN)")
+	backup_dir := fs.String("backupdir", "", "backup directory used with -db (defaults to backup.dir of the api config)")
+	json_out := fs.Bool("json", false, "print JSON instead of text")
+	timeout := fs.Duration("timeout", time.Minute, "timeout of the command")
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		os.Exit(2)
+	}
+	if fs.NArg() == 0 || (*dsn == "") == (*api == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	c := &cli{json: *json_out, out: os.Stdout}
+	if *api != "" {
+		c.backend = newAPIBackend(*api, *token)
+	} else {
+		log, _ := util.NewLogger(os.Stderr, "warn", "text")
+		// backups are kept like those of the api, from its config file and environment
+		cfg, err := config.Load("api", nil)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "moviepoll:", err)
+			os.Exit(1)
+		}
+		backups := database.Backups{Dir: cfg.Backup.Dir, Keep: cfg.Backup.Keep}
+		if *backup_dir != "" {
+			backups.Dir = *backup_dir
+		}
+		admin, close, err := openDB(ctx, *dsn, backups, log)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "moviepoll:", err)
+			os.Exit(1)
+		}
+		defer close()
+		c.backend = admin
+		// the api records changes made through it as caused by the admin
+		ctx = handler.ContextWithActor(ctx, cliActor())
+	}
+
+	if err := c.run(ctx, fs.Arg(0), fs.Args()[1:]); err != nil {
+		if errors.Is(err, errUsage) {
+			fmt.Fprintln(os.Stderr, "moviepoll:", err)
+			os.Exit(2)
+		}
+		fmt.Fprintln(os.Stderr, "moviepoll:", describe(err))
+		os.Exit(1)
+	}
+}
+
+// Actor of audit events recorded by commands working directly on the poll database.
+func cliActor() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return "cli:" + u.Username
+	}
+	return "cli"
+}
+
+// Formats API errors including their code and details.
+func describe(err error) string {
+	var apiErr *messages.Error
+	if !errors.As(err, &apiErr) {
+		return err.Error()
+	}
+	msg := fmt.Sprintf("%s (%s)", apiErr.Message, apiErr.Code)
+	keys := make([]string, 0, len(apiErr.Details))
+	for key := range apiErr.Details {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		msg += fmt.Sprintf(", %s: %v", key, apiErr.Details[key])
+	}
+	return msg
+}
+
+func (c *cli) run(ctx context.Context, command string, args []string) error {
+	switch command {
+	case "list":
+		return c.list(ctx, args)
+	case "show":
+		return c.show(ctx, args)
+	case "close":
+		return c.setClosed(ctx, args, true)
+	case "reopen":
+		return c.setClosed(ctx, args, false)
+	case "delete-chain":
+		return c.deleteChain(ctx, args)
+	case "purge":
+		return c.purge(ctx, args)
+	case "recount":
+		return c.recount(ctx, args)
+	case "export":
+		return c.export(ctx, args)
+	case "import":
+		return c.importPolls(ctx, args)
+	case "backup":
+		return c.backup(ctx, args)
+	case "backups":
+		return c.listBackups(ctx, args)
+	case "restore":
+		return c.restore(ctx, args)
+	case "audit":
+		return c.audit(ctx, args)
+	default:
+		return fmt.Errorf("%w: unknown command %q", errUsage, command)
+	}
+}
+
+// Parses command flags, fails unless exactly nargs arguments remain.
+func parse(fs *flag.FlagSet, args []string, nargs int) error {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if fs.NArg() != nargs {
+		return fmt.Errorf("%w: %s expects %d arguments", errUsage, fs.Name(), nargs)
+	}
+	return nil
+}
+
+// Prints resp as JSON if requested, calls text otherwise.
+func (c *cli) print(resp any, text func(w *tabwriter.Writer)) error {
+	if c.json {
+		return writeJSON(c.out, resp)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	text(w)
+	return w.Flush()
+}
+
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (c *cli) list(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	status := fs.String("status", "", "only list polls with this status (open, closed, concluded or deleted)")
+	limit := fs.Int("limit", 0, "maximum number of polls (0 is unlimited)")
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	resp, err := c.backend.ListPolls(ctx, messages.ListPollsReq{Status: messages.PollStatus(*status), Limit: *limit})
+	if err != nil {
+		return err
+	}
+	return c.print(resp, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "ID\tSTATUS\tTYPE\tVOTES\tCREATED\tTITLE")
+		for _, poll := range resp.Polls {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d/%d\t%s\t%s\n", poll.ID, poll.Status, poll.Type,
+				poll.VotesCast, poll.VotesRequired, poll.CreatedAt.Format(time.DateTime), poll.Title)
+		}
+	})
+}
+
+func (c *cli) show(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("show", flag.ContinueOnError)
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	resp, err := c.backend.Poll(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return c.print(resp, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "ID:\t%s\n", resp.ID)
+		fmt.Fprintf(w, "Title:\t%s\n", resp.Title)
+		fmt.Fprintf(w, "Type:\t%s\n", resp.Type)
+		fmt.Fprintf(w, "Status:\t%s\n", resp.Status)
+		fmt.Fprintf(w, "Votes:\t%d/%d\n", resp.VotesCast, resp.VotesRequired)
+		fmt.Fprintf(w, "Auto create:\t%t\n", resp.AutoCreate)
+		fmt.Fprintf(w, "Identity:\t%s\n", resp.Identity)
+		fmt.Fprintf(w, "Invite only:\t%t\n", resp.InviteOnly)
+		fmt.Fprintf(w, "Visibility:\t%s\n", resp.Visibility)
+		fmt.Fprintf(w, "Anonymous:\t%t\n", resp.Anonymous)
+		fmt.Fprintf(w, "Created:\t%s\n", resp.CreatedAt.Format(time.DateTime))
+		fmt.Fprintf(w, "Previous poll:\t%s\n", orNone(resp.PrevPoll))
+		fmt.Fprintf(w, "Next poll:\t%s\n", orNone(resp.NextPoll))
+		fmt.Fprintf(w, "Latest poll:\t%s\n", orNone(resp.LatestPoll))
+		fmt.Fprintln(w)
+
+		winners := make(map[int]bool, len(resp.Winners))
+		for _, id := range resp.Winners {
+			winners[id] = true
+		}
+		fmt.Fprintln(w, "CHOICE\tVOTES\tWINNER\tCONTENT")
+		for _, result := range resp.Results {
+			winner := ""
+			if winners[result.ID] {
+				winner = "*"
+			}
+			fmt.Fprintf(w, "%d\t%d\t%s\t%s\n", result.ID, result.Votes, winner, result.Content)
+		}
+	})
+}
+
+func orNone(id string) string {
+	if id == "" {
+		return "-"
+	}
+	return id
+}
+
+func (c *cli) setClosed(ctx context.Context, args []string, closed bool) error {
+	name := "reopen"
+	if closed {
+		name = "close"
+	}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	if err := c.backend.SetClosed(ctx, fs.Arg(0), closed); err != nil {
+		return err
+	}
+	resp := struct {
+		PollID string `json:"poll_id"`
+		Closed bool   `json:"closed"`
+	}{fs.Arg(0), closed}
+	return c.print(resp, func(w *tabwriter.Writer) {
+		if closed {
+			fmt.Fprintf(w, "Closed poll %s\n", resp.PollID)
+		} else {
+			fmt.Fprintf(w, "Reopened poll %s\n", resp.PollID)
+		}
+	})
+}
+
+func (c *cli) deleteChain(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("delete-chain", flag.ContinueOnError)
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	resp, err := c.backend.DeleteChain(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return c.print(resp, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Deleted %d polls\n", len(resp.Deleted))
+		for _, id := range resp.Deleted {
+			fmt.Fprintln(w, id)
+		}
+	})
+}
+
+func (c *cli) purge(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ContinueOnError)
+	older_than := fs.Duration("older-than", 0, "purge polls created before now - duration, e.g. 720h")
+	dry_run := fs.Bool("dry-run", false, "only list polls which would be purged")
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	set := false
+	fs.Visit(func(f *flag.Flag) { set = set || f.Name == "older-than" })
+	if !set {
+		return fmt.Errorf("%w: purge requires -older-than", errUsage)
+	}
+
+	resp, err := c.backend.Purge(ctx, messages.PurgeReq{OlderThan: older_than.String(), DryRun: *dry_run})
+	if err != nil {
+		return err
+	}
+	return c.print(resp, func(w *tabwriter.Writer) {
+		if resp.DryRun {
+			fmt.Fprintf(w, "Would purge %d polls\n", len(resp.Purged))
+		} else {
+			fmt.Fprintf(w, "Purged %d polls\n", len(resp.Purged))
+		}
+		for _, id := range resp.Purged {
+			fmt.Fprintln(w, id)
+		}
+	})
+}
+
+func (c *cli) recount(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("recount", flag.ContinueOnError)
+	dry_run := fs.Bool("dry-run", false, "only list polls whose cast votes are wrong")
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	resp, err := c.backend.Recount(ctx, messages.RecountReq{DryRun: *dry_run})
+	if err != nil {
+		return err
+	}
+	return c.print(resp, func(w *tabwriter.Writer) {
+		if resp.DryRun {
+			fmt.Fprintf(w, "Would fix %d polls\n", len(resp.Fixed))
+		} else {
+			fmt.Fprintf(w, "Fixed %d polls\n", len(resp.Fixed))
+		}
+		if len(resp.Fixed) == 0 {
+			return
+		}
+		fmt.Fprintln(w, "POLL\tSTORED\tCOUNTED")
+		for _, poll := range resp.Fixed {
+			fmt.Fprintf(w, "%s\t%d\t%d\n", poll.PollID, poll.Stored, poll.Counted)
+		}
+	})
+}
+
+// Always writes JSON, the export format is the JSON document.
+func (c *cli) export(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	poll_id := fs.String("poll", "", "only export the chain of this poll")
+	file := fs.String("o", "", "output file (default stdout)")
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	resp, err := c.backend.Export(ctx, messages.ExportReq{PollID: *poll_id})
+	if err != nil {
+		return err
+	}
+
+	if *file == "" {
+		return writeJSON(c.out, resp)
+	}
+	f, err := os.Create(*file)
+	if err != nil {
+		return err
+	}
+	if err := writeJSON(f, resp); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d polls to %s\n", len(resp.Polls), *file)
+	return nil
+}
+
+func (c *cli) importPolls(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", "", "json or csv (default csv for .csv files, json otherwise)")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+	if *format == "" {
+		*format = "json"
+		if strings.EqualFold(filepath.Ext(fs.Arg(0)), ".csv") {
+			*format = "csv"
+		}
+	}
+
+	in := io.Reader(os.Stdin)
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	export := new(messages.PollsExport)
+	switch *format {
+	case "json":
+		if err := json.NewDecoder(in).Decode(export); err != nil {
+			return fmt.Errorf("invalid export: %w", err)
+		}
+	case "csv":
+		var err error
+		if export, err = handler.ParseImportCSV(in); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: unknown import format %q", errUsage, *format)
+	}
+
+	resp, err := c.backend.Import(ctx, export)
+	if err != nil {
+		return err
+	}
+	if *format == "csv" {
+		resp.Choices = nil
+	}
+	return c.print(resp, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Imported %d polls\n", len(resp.Polls))
+		fmt.Fprintln(w, "EXPORTED\tIMPORTED")
+		for _, poll := range export.Polls {
+			fmt.Fprintf(w, "%s\t%s\n", poll.ID, resp.Polls[poll.ID])
+		}
+	})
+}
+
+func (c *cli) backup(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	file := fs.String("o", "", "also copy the backup to this file")
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	// existing files aren't overwritten, fail before creating the backup
+	var f *os.File
+	if *file != "" {
+		var err error
+		if f, err = os.OpenFile(*file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640); err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+
+	resp, err := c.backend.Backup(ctx)
+	if err == nil && f != nil {
+		if err = c.backend.CopyBackup(ctx, resp.Name, f); err == nil {
+			err = f.Close()
+		}
+	}
+	if err != nil {
+		if f != nil {
+			os.Remove(*file)
+		}
+		return err
+	}
+	return c.print(resp, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Created backup %s (%d bytes)\n", resp.Name, resp.Size)
+		if *file != "" {
+			fmt.Fprintf(w, "Copied backup to %s\n", *file)
+		}
+	})
+}
+
+func (c *cli) listBackups(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("backups", flag.ContinueOnError)
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	resp, err := c.backend.ListBackups(ctx)
+	if err != nil {
+		return err
+	}
+	return c.print(resp, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "NAME\tSIZE\tCREATED")
+		for _, backup := range resp.Backups {
+			fmt.Fprintf(w, "%s\t%d\t%s\n", backup.Name, backup.Size, backup.CreatedAt.Format(time.DateTime))
+		}
+	})
+}
+
+func (c *cli) restore(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	resp, err := c.backend.Restore(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return c.print(resp, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Restored %s, the replaced database was backed up as %s\n", resp.Restored, resp.Previous)
+		if resp.WebhooksRemoved > 0 {
+			fmt.Fprintf(w, "Removed %d webhooks without secret, they have to be registered again\n", resp.WebhooksRemoved)
+		}
+	})
+}
+
+func (c *cli) audit(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	poll_id := fs.String("poll", "", "only list events of this poll")
+	action := fs.String("action", "", "only list events of this action, e.g. create, vote or delete")
+	actor := fs.String("actor", "", "only list events of this actor, e.g. admin or ip:127.0.0.1")
+	since := fs.String("since", "", "only list events at or after this time (RFC 3339)")
+	until := fs.String("until", "", "only list events before this time (RFC 3339)")
+	before := fs.Int64("before", 0, "only list events with smaller ids, the next cursor of the previous page")
+	limit := fs.Int("limit", 0, "maximum number of events (default 100, at most 1000)")
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	req := messages.AuditReq{
+		PollID: *poll_id,
+		Action: messages.AuditAction(*action),
+		Actor:  *actor,
+		Before: *before,
+		Limit:  *limit,
+	}
+	for _, t := range []struct {
+		flag  string
+		value string
+		dst   *time.Time
+	}{{"since", *since, &req.Since}, {"until", *until, &req.Until}} {
+		if t.value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, t.value)
+		if err != nil {
+			return fmt.Errorf("%w: invalid -%s: %v", errUsage, t.flag, err)
+		}
+		*t.dst = parsed
+	}
+
+	resp, err := c.backend.Audit(ctx, req)
+	if err != nil {
+		return err
+	}
+	return c.print(resp, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "ID\tTIME\tACTION\tPOLL\tACTOR\tREQUEST\tPAYLOAD")
+		for _, event := range resp.Events {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", event.ID, event.CreatedAt.Format(time.DateTime), event.Action,
+				orNone(event.PollID), event.Actor, orNone(event.RequestID), event.Payload)
+		}
+		if resp.Next != 0 {
+			fmt.Fprintf(w, "\nMore events with -before %d\n", resp.Next)
+		}
+	})
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AdrianPrawda/movie-poll/api/database"
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/AdrianPrawda/movie-poll/config"
+	"github.com/huandu/go-sqlbuilder"
+)
+
+func TestMain(m *testing.M) {
+	sqlbuilder.DefaultFlavor = sqlbuilder.SQLite
+	os.Exit(m.Run())
+}
+
+// Returns the DSN of a migrated poll database in a temporary directory.
+func setupDB(t *testing.T) string {
+	t.Helper()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := config.Default().DB
+	cfg.DSN = "file:" + filepath.Join(t.TempDir(), "poll.db")
+	db, err := database.Open(cfg, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := database.Setup(cfg, log, db); err != nil {
+		t.Fatal(err)
+	}
+	return cfg.DSN
+}
+
+// Runs a command and returns its output.
+func (c *cli) exec(t *testing.T, args ...string) string {
+	t.Helper()
+	out := new(bytes.Buffer)
+	c.out = out
+	if err := c.run(context.Background(), args[0], args[1:]); err != nil {
+		t.Fatalf("%v: %s", args, describe(err))
+	}
+	return out.String()
+}
+
+func TestCommands(t *testing.T) {
+	dsn := setupDB(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	admin, close, err := openDB(context.Background(), dsn, database.Backups{Dir: t.TempDir()}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+	c := &cli{backend: admin, json: true}
+
+	file := filepath.Join(t.TempDir(), "history.csv")
+	csv := "poll_id,title,choice,user_id,target_votes\n" +
+		"old,Movie night,Alien,alice,\n" +
+		"old,,Heat,bob,\n" +
+		"old,,Heat,carol,\n" +
+		"new,Next movie night,Ronin,alice,5\n" +
+		"new,,Alien,,\n"
+	if err := os.WriteFile(file, []byte(csv), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var imported messages.ImportResp
+	if err := json.Unmarshal([]byte(c.exec(t, "import", file)), &imported); err != nil {
+		t.Fatal(err)
+	}
+	concluded, open := imported.Polls["old"], imported.Polls["new"]
+	if concluded == "" || open == "" || imported.Choices != nil {
+		t.Fatalf("unexpected import %+v", imported)
+	}
+
+	var listed messages.ListPollsResp
+	if err := json.Unmarshal([]byte(c.exec(t, "list", "-status", "open")), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed.Polls) != 1 || listed.Polls[0].ID != open {
+		t.Errorf("open polls %+v", listed.Polls)
+	}
+
+	c.json = false
+	shown := c.exec(t, "show", concluded)
+	// choice ids are assigned by the database, compare rows without them
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(shown, "\n") {
+		fields := strings.Fields(line)
+		lines[strings.Join(fields, " ")] = true
+		if len(fields) > 1 {
+			lines[strings.Join(fields[1:], " ")] = true
+		}
+	}
+	for _, line := range []string{"Status: concluded", "Votes: 3/3", "Previous poll: -"} {
+		if !lines[line] {
+			t.Errorf("show is missing %q:\n%s", line, shown)
+		}
+	}
+	if !lines["2 * Heat"] || !lines["1 Alien"] {
+		t.Errorf("show doesn't mark the winner:\n%s", shown)
+	}
+
+	if out := c.exec(t, "close", open); out != "Closed poll "+open+"\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+	if out := c.exec(t, "list", "-status", "closed"); !strings.Contains(out, open) || strings.Contains(out, concluded) {
+		t.Errorf("unexpected closed polls:\n%s", out)
+	}
+	c.exec(t, "reopen", open)
+	if out := c.exec(t, "recount", "-dry-run"); out != "Would fix 0 polls\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+	if out := c.exec(t, "delete-chain", concluded); !strings.HasPrefix(out, "Deleted 1 polls\n") {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestUsageErrors(t *testing.T) {
+	c := &cli{out: io.Discard}
+	for _, args := range [][]string{
+		{"unknown"},
+		{"show"},
+		{"close", "a", "b"},
+		{"list", "-unknown"},
+		{"purge"},
+		{"audit", "-since", "yesterday"},
+	} {
+		if err := c.run(context.Background(), args[0], args[1:]); !errors.Is(err, errUsage) {
+			t.Errorf("%v: %v", args, err)
+		}
+	}
+}
+
+func TestOpenUnmigratedDB(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dsn := "file:" + filepath.Join(t.TempDir(), "poll.db")
+	if _, _, err := openDB(context.Background(), dsn, database.Backups{}, log); err == nil {
+		t.Error("database without schema was opened")
+	}
+}
+
+func TestAPIBackend(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Header.Get("Authorization") != "Bearer admin-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(messages.Error{Code: messages.UNAUTHORIZED, Message: "unauthorized"})
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/admin/v1/polls":
+			if r.URL.RawQuery != "limit=1&status=open" {
+				t.Errorf("unexpected query %q", r.URL.RawQuery)
+			}
+			json.NewEncoder(w).Encode(messages.ListPollsResp{Polls: []messages.PollSummary{{ID: "p1"}}})
+		case "POST /api/admin/v1/polls/p1/close":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(messages.Error{
+				Code:    messages.POLL_NOT_FOUND,
+				Message: "poll not found",
+				Details: map[string]any{"poll_id": "p2", "chain": "p1"},
+			})
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	api := newAPIBackend(server.URL+"/", "admin-token")
+	resp, err := api.ListPolls(ctx, messages.ListPollsReq{Status: messages.OPEN, Limit: 1})
+	if err != nil || len(resp.Polls) != 1 || resp.Polls[0].ID != "p1" {
+		t.Errorf("unexpected polls %+v: %v", resp, err)
+	}
+	if err := api.SetClosed(ctx, "p1", true); err != nil {
+		t.Error(err)
+	}
+
+	_, err = api.Poll(ctx, "p2")
+	if msg := describe(err); msg != "poll not found (poll_not_found), chain: p1, poll_id: p2" {
+		t.Errorf("unexpected error %q", msg)
+	}
+	_, err = newAPIBackend(server.URL, "wrong").ListPolls(ctx, messages.ListPollsReq{})
+	var apiErr *messages.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != messages.UNAUTHORIZED {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,387 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Backups of the poll database, written as plain SQLite databases.
+
+var (
+	ErrBackupNotFound = errors.New("backup not found")
+	ErrBackupExists   = errors.New("backup file already exists")
+)
+
+// Writes a consistent copy of the poll database to path using VACUUM INTO. Votes can be
+// cast while the copy is written. The copy is written next to path and renamed once
+// complete, existing files are never overwritten. Webhook secrets are removed from the copy,
+// backups are downloaded and kept around longer than the database.
+func Backup(ctx context.Context, db *sql.DB, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%w: %s", ErrBackupExists, path)
+	}
+	tmp := path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, "VACUUM INTO ?", tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := scrubSecrets(ctx, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Clears the webhook secrets of a backup. Secure delete overwrites the old values instead of
+// leaving them in free pages.
+func scrubSecrets(ctx context.Context, path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	dsn := "file:" + (&url.URL{Path: abs}).EscapedPath()
+	dst, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	dst.SetMaxOpenConns(1)
+	// databases from before webhooks have none
+	var exists bool
+	if err := dst.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'webhook')").Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		if _, err := dst.ExecContext(ctx, "PRAGMA secure_delete = ON; UPDATE webhook SET secret = ''"); err != nil {
+			return err
+		}
+	}
+	return dst.Close()
+}
+
+// Fails unless path is an intact poll database of the current schema version.
+func CheckBackup(ctx context.Context, path string) error {
+	src, err := openBackup(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return checkBackup(ctx, src)
+}
+
+func checkBackup(ctx context.Context, src *sql.DB) error {
+	var result string
+	if err := src.QueryRowContext(ctx, "PRAGMA quick_check").Scan(&result); err != nil {
+		return fmt.Errorf("backup is not a readable database: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("backup is corrupt: %s", result)
+	}
+	version, err := Version(ctx, src)
+	if err != nil {
+		return err
+	}
+	if version != SchemaVersion {
+		return fmt.Errorf("backup has schema version %d, expected %d", version, SchemaVersion)
+	}
+	return nil
+}
+
+// Replaces the contents of the poll database with the backup at path. The backup is checked
+// before, the contents are swapped by the SQLite online backup API within a single write lock.
+// Readers see either the old or the restored database.
+// Restored webhooks keep the secrets they have in the replaced database. Webhooks removed since
+// the backup was created have no secret left and are removed, returns their number.
+func Restore(ctx context.Context, db *sql.DB, path string) (int64, error) {
+	src, err := openBackup(path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	if err := checkBackup(ctx, src); err != nil {
+		return 0, err
+	}
+	secrets, err := webhookSecrets(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+
+	src_conn, err := src.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer src_conn.Close()
+	dst_conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer dst_conn.Close()
+
+	err = dst_conn.Raw(func(dst any) error {
+		return src_conn.Raw(func(src any) error {
+			return copyDatabase(ctx, dst.(*sqlite3.SQLiteConn), src.(*sqlite3.SQLiteConn))
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := CheckVersion(ctx, db); err != nil {
+		return 0, err
+	}
+	return restoreSecrets(ctx, db, secrets)
+}
+
+// Returns the webhook secrets of the poll database by webhook id.
+func webhookSecrets(ctx context.Context, db *sql.DB) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, secret FROM webhook WHERE secret != ''")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	secrets := make(map[string]string)
+	for rows.Next() {
+		var id, secret string
+		if err := rows.Scan(&id, &secret); err != nil {
+			return nil, err
+		}
+		secrets[id] = secret
+	}
+	return secrets, rows.Err()
+}
+
+// Sets the secrets of restored webhooks and removes those without secret, including their
+// deliveries. Returns the number of removed webhooks.
+func restoreSecrets(ctx context.Context, db *sql.DB, secrets map[string]string) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for id, secret := range secrets {
+		if _, err := tx.ExecContext(ctx, "UPDATE webhook SET secret=? WHERE id=? AND secret = ''", secret, id); err != nil {
+			return 0, err
+		}
+	}
+	res, err := tx.ExecContext(ctx, "DELETE FROM webhook WHERE secret = ''")
+	if err != nil {
+		return 0, err
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return removed, tx.Commit()
+}
+
+// Copies all pages at once, retrying while other connections hold locks.
+func copyDatabase(ctx context.Context, dst *sqlite3.SQLiteConn, src *sqlite3.SQLiteConn) error {
+	backup, err := dst.Backup("main", src, "main")
+	if err != nil {
+		return err
+	}
+	for {
+		done, err := backup.Step(-1)
+		if done {
+			return backup.Finish()
+		}
+		var sqliteErr sqlite3.Error
+		if err != nil && !(errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)) {
+			backup.Finish()
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			backup.Finish()
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// Opens a backup read-only without the poll DB pragmas.
+func openBackup(path string) (*sql.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %s", ErrBackupNotFound, path)
+		}
+		return nil, err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	dsn := "file:" + (&url.URL{Path: abs}).EscapedPath() + "?mode=ro"
+	src, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	src.SetMaxOpenConns(1)
+	return src, nil
+}
+
+// Backup file of a backup directory
+type BackupFile struct {
+	Name      string
+	Size      int64
+	CreatedAt time.Time
+}
+
+// Backup files are named after their creation time, e.g. poll-20240501T120000.000Z.db
+const (
+	backupPrefix = "poll-"
+	backupSuffix = ".db"
+	backupLayout = "20060102T150405.000Z"
+)
+
+// Directory of backups. Creating a backup removes the oldest timestamped backups exceeding
+// Keep, 0 keeps all backups.
+type Backups struct {
+	Dir  string
+	Keep int
+}
+
+// Creates a new backup and removes old ones.
+func (b Backups) Create(ctx context.Context, db *sql.DB) (BackupFile, error) {
+	backup, err := b.Snapshot(ctx, db)
+	if err != nil {
+		return BackupFile{}, err
+	}
+	if _, err := b.Prune(); err != nil {
+		return BackupFile{}, err
+	}
+	return backup, nil
+}
+
+// Creates a new backup without removing old ones, e.g. while one of them is about to be restored.
+func (b Backups) Snapshot(ctx context.Context, db *sql.DB) (BackupFile, error) {
+	if err := os.MkdirAll(b.Dir, 0o750); err != nil {
+		return BackupFile{}, err
+	}
+	name := backupPrefix + time.Now().UTC().Format(backupLayout) + backupSuffix
+	path := filepath.Join(b.Dir, name)
+	if err := Backup(ctx, db, path); err != nil {
+		return BackupFile{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return BackupFile{}, err
+	}
+	return BackupFile{Name: name, Size: info.Size(), CreatedAt: info.ModTime().UTC()}, nil
+}
+
+// Lists backups, newest first. Other .db files copied into the directory are listed too.
+func (b Backups) List() ([]BackupFile, error) {
+	entries, err := os.ReadDir(b.Dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []BackupFile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]BackupFile, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !isBackupName(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, BackupFile{Name: entry.Name(), Size: info.Size(), CreatedAt: info.ModTime().UTC()})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].CreatedAt.After(backups[j].CreatedAt)
+	})
+	return backups, nil
+}
+
+// Returns the path of the named backup. Names of files outside the directory are rejected.
+func (b Backups) Path(name string) (string, error) {
+	if !isBackupName(name) {
+		return "", fmt.Errorf("%w: %s", ErrBackupNotFound, name)
+	}
+	path := filepath.Join(b.Dir, name)
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && !info.Mode().IsRegular()) {
+		return "", fmt.Errorf("%w: %s", ErrBackupNotFound, name)
+	}
+	return path, err
+}
+
+// Removes the oldest backups created by Create exceeding Keep and returns their names.
+func (b Backups) Prune() ([]string, error) {
+	if b.Keep <= 0 {
+		return nil, nil
+	}
+	backups, err := b.List()
+	if err != nil {
+		return nil, err
+	}
+	removed := make([]string, 0)
+	kept := 0
+	for _, backup := range backups {
+		if !isTimestampedName(backup.Name) {
+			continue
+		}
+		if kept < b.Keep {
+			kept++
+			continue
+		}
+		if err := os.Remove(filepath.Join(b.Dir, backup.Name)); err != nil {
+			return removed, err
+		}
+		removed = append(removed, backup.Name)
+	}
+	return removed, nil
+}
+
+// Creates a backup every interval until ctx is done. Failed backups are logged and retried
+// with the next interval.
+func (b Backups) Schedule(ctx context.Context, db *sql.DB, interval time.Duration, log *slog.Logger) {
+	log = log.With("dir", b.Dir)
+	log.Info("Scheduling backups", "interval", interval, "keep", b.Keep)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		backup, err := b.Create(ctx, db)
+		if err != nil {
+			log.Error("Scheduled backup failed", "error", err)
+			continue
+		}
+		log.Info("Created scheduled backup", "backup", backup.Name, "size", backup.Size)
+	}
+}
+
+func isBackupName(name string) bool {
+	return filepath.Base(name) == name && !strings.HasPrefix(name, ".") && strings.HasSuffix(name, backupSuffix)
+}
+
+func isTimestampedName(name string) bool {
+	if !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+		return false
+	}
+	_, err := time.Parse(backupLayout, strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupSuffix))
+	return err == nil
+}
@@ -0,0 +1,220 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Opens a migrated poll database with one poll.
+func openSetupDB(t *testing.T) *sql.DB {
+	t.Helper()
+	cfg, db := openTestDB(t)
+	if err := Setup(cfg, testLogger(), db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO poll(id, title, target_votes) VALUES ("p1", "Movie night", 2)`); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// Returns the ids of all polls.
+func pollIDs(t *testing.T, db *sql.DB) []string {
+	t.Helper()
+	rows, err := db.Query("SELECT id FROM poll ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	ctx := context.Background()
+	db := openSetupDB(t)
+	path := filepath.Join(t.TempDir(), "backup.db")
+	if err := Backup(ctx, db, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := Backup(ctx, db, path); !errors.Is(err, ErrBackupExists) {
+		t.Errorf("existing backup was overwritten: %v", err)
+	}
+	if err := CheckBackup(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(`INSERT INTO poll(id, title, target_votes) VALUES ("p2", "Next movie night", 2)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Restore(ctx, db, path); err != nil {
+		t.Fatal(err)
+	}
+	if ids := pollIDs(t, db); !reflect.DeepEqual(ids, []string{"p1"}) {
+		t.Errorf("polls %v after restoring", ids)
+	}
+}
+
+func TestBackupsHaveNoWebhookSecrets(t *testing.T) {
+	ctx := context.Background()
+	db := openSetupDB(t)
+	const KEPT, REMOVED = "kept-secret-4f1c9a", "removed-secret-8d2e7b"
+	if _, err := db.Exec(`INSERT INTO webhook(id, poll_id, url, secret) VALUES ("w1", "p1", "https://example.com", ?), ("w2", "p1", "https://example.com", ?)`,
+		KEPT, REMOVED); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "backup.db")
+	if err := Backup(ctx, db, path); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(contents, []byte(KEPT)) || bytes.Contains(contents, []byte(REMOVED)) {
+		t.Error("backup contains webhook secrets")
+	}
+
+	// webhooks removed since the backup can't be restored without their secret
+	if _, err := db.Exec(`DELETE FROM webhook WHERE id = "w2"`); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := Restore(ctx, db, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("%d webhooks removed, expected 1", removed)
+	}
+	var secret string
+	if err := db.QueryRow(`SELECT secret FROM webhook WHERE id = "w1"`).Scan(&secret); err != nil || secret != KEPT {
+		t.Errorf("restored webhook has secret %q: %v", secret, err)
+	}
+	var webhooks int
+	if err := db.QueryRow("SELECT COUNT(*) FROM webhook").Scan(&webhooks); err != nil || webhooks != 1 {
+		t.Errorf("%d webhooks after restoring: %v", webhooks, err)
+	}
+}
+
+func TestRestoreChecksBackup(t *testing.T) {
+	ctx := context.Background()
+	db := openSetupDB(t)
+	dir := t.TempDir()
+
+	garbage := filepath.Join(dir, "garbage.db")
+	if err := os.WriteFile(garbage, []byte("not a database"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// databases from before versioning have to be migrated by the api first
+	_, baseline := openBaselineDB(t)
+	outdated := filepath.Join(dir, "outdated.db")
+	if err := Backup(ctx, baseline, outdated); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{garbage, outdated} {
+		if _, err := Restore(ctx, db, path); err == nil {
+			t.Errorf("%s was restored", filepath.Base(path))
+		}
+	}
+	if _, err := Restore(ctx, db, filepath.Join(dir, "missing.db")); !errors.Is(err, ErrBackupNotFound) {
+		t.Errorf("unexpected error restoring a missing backup: %v", err)
+	}
+	if ids := pollIDs(t, db); !reflect.DeepEqual(ids, []string{"p1"}) {
+		t.Errorf("polls %v after failed restores", ids)
+	}
+}
+
+func TestBackups(t *testing.T) {
+	ctx := context.Background()
+	db := openSetupDB(t)
+	b := Backups{Dir: filepath.Join(t.TempDir(), "backups"), Keep: 2}
+	if backups, err := b.List(); err != nil || len(backups) != 0 {
+		t.Fatalf("missing directory lists %v: %v", backups, err)
+	}
+
+	created := make([]string, 0, 3)
+	for i := 0; i < 3; i++ {
+		backup, err := b.Create(ctx, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		created = append(created, backup.Name)
+		// names have millisecond precision, modification times order the list
+		time.Sleep(10 * time.Millisecond)
+	}
+	// copied files are listed, but never pruned
+	if err := os.WriteFile(filepath.Join(b.Dir, "copied.db"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Prune(); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := b.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(backups))
+	for _, backup := range backups {
+		names = append(names, backup.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"copied.db", created[2], created[1]}) {
+		t.Errorf("listed %v, created %v", names, created)
+	}
+
+	if _, err := b.Path(created[2]); err != nil {
+		t.Error(err)
+	}
+	for _, name := range []string{created[0], "../poll.db", ".hidden.db", "notes.txt", "missing.db"} {
+		if _, err := b.Path(name); !errors.Is(err, ErrBackupNotFound) {
+			t.Errorf("path of %q: %v", name, err)
+		}
+	}
+}
+
+func TestScheduledBackups(t *testing.T) {
+	db := openSetupDB(t)
+	b := Backups{Dir: t.TempDir(), Keep: 1}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.Schedule(ctx, db, 10*time.Millisecond, testLogger())
+		close(done)
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		backups, err := b.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(backups) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no backup was created")
+		}
+	}
+	cancel()
+	<-done
+	if backups, _ := b.List(); len(backups) != 1 {
+		t.Errorf("%d backups kept, expected 1", len(backups))
+	}
+}
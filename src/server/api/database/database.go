@@ -0,0 +1,251 @@
+// Poll database setup and schema migrations.
+package database
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdrianPrawda/movie-poll/api/util"
+	"github.com/AdrianPrawda/movie-poll/config"
+	"github.com/mattn/go-sqlite3"
+	"github.com/qustavo/dotsql"
+)
+
+// Version of the poll database schema, stored as PRAGMA user_version. init.sql creates
+// the schema of this version, migrations.sql has a migration named migrate-<version> for
+// every version. Databases created before versioning have version 0.
+const SchemaVersion = 9
+
+// Number of tables created by init.sql before versioning, see Setup
+const INITIAL_TABLES = 4
+
+// sqlite3 driver running the poll DB pragmas on every new connection
+const driverName = "sqlite3_poll"
+
+//go:embed init.sql
+var initSQL string
+
+//go:embed migrations.sql
+var migrationsSQL string
+
+var (
+	register    sync.Once
+	busyTimeout atomic.Int64 // milliseconds
+)
+
+// Opens the poll database. Connections are established lazily, see Setup.
+func Open(cfg config.DB, log *slog.Logger) (*sql.DB, error) {
+	// pragmas are connection specific and have to be set for all pooled connections
+	register.Do(func() {
+		sql.Register(driverName, &sqlite3.SQLiteDriver{
+			ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+				pragmas := fmt.Sprintf(
+					"PRAGMA foreign_keys = ON; PRAGMA busy_timeout = %d;",
+					busyTimeout.Load())
+				_, err := conn.Exec(pragmas, nil)
+				return err
+			},
+		})
+	})
+	busyTimeout.Store(cfg.BusyTimeout.Milliseconds())
+
+	db, err := sql.Open(driverName, cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+
+	// shared in-memory databases are dropped once the last connection closes
+	if InMemory(cfg.DSN) {
+		log.Info("In-Memory database detected, adjusting connection settings")
+		if cfg.MaxIdleConns < 1 {
+			db.SetMaxIdleConns(2)
+		}
+		db.SetConnMaxLifetime(0)
+	}
+	return db, nil
+}
+
+// Checks if the connection string refers to an in-memory database.
+func InMemory(dsn string) bool {
+	return strings.Contains(dsn, ":memory:")
+}
+
+// Waits for the poll database to become available, creates missing tables and
+// migrates the schema to the current version.
+func Setup(cfg config.DB, log *slog.Logger, db *sql.DB) error {
+	log.Info("Setting up databases")
+
+	// check DB connection, pings time out with increasing durations and
+	// failed attempts wait before retrying
+	attempts := 0
+	timeouts := util.NewExpBackoffContext(context.Background(), 2*time.Second, 1.25)
+	backoff := util.NewExpBackoffContext(context.Background(), 500*time.Millisecond, 2)
+
+	for {
+		ctx, cancel := timeouts.Next()
+		err := db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			break
+		}
+		attempts++
+		if attempts >= 5 {
+			log.Error("Could not establish connection to poll database", "error", err)
+			return errors.New("could not establish connection to poll database")
+		}
+		log.Warn("Could not ping poll DB, retrying", "attempt", attempts, "error", err)
+		backoff.Wait(0.2)
+	}
+	log.Info("Successfully pinged poll DB")
+
+	// WAL lets readers continue while votes are written. The journal mode is persistent,
+	// but can't be changed within a transaction.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if !InMemory(cfg.DSN) {
+		log.Debug("Switching poll DB to WAL journal mode")
+		var mode string
+		if err := db.QueryRowContext(ctx, "PRAGMA journal_mode = WAL;").Scan(&mode); err != nil {
+			log.Error("Couldn't set journal mode pragma")
+			return err
+		}
+		if mode != "wal" {
+			log.Warn("Poll DB doesn't support WAL journal mode", "journal_mode", mode)
+		}
+	}
+
+	// prepare DB
+	log.Debug("Loading init sql file")
+	ds, err := dotsql.LoadFromString(initSQL)
+	if err != nil {
+		log.Error("Couldn't load init sql file")
+		return err
+	}
+	migrations, err := dotsql.LoadFromString(migrationsSQL)
+	if err != nil {
+		log.Error("Couldn't load migrations sql file")
+		return err
+	}
+
+	log.Debug("Setting up init transcation")
+	ctx, tx_cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer tx_cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Error("Couldn't begin init transaction", "error", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var version, tables int
+	if err := tx.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if err := tx.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='poll'").Scan(&tables); err != nil {
+		return err
+	}
+	if version > SchemaVersion {
+		return fmt.Errorf("poll database schema version %d is newer than supported version %d", version, SchemaVersion)
+	}
+
+	// new databases are created with the current schema. Databases created before versioning
+	// report 0 and might miss tables of the initial schema, everything added later on is created
+	// by the migrations.
+	statements := []struct{ name, desc string }{
+		{"create-poll-table", "poll table"},
+		{"create-choice-table", "choice table"},
+		{"create-vote-table", "vote table"},
+		{"create-next-poll-table", "next poll table"},
+		{"create-invite-table", "invite table"},
+		{"create-voter-table", "voter table"},
+		{"create-audit-event-table", "audit event table"},
+		{"create-audit-event-indexes", "audit event indexes"},
+		{"create-audit-event-triggers", "audit event triggers"}, // audit events are append only
+		{"create-webhook-table", "webhook table"},
+		{"create-webhook-delivery-table", "webhook delivery table"}, // outbox of webhook payloads
+		{"create-webhook-attempt-table", "webhook attempt table"},   // delivery log
+		{"create-webhook-indexes", "webhook indexes"},
+		{"create-vote-choice-trigger", "vote choice trigger"}, // votes must reference choices of the same poll
+	}
+	if tables != 0 {
+		statements = statements[:INITIAL_TABLES]
+	}
+	if version == 0 {
+		for _, stmt := range statements {
+			log.Info("Preparing " + stmt.desc)
+			query, err := ds.Raw(stmt.name)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(query); err != nil {
+				return err
+			}
+		}
+	}
+
+	if tables == 0 {
+		query, err := ds.Raw("set-schema-version")
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	} else {
+		for next := version + 1; next <= SchemaVersion; next++ {
+			log.Info("Migrating schema", "to", next)
+			query, err := migrations.Raw(fmt.Sprintf("migrate-%d", next))
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(query); err != nil {
+				return fmt.Errorf("migration to schema version %d failed: %w", next, err)
+			}
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", SchemaVersion)); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version != SchemaVersion {
+		return fmt.Errorf("init sql file sets schema version %d, expected %d", version, SchemaVersion)
+	}
+
+	// try to commit
+	log.Debug("Commiting transaction")
+	return tx.Commit()
+}
+
+// Returns the schema version of the poll database.
+func Version(ctx context.Context, db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+// Fails unless the poll database has the current schema version. Databases are only
+// migrated by Setup.
+func CheckVersion(ctx context.Context, db *sql.DB) error {
+	version, err := Version(ctx, db)
+	if err != nil {
+		return err
+	}
+	if version != SchemaVersion {
+		return fmt.Errorf("poll database has schema version %d, expected %d (start the api to migrate it)", version, SchemaVersion)
+	}
+	return nil
+}
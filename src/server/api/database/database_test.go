@@ -0,0 +1,169 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/AdrianPrawda/movie-poll/config"
+)
+
+// schema of poll databases created before versioning was introduced
+const BASELINE_SCHEMA = "testdata/baseline.sql"
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// Opens a new poll database file in a temporary directory.
+func openTestDB(t *testing.T) (config.DB, *sql.DB) {
+	t.Helper()
+	cfg := config.Default().DB
+	cfg.DSN = "file:" + filepath.Join(t.TempDir(), "poll.db")
+	db, err := Open(cfg, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return cfg, db
+}
+
+// Opens a poll database with the schema from before versioning and a concluded poll.
+func openBaselineDB(t *testing.T) (config.DB, *sql.DB) {
+	t.Helper()
+	cfg, db := openTestDB(t)
+	baseline, err := os.ReadFile(BASELINE_SCHEMA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmts := []string{
+		string(baseline),
+		`INSERT INTO poll(id, title, target_votes) VALUES ("p1", "Movie night", 1), ("p2", "Next movie night", 1)`,
+		`INSERT INTO choice(poll_id, content) VALUES ("p1", "Alien"), ("p1", "Heat"), ("p2", "Alien")`,
+		`INSERT INTO vote(poll_id, choice_id, user) VALUES ("p1", 1, "alice")`,
+		`UPDATE poll SET cast_votes = 1 WHERE id = "p1"`,
+		`INSERT INTO next_poll(poll_id, next_poll) VALUES ("p1", "p2")`,
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cfg, db
+}
+
+// Returns the columns of all tables and the names of all indexes and triggers.
+func schema(t *testing.T, db *sql.DB) map[string][]string {
+	t.Helper()
+	rows, err := db.Query("SELECT type, name FROM sqlite_master WHERE name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := map[string][]string{}
+	for rows.Next() {
+		var typ, name string
+		if err := rows.Scan(&typ, &name); err != nil {
+			t.Fatal(err)
+		}
+		objects[typ+" "+name] = nil
+	}
+	if err := rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for object := range objects {
+		table, ok := strings.CutPrefix(object, "table ")
+		if !ok {
+			continue
+		}
+		rows, err := db.Query("SELECT name, type, \"notnull\", dflt_value FROM pragma_table_info(?) ORDER BY name", table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var name, typ string
+			var notnull bool
+			var dflt sql.NullString
+			if err := rows.Scan(&name, &typ, &notnull, &dflt); err != nil {
+				t.Fatal(err)
+			}
+			col := name + " " + typ
+			if notnull {
+				col += " NOT NULL"
+			}
+			if dflt.Valid {
+				col += " DEFAULT " + dflt.String
+			}
+			objects[object] = append(objects[object], col)
+		}
+		if err := rows.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return objects
+}
+
+func TestSetupCreatesSchema(t *testing.T) {
+	cfg, db := openTestDB(t)
+	for i := 0; i < 2; i++ {
+		if err := Setup(cfg, testLogger(), db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := CheckVersion(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetupMigratesUnversionedDatabase(t *testing.T) {
+	cfg, db := openBaselineDB(t)
+	if err := Setup(cfg, testLogger(), db); err != nil {
+		t.Fatal(err)
+	}
+	version, err := Version(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != SchemaVersion {
+		t.Fatalf("schema version is %d, expected %d", version, SchemaVersion)
+	}
+
+	// migrated databases have the same schema as new ones
+	fresh_cfg, fresh := openTestDB(t)
+	if err := Setup(fresh_cfg, testLogger(), fresh); err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := schema(t, db), schema(t, fresh); !reflect.DeepEqual(got, expected) {
+		t.Errorf("migrated schema differs from new schema\n got: %v\nwant: %v", got, expected)
+	}
+
+	// existing polls keep their data
+	var title string
+	var cast_votes int
+	var closed bool
+	var identity, visibility string
+	err = db.QueryRow("SELECT title, cast_votes, closed, identity, visibility FROM poll WHERE id = 'p1'").
+		Scan(&title, &cast_votes, &closed, &identity, &visibility)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title != "Movie night" || cast_votes != 1 || closed || identity != "raw" || visibility != "live" {
+		t.Errorf("unexpected migrated poll: %q %d %v %q %q", title, cast_votes, closed, identity, visibility)
+	}
+
+	// the vote choice trigger is added by the migrations
+	if _, err := db.Exec("INSERT INTO vote(poll_id, choice_id, user) VALUES ('p2', 1, 'bob')"); err == nil {
+		t.Error("vote for choice of another poll was accepted")
+	}
+
+	// migrated databases aren't migrated again
+	if err := Setup(cfg, testLogger(), db); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,154 @@
+--name: pragma_fk
+PRAGMA FOREIGN_KEYS = ON;
+
+-- name: create-poll-table
+CREATE TABLE IF NOT EXISTS poll(
+    id TEXT NOT NULL PRIMARY KEY,
+    title TEXT NOT NULL,
+    poll_type TEXT NOT NULL DEFAULT "single", --either single or multiple
+    cast_votes INT NOT NULL CHECK(cast_votes >= 0) DEFAULT 0,
+    target_votes INT NOT NULL CHECK(target_votes > 0), --number of votes needed for poll to conclude
+    auto_create BOOLEAN NOT NULL DEFAULT 1,
+    closed BOOLEAN NOT NULL DEFAULT 0, --closed polls reject votes until reopened
+    identity TEXT NOT NULL DEFAULT "raw", --how voters are identified, either raw, signed or authenticated
+    invite_only BOOLEAN NOT NULL DEFAULT 0, --only invite tokens can vote
+    owner_hash TEXT NOT NULL DEFAULT "", --sha-256 of the owner token, empty for polls without owner
+    visibility TEXT NOT NULL DEFAULT "live", --when tallies are shown, either live, voted or closed
+    anonymous BOOLEAN NOT NULL DEFAULT 0, --ballots can't be traced back to voters
+    voter_salt TEXT NOT NULL DEFAULT "", --scopes voter hashes of anonymous polls to the poll
+    created_at DATETIME NOT NULL DEFAULT current_timestamp,
+    deleted_at DATETIME --set by deleting the poll, it is purged once the trash retention expired
+);
+
+--name: create-choice-table
+CREATE TABLE IF NOT EXISTS choice(
+    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    poll_id INT NOT NULL,
+    content TEXT NOT NULL, --textural representation of that choice
+    FOREIGN KEY(poll_id) REFERENCES poll(id) ON DELETE CASCADE
+);
+
+--name: create-vote-table
+CREATE TABLE IF NOT EXISTS vote(
+    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    poll_id INT NOT NULL,
+    choice_id INT NOT NULL,
+    user TEXT NOT NULL, --user id
+    created_at DATETIME NOT NULL DEFAULT current_timestamp,
+    FOREIGN KEY(poll_id) REFERENCES poll(id) ON DELETE CASCADE,
+    FOREIGN KEY(choice_id) REFERENCES choice(id) ON DELETE CASCADE
+);
+
+--name: create-next-poll-table
+CREATE TABLE IF NOT EXISTS next_poll(
+    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    poll_id TEXT NOT NULL UNIQUE,
+    next_poll INT NOT NULL UNIQUE,
+    FOREIGN KEY(poll_id) REFERENCES poll(id) ON DELETE CASCADE,
+    FOREIGN KEY(next_poll) REFERENCES poll(id) ON DELETE CASCADE
+);
+
+--name: create-invite-table
+CREATE TABLE IF NOT EXISTS invite(
+    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    poll_id TEXT NOT NULL,
+    name TEXT NOT NULL, --invitee, votes are cast as this user
+    token_hash TEXT NOT NULL, --sha-256 of the invite token
+    used BOOLEAN NOT NULL DEFAULT 0, --set once the invitee voted
+    used_at DATETIME, --set once the invitee voted, stays empty for anonymous polls
+    UNIQUE(poll_id, name),
+    UNIQUE(poll_id, token_hash),
+    FOREIGN KEY(poll_id) REFERENCES poll(id) ON DELETE CASCADE
+);
+
+--name: create-voter-table
+CREATE TABLE IF NOT EXISTS voter(
+    poll_id TEXT NOT NULL, --anonymous poll
+    voter_hash TEXT NOT NULL, --keyed hash of the user
+    PRIMARY KEY(poll_id, voter_hash),
+    FOREIGN KEY(poll_id) REFERENCES poll(id) ON DELETE CASCADE
+) WITHOUT ROWID; --ordered by hash, rows must not reveal the order of votes
+
+--name: create-audit-event-table
+CREATE TABLE IF NOT EXISTS audit_event(
+    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    created_at DATETIME NOT NULL DEFAULT current_timestamp,
+    action TEXT NOT NULL, --create, vote, delete, auto_create or an admin operation
+    poll_id TEXT NOT NULL DEFAULT "", --no foreign key, events outlive their polls
+    actor TEXT NOT NULL, --who caused the event, e.g. admin, ip:<address> or system
+    request_id TEXT NOT NULL DEFAULT "",
+    payload TEXT NOT NULL DEFAULT "{}" CHECK(json_valid(payload))
+);
+
+--name: create-audit-event-indexes
+CREATE INDEX IF NOT EXISTS audit_event_poll_id ON audit_event(poll_id, id);
+CREATE INDEX IF NOT EXISTS audit_event_created_at ON audit_event(created_at);
+
+--name: create-audit-event-triggers
+CREATE TRIGGER IF NOT EXISTS audit_event_no_update
+BEFORE UPDATE ON audit_event
+BEGIN
+    SELECT RAISE(ABORT, 'audit events are append only');
+END;
+CREATE TRIGGER IF NOT EXISTS audit_event_no_delete
+BEFORE DELETE ON audit_event
+BEGIN
+    SELECT RAISE(ABORT, 'audit events are append only');
+END;
+
+--name: create-webhook-table
+CREATE TABLE IF NOT EXISTS webhook(
+    id TEXT NOT NULL PRIMARY KEY,
+    poll_id TEXT NOT NULL,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL, --signs payloads, stored as is since receivers verify signatures with it, empty in backups
+    events TEXT NOT NULL DEFAULT "[]" CHECK(json_valid(events)), --subscribed events, all events if empty
+    created_at DATETIME NOT NULL DEFAULT current_timestamp,
+    FOREIGN KEY(poll_id) REFERENCES poll(id) ON DELETE CASCADE
+);
+
+--name: create-webhook-delivery-table
+CREATE TABLE IF NOT EXISTS webhook_delivery(
+    id TEXT NOT NULL PRIMARY KEY, --sent as X-MoviePoll-Delivery
+    webhook_id TEXT NOT NULL,
+    event_id TEXT NOT NULL, --shared by the deliveries of an event to all webhooks
+    event TEXT NOT NULL, --e.g. vote.cast
+    payload TEXT NOT NULL CHECK(json_valid(payload)),
+    status TEXT NOT NULL DEFAULT "pending", --either pending, delivered or failed once all attempts failed
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME DEFAULT current_timestamp, --empty once the delivery finished
+    created_at DATETIME NOT NULL DEFAULT current_timestamp,
+    finished_at DATETIME,
+    FOREIGN KEY(webhook_id) REFERENCES webhook(id) ON DELETE CASCADE
+);
+
+--name: create-webhook-attempt-table
+CREATE TABLE IF NOT EXISTS webhook_attempt(
+    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    delivery_id TEXT NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT current_timestamp,
+    status_code INT NOT NULL DEFAULT 0, --0 if no response was received
+    error TEXT NOT NULL DEFAULT "",
+    duration_ms INT NOT NULL DEFAULT 0,
+    FOREIGN KEY(delivery_id) REFERENCES webhook_delivery(id) ON DELETE CASCADE
+);
+
+--name: create-webhook-indexes
+CREATE INDEX IF NOT EXISTS webhook_poll_id ON webhook(poll_id);
+CREATE INDEX IF NOT EXISTS webhook_delivery_due ON webhook_delivery(next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_delivery_webhook_id ON webhook_delivery(webhook_id, created_at);
+CREATE INDEX IF NOT EXISTS webhook_delivery_finished_at ON webhook_delivery(finished_at);
+CREATE INDEX IF NOT EXISTS webhook_attempt_delivery_id ON webhook_attempt(delivery_id, id);
+
+--name: create-vote-choice-trigger
+CREATE TRIGGER IF NOT EXISTS vote_choice_poll
+BEFORE INSERT ON vote
+FOR EACH ROW
+WHEN (SELECT poll_id FROM choice WHERE id = NEW.choice_id) IS NOT NEW.poll_id
+BEGIN
+    SELECT RAISE(ABORT, 'choice does not belong to poll');
+END;
+
+
+--name: set-schema-version
+PRAGMA user_version = 9; --keep in sync with database.SchemaVersion
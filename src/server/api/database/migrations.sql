@@ -0,0 +1,110 @@
+-- Migrations of existing poll databases, see database.SchemaVersion.
+-- init.sql has to create the same schema for new databases.
+
+--name: migrate-1
+CREATE TRIGGER IF NOT EXISTS vote_choice_poll
+BEFORE INSERT ON vote
+FOR EACH ROW
+WHEN (SELECT poll_id FROM choice WHERE id = NEW.choice_id) IS NOT NEW.poll_id
+BEGIN
+    SELECT RAISE(ABORT, 'choice does not belong to poll');
+END;
+
+--name: migrate-2
+ALTER TABLE poll ADD COLUMN closed BOOLEAN NOT NULL DEFAULT 0;
+
+--name: migrate-3
+ALTER TABLE poll ADD COLUMN identity TEXT NOT NULL DEFAULT "raw";
+
+--name: migrate-4
+ALTER TABLE poll ADD COLUMN invite_only BOOLEAN NOT NULL DEFAULT 0;
+ALTER TABLE poll ADD COLUMN owner_hash TEXT NOT NULL DEFAULT "";
+CREATE TABLE IF NOT EXISTS invite(
+    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    poll_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    token_hash TEXT NOT NULL,
+    used_at DATETIME,
+    UNIQUE(poll_id, name),
+    UNIQUE(poll_id, token_hash),
+    FOREIGN KEY(poll_id) REFERENCES poll(id) ON DELETE CASCADE
+);
+
+--name: migrate-5
+ALTER TABLE poll ADD COLUMN visibility TEXT NOT NULL DEFAULT "live";
+
+--name: migrate-6
+ALTER TABLE poll ADD COLUMN anonymous BOOLEAN NOT NULL DEFAULT 0;
+ALTER TABLE poll ADD COLUMN voter_salt TEXT NOT NULL DEFAULT "";
+ALTER TABLE invite ADD COLUMN used BOOLEAN NOT NULL DEFAULT 0;
+UPDATE invite SET used = 1 WHERE used_at IS NOT NULL;
+CREATE TABLE IF NOT EXISTS voter(
+    poll_id TEXT NOT NULL,
+    voter_hash TEXT NOT NULL,
+    PRIMARY KEY(poll_id, voter_hash),
+    FOREIGN KEY(poll_id) REFERENCES poll(id) ON DELETE CASCADE
+) WITHOUT ROWID;
+
+--name: migrate-7
+CREATE TABLE IF NOT EXISTS audit_event(
+    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    created_at DATETIME NOT NULL DEFAULT current_timestamp,
+    action TEXT NOT NULL,
+    poll_id TEXT NOT NULL DEFAULT "",
+    actor TEXT NOT NULL,
+    request_id TEXT NOT NULL DEFAULT "",
+    payload TEXT NOT NULL DEFAULT "{}" CHECK(json_valid(payload))
+);
+CREATE INDEX IF NOT EXISTS audit_event_poll_id ON audit_event(poll_id, id);
+CREATE INDEX IF NOT EXISTS audit_event_created_at ON audit_event(created_at);
+CREATE TRIGGER IF NOT EXISTS audit_event_no_update
+BEFORE UPDATE ON audit_event
+BEGIN
+    SELECT RAISE(ABORT, 'audit events are append only');
+END;
+CREATE TRIGGER IF NOT EXISTS audit_event_no_delete
+BEFORE DELETE ON audit_event
+BEGIN
+    SELECT RAISE(ABORT, 'audit events are append only');
+END;
+
+--name: migrate-8
+ALTER TABLE poll ADD COLUMN deleted_at DATETIME;
+
+--name: migrate-9
+CREATE TABLE IF NOT EXISTS webhook(
+    id TEXT NOT NULL PRIMARY KEY,
+    poll_id TEXT NOT NULL,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    events TEXT NOT NULL DEFAULT "[]" CHECK(json_valid(events)),
+    created_at DATETIME NOT NULL DEFAULT current_timestamp,
+    FOREIGN KEY(poll_id) REFERENCES poll(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS webhook_delivery(
+    id TEXT NOT NULL PRIMARY KEY,
+    webhook_id TEXT NOT NULL,
+    event_id TEXT NOT NULL,
+    event TEXT NOT NULL,
+    payload TEXT NOT NULL CHECK(json_valid(payload)),
+    status TEXT NOT NULL DEFAULT "pending",
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME DEFAULT current_timestamp,
+    created_at DATETIME NOT NULL DEFAULT current_timestamp,
+    finished_at DATETIME,
+    FOREIGN KEY(webhook_id) REFERENCES webhook(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS webhook_attempt(
+    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    delivery_id TEXT NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT current_timestamp,
+    status_code INT NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT "",
+    duration_ms INT NOT NULL DEFAULT 0,
+    FOREIGN KEY(delivery_id) REFERENCES webhook_delivery(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS webhook_poll_id ON webhook(poll_id);
+CREATE INDEX IF NOT EXISTS webhook_delivery_due ON webhook_delivery(next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_delivery_webhook_id ON webhook_delivery(webhook_id, created_at);
+CREATE INDEX IF NOT EXISTS webhook_delivery_finished_at ON webhook_delivery(finished_at);
+CREATE INDEX IF NOT EXISTS webhook_attempt_delivery_id ON webhook_attempt(delivery_id, id);
@@ -38,4 +38,4 @@ CREATE TABLE IF NOT EXISTS next_poll(
     next_poll INT NOT NULL UNIQUE,
     FOREIGN KEY(poll_id) REFERENCES poll(id) ON DELETE CASCADE,
     FOREIGN KEY(next_poll) REFERENCES poll(id) ON DELETE CASCADE
-)
\ No newline at end of file
+)
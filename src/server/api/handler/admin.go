@@ -0,0 +1,524 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/AdrianPrawda/movie-poll/api/database"
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/AdrianPrawda/movie-poll/api/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Admin operations, served by the admin API and used directly by the moviepoll CLI.
+// Errors are either poll operation errors or database errors.
+type Admin struct {
+	h *Handler
+}
+
+// Returns admin operations sharing the handler's database, cache and metrics.
+func (h *Handler) Admin() *Admin {
+	return &Admin{h}
+}
+
+// Creates admin operations working on the database without a running API.
+func NewAdmin(db *sql.DB, log *slog.Logger, backups database.Backups) *Admin {
+	h := NewHandler(db, log, metrics.New(prometheus.NewRegistry()), Timeouts{}, HealthConfig{})
+	h.SetBackups(backups)
+	return h.Admin()
+}
+
+// Status of a poll, closing a poll takes precedence over reaching its target votes.
+func pollStatus(closed bool, cast_votes uint, target_votes uint) messages.PollStatus {
+	switch {
+	case closed:
+		return messages.CLOSED
+	case cast_votes >= target_votes:
+		return messages.CONCLUDED
+	default:
+		return messages.OPEN
+	}
+}
+
+// Lists polls, optionally filtered by status. Deleted polls are only listed by their status.
+func (a *Admin) ListPolls(ctx context.Context, req messages.ListPollsReq) (messages.ListPollsResp, error) {
+	switch req.Status {
+	case "", messages.OPEN, messages.CLOSED, messages.CONCLUDED, messages.DELETED:
+	default:
+		return messages.ListPollsResp{}, errMalformedRequest.WithDetails("reason", fmt.Sprintf("unknown poll status %q", req.Status))
+	}
+	if req.Limit < 0 {
+		return messages.ListPollsResp{}, errMalformedRequest.WithDetails("reason", "limit must not be negative")
+	}
+
+	polls, err := a.h.queries.listPolls(ctx, req.Status, req.Limit)
+	if err != nil {
+		return messages.ListPollsResp{}, err
+	}
+	return messages.ListPollsResp{Polls: polls}, nil
+}
+
+// Returns a poll including its tallies.
+func (a *Admin) Poll(ctx context.Context, id string) (messages.AdminPollResp, error) {
+	poll, err := a.h.poll(ctx, id)
+	if err != nil {
+		return messages.AdminPollResp{}, err
+	}
+	results, err := a.h.pollResults(ctx, id)
+	if err != nil {
+		return messages.AdminPollResp{}, err
+	}
+	data, err := a.h.queries.getPollData(ctx, id)
+	if err != nil {
+		return messages.AdminPollResp{}, err
+	}
+
+	return messages.AdminPollResp{
+		PollResp:  poll,
+		Status:    pollStatus(data.closed, data.cast_votes, data.target_votes),
+		CreatedAt: data.created_at,
+		Results:   results.Results,
+		Winners:   results.Winners,
+	}, nil
+}
+
+// Closes or reopens a poll. Closed polls reject votes regardless of their target votes.
+func (a *Admin) SetClosed(ctx context.Context, id string, closed bool) error {
+	log := a.h.logger(ctx).With("poll_id", id)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("poll_id", id))
+
+	var ok bool
+	err := a.h.retry(ctx, "closing poll", func(ctx context.Context) error {
+		var err error
+		ok, err = a.h.queries.setPollClosed(ctx, id, closed)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		log.Warn("Can't close or reopen poll, poll not found")
+		return errPollNotFound
+	}
+	a.h.cache.invalidate(id)
+	action := messages.AUDIT_REOPEN
+	if closed {
+		action = messages.AUDIT_CLOSE
+	}
+	a.h.audit(ctx, action, id, nil)
+	log.Info("Poll closed state changed", "closed", closed)
+	return nil
+}
+
+// Permanently deletes every poll of the chain the poll belongs to, bypassing the trash.
+func (a *Admin) DeleteChain(ctx context.Context, id string) (messages.DeleteChainResp, error) {
+	log := a.h.logger(ctx).With("poll_id", id)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("poll_id", id))
+
+	chain, err := a.h.pollChain(ctx, id)
+	if err != nil {
+		return messages.DeleteChainResp{}, err
+	}
+	err = a.h.retry(ctx, "deleting chain", func(ctx context.Context) error {
+		return a.h.queries.deletePolls(ctx, chain.Polls)
+	})
+	if err != nil {
+		return messages.DeleteChainResp{}, err
+	}
+	a.h.cache.purge()
+	for _, poll := range chain.Polls {
+		a.h.audit(ctx, messages.AUDIT_DELETE_CHAIN, poll, map[string]any{"chain": chain.Polls, "requested": id})
+	}
+	log.Info("Poll chain deleted", "polls", len(chain.Polls))
+	return messages.DeleteChainResp{Deleted: chain.Polls}, nil
+}
+
+// Deletes closed and concluded polls older than the specified duration.
+func (a *Admin) Purge(ctx context.Context, req messages.PurgeReq) (messages.PurgeResp, error) {
+	log := a.h.logger(ctx)
+
+	older_than, err := time.ParseDuration(req.OlderThan)
+	if err != nil || older_than < 0 {
+		return messages.PurgeResp{}, errMalformedRequest.WithDetails("reason", fmt.Sprintf("invalid duration %q", req.OlderThan))
+	}
+
+	var purged []string
+	err = a.h.retry(ctx, "purging polls", func(ctx context.Context) error {
+		var err error
+		purged, err = a.h.queries.purgePolls(ctx, time.Now().Add(-older_than), req.DryRun)
+		return err
+	})
+	if err != nil {
+		return messages.PurgeResp{}, err
+	}
+	if !req.DryRun {
+		a.h.cache.purge()
+		for _, poll := range purged {
+			a.h.audit(ctx, messages.AUDIT_PURGE, poll, map[string]any{"older_than": older_than.String()})
+		}
+		log.Info("Polls purged", "older_than", older_than, "polls", len(purged))
+	}
+	return messages.PurgeResp{Purged: purged, DryRun: req.DryRun}, nil
+}
+
+// Fixes cast votes drifting from the ballots in the vote table. Successors of polls
+// concluding by a recount aren't created.
+func (a *Admin) Recount(ctx context.Context, req messages.RecountReq) (messages.RecountResp, error) {
+	log := a.h.logger(ctx)
+
+	var fixed []messages.RecountedPoll
+	err := a.h.retry(ctx, "recounting votes", func(ctx context.Context) error {
+		var err error
+		fixed, err = a.h.queries.recountVotes(ctx, req.DryRun)
+		return err
+	})
+	if err != nil {
+		return messages.RecountResp{}, err
+	}
+	if !req.DryRun && len(fixed) > 0 {
+		a.h.cache.purge()
+		for _, poll := range fixed {
+			a.h.audit(ctx, messages.AUDIT_RECOUNT, poll.PollID, map[string]any{"stored_votes": poll.Stored, "counted_votes": poll.Counted})
+		}
+		log.Warn("Fixed cast votes", "polls", fixed)
+	}
+	return messages.RecountResp{Fixed: fixed, DryRun: req.DryRun}, nil
+}
+
+// Exports all polls or the chain of the specified poll, including their ballots.
+func (a *Admin) Export(ctx context.Context, req messages.ExportReq) (messages.PollsExport, error) {
+	var chains [][]string
+	if req.PollID != "" {
+		chain, err := a.h.pollChain(ctx, req.PollID)
+		if err != nil {
+			return messages.PollsExport{}, err
+		}
+		chains = append(chains, chain.Polls)
+	} else {
+		roots, err := a.h.queries.getChainRoots(ctx)
+		if err != nil {
+			return messages.PollsExport{}, err
+		}
+		for _, root := range roots {
+			chain, err := a.h.pollChain(ctx, root)
+			if err != nil {
+				return messages.PollsExport{}, err
+			}
+			chains = append(chains, chain.Polls)
+		}
+	}
+
+	export := messages.PollsExport{
+		Version:    messages.EXPORT_VERSION,
+		ExportedAt: time.Now().UTC(),
+		Polls:      make([]messages.PollExport, 0),
+	}
+	for _, chain := range chains {
+		prev := ""
+		for _, id := range chain {
+			poll, err := a.exportPoll(ctx, id, prev)
+			if err != nil {
+				return messages.PollsExport{}, err
+			}
+			export.Polls = append(export.Polls, poll)
+			prev = id
+		}
+	}
+	return export, nil
+}
+
+func (a *Admin) exportPoll(ctx context.Context, id string, prev string) (messages.PollExport, error) {
+	data, err := a.h.queries.getPollData(ctx, id)
+	if err != nil {
+		return messages.PollExport{}, err
+	}
+	choices, err := a.h.queries.getPollChoices(ctx, id)
+	if err != nil {
+		return messages.PollExport{}, err
+	}
+	ballots, err := a.h.queries.getPollBallots(ctx, id)
+	if err != nil {
+		return messages.PollExport{}, err
+	}
+	var voters []string
+	if data.anonymous {
+		if voters, err = a.h.queries.getVoters(ctx, id); err != nil {
+			return messages.PollExport{}, err
+		}
+	}
+
+	poll := messages.PollExport{
+		ID:          id,
+		Title:       data.title,
+		Type:        data.poll_type,
+		TargetVotes: data.target_votes,
+		AutoCreate:  data.auto_create,
+		Closed:      data.closed,
+		Identity:    data.identity,
+		Visibility:  data.visibility,
+		Anonymous:   data.anonymous,
+		VoterSalt:   data.voter_salt,
+		Voters:      voters,
+		CreatedAt:   data.created_at,
+		PrevPoll:    prev,
+		Choices:     make([]messages.Choice, 0, len(choices)),
+		Ballots:     ballots,
+	}
+	for cid, content := range choices {
+		poll.Choices = append(poll.Choices, messages.Choice{ID: cid, Content: content})
+	}
+	sort.Slice(poll.Choices, func(i, j int) bool {
+		return poll.Choices[i].ID < poll.Choices[j].ID
+	})
+	return poll, nil
+}
+
+// Validates and imports exported polls in a single transaction. Polls and choices get new ids.
+// Documents written by hand may omit the version, poll types (single), identities (raw) and
+// visibilities (live). Ballots of anonymous polls without voters are anonymized on import.
+func (a *Admin) Import(ctx context.Context, export *messages.PollsExport) (messages.ImportResp, error) {
+	log := a.h.logger(ctx)
+
+	for i := range export.Polls {
+		if export.Polls[i].Type == "" {
+			export.Polls[i].Type = messages.SINGLE
+		}
+		if export.Polls[i].Identity == "" {
+			export.Polls[i].Identity = messages.IDENTITY_RAW
+		}
+		if export.Polls[i].Visibility == "" {
+			export.Polls[i].Visibility = messages.RESULTS_LIVE
+		}
+	}
+	if export.Version != 0 && export.Version != messages.EXPORT_VERSION {
+		return messages.ImportResp{}, errMalformedRequest.WithDetails("reason",
+			fmt.Sprintf("unsupported export version %d", export.Version))
+	}
+	if err := validateExport(export.Polls); err != nil {
+		log.Warn("Invalid export", "error", err)
+		return messages.ImportResp{}, err
+	}
+	for i := range export.Polls {
+		if !export.Polls[i].Anonymous {
+			continue
+		}
+		if err := a.h.validateAnonymous(true); err != nil {
+			log.Warn("Can't import anonymous poll without ballot secret", "poll_id", export.Polls[i].ID)
+			return messages.ImportResp{}, err
+		}
+		a.h.anonymizeBallots(&export.Polls[i])
+	}
+
+	var resp messages.ImportResp
+	err := a.h.retry(ctx, "importing polls", func(ctx context.Context) error {
+		var err error
+		resp, err = a.h.queries.importPolls(ctx, export.Polls)
+		return err
+	})
+	if err != nil {
+		return messages.ImportResp{}, err
+	}
+	a.h.cache.purge()
+	for _, poll := range export.Polls {
+		a.h.audit(ctx, messages.AUDIT_IMPORT, resp.Polls[poll.ID], map[string]any{
+			"exported_id": poll.ID,
+			"title":       poll.Title,
+			"ballots":     len(poll.Ballots),
+		})
+	}
+	log.Info("Polls imported", "polls", len(resp.Polls))
+	return resp, nil
+}
+
+// Writes a backup of the poll database into the backup directory.
+func (a *Admin) Backup(ctx context.Context) (messages.BackupInfo, error) {
+	log := a.h.logger(ctx)
+	if a.h.backups.Dir == "" {
+		return messages.BackupInfo{}, errBackupsDisabled
+	}
+
+	backup, err := a.h.backups.Create(ctx, a.h.db)
+	if err != nil {
+		log.Error("Backup failed", "error", err)
+		return messages.BackupInfo{}, err
+	}
+	log.Info("Created backup", "backup", backup.Name, "size", backup.Size)
+	return backupInfo(backup), nil
+}
+
+// Lists the backups of the backup directory.
+func (a *Admin) ListBackups(ctx context.Context) (messages.ListBackupsResp, error) {
+	if a.h.backups.Dir == "" {
+		return messages.ListBackupsResp{}, errBackupsDisabled
+	}
+	backups, err := a.h.backups.List()
+	if err != nil {
+		return messages.ListBackupsResp{}, err
+	}
+	resp := messages.ListBackupsResp{Backups: make([]messages.BackupInfo, 0, len(backups))}
+	for _, backup := range backups {
+		resp.Backups = append(resp.Backups, backupInfo(backup))
+	}
+	return resp, nil
+}
+
+// Returns the path of a backup in the backup directory.
+func (a *Admin) BackupPath(name string) (string, error) {
+	if a.h.backups.Dir == "" {
+		return "", errBackupsDisabled
+	}
+	path, err := a.h.backups.Path(name)
+	if errors.Is(err, database.ErrBackupNotFound) {
+		return "", errBackupNotFound.WithDetails("name", name)
+	}
+	return path, err
+}
+
+// Copies a backup of the backup directory to w.
+func (a *Admin) CopyBackup(ctx context.Context, name string, w io.Writer) error {
+	path, err := a.BackupPath(name)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Replaces the poll database with a backup of the backup directory. The backup has to have
+// the current schema version. The replaced database is backed up first, audit events recorded
+// after the backup was created are only kept in that backup. Old backups are only pruned once
+// the restore succeeded, the restored backup may be the oldest one kept. Backups have no webhook
+// secrets, restored webhooks removed since have to be registered again.
+func (a *Admin) Restore(ctx context.Context, name string) (messages.RestoreResp, error) {
+	log := a.h.logger(ctx).With("backup", name)
+
+	path, err := a.BackupPath(name)
+	if err != nil {
+		return messages.RestoreResp{}, err
+	}
+	if err := database.CheckBackup(ctx, path); err != nil {
+		log.Warn("Backup can't be restored", "error", err)
+		return messages.RestoreResp{}, errInvalidBackup.WithDetails("reason", err.Error())
+	}
+
+	previous, err := a.h.backups.Snapshot(ctx, a.h.db)
+	if err != nil {
+		log.Error("Couldn't back up database before restoring", "error", err)
+		return messages.RestoreResp{}, err
+	}
+	removed, err := database.Restore(ctx, a.h.db, path)
+	if err != nil {
+		log.Error("Restore failed", "error", err, "previous", previous.Name)
+		return messages.RestoreResp{}, err
+	}
+	a.h.cache.purge()
+	if _, err := a.h.backups.Prune(); err != nil {
+		log.Error("Couldn't prune backups after restoring", "error", err)
+	}
+	a.h.audit(ctx, messages.AUDIT_RESTORE, "", map[string]any{"backup": name, "previous": previous.Name, "webhooks_removed": removed})
+	log.Warn("Restored poll database", "previous", previous.Name, "webhooks_removed", removed)
+	return messages.RestoreResp{Restored: name, Previous: previous.Name, WebhooksRemoved: removed}, nil
+}
+
+func backupInfo(backup database.BackupFile) messages.BackupInfo {
+	return messages.BackupInfo{Name: backup.Name, Size: backup.Size, CreatedAt: backup.CreatedAt}
+}
+
+// Applies the checks of creating polls and casting votes to exported polls.
+// Also ensures ids are unique and predecessors are imported first.
+func validateExport(polls []messages.PollExport) error {
+	invalid := func(id string, err error) error {
+		var reason string
+		var resp *messages.Error
+		if errors.As(err, &resp) {
+			reason = resp.Message
+		} else {
+			reason = err.Error()
+		}
+		return errMalformedRequest.WithDetails("reason", reason).WithDetails("poll_id", id)
+	}
+
+	seen_polls := make(map[string]bool, len(polls))
+	seen_choices := make(map[int]bool)
+	for _, poll := range polls {
+		contents := make([]string, 0, len(poll.Choices))
+		for _, choice := range poll.Choices {
+			contents = append(contents, choice.Content)
+		}
+		if err := validatePoll(poll.Title, contents, poll.TargetVotes); err != nil {
+			return invalid(poll.ID, err)
+		}
+		switch {
+		case poll.ID == "" || seen_polls[poll.ID]:
+			return invalid(poll.ID, errors.New("poll ids must be unique and not empty"))
+		case poll.Type != messages.SINGLE && poll.Type != messages.MULTIPLE:
+			return invalid(poll.ID, fmt.Errorf("unknown poll type %q", poll.Type))
+		case poll.Identity != messages.IDENTITY_RAW && poll.Identity != messages.IDENTITY_SIGNED &&
+			poll.Identity != messages.IDENTITY_AUTHENTICATED:
+			return invalid(poll.ID, fmt.Errorf("unknown identity %q", poll.Identity))
+		case poll.Visibility != messages.RESULTS_LIVE && poll.Visibility != messages.RESULTS_VOTED &&
+			poll.Visibility != messages.RESULTS_CLOSED:
+			return invalid(poll.ID, fmt.Errorf("unknown visibility %q", poll.Visibility))
+		case uint(len(poll.Ballots)) > poll.TargetVotes:
+			return invalid(poll.ID, errors.New("more ballots than target votes"))
+		case poll.PrevPoll != "" && !seen_polls[poll.PrevPoll]:
+			return invalid(poll.ID, errors.New("previous poll must be imported before its successor"))
+		case !poll.Anonymous && (poll.VoterSalt != "" || len(poll.Voters) > 0):
+			return invalid(poll.ID, errors.New("only anonymous polls have voters"))
+		case len(poll.Voters) > 0 && (poll.VoterSalt == "" || len(poll.Voters) != len(poll.Ballots)):
+			return invalid(poll.ID, errors.New("voters need a voter salt and one voter per ballot"))
+		}
+		seen_polls[poll.ID] = true
+
+		choices := make(map[int]bool, len(poll.Choices))
+		for _, choice := range poll.Choices {
+			if seen_choices[choice.ID] {
+				return invalid(poll.ID, fmt.Errorf("duplicate choice id %d", choice.ID))
+			}
+			seen_choices[choice.ID] = true
+			choices[choice.ID] = true
+		}
+
+		voters := make(map[string]bool, len(poll.Voters))
+		for _, voter := range poll.Voters {
+			if voters[voter] {
+				return invalid(poll.ID, errAlreadyVoted)
+			}
+			voters[voter] = true
+		}
+
+		users := make(map[string]bool, len(poll.Ballots))
+		for _, ballot := range poll.Ballots {
+			if users[ballot.UserID] {
+				return invalid(poll.ID, errAlreadyVoted)
+			}
+			users[ballot.UserID] = true
+			if err := validateVotes(ballot.Votes); err != nil {
+				return invalid(poll.ID, err)
+			}
+			if err := validateVoteCount(poll.Type, ballot.Votes); err != nil {
+				return invalid(poll.ID, err)
+			}
+			for _, choice := range ballot.Votes {
+				if !choices[choice] {
+					return invalid(poll.ID, errInvalidChoice)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,365 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/AdrianPrawda/movie-poll/api/util"
+	"github.com/huandu/go-sqlbuilder"
+)
+
+// Queries of the admin operations.
+
+// Layout of DATETIME columns written by SQLite's current_timestamp. Times written by us have to
+// match it, otherwise they don't compare correctly with default values.
+const sqliteTime = "2006-01-02 15:04:05"
+
+// Returns summaries of polls with the specified status (all but deleted polls if empty), newest poll first.
+func (q *queryHandler) listPolls(
+	ctx context.Context,
+	status messages.PollStatus,
+	limit int) ([]messages.PollSummary, error) {
+
+	ctx, end := q.trace(ctx, "list_polls", "")
+	defer end()
+
+	sb := sqlbuilder.SQLite.NewSelectBuilder()
+	sb.Select("id", "title", "poll_type", "cast_votes", "target_votes", "closed", "created_at", "deleted_at").From("poll")
+	switch status {
+	case messages.OPEN:
+		sb.Where("closed = 0", "cast_votes < target_votes", "deleted_at IS NULL")
+	case messages.CLOSED:
+		sb.Where("closed = 1", "deleted_at IS NULL")
+	case messages.CONCLUDED:
+		sb.Where("closed = 0", "cast_votes >= target_votes", "deleted_at IS NULL")
+	case messages.DELETED:
+		sb.Where("deleted_at IS NOT NULL")
+	default:
+		sb.Where("deleted_at IS NULL")
+	}
+	sb.OrderBy("created_at DESC", "rowid DESC")
+	if limit > 0 {
+		sb.Limit(limit)
+	}
+	query, args := sb.Build()
+
+	rows, err := q._db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	polls := make([]messages.PollSummary, 0)
+	for rows.Next() {
+		var poll messages.PollSummary
+		var closed bool
+		var deleted_at sql.NullTime
+		if err := rows.Scan(&poll.ID, &poll.Title, &poll.Type, &poll.VotesCast, &poll.VotesRequired, &closed, &poll.CreatedAt,
+			&deleted_at); err != nil {
+			return nil, err
+		}
+		poll.Status = pollStatus(closed, poll.VotesCast, poll.VotesRequired)
+		if deleted_at.Valid {
+			poll.Status = messages.DELETED
+			poll.DeletedAt = &deleted_at.Time
+		}
+		polls = append(polls, poll)
+	}
+	return polls, rows.Err()
+}
+
+// Sets the closed flag of a poll. Returns false if the poll doesn't exist.
+func (q *queryHandler) setPollClosed(
+	ctx context.Context,
+	id string,
+	closed bool) (bool, error) {
+
+	ctx, end := q.trace(ctx, "set_poll_closed", id)
+	defer end()
+
+	res, err := q._db.ExecContext(ctx, "UPDATE poll SET closed=? WHERE id=? AND deleted_at IS NULL", closed, id)
+	if err != nil {
+		return false, err
+	}
+	changes, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return changes != 0, nil
+}
+
+// Deletes all specified polls in a single transaction.
+func (q *queryHandler) deletePolls(
+	ctx context.Context,
+	ids []string) error {
+
+	ctx, end := q.trace(ctx, "delete_polls", "")
+	defer end()
+
+	return q.immediateTx(ctx, func(conn *sql.Conn) error {
+		for _, id := range ids {
+			if _, err := conn.ExecContext(ctx, "DELETE FROM poll WHERE id=?", id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Deletes closed and concluded polls created before cutoff. Only returns them if dry_run is set.
+func (q *queryHandler) purgePolls(
+	ctx context.Context,
+	cutoff time.Time,
+	dry_run bool) ([]string, error) {
+
+	ctx, end := q.trace(ctx, "purge_polls", "")
+	defer end()
+
+	const (
+		STMT_SELECT = "SELECT id FROM poll WHERE (closed = 1 OR cast_votes >= target_votes) AND created_at < ? ORDER BY created_at, rowid"
+		STMT_DELETE = "DELETE FROM poll WHERE id=?"
+	)
+
+	purged := make([]string, 0)
+	err := q.immediateTx(ctx, func(conn *sql.Conn) error {
+		purged = purged[:0]
+		rows, err := conn.QueryContext(ctx, STMT_SELECT, cutoff.UTC().Format(sqliteTime))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			purged = append(purged, id)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		if dry_run {
+			return nil
+		}
+		for _, id := range purged {
+			if _, err := conn.ExecContext(ctx, STMT_DELETE, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return purged, err
+}
+
+// Finds polls whose cast votes don't match the number of users who voted on them and
+// corrects them unless dry_run is set.
+func (q *queryHandler) recountVotes(
+	ctx context.Context,
+	dry_run bool) ([]messages.RecountedPoll, error) {
+
+	ctx, end := q.trace(ctx, "recount_votes", "")
+	defer end()
+
+	const (
+		STMT_SELECT = `SELECT id, cast_votes, counted FROM (
+			SELECT id, cast_votes, (SELECT COUNT(DISTINCT user) FROM vote WHERE vote.poll_id = poll.id) AS counted
+			FROM poll
+		) WHERE cast_votes != counted ORDER BY id`
+		STMT_UPDATE = "UPDATE poll SET cast_votes=? WHERE id=?"
+	)
+
+	fixed := make([]messages.RecountedPoll, 0)
+	err := q.immediateTx(ctx, func(conn *sql.Conn) error {
+		fixed = fixed[:0]
+		rows, err := conn.QueryContext(ctx, STMT_SELECT)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var poll messages.RecountedPoll
+			if err := rows.Scan(&poll.PollID, &poll.Stored, &poll.Counted); err != nil {
+				return err
+			}
+			fixed = append(fixed, poll)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		if dry_run {
+			return nil
+		}
+		for _, poll := range fixed {
+			if _, err := conn.ExecContext(ctx, STMT_UPDATE, poll.Counted, poll.PollID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return fixed, err
+}
+
+// Returns the first poll of every chain, oldest first. Polls without predecessor and
+// successor are chains of their own, deleted polls are skipped.
+func (q *queryHandler) getChainRoots(ctx context.Context) ([]string, error) {
+	ctx, end := q.trace(ctx, "get_chain_roots", "")
+	defer end()
+
+	const STMT = `SELECT id FROM poll WHERE deleted_at IS NULL AND id NOT IN (
+		SELECT next_poll.next_poll FROM next_poll JOIN poll ON poll.id = next_poll.poll_id WHERE poll.deleted_at IS NULL)
+		ORDER BY created_at, rowid`
+	rows, err := q._db.QueryContext(ctx, STMT)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roots := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		roots = append(roots, id)
+	}
+	return roots, rows.Err()
+}
+
+// Returns all ballots cast on a poll in the order they were cast, ballots of anonymous polls in random order.
+func (q *queryHandler) getPollBallots(
+	ctx context.Context,
+	id string) ([]messages.BallotExport, error) {
+
+	ctx, end := q.trace(ctx, "get_poll_ballots", id)
+	defer end()
+
+	const STMT = "SELECT user, choice_id, created_at FROM vote WHERE poll_id=? ORDER BY id"
+	rows, err := q._db.QueryContext(ctx, STMT, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ballots := make([]messages.BallotExport, 0)
+	index := make(map[string]int)
+	for rows.Next() {
+		var user string
+		var choice int
+		var cast_at time.Time
+		if err := rows.Scan(&user, &choice, &cast_at); err != nil {
+			return nil, err
+		}
+		i, ok := index[user]
+		if !ok {
+			i = len(ballots)
+			index[user] = i
+			ballots = append(ballots, messages.BallotExport{UserID: user, CastAt: cast_at})
+		}
+		ballots[i].Votes = append(ballots[i].Votes, choice)
+	}
+	return ballots, rows.Err()
+}
+
+// Returns the voter hashes of an anonymous poll. Ordered by hash, like they are stored.
+func (q *queryHandler) getVoters(
+	ctx context.Context,
+	id string) ([]string, error) {
+
+	ctx, end := q.trace(ctx, "get_voters", id)
+	defer end()
+
+	rows, err := q._db.QueryContext(ctx, "SELECT voter_hash FROM voter WHERE poll_id=? ORDER BY voter_hash", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	voters := make([]string, 0)
+	for rows.Next() {
+		var voter string
+		if err := rows.Scan(&voter); err != nil {
+			return nil, err
+		}
+		voters = append(voters, voter)
+	}
+	return voters, rows.Err()
+}
+
+// Inserts exported polls with new ids in a single transaction. Polls have to be validated
+// by the caller and predecessors have to be listed before their successors.
+func (q *queryHandler) importPolls(
+	ctx context.Context,
+	polls []messages.PollExport) (messages.ImportResp, error) {
+
+	ctx, end := q.trace(ctx, "import_polls", "")
+	defer end()
+
+	const (
+		STMT_INSERT_POLL = `INSERT INTO poll (id, title, poll_type, cast_votes, target_votes, auto_create, closed, identity, visibility,
+			anonymous, voter_salt, created_at) VALUES (?,?,?,?,?,?,?,?,?,?,?,?)`
+		STMT_INSERT_NEXT   = "INSERT INTO next_poll (poll_id, next_poll) VALUES (?,?)"
+		STMT_INSERT_CHOICE = "INSERT INTO choice (poll_id, content) VALUES (?,?)"
+		STMT_INSERT_VOTE   = "INSERT INTO vote (poll_id, choice_id, user, created_at) VALUES (?,?,?,?)"
+		STMT_INSERT_VOTER  = "INSERT INTO voter (poll_id, voter_hash) VALUES (?,?)"
+
+		STMT_INSERT_ANONYMOUS_VOTE = "INSERT INTO vote (id, poll_id, choice_id, user, created_at) VALUES (" + ANONYMOUS_VOTE_ID + ",?,?,?,?)"
+	)
+
+	var resp messages.ImportResp
+	err := q.immediateTx(ctx, func(conn *sql.Conn) error {
+		resp = messages.ImportResp{Polls: make(map[string]string, len(polls)), Choices: make(map[int]int)}
+
+		for _, poll := range polls {
+			id := util.GenerateID()
+			resp.Polls[poll.ID] = id
+			if _, err := conn.ExecContext(ctx, STMT_INSERT_POLL, id, poll.Title, poll.Type, len(poll.Ballots),
+				poll.TargetVotes, poll.AutoCreate, poll.Closed, poll.Identity, poll.Visibility, poll.Anonymous, poll.VoterSalt,
+				poll.CreatedAt.UTC().Format(sqliteTime)); err != nil {
+				return err
+			}
+			if poll.PrevPoll != "" {
+				if _, err := conn.ExecContext(ctx, STMT_INSERT_NEXT, resp.Polls[poll.PrevPoll], id); err != nil {
+					return err
+				}
+			}
+
+			for _, choice := range poll.Choices {
+				res, err := conn.ExecContext(ctx, STMT_INSERT_CHOICE, id, choice.Content)
+				if err != nil {
+					return err
+				}
+				cid, err := res.LastInsertId()
+				if err != nil {
+					return err
+				}
+				resp.Choices[choice.ID] = int(cid)
+			}
+
+			stmt_insert_vote := STMT_INSERT_VOTE
+			if poll.Anonymous {
+				stmt_insert_vote = STMT_INSERT_ANONYMOUS_VOTE
+			}
+			for _, ballot := range poll.Ballots {
+				for _, choice := range ballot.Votes {
+					if _, err := conn.ExecContext(ctx, stmt_insert_vote, id, resp.Choices[choice], ballot.UserID,
+						ballot.CastAt.UTC().Format(sqliteTime)); err != nil {
+						return err
+					}
+				}
+			}
+			for _, voter := range poll.Voters {
+				if _, err := conn.ExecContext(ctx, STMT_INSERT_VOTER, id, voter); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return resp, err
+}
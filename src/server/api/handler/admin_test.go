@@ -0,0 +1,234 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdrianPrawda/movie-poll/api/database"
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+)
+
+// Sends a request to the admin API with the admin token.
+func (s *testServer) admin(method string, path string, body any) *httptest.ResponseRecorder {
+	s.t.Helper()
+	return s.request(method, "/api/admin/v1"+path, body, bearer(TEST_ADMIN_TOKEN)...)
+}
+
+// Returns the ids of listed polls.
+func pollIDs(polls []messages.PollSummary) []string {
+	ids := make([]string, 0, len(polls))
+	for _, poll := range polls {
+		ids = append(ids, poll.ID)
+	}
+	return ids
+}
+
+func TestAdminListPolls(t *testing.T) {
+	s := newTestServer(t)
+	open := s.createPoll(messages.CreatePollReq{})
+	concluded := s.createPoll(messages.CreatePollReq{TargetVotes: 1})
+	expectStatus(t, s.vote(concluded.PollID, messages.CastVotesReq{UserID: "alice", Votes: s.choices(concluded.PollID)[:1]}), http.StatusNoContent)
+	closed := s.createPoll(messages.CreatePollReq{})
+	expectStatus(t, s.admin(http.MethodPost, "/polls/"+closed.PollID+"/close", nil), http.StatusNoContent)
+	deleted := s.createPoll(messages.CreatePollReq{})
+	expectStatus(t, s.request(http.MethodDelete, "/api/v2/polls/"+deleted.PollID, nil, bearer(deleted.OwnerToken)...), http.StatusNoContent)
+
+	tests := []struct {
+		query string
+		polls []string
+	}{
+		// deleted polls are only listed on request
+		{"", []string{closed.PollID, concluded.PollID, open.PollID}},
+		{"?limit=2", []string{closed.PollID, concluded.PollID}},
+		{"?status=open", []string{open.PollID}},
+		{"?status=concluded", []string{concluded.PollID}},
+		{"?status=closed", []string{closed.PollID}},
+		{"?status=deleted", []string{deleted.PollID}},
+	}
+	for _, test := range tests {
+		resp := decode[messages.ListPollsResp](t, s.admin(http.MethodGet, "/polls"+test.query, nil), http.StatusOK)
+		if ids := pollIDs(resp.Polls); !reflect.DeepEqual(ids, test.polls) {
+			t.Errorf("polls%s listed %v, expected %v", test.query, ids, test.polls)
+		}
+	}
+	expectError(t, s.admin(http.MethodGet, "/polls?status=unknown", nil), http.StatusBadRequest, messages.MALFORMED_REQUEST)
+	expectError(t, s.request(http.MethodGet, "/api/admin/v1/polls", nil), http.StatusUnauthorized, messages.UNAUTHORIZED)
+	expectError(t, s.request(http.MethodGet, "/api/admin/v1/polls", nil, bearer(open.OwnerToken)...), http.StatusUnauthorized, messages.UNAUTHORIZED)
+}
+
+func TestAdminGetPoll(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{Type: messages.MULTIPLE, Choices: []string{"Alien", "Heat", "Ronin"}, TargetVotes: 3})
+	choices := s.choices(poll.PollID)
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: choices[1:]}), http.StatusNoContent)
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "bob", Votes: choices[:2]}), http.StatusNoContent)
+
+	resp := decode[messages.AdminPollResp](t, s.admin(http.MethodGet, "/polls/"+poll.PollID, nil), http.StatusOK)
+	if resp.Status != messages.OPEN || resp.VotesCast != 2 || resp.Title != "Movie night" {
+		t.Errorf("unexpected poll %+v", resp)
+	}
+	results := []messages.ChoiceResult{
+		{ID: choices[1], Content: "Heat", Votes: 2},
+		{ID: choices[0], Content: "Alien", Votes: 1},
+		{ID: choices[2], Content: "Ronin", Votes: 1},
+	}
+	if !reflect.DeepEqual(resp.Results, results) || !reflect.DeepEqual(resp.Winners, []int{choices[1]}) {
+		t.Errorf("unexpected results %+v, winners %v", resp.Results, resp.Winners)
+	}
+	expectError(t, s.admin(http.MethodGet, "/polls/unknown", nil), http.StatusNotFound, messages.POLL_NOT_FOUND)
+}
+
+func TestAdminCloseAndReopen(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{})
+	choices := s.choices(poll.PollID)
+
+	expectStatus(t, s.admin(http.MethodPost, "/polls/"+poll.PollID+"/close", nil), http.StatusNoContent)
+	expectError(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: choices[:1]}), http.StatusConflict, messages.POLL_CLOSED)
+	expectStatus(t, s.admin(http.MethodPost, "/polls/"+poll.PollID+"/reopen", nil), http.StatusNoContent)
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: choices[:1]}), http.StatusNoContent)
+	expectError(t, s.admin(http.MethodPost, "/polls/unknown/close", nil), http.StatusNotFound, messages.POLL_NOT_FOUND)
+}
+
+func TestAdminDeleteChain(t *testing.T) {
+	s := newTestServer(t)
+	first := s.createPoll(messages.CreatePollReq{})
+	second := s.createPoll(messages.CreatePollReq{PrevPollID: first.PollID})
+	other := s.createPoll(messages.CreatePollReq{})
+
+	resp := decode[messages.DeleteChainResp](t, s.admin(http.MethodDelete, "/chains/"+second.PollID, nil), http.StatusOK)
+	if !reflect.DeepEqual(resp.Deleted, []string{first.PollID, second.PollID}) {
+		t.Errorf("deleted %v", resp.Deleted)
+	}
+	// chains are deleted permanently, not moved to the trash
+	for _, id := range resp.Deleted {
+		expectError(t, s.request(http.MethodGet, "/api/v2/polls/"+id, nil), http.StatusNotFound, messages.POLL_NOT_FOUND)
+		expectError(t, s.admin(http.MethodGet, "/polls/"+id, nil), http.StatusNotFound, messages.POLL_NOT_FOUND)
+	}
+	s.poll(other.PollID)
+}
+
+func TestAdminPurge(t *testing.T) {
+	s := newTestServer(t)
+	open := s.createPoll(messages.CreatePollReq{})
+	closed := s.createPoll(messages.CreatePollReq{})
+	expectStatus(t, s.admin(http.MethodPost, "/polls/"+closed.PollID+"/close", nil), http.StatusNoContent)
+	if _, err := s.db.Exec("UPDATE poll SET created_at = datetime('now', '-2 minutes')"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := decode[messages.PurgeResp](t, s.admin(http.MethodPost, "/purge", messages.PurgeReq{OlderThan: "1h"}), http.StatusOK)
+	if len(resp.Purged) != 0 {
+		t.Errorf("recent polls were purged %v", resp.Purged)
+	}
+	resp = decode[messages.PurgeResp](t, s.admin(http.MethodPost, "/purge", messages.PurgeReq{OlderThan: "1m", DryRun: true}), http.StatusOK)
+	if !resp.DryRun || !reflect.DeepEqual(resp.Purged, []string{closed.PollID}) {
+		t.Errorf("unexpected dry run %+v", resp)
+	}
+	s.poll(closed.PollID)
+
+	resp = decode[messages.PurgeResp](t, s.admin(http.MethodPost, "/purge", messages.PurgeReq{OlderThan: "1m"}), http.StatusOK)
+	if resp.DryRun || !reflect.DeepEqual(resp.Purged, []string{closed.PollID}) {
+		t.Errorf("unexpected purge %+v", resp)
+	}
+	expectError(t, s.admin(http.MethodGet, "/polls/"+closed.PollID, nil), http.StatusNotFound, messages.POLL_NOT_FOUND)
+	s.poll(open.PollID)
+
+	for _, older_than := range []string{"", "month", "-1h"} {
+		expectError(t, s.admin(http.MethodPost, "/purge", messages.PurgeReq{OlderThan: older_than}), http.StatusBadRequest, messages.MALFORMED_REQUEST)
+	}
+}
+
+func TestAdminRecount(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{TargetVotes: 3})
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: s.choices(poll.PollID)[:1]}), http.StatusNoContent)
+	if _, err := s.db.Exec("UPDATE poll SET cast_votes = 2 WHERE id = ?", poll.PollID); err != nil {
+		t.Fatal(err)
+	}
+
+	fixed := []messages.RecountedPoll{{PollID: poll.PollID, Stored: 2, Counted: 1}}
+	resp := decode[messages.RecountResp](t, s.admin(http.MethodPost, "/recount", messages.RecountReq{DryRun: true}), http.StatusOK)
+	if !resp.DryRun || !reflect.DeepEqual(resp.Fixed, fixed) {
+		t.Errorf("unexpected dry run %+v", resp)
+	}
+	resp = decode[messages.RecountResp](t, s.admin(http.MethodPost, "/recount", messages.RecountReq{}), http.StatusOK)
+	if !reflect.DeepEqual(resp.Fixed, fixed) {
+		t.Errorf("unexpected recount %+v", resp)
+	}
+	if cast := s.poll(poll.PollID).VotesCast; cast != 1 {
+		t.Errorf("%d votes cast after the recount", cast)
+	}
+	resp = decode[messages.RecountResp](t, s.admin(http.MethodPost, "/recount", messages.RecountReq{}), http.StatusOK)
+	if len(resp.Fixed) != 0 {
+		t.Errorf("recounted polls are fixed again %+v", resp.Fixed)
+	}
+}
+
+func TestAdminBackups(t *testing.T) {
+	s := newTestServer(t)
+	expectError(t, s.admin(http.MethodPost, "/backups", nil), http.StatusConflict, messages.BACKUPS_DISABLED)
+	dir := t.TempDir()
+	s.h.SetBackups(database.Backups{Dir: dir})
+
+	poll := s.createPoll(messages.CreatePollReq{})
+	backup := decode[messages.BackupInfo](t, s.admin(http.MethodPost, "/backups", nil), http.StatusCreated)
+	listed := decode[messages.ListBackupsResp](t, s.admin(http.MethodGet, "/backups", nil), http.StatusOK)
+	if len(listed.Backups) != 1 || listed.Backups[0].Name != backup.Name || listed.Backups[0].Size != backup.Size {
+		t.Errorf("unexpected backups %+v, created %+v", listed.Backups, backup)
+	}
+	rec := s.admin(http.MethodGet, "/backups/"+backup.Name, nil)
+	expectStatus(t, rec, http.StatusOK)
+	if int64(rec.Body.Len()) != backup.Size || !strings.HasPrefix(rec.Body.String(), "SQLite format 3") {
+		t.Errorf("downloaded %d bytes, expected the %d bytes database", rec.Body.Len(), backup.Size)
+	}
+
+	// polls created after the backup are only kept in the backup of the replaced database
+	later := s.createPoll(messages.CreatePollReq{})
+	resp := decode[messages.RestoreResp](t, s.admin(http.MethodPost, "/restore", messages.RestoreReq{Name: backup.Name}), http.StatusOK)
+	if resp.Restored != backup.Name || resp.Previous == "" || resp.Previous == backup.Name {
+		t.Errorf("unexpected restore %+v", resp)
+	}
+	s.poll(poll.PollID)
+	expectError(t, s.request(http.MethodGet, "/api/v2/polls/"+later.PollID, nil), http.StatusNotFound, messages.POLL_NOT_FOUND)
+	expectStatus(t, s.admin(http.MethodPost, "/restore", messages.RestoreReq{Name: resp.Previous}), http.StatusOK)
+	s.poll(later.PollID)
+
+	if err := os.WriteFile(filepath.Join(dir, "garbage.db"), []byte("not a database"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	expectError(t, s.admin(http.MethodPost, "/restore", messages.RestoreReq{Name: "garbage.db"}), http.StatusUnprocessableEntity, messages.INVALID_BACKUP)
+	expectError(t, s.admin(http.MethodPost, "/restore", messages.RestoreReq{Name: "missing.db"}), http.StatusNotFound, messages.BACKUP_NOT_FOUND)
+	expectError(t, s.admin(http.MethodGet, "/backups/..%2Fpoll.db", nil), http.StatusNotFound, messages.BACKUP_NOT_FOUND)
+	expectError(t, s.request(http.MethodPost, "/api/admin/v1/backups", nil), http.StatusUnauthorized, messages.UNAUTHORIZED)
+}
+
+func TestAdminRestoreOldestKeptBackup(t *testing.T) {
+	s := newTestServer(t)
+	s.h.SetBackups(database.Backups{Dir: t.TempDir(), Keep: 2})
+
+	poll := s.createPoll(messages.CreatePollReq{})
+	oldest := decode[messages.BackupInfo](t, s.admin(http.MethodPost, "/backups", nil), http.StatusCreated)
+	later := s.createPoll(messages.CreatePollReq{})
+	// backups are named after their creation time in milliseconds
+	time.Sleep(5 * time.Millisecond)
+	expectStatus(t, s.admin(http.MethodPost, "/backups", nil), http.StatusCreated)
+
+	resp := decode[messages.RestoreResp](t, s.admin(http.MethodPost, "/restore", messages.RestoreReq{Name: oldest.Name}), http.StatusOK)
+	if resp.Restored != oldest.Name {
+		t.Errorf("unexpected restore %+v", resp)
+	}
+	s.poll(poll.PollID)
+	expectError(t, s.request(http.MethodGet, "/api/v2/polls/"+later.PollID, nil), http.StatusNotFound, messages.POLL_NOT_FOUND)
+
+	listed := decode[messages.ListBackupsResp](t, s.admin(http.MethodGet, "/backups", nil), http.StatusOK)
+	if len(listed.Backups) != 2 || listed.Backups[0].Name != resp.Previous {
+		t.Errorf("backups weren't pruned after restoring: %+v", listed.Backups)
+	}
+}
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/AdrianPrawda/movie-poll/api/util"
+)
+
+// Anonymous polls store ballots under random ids. Voters are recorded separately as keyed
+// hashes of their users, salted per poll, which keeps them from voting twice without linking
+// them to their ballots or to their votes in other polls.
+
+// Separates voter hashes from other uses of the secret
+const VOTER_HASH_PREFIX = "moviepoll-voter:"
+
+// Row id of anonymous ballots, ids in order of insertion would reveal which ballot was cast by
+// which request. Kept below 2^53, so ids stay exact in JSON clients.
+const ANONYMOUS_VOTE_ID = "(random() & 9007199254740991) + 1"
+
+// Checks if the server can hash voters of anonymous polls.
+func (h *Handler) validateAnonymous(anonymous bool) error {
+	if anonymous && len(h.identity.BallotSecret) == 0 {
+		return errAnonymityDisabled
+	}
+	return nil
+}
+
+// Returns the keyed hash recording that the user voted in the poll with the voter salt.
+func (h *Handler) voterHash(salt string, user string) string {
+	mac := hmac.New(sha256.New, h.identity.BallotSecret)
+	mac.Write([]byte(VOTER_HASH_PREFIX + salt + ":" + user))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Prepares ballots of an imported anonymous poll. Ballots of exported anonymous polls come with
+// their voters, users of other ballots are replaced by their voter hashes and random ballot ids.
+func (h *Handler) anonymizeBallots(poll *messages.PollExport) {
+	if len(poll.Voters) == 0 {
+		poll.VoterSalt = util.GenerateID()
+		poll.Voters = make([]string, 0, len(poll.Ballots))
+		for i := range poll.Ballots {
+			poll.Voters = append(poll.Voters, h.voterHash(poll.VoterSalt, poll.Ballots[i].UserID))
+			poll.Ballots[i].UserID = util.GenerateID()
+		}
+	}
+	// cast times would date the ballots
+	for i := range poll.Ballots {
+		poll.Ballots[i].CastAt = poll.CreatedAt
+	}
+}
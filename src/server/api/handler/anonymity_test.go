@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+)
+
+// Enables anonymous ballots.
+func (s *testServer) allowAnonymous() {
+	s.h.SetIdentity(IdentityConfig{BallotSecret: []byte("ballot-secret")})
+}
+
+func TestAnonymousPollsNeedBallotSecret(t *testing.T) {
+	s := newTestServer(t)
+	rec := s.request(http.MethodPost, "/api/v2/polls", messages.CreatePollReq{
+		Title: "Movie night", TargetVotes: 1, Choices: []string{"Alien", "Heat"}, Anonymous: true})
+	expectError(t, rec, http.StatusUnprocessableEntity, messages.ANONYMITY_DISABLED)
+}
+
+func TestAnonymousBallotsAreUnlinkable(t *testing.T) {
+	const VOTERS = 20
+	s := newTestServer(t)
+	s.allowAnonymous()
+	poll := s.createPoll(messages.CreatePollReq{TargetVotes: VOTERS + 1, Anonymous: true})
+	choices := s.choices(poll.PollID)
+
+	// ids of the ballots in the order they were cast
+	var ids []int64
+	for i := 0; i < VOTERS; i++ {
+		req := messages.CastVotesReq{UserID: fmt.Sprintf("voter-%d", i), Votes: choices[i%2 : i%2+1]}
+		expectStatus(t, s.vote(poll.PollID, req), http.StatusNoContent)
+		var id int64
+		if err := s.db.QueryRow("SELECT id FROM vote WHERE poll_id=? AND id NOT IN (SELECT value FROM json_each(?))",
+			poll.PollID, jsonIDs(ids)).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	expectError(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "voter-0", Votes: choices[:1]}),
+		http.StatusConflict, messages.ALREADY_VOTED)
+
+	var created string
+	if err := s.db.QueryRow("SELECT created_at FROM poll WHERE id=?", poll.PollID).Scan(&created); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := s.db.Query("SELECT user, created_at FROM vote WHERE poll_id=?", poll.PollID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user, cast_at string
+		if err := rows.Scan(&user, &cast_at); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(user, "voter-") {
+			t.Errorf("ballot stored with user %q", user)
+		}
+		if cast_at != created {
+			t.Errorf("ballot dated %s, poll was created %s", cast_at, created)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	// the chance of random ids being ordered by insertion is 1/20!
+	if sort.SliceIsSorted(ids, func(i, j int) bool { return ids[i] < ids[j] }) {
+		t.Errorf("ballot ids %v reveal the order ballots were cast in", ids)
+	}
+
+	var voters int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM voter WHERE poll_id=? AND voter_hash NOT LIKE 'voter-%'", poll.PollID).Scan(&voters); err != nil {
+		t.Fatal(err)
+	}
+	if voters != VOTERS {
+		t.Errorf("%d voter hashes stored, expected %d", voters, VOTERS)
+	}
+
+	results := decode[messages.PollResultsResp](t, s.request(http.MethodGet, "/api/v2/polls/"+poll.PollID+"/results", nil), http.StatusOK)
+	if results.VotesCast != VOTERS || results.Results[0].Votes != VOTERS/2 || results.Results[1].Votes != VOTERS/2 {
+		t.Errorf("unexpected results %+v", results)
+	}
+}
+
+func TestAnonymousInvitesHideWhenTheyWereUsed(t *testing.T) {
+	s := newTestServer(t)
+	s.allowAnonymous()
+	poll := s.createPoll(messages.CreatePollReq{Invitees: []string{"alice", "bob"}, Anonymous: true})
+	choices := s.choices(poll.PollID)
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{Token: poll.Invites[0].Token, Votes: choices[:1]}), http.StatusNoContent)
+
+	invites := decode[messages.PollInvitesResp](t, s.request(http.MethodGet, "/api/v2/polls/"+poll.PollID+"/invites", nil,
+		bearer(poll.OwnerToken)...), http.StatusOK)
+	if !invites.Invites[0].Voted || invites.Invites[0].VotedAt != nil || invites.Invites[1].Voted {
+		t.Errorf("unexpected invites %+v", invites.Invites)
+	}
+
+	var user string
+	if err := s.db.QueryRow("SELECT user FROM vote WHERE poll_id=?", poll.PollID).Scan(&user); err != nil {
+		t.Fatal(err)
+	}
+	if user == "alice" {
+		t.Error("ballot stored with the name of the invitee")
+	}
+}
+
+// Encodes ids as JSON array.
+func jsonIDs(ids []int64) string {
+	if ids == nil {
+		return "[]"
+	}
+	encoded, _ := json.Marshal(ids)
+	return string(encoded)
+}
@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/huandu/go-sqlbuilder"
+)
+
+// Poll mutations are recorded in the append only audit_event table. Events are written after
+// the mutation committed, failing to record one is logged but doesn't fail the request.
+// Payloads never contain tokens, events of anonymous polls never reveal voters. Votes on
+// anonymous polls aren't recorded at all, the time and request of their events would link
+// voters to their ballots.
+
+// Actors of events not caused by a client
+const (
+	AUDIT_ACTOR_ADMIN   = "admin"  // admin API
+	AUDIT_ACTOR_SYSTEM  = "system" // e.g. successors created by a concluding vote
+	AUDIT_ACTOR_UNKNOWN = "unknown"
+)
+
+// Default and upper bound for the number of listed audit events
+const (
+	AUDIT_DEFAULT_LIMIT = 100
+	AUDIT_MAX_LIMIT     = 1000
+)
+
+// Recording an event must not be cancelled by the client disconnecting
+const AUDIT_TIMEOUT = 5 * time.Second
+
+// Request attributes recorded with audit events, set by RequestLogger.
+type requestInfo struct {
+	id        string
+	remote_ip string
+}
+
+type requestInfoKey struct{}
+
+type actorKey struct{}
+
+func contextWithRequestInfo(ctx context.Context, info requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+func requestInfoFromContext(ctx context.Context) requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(requestInfo)
+	return info
+}
+
+// Returns a context recording actor as the cause of audit events, e.g. cli:<user>.
+func ContextWithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// Returns who caused the events of a request. Explicit actors take precedence over
+// authenticated users, signed identities and client addresses.
+func auditActor(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	v := voterFromContext(ctx)
+	switch {
+	case v.user != "":
+		return "user:" + v.user
+	case v.signed != "":
+		return "voter:" + v.signed
+	}
+	if ip := requestInfoFromContext(ctx).remote_ip; ip != "" {
+		return "ip:" + ip
+	}
+	return AUDIT_ACTOR_UNKNOWN
+}
+
+// Records an event caused by the actor of ctx. Empty poll ids record events without poll.
+func (h *Handler) audit(ctx context.Context, action messages.AuditAction, poll_id string, payload any) {
+	log := h.logger(ctx).With("action", action)
+	actor := auditActor(ctx)
+
+	data := []byte("{}")
+	if payload != nil {
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			log.Error("Couldn't encode audit event", "error", err)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), AUDIT_TIMEOUT)
+	defer cancel()
+	err := h.retry(ctx, "recording audit event", func(ctx context.Context) error {
+		return h.queries.insertAuditEvent(ctx, action, poll_id, actor, requestInfoFromContext(ctx).id, data)
+	})
+	if err != nil {
+		log.Error("Couldn't record audit event", "error", err, "poll_id", poll_id, "actor", actor)
+	}
+}
+
+// Appends an event to the audit log.
+func (q *queryHandler) insertAuditEvent(
+	ctx context.Context,
+	action messages.AuditAction,
+	poll_id string,
+	actor string,
+	request_id string,
+	payload []byte) error {
+
+	ctx, end := q.trace(ctx, "insert_audit_event", poll_id)
+	defer end()
+
+	const STMT = "INSERT INTO audit_event (action, poll_id, actor, request_id, payload) VALUES (?,?,?,?,?)"
+	_, err := q._db.ExecContext(ctx, STMT, action, poll_id, actor, request_id, string(payload))
+	return err
+}
+
+// Returns audit events matching all non-empty filters, newest event first.
+func (q *queryHandler) listAuditEvents(
+	ctx context.Context,
+	req messages.AuditReq,
+	limit int) ([]messages.AuditEvent, error) {
+
+	ctx, end := q.trace(ctx, "list_audit_events", req.PollID)
+	defer end()
+
+	sb := sqlbuilder.SQLite.NewSelectBuilder()
+	sb.Select("id", "created_at", "action", "poll_id", "actor", "request_id", "payload").From("audit_event")
+	if req.PollID != "" {
+		sb.Where(sb.Equal("poll_id", req.PollID))
+	}
+	if req.Action != "" {
+		sb.Where(sb.Equal("action", req.Action))
+	}
+	if req.Actor != "" {
+		sb.Where(sb.Equal("actor", req.Actor))
+	}
+	if !req.Since.IsZero() {
+		sb.Where(sb.GreaterEqualThan("created_at", req.Since.UTC().Format(sqliteTime)))
+	}
+	if !req.Until.IsZero() {
+		sb.Where(sb.LessThan("created_at", req.Until.UTC().Format(sqliteTime)))
+	}
+	if req.Before > 0 {
+		sb.Where(sb.LessThan("id", req.Before))
+	}
+	sb.OrderBy("id DESC").Limit(limit)
+	query, args := sb.Build()
+
+	rows, err := q._db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]messages.AuditEvent, 0)
+	for rows.Next() {
+		var event messages.AuditEvent
+		var payload string
+		if err := rows.Scan(&event.ID, &event.CreatedAt, &event.Action, &event.PollID, &event.Actor, &event.RequestID, &payload); err != nil {
+			return nil, err
+		}
+		event.Payload = json.RawMessage(payload)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// Lists audit events, optionally filtered by poll, action, actor and time. Pages are
+// requested by passing the next cursor of the previous page as before.
+func (a *Admin) Audit(ctx context.Context, req messages.AuditReq) (messages.AuditResp, error) {
+	limit := req.Limit
+	switch {
+	case limit < 0 || limit > AUDIT_MAX_LIMIT:
+		return messages.AuditResp{}, errMalformedRequest.WithDetails("reason", fmt.Sprintf("limit must be between 0 and %d", AUDIT_MAX_LIMIT))
+	case limit == 0:
+		limit = AUDIT_DEFAULT_LIMIT
+	}
+	if req.Before < 0 {
+		return messages.AuditResp{}, errMalformedRequest.WithDetails("reason", "before must not be negative")
+	}
+	if !req.Since.IsZero() && !req.Until.IsZero() && !req.Until.After(req.Since) {
+		return messages.AuditResp{}, errMalformedRequest.WithDetails("reason", "until must be after since")
+	}
+
+	events, err := a.h.queries.listAuditEvents(ctx, req, limit)
+	if err != nil {
+		return messages.AuditResp{}, err
+	}
+	resp := messages.AuditResp{Events: events}
+	if len(events) == limit {
+		resp.Next = events[len(events)-1].ID
+	}
+	return resp, nil
+}
@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+)
+
+// Lists audit events through the admin API.
+func (s *testServer) auditEvents(query url.Values) []messages.AuditEvent {
+	s.t.Helper()
+	rec := s.request(http.MethodGet, "/api/admin/v1/audit?"+query.Encode(), nil, bearer(TEST_ADMIN_TOKEN)...)
+	return decode[messages.AuditResp](s.t, rec, http.StatusOK).Events
+}
+
+func TestAuditEvents(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{TargetVotes: 1, AutoCreate: true})
+	choices := s.choices(poll.PollID)
+	rec := s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: choices[:1]}, "X-Request-Id", "vote-request")
+	expectStatus(t, rec, http.StatusNoContent)
+	successor := s.poll(poll.PollID).NextPoll
+	expectStatus(t, s.request(http.MethodDelete, "/api/v2/polls/"+successor, nil, bearer(poll.OwnerToken)...), http.StatusNoContent)
+
+	events := s.auditEvents(nil)
+	expected := []struct {
+		action messages.AuditAction
+		poll   string
+	}{
+		{messages.AUDIT_DELETE, successor},
+		{messages.AUDIT_AUTO_CREATE, successor},
+		{messages.AUDIT_VOTE, poll.PollID},
+		{messages.AUDIT_CREATE, poll.PollID},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	for i, e := range expected {
+		if events[i].Action != e.action || events[i].PollID != e.poll {
+			t.Errorf("event %d is %s of %s, expected %s of %s", i, events[i].Action, events[i].PollID, e.action, e.poll)
+		}
+	}
+
+	vote := events[2]
+	var payload map[string]any
+	if err := json.Unmarshal(vote.Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if vote.RequestID != "vote-request" || vote.Actor != "ip:192.0.2.1" || payload["user_id"] != "alice" {
+		t.Errorf("unexpected vote event %+v", vote)
+	}
+	// successors are created by the concluding vote
+	if auto := events[1]; auto.Actor != AUDIT_ACTOR_SYSTEM || auto.RequestID != "vote-request" {
+		t.Errorf("unexpected auto create event %+v", auto)
+	}
+
+	filtered := s.auditEvents(url.Values{"poll_id": {successor}, "action": {string(messages.AUDIT_DELETE)}})
+	if len(filtered) != 1 || filtered[0].ID != events[0].ID {
+		t.Errorf("unexpected filtered events %+v", filtered)
+	}
+	page := decode[messages.AuditResp](t, s.request(http.MethodGet, "/api/admin/v1/audit?limit=3", nil, bearer(TEST_ADMIN_TOKEN)...), http.StatusOK)
+	if len(page.Events) != 3 || page.Next != events[2].ID {
+		t.Errorf("unexpected page %+v", page)
+	}
+	next := s.auditEvents(url.Values{"before": {"3"}})
+	if len(next) != 2 || next[0].ID != 2 {
+		t.Errorf("unexpected next page %+v", next)
+	}
+	expectError(t, s.request(http.MethodGet, "/api/admin/v1/audit?limit=1001", nil, bearer(TEST_ADMIN_TOKEN)...),
+		http.StatusBadRequest, messages.MALFORMED_REQUEST)
+	expectError(t, s.request(http.MethodGet, "/api/admin/v1/audit", nil), http.StatusUnauthorized, messages.UNAUTHORIZED)
+}
+
+func TestAuditEventsAreAppendOnly(t *testing.T) {
+	s := newTestServer(t)
+	s.createPoll(messages.CreatePollReq{})
+	if _, err := s.db.Exec("UPDATE audit_event SET actor = 'someone'"); err == nil {
+		t.Error("audit event was updated")
+	}
+	if _, err := s.db.Exec("DELETE FROM audit_event"); err == nil {
+		t.Error("audit event was deleted")
+	}
+}
+
+func TestAnonymousVotesAreNotAudited(t *testing.T) {
+	s := newTestServer(t)
+	s.allowAnonymous()
+	poll := s.createPoll(messages.CreatePollReq{Anonymous: true})
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: s.choices(poll.PollID)[:1]}), http.StatusNoContent)
+
+	events := s.auditEvents(url.Values{"poll_id": {poll.PollID}})
+	if len(events) != 1 || events[0].Action != messages.AUDIT_CREATE {
+		t.Errorf("unexpected events of anonymous poll %+v", events)
+	}
+}
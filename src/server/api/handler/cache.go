@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Upper bound for cached polls. Arbitrary entries are evicted once reached.
+const pollCacheCapacity = 4096
+
+// Lifetime of cached responses. Writes of other processes sharing the poll database, e.g. the
+// CLI, don't invalidate the cache and are served once cached responses expired.
+const pollCacheTTL = 5 * time.Second
+
+type cacheKind int
+
+const (
+	cacheData cacheKind = iota
+	cacheStatus
+	cachePoll
+	cacheResults
+	cacheChain
+	cacheDataHidden    // poll data without tallies
+	cacheResultsHidden // results without tallies
+	cacheKinds
+)
+
+// Encoded response body, its entity tag and the response it was encoded from.
+type cacheEntry struct {
+	body    []byte
+	etag    string
+	resp    any
+	expires time.Time
+}
+
+// In-process read-through cache for encoded poll data and status responses.
+// Entries are keyed by poll id and have to be invalidated by writers after commit.
+type pollCache struct {
+	mu         sync.RWMutex
+	entries    map[string]*[cacheKinds]*cacheEntry
+	generation uint64
+	ttl        time.Duration
+	hits       atomic.Uint64
+	misses     atomic.Uint64
+}
+
+func newPollCache() *pollCache {
+	return &pollCache{entries: make(map[string]*[cacheKinds]*cacheEntry), ttl: pollCacheTTL}
+}
+
+// Returns the current cache generation. Must be read before querying the database,
+// otherwise results that raced with an invalidation could end up in the cache.
+func (c *pollCache) gen() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.generation
+}
+
+// Returns a cached response for the specified poll and counts the lookup as hit or miss.
+// Expired responses are misses, they are replaced by the next put.
+func (c *pollCache) get(id string, kind cacheKind) (*cacheEntry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if polls, ok := c.entries[id]; ok && polls[kind] != nil && time.Now().Before(polls[kind].expires) {
+		c.hits.Add(1)
+		return polls[kind], true
+	}
+	c.misses.Add(1)
+	return nil, false
+}
+
+// Encodes the response and stores it, unless the cache was invalidated since gen was read.
+// The encoded entry is returned in both cases.
+func (c *pollCache) put(id string, kind cacheKind, gen uint64, resp any) (*cacheEntry, error) {
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(body)
+	entry := &cacheEntry{body: body, etag: `"` + hex.EncodeToString(sum[:10]) + `"`, resp: resp, expires: time.Now().Add(c.ttl)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.generation {
+		return entry, nil
+	}
+	polls, ok := c.entries[id]
+	if !ok {
+		if len(c.entries) >= pollCacheCapacity {
+			for key := range c.entries {
+				delete(c.entries, key)
+				break
+			}
+		}
+		polls = new([cacheKinds]*cacheEntry)
+		c.entries[id] = polls
+	}
+	polls[kind] = entry
+	return entry, nil
+}
+
+// Drops all cached responses for the specified polls.
+func (c *pollCache) invalidate(ids ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range ids {
+		delete(c.entries, id)
+	}
+	c.generation++
+}
+
+// Drops all cached responses. Used when a change affects more than a single poll,
+// e.g. linking or unlinking polls changes the latest poll of the entire chain.
+func (c *pollCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*[cacheKinds]*cacheEntry)
+	c.generation++
+}
+
+// Returns number of cache hits, misses and cached polls.
+func (c *pollCache) stats() (uint64, uint64, int) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.hits.Load(), c.misses.Load(), len(c.entries)
+}
+
+// Writes a cached entry, answering with 304 if the client already has the current version.
+func writeCached(c echo.Context, entry *cacheEntry) error {
+	header := c.Response().Header()
+	header.Set("ETag", entry.etag)
+	header.Set("Cache-Control", "no-cache")
+	if etagMatches(c.Request().Header.Get("If-None-Match"), entry.etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.JSONBlob(http.StatusOK, entry.body)
+}
+
+// Checks if an If-None-Match header value matches the entity tag (weak comparison).
+func etagMatches(header string, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
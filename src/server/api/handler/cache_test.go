@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+)
+
+func TestETagMatches(t *testing.T) {
+	const ETAG = `"0123456789abcdef0123"`
+	tests := []struct {
+		header string
+		match  bool
+	}{
+		{"", false},
+		{ETAG, true},
+		{"W/" + ETAG, true},
+		{`"other", ` + ETAG, true},
+		{"*", true},
+		{`"other"`, false},
+		{"0123456789abcdef0123", false},
+	}
+	for _, test := range tests {
+		if match := etagMatches(test.header, ETAG); match != test.match {
+			t.Errorf("etagMatches(%q) = %v, expected %v", test.header, match, test.match)
+		}
+	}
+}
+
+func TestPollCacheIgnoresStaleResults(t *testing.T) {
+	cache := newPollCache()
+	gen := cache.gen()
+	cache.invalidate("p1")
+	if _, err := cache.put("p1", cacheStatus, gen, "stale"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.get("p1", cacheStatus); ok {
+		t.Error("result loaded before invalidation was cached")
+	}
+
+	if _, err := cache.put("p1", cacheStatus, cache.gen(), "fresh"); err != nil {
+		t.Fatal(err)
+	}
+	if entry, ok := cache.get("p1", cacheStatus); !ok || entry.resp != "fresh" {
+		t.Error("current result wasn't cached")
+	}
+	cache.purge()
+	if _, ok := cache.get("p1", cacheStatus); ok {
+		t.Error("purged result is still cached")
+	}
+}
+
+func TestPollCacheExpires(t *testing.T) {
+	cache := newPollCache()
+	cache.ttl = time.Millisecond
+	if _, err := cache.put("p1", cacheStatus, cache.gen(), "expired"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := cache.get("p1", cacheStatus); ok {
+		t.Error("expired result is still cached")
+	}
+}
+
+func TestCacheServesWritesOfOtherProcesses(t *testing.T) {
+	s := newTestServer(t)
+	s.h.cache.ttl = 10 * time.Millisecond
+	poll := s.createPoll(messages.CreatePollReq{})
+	s.poll(poll.PollID)
+
+	// e.g. the CLI writing to the database directly
+	if _, err := s.db.Exec("UPDATE poll SET title = 'Renamed' WHERE id = ?", poll.PollID); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if title := s.poll(poll.PollID).Title; title != "Renamed" {
+		t.Errorf("expired poll has title %q", title)
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{})
+
+	for _, path := range []string{
+		"/api/poll/v1/status/" + poll.PollID,
+		"/api/poll/v1/data?poll_id=" + poll.PollID,
+		"/api/v2/polls/" + poll.PollID,
+		"/api/v2/polls/" + poll.PollID + "/results",
+		"/api/v2/polls/" + poll.PollID + "/chain",
+	} {
+		rec := s.request(http.MethodGet, path, nil)
+		expectStatus(t, rec, http.StatusOK)
+		etag := rec.Header().Get("ETag")
+		if etag == "" {
+			t.Fatalf("%s: no ETag", path)
+		}
+
+		rec = s.request(http.MethodGet, path, nil, "If-None-Match", etag)
+		expectStatus(t, rec, http.StatusNotModified)
+		if rec.Body.Len() != 0 || rec.Header().Get("ETag") != etag {
+			t.Errorf("%s: unexpected 304 response %q with ETag %q", path, rec.Body.String(), rec.Header().Get("ETag"))
+		}
+		expectStatus(t, s.request(http.MethodGet, path, nil, "If-None-Match", `"outdated"`), http.StatusOK)
+	}
+
+	stats := decode[messages.CacheStatsResp](t, s.request(http.MethodGet, "/api/cache/stats", nil), http.StatusOK)
+	if stats.Hits == 0 || stats.Entries != 1 {
+		t.Errorf("unexpected cache stats %+v", stats)
+	}
+}
+
+// Returns the v1 data of a poll and its ETag, expecting that it changed since etag.
+func changedData(s *testServer, id string, etag string) (messages.GetPollDataResp, string) {
+	s.t.Helper()
+	rec := s.request(http.MethodGet, "/api/poll/v1/data/"+id, nil, "If-None-Match", etag)
+	resp := decode[messages.GetPollDataResp](s.t, rec, http.StatusOK)
+	return resp, rec.Header().Get("ETag")
+}
+
+func TestCacheInvalidatedByVotes(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{})
+	choices := s.choices(poll.PollID)
+
+	data, etag := changedData(s, poll.PollID, "")
+	if data.VotesCast != 0 {
+		t.Fatalf("new poll has %d votes", data.VotesCast)
+	}
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: []int{choices[0]}}), http.StatusNoContent)
+
+	data, _ = changedData(s, poll.PollID, etag)
+	if data.VotesCast != 1 || data.Votes[choices[0]] != 1 {
+		t.Errorf("cached data wasn't invalidated by the vote: %+v", data)
+	}
+	results := decode[messages.PollResultsResp](t, s.request(http.MethodGet, "/api/v2/polls/"+poll.PollID+"/results", nil), http.StatusOK)
+	if results.VotesCast != 1 {
+		t.Errorf("cached results weren't invalidated by the vote: %+v", results)
+	}
+}
+
+func TestCacheInvalidatedByDeleteAndRestore(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{})
+	path := "/api/v2/polls/" + poll.PollID
+	expectStatus(t, s.request(http.MethodGet, path, nil), http.StatusOK)
+	expectStatus(t, s.request(http.MethodGet, "/api/poll/v1/status/"+poll.PollID, nil), http.StatusOK)
+
+	expectStatus(t, s.request(http.MethodDelete, path, nil, bearer(poll.OwnerToken)...), http.StatusNoContent)
+	expectError(t, s.request(http.MethodGet, path, nil), http.StatusNotFound, messages.POLL_NOT_FOUND)
+	expectError(t, s.request(http.MethodGet, "/api/poll/v1/status/"+poll.PollID, nil), http.StatusNotFound, messages.POLL_NOT_FOUND)
+
+	expectStatus(t, s.request(http.MethodPost, path+"/restore", struct{}{}, bearer(poll.OwnerToken)...), http.StatusOK)
+	expectStatus(t, s.request(http.MethodGet, path, nil), http.StatusOK)
+	expectStatus(t, s.request(http.MethodGet, "/api/poll/v1/status/"+poll.PollID, nil), http.StatusOK)
+}
+
+func TestCacheInvalidatedByChainChanges(t *testing.T) {
+	s := newTestServer(t)
+	first := s.createPoll(messages.CreatePollReq{TargetVotes: 1, AutoCreate: true})
+	data, etag := changedData(s, first.PollID, "")
+	if data.NextPoll != "" || data.LatestPoll != "" {
+		t.Fatalf("unexpected successors of new poll: %+v", data)
+	}
+
+	// linking a new poll
+	second := s.createPoll(messages.CreatePollReq{TargetVotes: 1, AutoCreate: true, PrevPollID: first.PollID})
+	data, etag = changedData(s, first.PollID, etag)
+	if data.NextPoll != second.PollID || data.LatestPoll != second.PollID {
+		t.Fatalf("cached data wasn't invalidated by linking a poll: %+v", data)
+	}
+
+	// successor created by the concluding vote
+	expectStatus(t, s.vote(second.PollID, messages.CastVotesReq{UserID: "alice", Votes: s.choices(second.PollID)[:1]}), http.StatusNoContent)
+	data, etag = changedData(s, first.PollID, etag)
+	third := s.poll(second.PollID).NextPoll
+	if third == "" || data.LatestPoll != third {
+		t.Fatalf("cached data wasn't invalidated by creating a successor: %+v", data)
+	}
+
+	// deleting a poll splits the chain
+	expectStatus(t, s.request(http.MethodDelete, "/api/v2/polls/"+second.PollID, nil, bearer(second.OwnerToken)...), http.StatusNoContent)
+	data, _ = changedData(s, first.PollID, etag)
+	if data.NextPoll != "" || data.LatestPoll != "" {
+		t.Errorf("cached data wasn't invalidated by deleting the successor: %+v", data)
+	}
+}
@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+)
+
+// Lets hundreds of voters vote at the same time, including voters trying to vote twice and
+// voters arriving after the poll concluded.
+func TestConcurrentVotes(t *testing.T) {
+	const (
+		VOTERS  = 300 // needed for the poll to conclude
+		LATE    = 50  // additional voters, all of them are rejected
+		TWICE   = 50  // voters voting a second time
+		CHOICES = 5
+	)
+	s := newTestServer(t)
+	server := httptest.NewServer(s.e)
+	t.Cleanup(server.Close)
+
+	var mode string
+	if err := s.db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil || mode != "wal" {
+		t.Fatalf("journal mode is %q, expected wal: %v", mode, err)
+	}
+
+	create := messages.CreatePollReq{TargetVotes: VOTERS, Type: messages.MULTIPLE, AutoCreate: true}
+	for i := 0; i < CHOICES; i++ {
+		create.Choices = append(create.Choices, fmt.Sprintf("choice %d", i))
+	}
+	poll := s.createPoll(create)
+	choices := s.choices(poll.PollID)
+
+	// voters voting twice use the same ballot
+	ballots := make([][]int, VOTERS+LATE)
+	for i := range ballots {
+		for _, j := range rand.Perm(CHOICES)[:1+rand.Intn(CHOICES)] {
+			ballots[i] = append(ballots[i], choices[j])
+		}
+	}
+
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: VOTERS + LATE + TWICE}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	accepted := make(map[int]int)
+	rejected := make(map[messages.ErrorCode]int)
+	start := make(chan struct{})
+	vote := func(voter int) {
+		defer wg.Done()
+		body, _ := json.Marshal(messages.CastVotesReq{UserID: fmt.Sprintf("voter-%d", voter), Votes: ballots[voter]})
+		<-start
+		resp, err := client.Post(server.URL+"/api/v2/polls/"+poll.PollID+"/votes", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer resp.Body.Close()
+		var e messages.Error
+		if resp.StatusCode != http.StatusNoContent {
+			json.NewDecoder(resp.Body).Decode(&e)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case resp.StatusCode == http.StatusNoContent:
+			accepted[voter]++
+		case resp.StatusCode == http.StatusConflict && (e.Code == messages.ALREADY_VOTED || e.Code == messages.POLL_CONCLUDED):
+			rejected[e.Code]++
+		default:
+			t.Errorf("vote of voter %d failed with status %d: %+v", voter, resp.StatusCode, e)
+		}
+	}
+	for voter := 0; voter < VOTERS+LATE; voter++ {
+		wg.Add(1)
+		go vote(voter)
+	}
+	for voter := 0; voter < TWICE; voter++ {
+		wg.Add(1)
+		go vote(voter)
+	}
+	close(start)
+	wg.Wait()
+	t.Logf("%d votes accepted, rejected %v", len(accepted), rejected)
+
+	if len(accepted) != VOTERS || rejected[messages.ALREADY_VOTED]+rejected[messages.POLL_CONCLUDED] != LATE+TWICE {
+		t.Errorf("%d votes accepted and %v rejected, expected %d and %d", len(accepted), rejected, VOTERS, LATE+TWICE)
+	}
+	ballots_cast := 0
+	expected := make(map[int]uint)
+	for voter, votes := range accepted {
+		if votes != 1 {
+			t.Errorf("voter %d voted %d times", voter, votes)
+		}
+		ballots_cast += len(ballots[voter])
+		for _, choice := range ballots[voter] {
+			expected[choice]++
+		}
+	}
+
+	// every accepted ballot is counted exactly once
+	var rows, users int
+	if err := s.db.QueryRow("SELECT COUNT(*), COUNT(DISTINCT user) FROM vote WHERE poll_id=?", poll.PollID).Scan(&rows, &users); err != nil {
+		t.Fatal(err)
+	}
+	if rows != ballots_cast || users != VOTERS {
+		t.Errorf("%d votes of %d users stored, expected %d of %d", rows, users, ballots_cast, VOTERS)
+	}
+	results := decode[messages.PollResultsResp](t, s.request(http.MethodGet, "/api/v2/polls/"+poll.PollID+"/results", nil), http.StatusOK)
+	if !results.Concluded || results.VotesCast != VOTERS {
+		t.Errorf("poll counts %d votes, expected %d", results.VotesCast, VOTERS)
+	}
+	for _, result := range results.Results {
+		if result.Votes != expected[result.ID] {
+			t.Errorf("choice %d has %d votes, expected %d", result.ID, result.Votes, expected[result.ID])
+		}
+	}
+	chain := decode[messages.PollChainResp](t, s.request(http.MethodGet, "/api/v2/polls/"+poll.PollID+"/chain", nil), http.StatusOK)
+	if len(chain.Polls) != 2 {
+		t.Errorf("poll chain has %d polls, expected one successor", len(chain.Polls))
+	}
+}
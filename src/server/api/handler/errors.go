@@ -0,0 +1,208 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/labstack/echo/v4"
+	"github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Errors returned by poll operations. Each API version maps their codes to its own status codes.
+var (
+	errMalformedRequest   = &messages.Error{Code: messages.MALFORMED_REQUEST, Message: "malformed request"}
+	errTooFewChoices      = &messages.Error{Code: messages.TOO_FEW_CHOICES, Message: "at least two choices must be provided"}
+	errEmptyTitle         = &messages.Error{Code: messages.EMPTY_TITLE, Message: "title must be at least 1 character long"}
+	errNoTargetVotes      = &messages.Error{Code: messages.INVALID_TARGET_VOTES, Message: "poll must allow for at least 1 vote"}
+	errPrevPollNotFound   = &messages.Error{Code: messages.PREVIOUS_POLL_NOT_FOUND, Message: "previous poll not found"}
+	errPollNotFound       = &messages.Error{Code: messages.POLL_NOT_FOUND, Message: "poll not found"}
+	errNoVotes            = &messages.Error{Code: messages.NO_VOTES, Message: "no votes specified"}
+	errDuplicateVotes     = &messages.Error{Code: messages.DUPLICATE_VOTES, Message: "duplicate votes are not allowed"}
+	errInvalidVoteCount   = &messages.Error{Code: messages.INVALID_VOTE_COUNT, Message: "number of votes doesn't match the poll type"}
+	errInvalidChoice      = &messages.Error{Code: messages.INVALID_CHOICE, Message: "votes contain choices that do not belong to the poll"}
+	errVoteLimitReached   = &messages.Error{Code: messages.POLL_CONCLUDED, Message: "poll already reached its target votes"}
+	errPollClosed         = &messages.Error{Code: messages.POLL_CLOSED, Message: "poll was closed"}
+	errAlreadyVoted       = &messages.Error{Code: messages.ALREADY_VOTED, Message: "user already voted"}
+	errPollNotDeleted     = &messages.Error{Code: messages.POLL_NOT_DELETED, Message: "poll is not deleted"}
+	errRetriesExhausted   = &messages.Error{Code: messages.BUSY, Message: "database busy, try again later"}
+	errUnavailable        = &messages.Error{Code: messages.UNAVAILABLE, Message: "service is starting or shutting down, try again later"}
+	errUnauthorized       = &messages.Error{Code: messages.UNAUTHORIZED, Message: "missing or invalid admin token"}
+	errIdentityRequired   = &messages.Error{Code: messages.IDENTITY_REQUIRED, Message: "poll requires a voter identity"}
+	errIdentityDisabled   = &messages.Error{Code: messages.IDENTITY_DISABLED, Message: "identity is not enabled on this server"}
+	errInviteRequired     = &messages.Error{Code: messages.INVITE_REQUIRED, Message: "poll is invite only, an invite token is required"}
+	errInvalidInvite      = &messages.Error{Code: messages.INVALID_INVITE, Message: "invalid invite token"}
+	errInviteUsed         = &messages.Error{Code: messages.INVITE_USED, Message: "invite was already used"}
+	errTooManyTargetVotes = &messages.Error{Code: messages.INVALID_TARGET_VOTES, Message: "target votes exceed the number of invites"}
+	errOwnerUnauthorized  = &messages.Error{Code: messages.UNAUTHORIZED, Message: "missing or invalid owner token"}
+	errAnonymityDisabled  = &messages.Error{Code: messages.ANONYMITY_DISABLED, Message: "anonymous ballots are not enabled on this server"}
+	errResultsHidden      = &messages.Error{Code: messages.RESULTS_HIDDEN, Message: "results are hidden until the poll closes"}
+	errWebhooksDisabled   = &messages.Error{Code: messages.WEBHOOKS_DISABLED, Message: "webhooks are not enabled on this server"}
+	errWebhookNotFound    = &messages.Error{Code: messages.WEBHOOK_NOT_FOUND, Message: "webhook not found"}
+	errTooManyWebhooks    = &messages.Error{Code: messages.MALFORMED_REQUEST, Message: fmt.Sprintf("poll can't have more than %d webhooks", MAX_WEBHOOKS)}
+	errBackupsDisabled    = &messages.Error{Code: messages.BACKUPS_DISABLED, Message: "no backup directory configured"}
+	errBackupNotFound     = &messages.Error{Code: messages.BACKUP_NOT_FOUND, Message: "backup not found"}
+	errInvalidBackup      = &messages.Error{Code: messages.INVALID_BACKUP, Message: "backup can't be restored"}
+)
+
+// Status codes of the v1 API.
+var statusV1 = map[messages.ErrorCode]int{
+	messages.MALFORMED_REQUEST:       http.StatusBadRequest,
+	messages.NOT_FOUND:               http.StatusNotFound,
+	messages.METHOD_NOT_ALLOWED:      http.StatusMethodNotAllowed,
+	messages.UNAUTHORIZED:            http.StatusUnauthorized,
+	messages.TOO_FEW_CHOICES:         http.StatusBadRequest,
+	messages.EMPTY_TITLE:             http.StatusBadRequest,
+	messages.INVALID_TARGET_VOTES:    http.StatusBadRequest,
+	messages.NO_VOTES:                http.StatusBadRequest,
+	messages.DUPLICATE_VOTES:         http.StatusBadRequest,
+	messages.INVALID_VOTE_COUNT:      http.StatusBadRequest,
+	messages.INVALID_CHOICE:          http.StatusBadRequest,
+	messages.POLL_NOT_FOUND:          http.StatusNotFound,
+	messages.PREVIOUS_POLL_NOT_FOUND: http.StatusNotFound,
+	messages.POLL_CLOSED:             http.StatusBadRequest,
+	messages.POLL_CONCLUDED:          http.StatusBadRequest,
+	messages.ALREADY_VOTED:           http.StatusBadRequest,
+	messages.POLL_NOT_DELETED:        http.StatusConflict,
+	messages.IDENTITY_REQUIRED:       http.StatusForbidden,
+	messages.IDENTITY_DISABLED:       http.StatusUnprocessableEntity,
+	messages.INVITE_REQUIRED:         http.StatusForbidden,
+	messages.INVALID_INVITE:          http.StatusForbidden,
+	messages.INVITE_USED:             http.StatusBadRequest,
+	messages.RESULTS_HIDDEN:          http.StatusForbidden,
+	messages.ANONYMITY_DISABLED:      http.StatusUnprocessableEntity,
+	messages.WEBHOOKS_DISABLED:       http.StatusUnprocessableEntity,
+	messages.WEBHOOK_NOT_FOUND:       http.StatusNotFound,
+	messages.BACKUPS_DISABLED:        http.StatusConflict,
+	messages.BACKUP_NOT_FOUND:        http.StatusNotFound,
+	messages.INVALID_BACKUP:          http.StatusUnprocessableEntity,
+	messages.CONSTRAINT_VIOLATION:    http.StatusBadRequest,
+	messages.BUSY:                    http.StatusInternalServerError,
+	messages.TIMEOUT:                 http.StatusRequestTimeout,
+	messages.RATE_LIMITED:            http.StatusTooManyRequests,
+	messages.UNAVAILABLE:             http.StatusServiceUnavailable,
+	messages.INTERNAL_ERROR:          http.StatusInternalServerError,
+}
+
+// Status codes of the v2 API. Differs from v1 where v1 didn't use proper status codes.
+var statusV2 = func() map[messages.ErrorCode]int {
+	status := make(map[messages.ErrorCode]int, len(statusV1))
+	for code, s := range statusV1 {
+		status[code] = s
+	}
+	status[messages.PREVIOUS_POLL_NOT_FOUND] = http.StatusUnprocessableEntity
+	status[messages.POLL_CLOSED] = http.StatusConflict
+	status[messages.POLL_CONCLUDED] = http.StatusConflict
+	status[messages.ALREADY_VOTED] = http.StatusConflict
+	status[messages.INVITE_USED] = http.StatusConflict
+	status[messages.BUSY] = http.StatusServiceUnavailable
+	return status
+}()
+
+// Wraps binding errors, keeping the reason as error detail.
+func malformedRequest(err error) *messages.Error {
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return errMalformedRequest.WithDetails("reason", fmt.Sprint(he.Message))
+	}
+	return errMalformedRequest.WithDetails("reason", err.Error())
+}
+
+// Writes an error response for the v1 API.
+func (h *Handler) handleError(c echo.Context, err error) error {
+	return h.writeError(c, err, statusV1)
+}
+
+// Writes an error response for the v2 API.
+func (h *Handler) handleErrorV2(c echo.Context, err error) error {
+	return h.writeError(c, err, statusV2)
+}
+
+// Writes poll operation errors as they are, all other errors are treated as database errors.
+func (h *Handler) writeError(c echo.Context, err error, statuses map[messages.ErrorCode]int) error {
+	var resp *messages.Error
+	if !errors.As(err, &resp) {
+		resp = h.dbError(c.Request().Context(), err)
+	}
+	status, ok := statuses[resp.Code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	h.metrics.Errors.WithLabelValues(string(resp.Code), sqliteCode(err)).Inc()
+	trace.SpanFromContext(c.Request().Context()).SetAttributes(attribute.String("error.code", string(resp.Code)))
+	return c.JSON(status, resp)
+}
+
+// Names of SQLite error codes for metrics. Unnamed codes are reported by number.
+var sqliteCodes = map[sqlite3.ErrNo]string{
+	sqlite3.ErrError:      "error",
+	sqlite3.ErrAbort:      "abort",
+	sqlite3.ErrBusy:       "busy",
+	sqlite3.ErrLocked:     "locked",
+	sqlite3.ErrNomem:      "nomem",
+	sqlite3.ErrReadonly:   "readonly",
+	sqlite3.ErrInterrupt:  "interrupt",
+	sqlite3.ErrIoErr:      "ioerr",
+	sqlite3.ErrCorrupt:    "corrupt",
+	sqlite3.ErrFull:       "full",
+	sqlite3.ErrCantOpen:   "cantopen",
+	sqlite3.ErrConstraint: "constraint",
+	sqlite3.ErrMismatch:   "mismatch",
+	sqlite3.ErrAuth:       "auth",
+}
+
+// Returns the name of the SQLite error code wrapped in err or none.
+func sqliteCode(err error) string {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return "none"
+	}
+	if name, ok := sqliteCodes[sqliteErr.Code]; ok {
+		return name
+	}
+	return strconv.Itoa(int(sqliteErr.Code))
+}
+
+// Error handler for errors not handled by the handlers, e.g. unknown routes.
+func (h *Handler) HTTPErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	var he *echo.HTTPError
+	if !errors.As(err, &he) {
+		if err := h.handleError(c, err); err != nil {
+			h.logger(c.Request().Context()).Error("Could not write error response", "error", err)
+		}
+		return
+	}
+
+	resp := &messages.Error{Code: messages.INTERNAL_ERROR, Message: fmt.Sprint(he.Message)}
+	switch he.Code {
+	case http.StatusNotFound:
+		resp.Code = messages.NOT_FOUND
+	case http.StatusMethodNotAllowed:
+		resp.Code = messages.METHOD_NOT_ALLOWED
+	case http.StatusRequestTimeout, http.StatusServiceUnavailable:
+		resp.Code = messages.TIMEOUT
+	case http.StatusTooManyRequests:
+		resp.Code = messages.RATE_LIMITED
+	default:
+		if he.Code < http.StatusInternalServerError {
+			resp.Code = messages.MALFORMED_REQUEST
+		}
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(he.Code)
+	} else {
+		err = c.JSON(he.Code, resp)
+	}
+	if err != nil {
+		h.logger(c.Request().Context()).Error("Could not write error response", "error", err)
+	}
+}
@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/labstack/echo/v4"
+	"github.com/mattn/go-sqlite3"
+)
+
+func TestErrorStatuses(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		code messages.ErrorCode
+		v1   int
+		v2   int
+	}{
+		{messages.MALFORMED_REQUEST, http.StatusBadRequest, http.StatusBadRequest},
+		{messages.NOT_FOUND, http.StatusNotFound, http.StatusNotFound},
+		{messages.METHOD_NOT_ALLOWED, http.StatusMethodNotAllowed, http.StatusMethodNotAllowed},
+		{messages.UNAUTHORIZED, http.StatusUnauthorized, http.StatusUnauthorized},
+		{messages.TOO_FEW_CHOICES, http.StatusBadRequest, http.StatusBadRequest},
+		{messages.EMPTY_TITLE, http.StatusBadRequest, http.StatusBadRequest},
+		{messages.INVALID_TARGET_VOTES, http.StatusBadRequest, http.StatusBadRequest},
+		{messages.NO_VOTES, http.StatusBadRequest, http.StatusBadRequest},
+		{messages.DUPLICATE_VOTES, http.StatusBadRequest, http.StatusBadRequest},
+		{messages.INVALID_VOTE_COUNT, http.StatusBadRequest, http.StatusBadRequest},
+		{messages.INVALID_CHOICE, http.StatusBadRequest, http.StatusBadRequest},
+		{messages.POLL_NOT_FOUND, http.StatusNotFound, http.StatusNotFound},
+		{messages.PREVIOUS_POLL_NOT_FOUND, http.StatusNotFound, http.StatusUnprocessableEntity},
+		{messages.POLL_CLOSED, http.StatusBadRequest, http.StatusConflict},
+		{messages.POLL_CONCLUDED, http.StatusBadRequest, http.StatusConflict},
+		{messages.ALREADY_VOTED, http.StatusBadRequest, http.StatusConflict},
+		{messages.POLL_NOT_DELETED, http.StatusConflict, http.StatusConflict},
+		{messages.IDENTITY_REQUIRED, http.StatusForbidden, http.StatusForbidden},
+		{messages.IDENTITY_DISABLED, http.StatusUnprocessableEntity, http.StatusUnprocessableEntity},
+		{messages.INVITE_REQUIRED, http.StatusForbidden, http.StatusForbidden},
+		{messages.INVALID_INVITE, http.StatusForbidden, http.StatusForbidden},
+		{messages.INVITE_USED, http.StatusBadRequest, http.StatusConflict},
+		{messages.RESULTS_HIDDEN, http.StatusForbidden, http.StatusForbidden},
+		{messages.ANONYMITY_DISABLED, http.StatusUnprocessableEntity, http.StatusUnprocessableEntity},
+		{messages.WEBHOOKS_DISABLED, http.StatusUnprocessableEntity, http.StatusUnprocessableEntity},
+		{messages.WEBHOOK_NOT_FOUND, http.StatusNotFound, http.StatusNotFound},
+		{messages.BACKUPS_DISABLED, http.StatusConflict, http.StatusConflict},
+		{messages.BACKUP_NOT_FOUND, http.StatusNotFound, http.StatusNotFound},
+		{messages.INVALID_BACKUP, http.StatusUnprocessableEntity, http.StatusUnprocessableEntity},
+		{messages.CONSTRAINT_VIOLATION, http.StatusBadRequest, http.StatusBadRequest},
+		{messages.BUSY, http.StatusInternalServerError, http.StatusServiceUnavailable},
+		{messages.TIMEOUT, http.StatusRequestTimeout, http.StatusRequestTimeout},
+		{messages.RATE_LIMITED, http.StatusTooManyRequests, http.StatusTooManyRequests},
+		{messages.UNAVAILABLE, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{messages.INTERNAL_ERROR, http.StatusInternalServerError, http.StatusInternalServerError},
+	}
+	if len(tests) != len(statusV1) || len(tests) != len(statusV2) {
+		t.Fatalf("%d codes tested, %d v1 and %d v2 codes mapped", len(tests), len(statusV1), len(statusV2))
+	}
+	for _, test := range tests {
+		err := &messages.Error{Code: test.code, Message: "message"}
+		if status := s.writeError(s.h.handleError, err); status != test.v1 {
+			t.Errorf("v1 status of %s is %d, expected %d", test.code, status, test.v1)
+		}
+		if status := s.writeError(s.h.handleErrorV2, err); status != test.v2 {
+			t.Errorf("v2 status of %s is %d, expected %d", test.code, status, test.v2)
+		}
+	}
+}
+
+// Writes an error with the error handler of an API version. Returns the status code.
+func (s *testServer) writeError(handle func(echo.Context, error) error, err error) int {
+	s.t.Helper()
+	rec := httptest.NewRecorder()
+	if err := handle(s.e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec), err); err != nil {
+		s.t.Fatal(err)
+	}
+	return rec.Code
+}
+
+func TestDatabaseErrors(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		err  error
+		code messages.ErrorCode
+	}{
+		{sqlite3.Error{Code: sqlite3.ErrBusy}, messages.BUSY},
+		{sqlite3.Error{Code: sqlite3.ErrConstraint, ExtendedCode: sqlite3.ErrConstraintForeignKey}, messages.CONSTRAINT_VIOLATION},
+		{sqlite3.Error{Code: sqlite3.ErrCorrupt}, messages.INTERNAL_ERROR},
+		{context.DeadlineExceeded, messages.TIMEOUT},
+		{context.Canceled, messages.TIMEOUT},
+		{sql.ErrNoRows, messages.INTERNAL_ERROR},
+		{errors.New("unexpected"), messages.INTERNAL_ERROR},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		if err := s.h.handleErrorV2(s.e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec), test.err); err != nil {
+			t.Fatal(err)
+		}
+		expectError(t, rec, statusV2[test.code], test.code)
+	}
+}
+
+func TestRequestErrors(t *testing.T) {
+	s := newTestServer(t)
+	expectError(t, s.request(http.MethodGet, "/api/unknown", nil), http.StatusNotFound, messages.NOT_FOUND)
+	expectError(t, s.request(http.MethodPut, "/api/v2/polls/unknown", nil), http.StatusMethodNotAllowed, messages.METHOD_NOT_ALLOWED)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v2/polls", strings.NewReader(`{"title": 1`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	s.e.ServeHTTP(rec, req)
+	if resp := expectError(t, rec, http.StatusBadRequest, messages.MALFORMED_REQUEST); resp.Details["reason"] == nil {
+		t.Errorf("malformed request without reason %+v", resp)
+	}
+}
+
+func TestInvalidChoiceDetails(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{Type: messages.MULTIPLE})
+	choices := s.choices(poll.PollID)
+	invalid := choices[1] + 100
+	votes := []int{choices[0], invalid}
+
+	v1 := s.request(http.MethodPost, "/api/poll/v1/vote", messages.VotePollReq{PollID: poll.PollID, UserID: "alice", Votes: votes})
+	v2 := s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: votes})
+	for _, rec := range []*httptest.ResponseRecorder{v1, v2} {
+		resp := expectError(t, rec, http.StatusBadRequest, messages.INVALID_CHOICE)
+		if !reflect.DeepEqual(resp.Details["invalid_choice_ids"], []any{float64(invalid)}) {
+			t.Errorf("unexpected details %+v", resp.Details)
+		}
+	}
+	if cast := s.poll(poll.PollID).VotesCast; cast != 0 {
+		t.Errorf("%d votes cast by invalid ballots", cast)
+	}
+}
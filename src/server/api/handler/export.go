@@ -0,0 +1,221 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+)
+
+// Poll result exports in formats meant for sharing, e.g. in wikis and chats.
+
+// Returns the results of a poll or its entire chain.
+func (h *Handler) exportPoll(ctx context.Context, req *messages.ExportPollReq) (messages.ExportPollResp, error) {
+	log := h.logger(ctx).With("poll_id", req.PollID)
+	log.Debug("Exporting poll", "format", req.Format, "ballots", req.Ballots, "chain", req.Chain)
+
+	polls := []string{req.PollID}
+	if req.Chain {
+		chain, err := h.pollChain(ctx, req.PollID)
+		if err != nil {
+			return messages.ExportPollResp{}, err
+		}
+		polls = chain.Polls
+	}
+
+	resp := messages.ExportPollResp{Polls: make([]messages.PollResultExport, 0, len(polls))}
+	for _, id := range polls {
+		poll, err := h.exportPollResults(ctx, id, req.Ballots)
+		if err != nil {
+			return messages.ExportPollResp{}, err
+		}
+		resp.Polls = append(resp.Polls, poll)
+	}
+	return resp, nil
+}
+
+func (h *Handler) exportPollResults(ctx context.Context, id string, ballots bool) (messages.PollResultExport, error) {
+	results, err := h.pollResults(ctx, id)
+	if err != nil {
+		return messages.PollResultExport{}, err
+	}
+	data, err := h.queries.getPollData(ctx, id)
+	if err != nil {
+		return messages.PollResultExport{}, err
+	}
+	// exports are public, tallies hidden from some callers are hidden from all
+	if !resultsPublic(data) {
+		h.logger(ctx).Warn("Can't export poll, results are hidden", "poll_id", id, "visibility", data.visibility)
+		return messages.PollResultExport{}, errResultsHidden.WithDetails("poll_id", id)
+	}
+
+	export := messages.PollResultExport{
+		PollID:        id,
+		Title:         data.title,
+		Type:          data.poll_type,
+		VotesRequired: results.VotesRequired,
+		VotesCast:     results.VotesCast,
+		Concluded:     results.Concluded,
+		Closed:        results.Closed,
+		CreatedAt:     data.created_at,
+		Results:       results.Results,
+		Winners:       make([]messages.Choice, 0, len(results.Winners)),
+	}
+	for _, result := range results.Results {
+		for _, winner := range results.Winners {
+			if result.ID == winner {
+				export.Winners = append(export.Winners, messages.Choice{ID: result.ID, Content: result.Content})
+			}
+		}
+	}
+
+	if ballots {
+		cast, err := h.queries.getPollBallots(ctx, id)
+		if err != nil {
+			return messages.PollResultExport{}, err
+		}
+		export.Ballots = make([]messages.Ballot, 0, len(cast))
+		for i, ballot := range cast {
+			export.Ballots = append(export.Ballots, messages.Ballot{Voter: i + 1, Votes: ballot.Votes})
+		}
+	}
+	return export, nil
+}
+
+// Writes one row per choice and poll. Ballots follow as a second table after an empty line.
+func exportCSV(resp messages.ExportPollResp) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	w.Write([]string{"poll_id", "title", "status", "choice_id", "choice", "votes", "winner"})
+	for _, poll := range resp.Polls {
+		winners := winnerIDs(poll)
+		for _, result := range poll.Results {
+			w.Write([]string{
+				poll.PollID,
+				poll.Title,
+				exportStatus(poll),
+				strconv.Itoa(result.ID),
+				result.Content,
+				strconv.FormatUint(uint64(result.Votes), 10),
+				strconv.FormatBool(winners[result.ID]),
+			})
+		}
+	}
+
+	if hasBallots(resp) {
+		w.Flush()
+		buf.WriteString("\n")
+		w.Write([]string{"poll_id", "voter", "choice_id", "choice"})
+		for _, poll := range resp.Polls {
+			choices := choiceNames(poll)
+			for _, ballot := range poll.Ballots {
+				for _, choice := range ballot.Votes {
+					w.Write([]string{poll.PollID, strconv.Itoa(ballot.Voter), strconv.Itoa(choice), choices[choice]})
+				}
+			}
+		}
+	}
+
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// Writes a section with a result table per poll, followed by its ballots.
+func exportMarkdown(resp messages.ExportPollResp) []byte {
+	var buf bytes.Buffer
+	for i, poll := range resp.Polls {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		fmt.Fprintf(&buf, "## %s\n\n", markdownEscape(poll.Title))
+		fmt.Fprintf(&buf, "Poll `%s`, %s, %d/%d votes, %s\n\n",
+			poll.PollID, poll.Type, poll.VotesCast, poll.VotesRequired, exportStatus(poll))
+
+		winners := winnerIDs(poll)
+		buf.WriteString("| Choice | Votes |\n|---|---:|\n")
+		for _, result := range poll.Results {
+			content := markdownEscape(result.Content)
+			if winners[result.ID] {
+				content = "**" + content + "**"
+			}
+			fmt.Fprintf(&buf, "| %s | %d |\n", content, result.Votes)
+		}
+
+		names := make([]string, 0, len(poll.Winners))
+		for _, winner := range poll.Winners {
+			names = append(names, markdownEscape(winner.Content))
+		}
+		switch len(names) {
+		case 0:
+			buf.WriteString("\nNo votes yet.\n")
+		case 1:
+			fmt.Fprintf(&buf, "\n**Winner:** %s\n", names[0])
+		default:
+			fmt.Fprintf(&buf, "\n**Tie:** %s\n", strings.Join(names, ", "))
+		}
+
+		if len(poll.Ballots) > 0 {
+			choices := choiceNames(poll)
+			buf.WriteString("\n| Voter | Choices |\n|---:|---|\n")
+			for _, ballot := range poll.Ballots {
+				voted := make([]string, 0, len(ballot.Votes))
+				for _, choice := range ballot.Votes {
+					voted = append(voted, markdownEscape(choices[choice]))
+				}
+				fmt.Fprintf(&buf, "| %d | %s |\n", ballot.Voter, strings.Join(voted, ", "))
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+func exportStatus(poll messages.PollResultExport) string {
+	switch {
+	case poll.Closed:
+		return string(messages.CLOSED)
+	case poll.Concluded:
+		return string(messages.CONCLUDED)
+	default:
+		return string(messages.OPEN)
+	}
+}
+
+func winnerIDs(poll messages.PollResultExport) map[int]bool {
+	winners := make(map[int]bool, len(poll.Winners))
+	for _, winner := range poll.Winners {
+		winners[winner.ID] = true
+	}
+	return winners
+}
+
+func choiceNames(poll messages.PollResultExport) map[int]string {
+	names := make(map[int]string, len(poll.Results))
+	for _, result := range poll.Results {
+		names[result.ID] = result.Content
+	}
+	return names
+}
+
+func hasBallots(resp messages.ExportPollResp) bool {
+	for _, poll := range resp.Polls {
+		if len(poll.Ballots) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Keeps user supplied text from breaking tables or adding markup.
+var markdownReplacer = strings.NewReplacer(
+	"\\", "\\\\", "|", "\\|", "*", "\\*", "_", "\\_", "`", "\\`", "#", "\\#",
+	"[", "\\[", "]", "\\]", "<", "&lt;", ">", "&gt;", "\r", " ", "\n", " ",
+)
+
+func markdownEscape(text string) string {
+	return markdownReplacer.Replace(text)
+}
@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/labstack/echo/v4"
+)
+
+// Exports a poll through the v1 API.
+func (s *testServer) export(query string) string {
+	s.t.Helper()
+	rec := s.request(http.MethodGet, "/api/poll/v1/export?"+query, nil)
+	expectStatus(s.t, rec, http.StatusOK)
+	return rec.Body.String()
+}
+
+func TestExportJSON(t *testing.T) {
+	s := newTestServer(t)
+	first := s.createPoll(messages.CreatePollReq{Type: messages.MULTIPLE})
+	choices := s.choices(first.PollID)
+	expectStatus(t, s.vote(first.PollID, messages.CastVotesReq{UserID: "alice", Votes: choices}), http.StatusNoContent)
+	expectStatus(t, s.vote(first.PollID, messages.CastVotesReq{UserID: "bob", Votes: choices[1:]}), http.StatusNoContent)
+	second := s.createPoll(messages.CreatePollReq{PrevPollID: first.PollID})
+
+	rec := s.request(http.MethodGet, "/api/poll/v1/export?poll_id="+second.PollID+"&chain=true&ballots=true", nil)
+	resp := decode[messages.ExportPollResp](t, rec, http.StatusOK)
+	if len(resp.Polls) != 2 || resp.Polls[0].PollID != first.PollID || resp.Polls[1].PollID != second.PollID {
+		t.Fatalf("unexpected polls %+v", resp.Polls)
+	}
+	poll := resp.Polls[0]
+	if !poll.Concluded || poll.VotesCast != 2 || poll.Type != messages.MULTIPLE {
+		t.Errorf("unexpected poll %+v", poll)
+	}
+	if !reflect.DeepEqual(poll.Winners, []messages.Choice{{ID: choices[1], Content: "Heat"}}) {
+		t.Errorf("unexpected winners %+v", poll.Winners)
+	}
+	// voters are numbered, user ids aren't exported
+	ballots := []messages.Ballot{{Voter: 1, Votes: choices}, {Voter: 2, Votes: choices[1:]}}
+	if !reflect.DeepEqual(poll.Ballots, ballots) {
+		t.Errorf("unexpected ballots %+v", poll.Ballots)
+	}
+	if strings.Contains(rec.Body.String(), "alice") {
+		t.Errorf("export contains user ids: %s", rec.Body.String())
+	}
+
+	resp = decode[messages.ExportPollResp](t, s.request(http.MethodGet, "/api/poll/v1/export?poll_id="+first.PollID, nil), http.StatusOK)
+	if len(resp.Polls) != 1 || resp.Polls[0].Ballots != nil {
+		t.Errorf("unexpected export without chain and ballots %+v", resp.Polls)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{Title: "Movie night, again", TargetVotes: 3})
+	choices := s.choices(poll.PollID)
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: choices[1:]}), http.StatusNoContent)
+
+	rec := s.request(http.MethodGet, "/api/poll/v1/export?poll_id="+poll.PollID+"&format=csv&ballots=true", nil)
+	expectStatus(t, rec, http.StatusOK)
+	if content_type := rec.Header().Get(echo.HeaderContentType); content_type != "text/csv; charset=utf-8" {
+		t.Errorf("content type %q", content_type)
+	}
+	if disposition := rec.Header().Get(echo.HeaderContentDisposition); disposition != `inline; filename="poll-`+poll.PollID+`.csv"` {
+		t.Errorf("content disposition %q", disposition)
+	}
+	expected := fmt.Sprintf(`poll_id,title,status,choice_id,choice,votes,winner
+%[1]s,"Movie night, again",open,%[3]d,Heat,1,true
+%[1]s,"Movie night, again",open,%[2]d,Alien,0,false
+
+poll_id,voter,choice_id,choice
+%[1]s,1,%[3]d,Heat
+`, poll.PollID, choices[0], choices[1])
+	if rec.Body.String() != expected {
+		t.Errorf("unexpected export:\n%s\nexpected:\n%s", rec.Body.String(), expected)
+	}
+}
+
+func TestExportMarkdown(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{Title: "Movie night #1", Choices: []string{"Alien | *Director's cut*", "Heat"}})
+	choices := s.choices(poll.PollID)
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: choices[:1]}), http.StatusNoContent)
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "bob", Votes: choices[1:]}), http.StatusNoContent)
+
+	expected := fmt.Sprintf("## Movie night \\#1\n\n"+
+		"Poll `%s`, single, 2/2 votes, concluded\n\n"+
+		"| Choice | Votes |\n|---|---:|\n"+
+		"| **Alien \\| \\*Director's cut\\*** | 1 |\n"+
+		"| **Heat** | 1 |\n\n"+
+		"**Tie:** Alien \\| \\*Director's cut\\*, Heat\n", poll.PollID)
+	if md := s.export("poll_id=" + poll.PollID + "&format=md"); md != expected {
+		t.Errorf("unexpected export:\n%s\nexpected:\n%s", md, expected)
+	}
+
+	empty := s.createPoll(messages.CreatePollReq{})
+	if md := s.export("poll_id=" + empty.PollID + "&format=md"); !strings.HasSuffix(md, "\nNo votes yet.\n") {
+		t.Errorf("unexpected export of a poll without votes:\n%s", md)
+	}
+}
+
+func TestExportFailures(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{})
+	expectError(t, s.request(http.MethodGet, "/api/poll/v1/export?poll_id="+poll.PollID+"&format=pdf", nil),
+		http.StatusBadRequest, messages.MALFORMED_REQUEST)
+	expectError(t, s.request(http.MethodGet, "/api/poll/v1/export?poll_id=unknown", nil), http.StatusNotFound, messages.POLL_NOT_FOUND)
+	expectError(t, s.request(http.MethodGet, "/api/poll/v1/export?poll_id=unknown&chain=true", nil), http.StatusNotFound, messages.POLL_NOT_FOUND)
+}
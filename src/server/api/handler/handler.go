@@ -4,88 +4,170 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"net/http"
+	"log/slog"
+	"sync/atomic"
 	"time"
 
+	"github.com/AdrianPrawda/movie-poll/api/database"
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/AdrianPrawda/movie-poll/api/metrics"
 	"github.com/AdrianPrawda/movie-poll/api/util"
 	"github.com/labstack/echo/v4"
 	"github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Handler struct {
 	db      *sql.DB
-	log     *util.Logger
+	log     *slog.Logger
 	queries *queryHandler
+	cache   *pollCache
+	metrics *metrics.Metrics
+
+	retryPolicy util.RetryPolicy
+	timeouts    Timeouts
+	health      HealthConfig
+	ready       *atomic.Bool
+	backups     database.Backups
+	identity    IdentityConfig
+	webhooks    webhookSender
+}
+
+// Creates a handler which isn't ready yet, see SetReady.
+func NewHandler(db *sql.DB, log *slog.Logger, m *metrics.Metrics, timeouts Timeouts, health HealthConfig) Handler {
+	return Handler{db, log, &queryHandler{db, log, m}, newPollCache(), m, defaultRetryPolicy, timeouts, health, new(atomic.Bool), database.Backups{}, IdentityConfig{},
+		webhookSender{wake: make(chan struct{}, 1)}}
 }
 
-func NewHandler(db *sql.DB, log *util.Logger) Handler {
-	return Handler{db, log, &queryHandler{db, log}}
+// Sets the backup directory used by the admin API. Backups are disabled without directory.
+func (h *Handler) SetBackups(backups database.Backups) {
+	h.backups = backups
 }
 
-func defaultTimeout() (context.Context, context.CancelFunc) {
-	return context.WithTimeout(context.Background(), 10*time.Second)
+// Handler timeouts. Endpoints without a specific timeout use the default timeout.
+type Timeouts struct {
+	Default   time.Duration
+	Endpoints map[string]time.Duration
 }
 
-func (h *Handler) handleError(c echo.Context, err error, noRowsErr bool) error {
-	lwarn := h.log.Warn
-	lerr := h.log.Error
+// Endpoints which can be configured with specific timeouts. v1 and v2 handlers share the same names.
+var TimeoutEndpoints = []string{"create", "vote", "delete", "data", "status", "results", "chain", "heartbeat", "ready", "admin", "export", "backup", "invites", "webhooks"}
 
-	if err == nil {
-		return c.NoContent(http.StatusOK)
+func (t Timeouts) get(endpoint string) time.Duration {
+	if timeout, ok := t.Endpoints[endpoint]; ok {
+		return timeout
 	}
-	// sql.ErrNoRows is not considered an error
-	if err == sql.ErrNoRows {
-		if noRowsErr {
-			lerr.Println("query returned no rows")
-			return c.NoContent(http.StatusInternalServerError)
+	return t.Default
+}
+
+// Returns the longest configured timeout.
+func (t Timeouts) Max() time.Duration {
+	longest := t.Default
+	for _, timeout := range t.Endpoints {
+		if timeout > longest {
+			longest = timeout
 		}
-		lwarn.Println("sql.ErrNoRows should be handled externally")
-		return c.NoContent(http.StatusOK)
+	}
+	return longest
+}
+
+// Retry policy for write operations failing due to a busy database.
+// Should stay well below the request timeout.
+var defaultRetryPolicy = util.RetryPolicy{
+	Attempts:   6,
+	Base:       20 * time.Millisecond,
+	Multiplier: 2,
+	Jitter:     0.5,
+}
+
+// Returns a context for handling the request. It is cancelled when the endpoint timeout
+// expires or the client disconnects.
+func (h *Handler) requestContext(c echo.Context, endpoint string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.Request().Context(), h.timeouts.get(endpoint))
+}
+
+// Returns the request scoped logger carried by ctx, falling back to the handler logger.
+func (h *Handler) logger(ctx context.Context) *slog.Logger {
+	return util.LoggerFromContext(ctx, h.log)
+}
+
+// Logs database errors and converts them into error responses.
+func (h *Handler) dbError(ctx context.Context, err error) *messages.Error {
+	log := h.logger(ctx)
+
+	if err == sql.ErrNoRows {
+		log.Error("Query returned no rows")
+		return &messages.Error{Code: messages.INTERNAL_ERROR, Message: "internal error"}
 	}
 
-	if err == sql.ErrConnDone || err == sql.ErrTxDone {
-		lwarn.Print("Request timed out")
-		return c.NoContent(http.StatusRequestTimeout)
+	if err == sql.ErrConnDone || err == sql.ErrTxDone || errors.Is(err, context.DeadlineExceeded) {
+		log.Warn("Request timed out", "error", err)
+		return &messages.Error{Code: messages.TIMEOUT, Message: "request timed out, try again later"}
+	}
+	if errors.Is(err, context.Canceled) {
+		log.Warn("Request cancelled, client disconnected")
+		return &messages.Error{Code: messages.TIMEOUT, Message: "request cancelled"}
 	}
 
 	// handle sqlite specific errors
 	var sqliteErr sqlite3.Error
 	if errors.As(err, &sqliteErr) {
+		log := log.With("sqlite_code", sqliteErr.Code.Error(), "sqlite_extended_code", sqliteErr.ExtendedCode.Error())
 		switch e := sqliteErr.Code; e {
 		case sqlite3.ErrAbort:
-			lwarn.Printf("DB operation aborted (most likely due transaction errors): %v", sqliteErr)
-			return c.NoContent(http.StatusInternalServerError)
+			log.Warn("DB operation aborted (most likely due transaction errors)", "error", sqliteErr)
 		case sqlite3.ErrBusy:
-			lwarn.Println("Database is busy")
-			return c.String(http.StatusInternalServerError, "Try again later")
+			log.Warn("Database is busy")
+			return &messages.Error{Code: messages.BUSY, Message: "try again later"}
 		case sqlite3.ErrAuth:
-			lerr.Printf("Unauthorized database access: %v", sqliteErr)
-			return c.NoContent(http.StatusInternalServerError)
+			log.Error("Unauthorized database access", "error", sqliteErr)
 		case sqlite3.ErrReadonly:
-			lerr.Printf("Can't modify data on a read-only connection: %v", sqliteErr)
-			return c.NoContent(http.StatusInternalServerError)
+			log.Error("Can't modify data on a read-only connection", "error", sqliteErr)
 		case sqlite3.ErrConstraint:
-			lwarn.Printf("Can't modify data, constraint failed: %s\n", sqliteErr.ExtendedCode.Error())
-			return c.NoContent(http.StatusBadRequest)
+			log.Warn("Can't modify data, constraint failed")
+			resp := &messages.Error{Code: messages.CONSTRAINT_VIOLATION, Message: "constraint failed"}
+			return resp.WithDetails("constraint", sqliteErr.ExtendedCode.Error())
 		default:
-			lerr.Print(sqliteErr)
-			return c.NoContent(http.StatusInternalServerError)
+			log.Error("Database error", "error", sqliteErr)
 		}
+		return &messages.Error{Code: messages.INTERNAL_ERROR, Message: "internal error"}
 	}
 
-	lerr.Print(err)
-	return c.NoContent(http.StatusInternalServerError)
+	log.Error("Unexpected error", "error", err)
+	return &messages.Error{Code: messages.INTERNAL_ERROR, Message: "internal error"}
 }
 
-// Checks if database was busy. Not yet used.
+// Checks if database was busy (including busy snapshots) or a table was locked by a
+// connection sharing the same cache. Both can be retried.
 func (h *Handler) isDBBusy(err error) bool {
 	var sqliteErr sqlite3.Error
 	if errors.As(err, &sqliteErr) {
-		return sqliteErr.Code == sqlite3.ErrBusy
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
 	}
 	return false
 }
 
+// Runs a write operation, retrying it while the database is busy.
+func (h *Handler) retry(ctx context.Context, op string, fn func(context.Context) error) error {
+	log := h.logger(ctx)
+	ctx, span := tracer.Start(ctx, op)
+	defer span.End()
+
+	attempts, err := h.retryPolicy.Do(ctx, h.isDBBusy, fn)
+	span.SetAttributes(attribute.Int("retry.attempts", attempts))
+	if attempts > 1 {
+		log.Debug("Operation retried", "op", op, "attempts", attempts)
+	}
+	if err != nil {
+		recordError(span, err)
+	}
+	if err != nil && h.isDBBusy(err) {
+		log.Error("Database busy, giving up (overload or stuck queries?)", "op", op, "attempts", attempts)
+		return errRetriesExhausted.WithDetails("attempts", attempts)
+	}
+	return err
+}
+
 func (h *Handler) isSQLiteErrNo(err error, errno sqlite3.ErrNo) bool {
 	var sqliteErr sqlite3.Error
 	if errors.As(err, &sqliteErr) {
@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdrianPrawda/movie-poll/api/database"
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/AdrianPrawda/movie-poll/api/metrics"
+	"github.com/AdrianPrawda/movie-poll/config"
+	"github.com/huandu/go-sqlbuilder"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Admin token of test servers
+const TEST_ADMIN_TOKEN = "admin-token"
+
+func TestMain(m *testing.M) {
+	sqlbuilder.DefaultFlavor = sqlbuilder.SQLite
+	os.Exit(m.Run())
+}
+
+// API served from a new poll database file.
+type testServer struct {
+	t   *testing.T
+	h   *Handler
+	e   *echo.Echo
+	db  *sql.DB
+	reg *prometheus.Registry
+}
+
+// Creates a ready test server with the routes serve registers, including the admin API.
+// Identity and webhooks are disabled until configured by the test.
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cfg := config.Default().DB
+	cfg.DSN = "file:" + filepath.Join(t.TempDir(), "poll.db")
+	db, err := database.Open(cfg, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Setup(cfg, log, db); err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewRegistry()
+	m := metrics.New(reg)
+	h := NewHandler(db, log, m, Timeouts{Default: 10 * time.Second}, HealthConfig{SchemaVersion: database.SchemaVersion})
+	h.SetReady(true)
+
+	e := echo.New()
+	h.Routes(e, RouteConfig{AdminToken: TEST_ADMIN_TOKEN})
+	return &testServer{t: t, h: &h, e: e, db: db, reg: reg}
+}
+
+// Sends a request with a JSON encoded body unless body is nil. Headers are passed as
+// name, value pairs.
+func (s *testServer) request(method string, target string, body any, headers ...string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	if body != nil {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	s.e.ServeHTTP(rec, req)
+	return rec
+}
+
+// Header authorizing requests with the owner token of a poll
+func bearer(token string) []string {
+	return []string{echo.HeaderAuthorization, "Bearer " + token}
+}
+
+// Decodes a JSON response, failing the test unless it has the expected status.
+func decode[T any](t *testing.T, rec *httptest.ResponseRecorder, status int) T {
+	t.Helper()
+	var resp T
+	if rec.Code != status {
+		t.Fatalf("status %d, expected %d: %s", rec.Code, status, rec.Body.String())
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("couldn't decode response %q: %v", rec.Body.String(), err)
+	}
+	return resp
+}
+
+// Fails the test unless the response is an error with the expected status and code.
+func expectError(t *testing.T, rec *httptest.ResponseRecorder, status int, code messages.ErrorCode) *messages.Error {
+	t.Helper()
+	resp := decode[messages.Error](t, rec, status)
+	if resp.Code != code {
+		t.Fatalf("error code %q, expected %q: %s", resp.Code, code, rec.Body.String())
+	}
+	return &resp
+}
+
+// Fails the test unless the response has the expected status.
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("status %d, expected %d: %s", rec.Code, status, rec.Body.String())
+	}
+}
+
+// Creates a poll through the v2 API. Polls default to single choice polls with two choices
+// and two votes.
+func (s *testServer) createPoll(req messages.CreatePollReq) messages.CreatePollResp {
+	s.t.Helper()
+	if req.Type == "" {
+		req.Type = messages.SINGLE
+	}
+	if req.Title == "" {
+		req.Title = "Movie night"
+	}
+	if req.Choices == nil {
+		req.Choices = []string{"Alien", "Heat"}
+	}
+	if req.TargetVotes == 0 && req.Invites == 0 && len(req.Invitees) == 0 {
+		req.TargetVotes = 2
+	}
+	return decode[messages.CreatePollResp](s.t, s.request(http.MethodPost, "/api/v2/polls", req), http.StatusCreated)
+}
+
+// Returns a poll through the v2 API.
+func (s *testServer) poll(id string) messages.PollResp {
+	s.t.Helper()
+	return decode[messages.PollResp](s.t, s.request(http.MethodGet, "/api/v2/polls/"+id, nil), http.StatusOK)
+}
+
+// Returns the choice ids of a poll in order of creation.
+func (s *testServer) choices(id string) []int {
+	s.t.Helper()
+	var ids []int
+	for _, choice := range s.poll(id).Choices {
+		ids = append(ids, choice.ID)
+	}
+	return ids
+}
+
+// Casts votes through the v2 API.
+func (s *testServer) vote(id string, req messages.CastVotesReq, headers ...string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	return s.request(http.MethodPost, "/api/v2/polls/"+id+"/votes", req, headers...)
+}
+
+func TestTimeouts(t *testing.T) {
+	timeouts := Timeouts{Default: 10 * time.Second, Endpoints: map[string]time.Duration{"vote": time.Second, "export": time.Minute}}
+	if timeouts.get("vote") != time.Second || timeouts.get("data") != 10*time.Second {
+		t.Errorf("unexpected endpoint timeouts %v and %v", timeouts.get("vote"), timeouts.get("data"))
+	}
+	if timeouts.Max() != time.Minute {
+		t.Errorf("longest timeout is %v, expected %v", timeouts.Max(), time.Minute)
+	}
+}
+
+func TestRequestsTimeOut(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{})
+	s.h.timeouts = Timeouts{Default: 10 * time.Second, Endpoints: map[string]time.Duration{"data": time.Nanosecond}}
+	expectError(t, s.request(http.MethodGet, "/api/poll/v1/data/"+poll.PollID, nil), http.StatusRequestTimeout, messages.TIMEOUT)
+	expectStatus(t, s.request(http.MethodGet, "/api/v2/polls/"+poll.PollID+"/results", nil), http.StatusOK)
+
+	// queries of disconnected clients are cancelled
+	other := s.createPoll(messages.CreatePollReq{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, "/api/v2/polls/"+other.PollID+"/results", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	s.e.ServeHTTP(rec, req)
+	expectError(t, rec, http.StatusRequestTimeout, messages.TIMEOUT)
+}
@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/AdrianPrawda/movie-poll/telemetry"
+	"github.com/labstack/echo/v4"
+)
+
+// Settings of the readiness checks.
+type HealthConfig struct {
+	SchemaVersion  int    // expected schema version (PRAGMA user_version) of the poll database
+	RenderURL      string // base url of the render service, not checked if empty
+	RenderRequired bool   // render failures fail readiness instead of degrading it
+}
+
+// Client for calls to the render service, propagating trace context
+var renderClient = telemetry.HTTPClient()
+
+// Routes answering while the handler isn't ready, so probes, scrapes and the web client
+// keep working. They aren't traced either.
+var readinessExempt = map[string]bool{
+	"/healthz":  true,
+	"/readyz":   true,
+	"/metrics":  true,
+	"/":         true,
+	"/polls/*":  true,
+	"/static/*": true,
+}
+
+// Marks the handler as ready (setup completed) or not ready (starting or shutting down).
+func (h *Handler) SetReady(ready bool) {
+	h.ready.Store(ready)
+}
+
+// Middleware rejecting requests with 503 until the handler is ready.
+func (h *Handler) RequireReady(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if h.ready.Load() || readinessExempt[c.Path()] {
+			return next(c)
+		}
+		return h.handleErrorV2(c, errUnavailable)
+	}
+}
+
+// Skips tracing of probes and metric scrapes.
+func (h *Handler) TraceSkipper(c echo.Context) bool {
+	return readinessExempt[c.Path()]
+}
+
+// Liveness probe. Answers as long as the process is able to serve requests.
+func (h *Handler) Healthz(c echo.Context) error {
+	return c.JSON(http.StatusOK, messages.LivenessResp{Status: messages.HEALTH_OK})
+}
+
+// Readiness probe. Checks setup completion, schema version, that a write transaction can begin
+// and the render service if configured. Answers with 503 if any required check fails. Polls are
+// served without the render service, its failures only degrade readiness unless it's required.
+func (h *Handler) Readyz(c echo.Context) error {
+	ctx, cancel := h.requestContext(c, "ready")
+	defer cancel()
+
+	checks := []struct {
+		name     string
+		check    func(context.Context) (messages.HealthStatus, error)
+		optional bool
+	}{
+		{"setup", h.checkSetup, false},
+		{"schema", h.checkSchema, false},
+		{"write", h.checkWrite, false},
+		{"render", h.checkRender, !h.health.RenderRequired},
+	}
+
+	resp := messages.ReadinessResp{
+		Status: messages.HEALTH_READY,
+		Checks: make(map[string]messages.CheckResult, len(checks)),
+	}
+	for _, check := range checks {
+		start := time.Now()
+		status, err := check.check(ctx)
+		result := messages.CheckResult{
+			Status:     status,
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if err != nil {
+			result.Status = messages.HEALTH_FAILED
+			result.Message = err.Error()
+			if !check.optional {
+				resp.Status = messages.HEALTH_NOT_READY
+			} else if resp.Status == messages.HEALTH_READY {
+				resp.Status = messages.HEALTH_DEGRADED
+			}
+		}
+		resp.Checks[check.name] = result
+	}
+
+	switch resp.Status {
+	case messages.HEALTH_NOT_READY:
+		h.logger(ctx).Warn("Not ready", "checks", resp.Checks)
+		return c.JSON(http.StatusServiceUnavailable, resp)
+	case messages.HEALTH_DEGRADED:
+		h.logger(ctx).Warn("Degraded", "checks", resp.Checks)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (h *Handler) checkSetup(ctx context.Context) (messages.HealthStatus, error) {
+	if !h.ready.Load() {
+		return "", errors.New("starting or shutting down")
+	}
+	return messages.HEALTH_OK, nil
+}
+
+// Schema version is only set once setup completed.
+func (h *Handler) checkSchema(ctx context.Context) (messages.HealthStatus, error) {
+	var version int
+	if err := h.db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return "", err
+	}
+	if version != h.health.SchemaVersion {
+		return "", fmt.Errorf("schema version %d, expected %d", version, h.health.SchemaVersion)
+	}
+	return messages.HEALTH_OK, nil
+}
+
+// Begins and rolls back a write transaction, failing if the write lock can't be acquired in time.
+func (h *Handler) checkWrite(ctx context.Context) (messages.HealthStatus, error) {
+	conn, err := h.db.Conn(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return "", err
+	}
+	if _, err := conn.ExecContext(context.Background(), "ROLLBACK"); err != nil {
+		conn.Raw(func(any) error { return driver.ErrBadConn })
+		return "", err
+	}
+	return messages.HEALTH_OK, nil
+}
+
+func (h *Handler) checkRender(ctx context.Context) (messages.HealthStatus, error) {
+	if h.health.RenderURL == "" {
+		return messages.HEALTH_SKIPPED, nil
+	}
+
+	url := strings.TrimSuffix(h.health.RenderURL, "/") + "/healthz"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := renderClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("render service answered with status %d", resp.StatusCode)
+	}
+	return messages.HEALTH_OK, nil
+}
@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+)
+
+// Returns the readiness response, failing the test unless it has the expected status.
+func (s *testServer) readyz(status int) messages.ReadinessResp {
+	s.t.Helper()
+	return decode[messages.ReadinessResp](s.t, s.request(http.MethodGet, "/readyz", nil), status)
+}
+
+func TestHealthz(t *testing.T) {
+	s := newTestServer(t)
+	s.h.SetReady(false)
+	if resp := decode[messages.LivenessResp](t, s.request(http.MethodGet, "/healthz", nil), http.StatusOK); resp.Status != messages.HEALTH_OK {
+		t.Errorf("unexpected liveness %+v", resp)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	s := newTestServer(t)
+	resp := s.readyz(http.StatusOK)
+	if resp.Status != messages.HEALTH_READY {
+		t.Errorf("unexpected readiness %+v", resp)
+	}
+	for name, status := range map[string]messages.HealthStatus{
+		"setup":  messages.HEALTH_OK,
+		"schema": messages.HEALTH_OK,
+		"write":  messages.HEALTH_OK,
+		"render": messages.HEALTH_SKIPPED,
+	} {
+		if resp.Checks[name].Status != status {
+			t.Errorf("check %s is %+v, expected %s", name, resp.Checks[name], status)
+		}
+	}
+	expectStatus(t, s.request(http.MethodPost, "/api/heartbeat", nil), http.StatusOK)
+}
+
+func TestNotReady(t *testing.T) {
+	s := newTestServer(t)
+	s.h.SetReady(false)
+	if resp := s.readyz(http.StatusServiceUnavailable); resp.Status != messages.HEALTH_NOT_READY || resp.Checks["setup"].Status != messages.HEALTH_FAILED {
+		t.Errorf("unexpected readiness %+v", resp)
+	}
+	expectError(t, s.request(http.MethodGet, "/api/v2/polls/unknown", nil), http.StatusServiceUnavailable, messages.UNAVAILABLE)
+	expectStatus(t, s.request(http.MethodGet, "/healthz", nil), http.StatusOK)
+
+	s.h.SetReady(true)
+	s.h.health.SchemaVersion++
+	resp := s.readyz(http.StatusServiceUnavailable)
+	if check := resp.Checks["schema"]; check.Status != messages.HEALTH_FAILED || check.Message == "" {
+		t.Errorf("schema check of an outdated database is %+v", check)
+	}
+}
+
+func TestReadyzNeedsWriteLock(t *testing.T) {
+	s := newTestServer(t)
+	s.h.timeouts.Endpoints = map[string]time.Duration{"ready": 100 * time.Millisecond}
+	conn, err := s.db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(context.Background(), "BEGIN IMMEDIATE"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := s.readyz(http.StatusServiceUnavailable)
+	if resp.Checks["write"].Status != messages.HEALTH_FAILED || resp.Checks["schema"].Status != messages.HEALTH_OK {
+		t.Errorf("unexpected checks while the write lock is held %+v", resp.Checks)
+	}
+
+	if _, err := conn.ExecContext(context.Background(), "ROLLBACK"); err != nil {
+		t.Fatal(err)
+	}
+	s.readyz(http.StatusOK)
+}
+
+func TestReadyzChecksRender(t *testing.T) {
+	status := http.StatusOK
+	render := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			t.Errorf("render service called at %s", r.URL.Path)
+		}
+		w.WriteHeader(status)
+	}))
+	defer render.Close()
+
+	s := newTestServer(t)
+	s.h.health.RenderURL = render.URL + "/"
+	if resp := s.readyz(http.StatusOK); resp.Checks["render"].Status != messages.HEALTH_OK {
+		t.Errorf("unexpected render check %+v", resp.Checks["render"])
+	}
+	// polls are served without the render service
+	status = http.StatusInternalServerError
+	if resp := s.readyz(http.StatusOK); resp.Status != messages.HEALTH_DEGRADED || resp.Checks["render"].Status != messages.HEALTH_FAILED {
+		t.Errorf("unexpected readiness %+v", resp)
+	}
+	s.h.health.RenderRequired = true
+	if resp := s.readyz(http.StatusServiceUnavailable); resp.Status != messages.HEALTH_NOT_READY || resp.Checks["render"].Status != messages.HEALTH_FAILED {
+		t.Errorf("unexpected readiness %+v", resp)
+	}
+}
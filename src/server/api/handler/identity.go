@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/AdrianPrawda/movie-poll/api/util"
+	"github.com/labstack/echo/v4"
+)
+
+// Voter identities. Signed identities are random ids the server hands out as HMAC signed
+// cookies, authenticated identities are users set by an authenticating reverse proxy.
+type IdentityConfig struct {
+	Secret       []byte // signs identity cookies, signed identities are disabled if empty
+	Cookie       string
+	MaxAge       time.Duration
+	Secure       bool
+	UserHeader   string // authenticated identities are disabled if empty
+	BallotSecret []byte // hashes voters of anonymous polls, anonymous ballots are disabled if empty
+}
+
+// Enables signed and authenticated identities and anonymous ballots, all are disabled by default.
+func (h *Handler) SetIdentity(cfg IdentityConfig) {
+	h.identity = cfg
+}
+
+// Identities presented by the client of a request.
+type voter struct {
+	signed string // id of a valid identity cookie
+	user   string // authenticated user
+}
+
+type voterKey struct{}
+
+func contextWithVoter(ctx context.Context, v voter) context.Context {
+	return context.WithValue(ctx, voterKey{}, v)
+}
+
+func voterFromContext(ctx context.Context) voter {
+	v, _ := ctx.Value(voterKey{}).(voter)
+	return v
+}
+
+// Separates identity signatures from other uses of the secret
+const IDENTITY_SIGNATURE_PREFIX = "moviepoll-identity:"
+
+// Upper bound for authenticated user names
+const MAX_USER_LENGTH = 256
+
+// Routes never issuing identity cookies: probes, scrapes, static files and the admin API.
+func identityExempt(path string) bool {
+	return path == "/healthz" || path == "/readyz" || path == "/metrics" || path == "/static/*" ||
+		strings.HasPrefix(path, "/api/admin/")
+}
+
+// Middleware reading the voter identities of a request. Clients without a valid identity
+// cookie are issued a new one, which is used from their next request on.
+func (h *Handler) Identify(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		var v voter
+
+		if len(h.identity.Secret) > 0 {
+			if cookie, err := req.Cookie(h.identity.Cookie); err == nil {
+				v.signed, _ = h.verifyIdentity(cookie.Value)
+			}
+			if v.signed == "" && !identityExempt(c.Path()) {
+				h.issueIdentity(c)
+			}
+		}
+		if h.identity.UserHeader != "" {
+			user := strings.TrimSpace(req.Header.Get(h.identity.UserHeader))
+			if len(user) <= MAX_USER_LENGTH {
+				v.user = user
+			}
+		}
+
+		c.SetRequest(req.WithContext(contextWithVoter(req.Context(), v)))
+		return next(c)
+	}
+}
+
+// Sets a cookie with a new signed identity.
+func (h *Handler) issueIdentity(c echo.Context) {
+	id := util.GenerateID()
+	c.SetCookie(&http.Cookie{
+		Name:     h.identity.Cookie,
+		Value:    id + "." + h.signIdentity(id),
+		Path:     "/",
+		MaxAge:   int(h.identity.MaxAge.Seconds()),
+		Secure:   h.identity.Secure || c.IsTLS(),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	h.logger(c.Request().Context()).Debug("Issued voter identity")
+}
+
+func (h *Handler) signIdentity(id string) string {
+	mac := hmac.New(sha256.New, h.identity.Secret)
+	mac.Write([]byte(IDENTITY_SIGNATURE_PREFIX + id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the id of a signed identity cookie value if its signature is valid.
+func (h *Handler) verifyIdentity(value string) (string, bool) {
+	id, sig, ok := strings.Cut(value, ".")
+	if !ok || id == "" {
+		return "", false
+	}
+	if !hmac.Equal([]byte(sig), []byte(h.signIdentity(id))) {
+		return "", false
+	}
+	return id, true
+}
+
+// Checks if the server can identify voters of a poll. Empty identities default to raw.
+func (h *Handler) validateIdentity(identity messages.Identity) (messages.Identity, error) {
+	switch identity {
+	case "", messages.IDENTITY_RAW:
+		return messages.IDENTITY_RAW, nil
+	case messages.IDENTITY_SIGNED:
+		if len(h.identity.Secret) == 0 {
+			return "", errIdentityDisabled.WithDetails("identity", identity)
+		}
+	case messages.IDENTITY_AUTHENTICATED:
+		if h.identity.UserHeader == "" {
+			return "", errIdentityDisabled.WithDetails("identity", identity)
+		}
+	default:
+		return "", errMalformedRequest.WithDetails("reason", "unknown identity "+string(identity))
+	}
+	return identity, nil
+}
+
+// Returns the user votes are cast as. Only polls identifying voters by raw ids trust the
+// client supplied user id.
+func voterID(ctx context.Context, identity messages.Identity, user_id string) (string, error) {
+	v := voterFromContext(ctx)
+	switch identity {
+	case messages.IDENTITY_SIGNED:
+		if v.signed == "" {
+			return "", errIdentityRequired.WithDetails("identity", identity)
+		}
+		return v.signed, nil
+	case messages.IDENTITY_AUTHENTICATED:
+		if v.user == "" {
+			return "", errIdentityRequired.WithDetails("identity", identity)
+		}
+		return v.user, nil
+	default:
+		return user_id, nil
+	}
+}
@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+)
+
+// Name of identity cookies and header of authenticated users in tests
+const (
+	TEST_COOKIE      = "moviepoll_voter"
+	TEST_USER_HEADER = "X-Forwarded-User"
+)
+
+// Enables signed and authenticated identities, as serve does if configured.
+func (s *testServer) enableIdentity() {
+	s.h.SetIdentity(IdentityConfig{
+		Secret:     []byte("identity-secret-of-at-least-32-bytes"),
+		Cookie:     TEST_COOKIE,
+		MaxAge:     24 * time.Hour,
+		UserHeader: TEST_USER_HEADER,
+	})
+}
+
+// Returns the identity cookie set by a response, nil if none was set.
+func identityCookie(rec *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == TEST_COOKIE {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// Returns the user of the only vote of a poll.
+func (s *testServer) voteUser(poll_id string) string {
+	s.t.Helper()
+	var user string
+	if err := s.db.QueryRow("SELECT user FROM vote WHERE poll_id=?", poll_id).Scan(&user); err != nil {
+		s.t.Fatal(err)
+	}
+	return user
+}
+
+func TestIdentityCookies(t *testing.T) {
+	s := newTestServer(t)
+	s.enableIdentity()
+
+	cookie := identityCookie(s.request(http.MethodGet, "/api/v2/polls/unknown", nil))
+	if cookie == nil || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.Path != "/" || cookie.MaxAge != 86400 {
+		t.Fatalf("unexpected identity cookie %+v", cookie)
+	}
+	id, ok := s.h.verifyIdentity(cookie.Value)
+	if !ok || !strings.HasPrefix(cookie.Value, id+".") {
+		t.Fatalf("issued identity %q doesn't verify", cookie.Value)
+	}
+
+	// valid identities are kept, forged ones replaced
+	if identityCookie(s.request(http.MethodGet, "/api/v2/polls/unknown", nil, "Cookie", cookie.String())) != nil {
+		t.Error("valid identity was replaced")
+	}
+	for _, forged := range []string{"mallory", "mallory." + strings.SplitN(cookie.Value, ".", 2)[1], id + ".signature"} {
+		rec := s.request(http.MethodGet, "/api/v2/polls/unknown", nil, "Cookie", TEST_COOKIE+"="+forged)
+		if identityCookie(rec) == nil {
+			t.Errorf("forged identity %q was kept", forged)
+		}
+	}
+	for _, path := range []string{"/healthz", "/readyz", "/api/admin/v1/polls"} {
+		if identityCookie(s.request(http.MethodGet, path, nil)) != nil {
+			t.Errorf("identity issued on %s", path)
+		}
+	}
+}
+
+func TestSignedIdentityVoting(t *testing.T) {
+	s := newTestServer(t)
+	s.enableIdentity()
+	poll := s.createPoll(messages.CreatePollReq{Identity: messages.IDENTITY_SIGNED})
+	choices := s.choices(poll.PollID)
+	if identity := s.poll(poll.PollID).Identity; identity != messages.IDENTITY_SIGNED {
+		t.Fatalf("poll with identity %q", identity)
+	}
+
+	rec := s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: choices[:1]})
+	expectError(t, rec, http.StatusForbidden, messages.IDENTITY_REQUIRED)
+	cookie := identityCookie(rec)
+	if cookie == nil {
+		t.Fatal("rejected voter wasn't issued an identity")
+	}
+
+	// the signed identity is used, whatever user id is sent
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "mallory", Votes: choices[:1]}, "Cookie", cookie.String()),
+		http.StatusNoContent)
+	expectError(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: choices[1:]}, "Cookie", cookie.String()),
+		http.StatusConflict, messages.ALREADY_VOTED)
+	if id, _ := s.h.verifyIdentity(cookie.Value); s.voteUser(poll.PollID) != id {
+		t.Errorf("vote cast as %q, expected the signed identity %q", s.voteUser(poll.PollID), id)
+	}
+}
+
+func TestAuthenticatedIdentityVoting(t *testing.T) {
+	s := newTestServer(t)
+	s.enableIdentity()
+	poll := s.createPoll(messages.CreatePollReq{Identity: messages.IDENTITY_AUTHENTICATED})
+	choices := s.choices(poll.PollID)
+
+	expectError(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: choices[:1]}),
+		http.StatusForbidden, messages.IDENTITY_REQUIRED)
+	expectError(t, s.vote(poll.PollID, messages.CastVotesReq{Votes: choices[:1]}, TEST_USER_HEADER, strings.Repeat("a", MAX_USER_LENGTH+1)),
+		http.StatusForbidden, messages.IDENTITY_REQUIRED)
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "mallory", Votes: choices[:1]}, TEST_USER_HEADER, " alice "),
+		http.StatusNoContent)
+	if user := s.voteUser(poll.PollID); user != "alice" {
+		t.Errorf("vote cast as %q, expected the authenticated user", user)
+	}
+}
+
+func TestRawIdentitiesTrustClients(t *testing.T) {
+	s := newTestServer(t)
+	s.enableIdentity()
+	poll := s.createPoll(messages.CreatePollReq{})
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: s.choices(poll.PollID)[:1]}, TEST_USER_HEADER, "bob"),
+		http.StatusNoContent)
+	if user := s.voteUser(poll.PollID); user != "alice" {
+		t.Errorf("vote cast as %q, expected the client's user id", user)
+	}
+}
+
+func TestDisabledIdentities(t *testing.T) {
+	s := newTestServer(t)
+	for _, identity := range []messages.Identity{messages.IDENTITY_SIGNED, messages.IDENTITY_AUTHENTICATED} {
+		req := messages.CreatePollReq{Type: messages.SINGLE, Title: "Movie night", Choices: []string{"Alien", "Heat"}, TargetVotes: 2, Identity: identity}
+		expectError(t, s.request(http.MethodPost, "/api/v2/polls", req), http.StatusUnprocessableEntity, messages.IDENTITY_DISABLED)
+	}
+	req := messages.CreatePollReq{Type: messages.SINGLE, Title: "Movie night", Choices: []string{"Alien", "Heat"}, TargetVotes: 2, Identity: "oauth"}
+	expectError(t, s.request(http.MethodPost, "/api/v2/polls", req), http.StatusBadRequest, messages.MALFORMED_REQUEST)
+}
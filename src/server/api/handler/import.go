@@ -0,0 +1,249 @@
+package handler
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+)
+
+// Columns of CSV imports. Columns are identified by their header, the order doesn't matter.
+const (
+	CSV_POLL_ID      = "poll_id"       // required, any id unique within the document
+	CSV_TITLE        = "title"         // required on the first row of a poll
+	CSV_CHOICE       = "choice"        // required, choices are identified by their content
+	CSV_USER_ID      = "user_id"       // voter, rows without user only declare the choice
+	CSV_TYPE         = "type"          // single (default) or multiple
+	CSV_TARGET_VOTES = "target_votes"  // defaults to the number of ballots
+	CSV_AUTO_CREATE  = "auto_create"   // defaults to false
+	CSV_CLOSED       = "closed"        // defaults to false
+	CSV_IDENTITY     = "identity"      // raw (default), signed or authenticated
+	CSV_VISIBILITY   = "visibility"    // live (default), voted or closed
+	CSV_ANONYMOUS    = "anonymous"     // defaults to false, users are hashed on import
+	CSV_CREATED_AT   = "created_at"    // RFC 3339 or date, defaults to now
+	CSV_CAST_AT      = "cast_at"       // defaults to the creation of the poll
+	CSV_PREV_POLL    = "previous_poll" // poll listed on an earlier row
+)
+
+// Time layouts accepted in CSV imports, spreadsheets rarely write RFC 3339.
+var csvTimeLayouts = []string{time.RFC3339, sqliteTime, "2006-01-02T15:04:05", "2006-01-02"}
+
+// Parses a CSV import. Every row names a poll and a choice. Rows with a user id are votes of
+// that user, all votes of a user on a poll form their ballot. Poll columns have to be set on
+// the first row of a poll and must either be empty or equal on its other rows.
+// Choice ids of the returned document are assigned in order of appearance.
+func ParseImportCSV(r io.Reader) (*messages.PollsExport, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errMalformedRequest.WithDetails("reason", fmt.Sprintf("invalid csv header: %v", err))
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	for _, name := range []string{CSV_POLL_ID, CSV_TITLE, CSV_CHOICE} {
+		if _, ok := columns[name]; !ok {
+			return nil, errMalformedRequest.WithDetails("reason", fmt.Sprintf("missing csv column %q", name))
+		}
+	}
+
+	p := &csvImport{
+		export:   &messages.PollsExport{Version: messages.EXPORT_VERSION, Polls: make([]messages.PollExport, 0)},
+		polls:    make(map[string]int),
+		choices:  make(map[string]map[string]int),
+		ballots:  make(map[string]map[string]int),
+		targets:  make(map[string]bool),
+		now:      time.Now().UTC(),
+		columns:  columns,
+		next_cid: 1,
+	}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errMalformedRequest.WithDetails("reason", fmt.Sprintf("invalid csv: %v", err))
+		}
+		if err := p.row(record); err != nil {
+			return nil, errMalformedRequest.WithDetails("reason", err.Error()).WithDetails("line", line)
+		}
+	}
+
+	for i := range p.export.Polls {
+		poll := &p.export.Polls[i]
+		if !p.targets[poll.ID] {
+			poll.TargetVotes = uint(len(poll.Ballots))
+		}
+	}
+	return p.export, nil
+}
+
+type csvImport struct {
+	export   *messages.PollsExport
+	polls    map[string]int            // poll id -> index
+	choices  map[string]map[string]int // poll id -> content -> choice id
+	ballots  map[string]map[string]int // poll id -> user id -> index
+	targets  map[string]bool           // polls with explicit target votes
+	now      time.Time
+	columns  map[string]int
+	next_cid int
+}
+
+// Returns the trimmed value of a column, empty if the column or value is missing.
+func (p *csvImport) get(record []string, column string) string {
+	i, ok := p.columns[column]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[i])
+}
+
+func (p *csvImport) row(record []string) error {
+	id := p.get(record, CSV_POLL_ID)
+	if id == "" {
+		return errors.New("poll_id must not be empty")
+	}
+
+	i, ok := p.polls[id]
+	if !ok {
+		poll, err := p.newPoll(id, record)
+		if err != nil {
+			return err
+		}
+		i = len(p.export.Polls)
+		p.polls[id] = i
+		p.choices[id] = make(map[string]int)
+		p.ballots[id] = make(map[string]int)
+		p.export.Polls = append(p.export.Polls, poll)
+	} else if err := p.checkPoll(&p.export.Polls[i], record); err != nil {
+		return err
+	}
+	poll := &p.export.Polls[i]
+
+	content := p.get(record, CSV_CHOICE)
+	if content == "" {
+		return errors.New("choice must not be empty")
+	}
+	cid, ok := p.choices[id][content]
+	if !ok {
+		cid = p.next_cid
+		p.next_cid++
+		p.choices[id][content] = cid
+		poll.Choices = append(poll.Choices, messages.Choice{ID: cid, Content: content})
+	}
+
+	user := p.get(record, CSV_USER_ID)
+	if user == "" {
+		return nil
+	}
+	b, ok := p.ballots[id][user]
+	if !ok {
+		cast_at := poll.CreatedAt
+		if value := p.get(record, CSV_CAST_AT); value != "" {
+			t, err := parseCSVTime(value)
+			if err != nil {
+				return fmt.Errorf("invalid cast_at: %w", err)
+			}
+			cast_at = t
+		}
+		b = len(poll.Ballots)
+		p.ballots[id][user] = b
+		poll.Ballots = append(poll.Ballots, messages.BallotExport{UserID: user, CastAt: cast_at})
+	}
+	poll.Ballots[b].Votes = append(poll.Ballots[b].Votes, cid)
+	return nil
+}
+
+func (p *csvImport) newPoll(id string, record []string) (messages.PollExport, error) {
+	poll := messages.PollExport{
+		ID:         id,
+		Title:      p.get(record, CSV_TITLE),
+		Type:       messages.PollType(p.get(record, CSV_TYPE)),
+		Identity:   messages.Identity(p.get(record, CSV_IDENTITY)),
+		Visibility: messages.Visibility(p.get(record, CSV_VISIBILITY)),
+		CreatedAt:  p.now,
+		PrevPoll:   p.get(record, CSV_PREV_POLL),
+		Choices:    make([]messages.Choice, 0, 2),
+		Ballots:    make([]messages.BallotExport, 0),
+	}
+	if poll.Type == "" {
+		poll.Type = messages.SINGLE
+	}
+	if poll.Identity == "" {
+		poll.Identity = messages.IDENTITY_RAW
+	}
+	if poll.Visibility == "" {
+		poll.Visibility = messages.RESULTS_LIVE
+	}
+
+	var err error
+	if value := p.get(record, CSV_TARGET_VOTES); value != "" {
+		target, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return poll, fmt.Errorf("invalid target_votes %q", value)
+		}
+		poll.TargetVotes = uint(target)
+		p.targets[id] = true
+	}
+	if poll.AutoCreate, err = parseCSVBool(p.get(record, CSV_AUTO_CREATE)); err != nil {
+		return poll, fmt.Errorf("invalid auto_create: %w", err)
+	}
+	if poll.Closed, err = parseCSVBool(p.get(record, CSV_CLOSED)); err != nil {
+		return poll, fmt.Errorf("invalid closed: %w", err)
+	}
+	if poll.Anonymous, err = parseCSVBool(p.get(record, CSV_ANONYMOUS)); err != nil {
+		return poll, fmt.Errorf("invalid anonymous: %w", err)
+	}
+	if value := p.get(record, CSV_CREATED_AT); value != "" {
+		if poll.CreatedAt, err = parseCSVTime(value); err != nil {
+			return poll, fmt.Errorf("invalid created_at: %w", err)
+		}
+	}
+	return poll, nil
+}
+
+// Poll columns on subsequent rows must be empty or repeat the first row.
+func (p *csvImport) checkPoll(poll *messages.PollExport, record []string) error {
+	first := map[string]string{
+		CSV_TITLE:      poll.Title,
+		CSV_TYPE:       string(poll.Type),
+		CSV_IDENTITY:   string(poll.Identity),
+		CSV_VISIBILITY: string(poll.Visibility),
+		CSV_PREV_POLL:  poll.PrevPoll,
+	}
+	if p.targets[poll.ID] {
+		first[CSV_TARGET_VOTES] = strconv.FormatUint(uint64(poll.TargetVotes), 10)
+	}
+	for column, value := range first {
+		if v := p.get(record, column); v != "" && v != value {
+			return fmt.Errorf("%s of poll %s differs from its first row", column, poll.ID)
+		}
+	}
+	return nil
+}
+
+func parseCSVBool(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(strings.ToLower(value))
+}
+
+func parseCSVTime(value string) (time.Time, error) {
+	for _, layout := range csvTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unknown time format %q", value)
+}
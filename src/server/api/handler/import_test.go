@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/labstack/echo/v4"
+)
+
+func TestParseImportCSV(t *testing.T) {
+	doc := "\ufeffPoll_ID, Title, Choice, User_ID, Type, Created_At, Previous_Poll, Target_Votes\n" +
+		"1,Movie night,Alien,alice,multiple,2021-03-05,,\n" +
+		"1,,Heat,alice,,,,\n" +
+		"1,Movie night,Heat,bob,,,,\n" +
+		"1,,Ronin,,,,,\n" +
+		"2,Next movie night,Heat,,,2021-03-12T20:00:00Z,1,4\n"
+	export, err := ParseImportCSV(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := time.Date(2021, 3, 5, 0, 0, 0, 0, time.UTC)
+	expected := []messages.PollExport{{
+		ID:          "1",
+		Title:       "Movie night",
+		Type:        messages.MULTIPLE,
+		TargetVotes: 2,
+		Identity:    messages.IDENTITY_RAW,
+		Visibility:  messages.RESULTS_LIVE,
+		CreatedAt:   created,
+		Choices:     []messages.Choice{{ID: 1, Content: "Alien"}, {ID: 2, Content: "Heat"}, {ID: 3, Content: "Ronin"}},
+		Ballots: []messages.BallotExport{
+			{UserID: "alice", Votes: []int{1, 2}, CastAt: created},
+			{UserID: "bob", Votes: []int{2}, CastAt: created},
+		},
+	}, {
+		ID:          "2",
+		Title:       "Next movie night",
+		Type:        messages.SINGLE,
+		TargetVotes: 4,
+		Identity:    messages.IDENTITY_RAW,
+		Visibility:  messages.RESULTS_LIVE,
+		CreatedAt:   time.Date(2021, 3, 12, 20, 0, 0, 0, time.UTC),
+		PrevPoll:    "1",
+		Choices:     []messages.Choice{{ID: 4, Content: "Heat"}},
+		Ballots:     []messages.BallotExport{},
+	}}
+	if export.Version != messages.EXPORT_VERSION || !reflect.DeepEqual(export.Polls, expected) {
+		t.Errorf("unexpected import %+v", export.Polls)
+	}
+}
+
+func TestParseImportCSVFailures(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+	}{
+		{"empty", ""},
+		{"missing column", "poll_id,title\n1,Movie night\n"},
+		{"empty poll id", "poll_id,title,choice\n,Movie night,Alien\n"},
+		{"empty choice", "poll_id,title,choice\n1,Movie night,\n"},
+		{"target votes", "poll_id,title,choice,target_votes\n1,Movie night,Alien,many\n"},
+		{"bool", "poll_id,title,choice,closed\n1,Movie night,Alien,maybe\n"},
+		{"time", "poll_id,title,choice,created_at\n1,Movie night,Alien,yesterday\n"},
+		{"differing title", "poll_id,title,choice\n1,Movie night,Alien\n1,Other night,Heat\n"},
+		{"quotes", "poll_id,title,choice\n1,\"Movie night,Alien\n"},
+	}
+	for _, test := range tests {
+		_, err := ParseImportCSV(strings.NewReader(test.doc))
+		var resp *messages.Error
+		if !errors.As(err, &resp) || resp.Code != messages.MALFORMED_REQUEST || resp.Details["reason"] == nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+	}
+	_, err := ParseImportCSV(strings.NewReader("poll_id,title,choice\n1,Movie night,Alien\n1,Movie night,\n"))
+	var resp *messages.Error
+	if !errors.As(err, &resp) || resp.Details["line"] != 3 {
+		t.Errorf("error %v, expected one on line 3", err)
+	}
+}
+
+func TestImportExport(t *testing.T) {
+	s := newTestServer(t)
+	first := s.createPoll(messages.CreatePollReq{Type: messages.MULTIPLE, AutoCreate: true})
+	choices := s.choices(first.PollID)
+	expectStatus(t, s.vote(first.PollID, messages.CastVotesReq{UserID: "alice", Votes: choices}), http.StatusNoContent)
+	expectStatus(t, s.vote(first.PollID, messages.CastVotesReq{UserID: "bob", Votes: choices[1:]}), http.StatusNoContent)
+	second := s.poll(first.PollID).NextPoll
+
+	export := decode[messages.PollsExport](t, s.admin(http.MethodGet, "/export?poll_id="+second, nil), http.StatusOK)
+	resp := decode[messages.ImportResp](t, s.admin(http.MethodPost, "/import", export), http.StatusCreated)
+	if len(resp.Polls) != 2 || len(resp.Choices) != 4 || resp.Polls[first.PollID] == first.PollID {
+		t.Fatalf("unexpected import %+v", resp)
+	}
+
+	// imported polls are a new chain with the same ballots
+	imported := s.poll(resp.Polls[first.PollID])
+	if imported.NextPoll != resp.Polls[second] || imported.VotesCast != 2 || !imported.Concluded {
+		t.Errorf("unexpected imported poll %+v", imported)
+	}
+	reexport := decode[messages.PollsExport](t, s.admin(http.MethodGet, "/export?poll_id="+resp.Polls[second], nil), http.StatusOK)
+	for i, poll := range reexport.Polls {
+		original := export.Polls[i]
+		if poll.ID != resp.Polls[original.ID] || poll.Title != original.Title || !poll.CreatedAt.Equal(original.CreatedAt) {
+			t.Errorf("poll %s imported as %+v", original.ID, poll)
+		}
+		for j, ballot := range poll.Ballots {
+			votes := make([]int, 0, len(ballot.Votes))
+			for _, choice := range original.Ballots[j].Votes {
+				votes = append(votes, resp.Choices[choice])
+			}
+			if ballot.UserID != original.Ballots[j].UserID || !reflect.DeepEqual(ballot.Votes, votes) {
+				t.Errorf("ballot %+v imported as %+v", original.Ballots[j], ballot)
+			}
+		}
+	}
+}
+
+func TestImportIsAtomic(t *testing.T) {
+	s := newTestServer(t)
+	valid := messages.PollExport{ID: "1", Title: "Movie night", TargetVotes: 2, Choices: []messages.Choice{{ID: 1, Content: "Alien"}, {ID: 2, Content: "Heat"}}}
+	tests := []struct {
+		name   string
+		change func(*messages.PollExport)
+	}{
+		{"duplicate id", func(p *messages.PollExport) { p.ID = "1" }},
+		{"empty title", func(p *messages.PollExport) { p.Title = "" }},
+		{"unknown type", func(p *messages.PollExport) { p.Type = "ranked" }},
+		{"duplicate choice id", func(p *messages.PollExport) { p.Choices[0].ID = 1 }},
+		{"missing previous poll", func(p *messages.PollExport) { p.PrevPoll = "3" }},
+		{"too many ballots", func(p *messages.PollExport) { p.TargetVotes = 0 }},
+		{"invalid choice", func(p *messages.PollExport) { p.Ballots[0].Votes = []int{1} }},
+		{"vote count", func(p *messages.PollExport) { p.Ballots[0].Votes = []int{3, 4} }},
+		{"duplicate voter", func(p *messages.PollExport) {
+			p.Ballots = append(p.Ballots, messages.BallotExport{UserID: "alice", Votes: []int{4}})
+		}},
+	}
+	for _, test := range tests {
+		second := messages.PollExport{
+			ID:          "2",
+			Title:       "Next movie night",
+			TargetVotes: 2,
+			Choices:     []messages.Choice{{ID: 3, Content: "Alien"}, {ID: 4, Content: "Heat"}},
+			Ballots:     []messages.BallotExport{{UserID: "alice", Votes: []int{3}}},
+		}
+		test.change(&second)
+		export := messages.PollsExport{Polls: []messages.PollExport{valid, second}}
+		resp := expectError(t, s.admin(http.MethodPost, "/import", export), http.StatusBadRequest, messages.MALFORMED_REQUEST)
+		if resp.Details["poll_id"] != second.ID {
+			t.Errorf("%s: unexpected details %+v", test.name, resp.Details)
+		}
+	}
+	expectError(t, s.admin(http.MethodPost, "/import", messages.PollsExport{Version: 2}), http.StatusBadRequest, messages.MALFORMED_REQUEST)
+
+	polls := decode[messages.ListPollsResp](t, s.admin(http.MethodGet, "/polls", nil), http.StatusOK)
+	if len(polls.Polls) != 0 {
+		t.Errorf("invalid imports created polls %v", pollIDs(polls.Polls))
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	s := newTestServer(t)
+	doc := "poll_id,title,choice,user_id\n1,Movie night,Alien,alice\n1,,Heat,bob\n"
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/v1/import", bytes.NewReader([]byte(doc)))
+	req.Header.Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+TEST_ADMIN_TOKEN)
+	rec := httptest.NewRecorder()
+	s.e.ServeHTTP(rec, req)
+
+	resp := decode[messages.ImportResp](t, rec, http.StatusCreated)
+	if len(resp.Polls) != 1 || resp.Choices != nil {
+		t.Fatalf("unexpected import %+v", resp)
+	}
+	if poll := s.poll(resp.Polls["1"]); poll.VotesCast != 2 || poll.VotesRequired != 2 || !poll.Concluded {
+		t.Errorf("unexpected imported poll %+v", poll)
+	}
+}
@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/AdrianPrawda/movie-poll/api/util"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Invite only polls accept one vote per invite token. Tokens and owner tokens are random ids,
+// the database only stores their SHA-256 hashes.
+
+// Upper bound for invites of a single poll
+const MAX_INVITES = 1000
+
+// Upper bound for invitee names
+const MAX_INVITEE_LENGTH = 128
+
+// Invite as stored in the database
+type inviteRow struct {
+	name       string
+	token_hash string
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Creates invites for the named invitees or count unnamed invitees (invite-1, invite-2, ...).
+// Returns the invites with their tokens and the rows to store.
+func newInvites(invitees []string, count uint) ([]messages.Invite, []inviteRow, error) {
+	if len(invitees) > 0 && count > 0 {
+		return nil, nil, errMalformedRequest.WithDetails("reason", "either list invitees or request a number of invites")
+	}
+	if count > MAX_INVITES || len(invitees) > MAX_INVITES {
+		return nil, nil, errMalformedRequest.WithDetails("reason", fmt.Sprintf("at most %d invites are allowed", MAX_INVITES))
+	}
+	if count > 0 {
+		invitees = make([]string, 0, count)
+		for i := uint(1); i <= count; i++ {
+			invitees = append(invitees, "invite-"+strconv.FormatUint(uint64(i), 10))
+		}
+	}
+
+	invites := make([]messages.Invite, 0, len(invitees))
+	rows := make([]inviteRow, 0, len(invitees))
+	seen := make(map[string]bool, len(invitees))
+	for _, name := range invitees {
+		if name == "" || len(name) > MAX_INVITEE_LENGTH || seen[name] {
+			return nil, nil, errMalformedRequest.WithDetails("reason",
+				fmt.Sprintf("invitee names must be unique and 1 to %d characters long", MAX_INVITEE_LENGTH))
+		}
+		seen[name] = true
+		token := util.GenerateID()
+		invites = append(invites, messages.Invite{Name: name, Token: token})
+		rows = append(rows, inviteRow{name: name, token_hash: hashToken(token)})
+	}
+	return invites, rows, nil
+}
+
+// Checks an owner token against the stored hash. Polls without owner reject every token.
+func ownerTokenValid(owner_hash string, token string) bool {
+	if owner_hash == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(owner_hash), []byte(hashToken(token))) == 1
+}
+
+// Checks the owner token of a poll. Returns errPollNotFound or errOwnerUnauthorized.
+func (h *Handler) authorizeOwner(ctx context.Context, id string, owner_token string) error {
+	log := h.logger(ctx).With("poll_id", id)
+
+	data, err := h.queries.getPollData(ctx, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.Warn("Poll not found")
+			return errPollNotFound
+		}
+		return err
+	}
+	if !ownerTokenValid(data.owner_hash, owner_token) {
+		log.Warn("Invalid owner token")
+		return errOwnerUnauthorized
+	}
+	return nil
+}
+
+// Returns the invites of a poll and who hasn't voted yet. Requires the owner token.
+func (h *Handler) pollInvites(ctx context.Context, id string, owner_token string) (messages.PollInvitesResp, error) {
+	log := h.logger(ctx).With("poll_id", id)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("poll_id", id))
+	log.Debug("Getting poll invites")
+
+	if err := h.authorizeOwner(ctx, id, owner_token); err != nil {
+		return messages.PollInvitesResp{}, err
+	}
+
+	invites, err := h.queries.getInviteStatus(ctx, id)
+	if err != nil {
+		return messages.PollInvitesResp{}, err
+	}
+	resp := messages.PollInvitesResp{PollID: id, Invites: invites, Pending: make([]string, 0)}
+	for _, invite := range invites {
+		if !invite.Voted {
+			resp.Pending = append(resp.Pending, invite.Name)
+		}
+	}
+	return resp, nil
+}
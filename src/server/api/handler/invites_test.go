@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+)
+
+// Returns the invites of a poll through the v2 API.
+func (s *testServer) invites(poll messages.CreatePollResp) messages.PollInvitesResp {
+	s.t.Helper()
+	rec := s.request(http.MethodGet, "/api/v2/polls/"+poll.PollID+"/invites", nil, bearer(poll.OwnerToken)...)
+	return decode[messages.PollInvitesResp](s.t, rec, http.StatusOK)
+}
+
+func TestCreateInvites(t *testing.T) {
+	s := newTestServer(t)
+	named := s.createPoll(messages.CreatePollReq{Invitees: []string{"alice", "bob", "carol"}})
+	if len(named.Invites) != 3 || named.Invites[0].Name != "alice" || named.Invites[0].Token == "" {
+		t.Fatalf("unexpected invites %+v", named.Invites)
+	}
+	if poll := s.poll(named.PollID); !poll.InviteOnly || poll.VotesRequired != 3 {
+		t.Errorf("target votes don't default to the number of invitees: %+v", poll)
+	}
+
+	unnamed := s.createPoll(messages.CreatePollReq{Invites: 2, TargetVotes: 1})
+	if len(unnamed.Invites) != 2 || unnamed.Invites[0].Name != "invite-1" || unnamed.Invites[1].Name != "invite-2" {
+		t.Fatalf("unexpected invites %+v", unnamed.Invites)
+	}
+	if poll := s.poll(unnamed.PollID); poll.VotesRequired != 1 {
+		t.Errorf("target votes of %d, expected 1", poll.VotesRequired)
+	}
+
+	// only hashes of the tokens are stored
+	rows, err := s.db.Query("SELECT name, token_hash FROM invite WHERE poll_id=? ORDER BY id", named.PollID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for i := 0; rows.Next(); i++ {
+		var name, token_hash string
+		if err := rows.Scan(&name, &token_hash); err != nil {
+			t.Fatal(err)
+		}
+		if name != named.Invites[i].Name || token_hash != hashToken(named.Invites[i].Token) {
+			t.Errorf("invite %q stored with hash %q", name, token_hash)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		req  messages.CreatePollReq
+		code messages.ErrorCode
+	}{
+		{messages.CreatePollReq{Invitees: []string{"alice"}, Invites: 1}, messages.MALFORMED_REQUEST},
+		{messages.CreatePollReq{Invitees: []string{"alice", "alice"}}, messages.MALFORMED_REQUEST},
+		{messages.CreatePollReq{Invitees: []string{"alice", ""}}, messages.MALFORMED_REQUEST},
+		{messages.CreatePollReq{Invitees: []string{strings.Repeat("a", MAX_INVITEE_LENGTH+1)}}, messages.MALFORMED_REQUEST},
+		{messages.CreatePollReq{Invites: MAX_INVITES + 1}, messages.MALFORMED_REQUEST},
+		{messages.CreatePollReq{Invites: 2, TargetVotes: 3}, messages.INVALID_TARGET_VOTES},
+	}
+	for _, test := range tests {
+		req := test.req
+		req.Type, req.Title, req.Choices = messages.SINGLE, "Movie night", []string{"Alien", "Heat"}
+		expectError(t, s.request(http.MethodPost, "/api/v2/polls", req), http.StatusBadRequest, test.code)
+	}
+}
+
+func TestInviteOnlyVoting(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{Invitees: []string{"alice", "bob", "carol"}})
+	choices := s.choices(poll.PollID)
+	alice, bob := poll.Invites[0].Token, poll.Invites[1].Token
+
+	expectError(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: choices[:1]}), http.StatusForbidden, messages.INVITE_REQUIRED)
+	expectError(t, s.vote(poll.PollID, messages.CastVotesReq{Token: "unknown", Votes: choices[:1]}), http.StatusForbidden, messages.INVALID_INVITE)
+	// invites of other polls aren't valid
+	other := s.createPoll(messages.CreatePollReq{Invites: 1})
+	expectError(t, s.vote(poll.PollID, messages.CastVotesReq{Token: other.Invites[0].Token, Votes: choices[:1]}),
+		http.StatusForbidden, messages.INVALID_INVITE)
+
+	// votes are cast as the invitee, whatever user id is sent
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "mallory", Token: alice, Votes: choices[:1]}), http.StatusNoContent)
+	expectError(t, s.vote(poll.PollID, messages.CastVotesReq{Token: alice, Votes: choices[1:]}), http.StatusConflict, messages.INVITE_USED)
+	expectError(t, s.request(http.MethodPost, "/api/poll/v1/vote", messages.VotePollReq{PollID: poll.PollID, Token: alice, Votes: choices[1:]}),
+		http.StatusBadRequest, messages.INVITE_USED)
+	expectStatus(t, s.request(http.MethodPost, "/api/poll/v1/vote", messages.VotePollReq{PollID: poll.PollID, Token: bob, Votes: choices[1:]}),
+		http.StatusOK)
+
+	var users []string
+	rows, err := s.db.Query("SELECT user FROM vote WHERE poll_id=? ORDER BY id", poll.PollID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user string
+		if err := rows.Scan(&user); err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+	if !reflect.DeepEqual(users, []string{"alice", "bob"}) {
+		t.Errorf("votes cast as %v", users)
+	}
+
+	invites := s.invites(poll)
+	if !reflect.DeepEqual(invites.Pending, []string{"carol"}) {
+		t.Errorf("unexpected pending invitees %v", invites.Pending)
+	}
+	if len(invites.Invites) != 3 || !invites.Invites[0].Voted || invites.Invites[0].VotedAt == nil || invites.Invites[2].Voted {
+		t.Errorf("unexpected invites %+v", invites.Invites)
+	}
+	expectOwnerChallenge(t, s.request(http.MethodGet, "/api/v2/polls/"+poll.PollID+"/invites", nil))
+	expectOwnerChallenge(t, s.request(http.MethodGet, "/api/v2/polls/"+poll.PollID+"/invites", nil, bearer(other.OwnerToken)...))
+}
+
+func TestInvitesOfOpenPolls(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{})
+	invites := s.invites(poll)
+	if len(invites.Invites) != 0 || len(invites.Pending) != 0 {
+		t.Errorf("poll without invites lists %+v", invites)
+	}
+}
@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Returns collectors reading handler state on every scrape: open polls and poll cache statistics.
+func (h *Handler) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "moviepoll",
+			Name:      "open_polls",
+			Help:      "Number of polls accepting votes, i.e. neither closed nor concluded.",
+		}, h.openPolls),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "moviepoll",
+			Name:      "cache_hits_total",
+			Help:      "Number of poll cache hits.",
+		}, func() float64 {
+			hits, _, _ := h.cache.stats()
+			return float64(hits)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "moviepoll",
+			Name:      "cache_misses_total",
+			Help:      "Number of poll cache misses.",
+		}, func() float64 {
+			_, misses, _ := h.cache.stats()
+			return float64(misses)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "moviepoll",
+			Name:      "cache_entries",
+			Help:      "Number of polls with cached responses.",
+		}, func() float64 {
+			_, _, entries := h.cache.stats()
+			return float64(entries)
+		}),
+	}
+}
+
+// Counts open polls. Returns NaN if the database can't be queried.
+func (h *Handler) openPolls() float64 {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	defer h.metrics.ObserveQuery("count_open_polls")()
+
+	var open int
+	const STMT = "SELECT COUNT(*) FROM poll WHERE cast_votes < target_votes AND closed = 0 AND deleted_at IS NULL"
+	if err := h.db.QueryRowContext(ctx, STMT).Scan(&open); err != nil {
+		h.log.Warn("Could not count open polls", "error", err)
+		return math.NaN()
+	}
+	return float64(open)
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	s := newTestServer(t)
+	s.reg.MustRegister(s.h.Collectors()...)
+	m := s.h.metrics
+
+	poll := s.createPoll(messages.CreatePollReq{AutoCreate: true})
+	s.createPoll(messages.CreatePollReq{Type: messages.MULTIPLE})
+	choices := s.choices(poll.PollID)
+	if open := testutil.ToFloat64(s.h.Collectors()[0]); open != 2 {
+		t.Errorf("%v open polls, expected 2", open)
+	}
+
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: choices[:1]}), http.StatusNoContent)
+	expectError(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: choices[:1]}), http.StatusConflict, messages.ALREADY_VOTED)
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "bob", Votes: choices[1:]}), http.StatusNoContent)
+
+	counters := []struct {
+		name  string
+		value float64
+		want  float64
+	}{
+		{"polls created", testutil.ToFloat64(m.PollsCreated), 2},
+		{"successors created", testutil.ToFloat64(m.SuccessorsCreated), 1},
+		{"single votes", testutil.ToFloat64(m.VotesCast.WithLabelValues(string(messages.SINGLE))), 2},
+		{"multiple votes", testutil.ToFloat64(m.VotesCast.WithLabelValues(string(messages.MULTIPLE))), 0},
+		{"rejected votes", testutil.ToFloat64(m.VotesRejected.WithLabelValues(string(messages.ALREADY_VOTED))), 1},
+		{"errors", testutil.ToFloat64(m.Errors.WithLabelValues(string(messages.ALREADY_VOTED), "none")), 1},
+	}
+	for _, counter := range counters {
+		if counter.value != counter.want {
+			t.Errorf("%v %s, expected %v", counter.value, counter.name, counter.want)
+		}
+	}
+
+	// the concluded poll is replaced by its open successor
+	if open := testutil.ToFloat64(s.h.Collectors()[0]); open != 2 {
+		t.Errorf("%v open polls, expected 2", open)
+	}
+	if n := testutil.CollectAndCount(m.HandlerDuration, "moviepoll_http_request_duration_seconds"); n == 0 {
+		t.Error("no request durations observed")
+	}
+	if n := testutil.CollectAndCount(m.QueryDuration, "moviepoll_db_query_duration_seconds"); n == 0 {
+		t.Error("no query durations observed")
+	}
+
+	// unknown routes share a label
+	s.request(http.MethodGet, "/api/unknown/1", nil)
+	s.request(http.MethodGet, "/api/unknown/2", nil)
+	if n := testutil.CollectAndCount(m.HandlerDuration); n != 5 {
+		t.Errorf("%d request duration series, expected create, get, vote, rejected vote and unknown route", n)
+	}
+}
+
+func TestSQLiteErrorCodes(t *testing.T) {
+	s := newTestServer(t)
+	s.writeError(s.h.handleErrorV2, sqlite3.Error{Code: sqlite3.ErrBusy})
+	s.writeError(s.h.handleErrorV2, sqlite3.Error{Code: sqlite3.ErrNotADB})
+	if busy := testutil.ToFloat64(s.h.metrics.Errors.WithLabelValues(string(messages.BUSY), "busy")); busy != 1 {
+		t.Errorf("%v busy errors, expected 1", busy)
+	}
+	if n := testutil.CollectAndCount(s.h.metrics.Errors); n != 2 {
+		t.Errorf("%d error series, expected 2", n)
+	}
+}
@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/AdrianPrawda/movie-poll/api/util"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Assigns an id to every request, either taken from the X-Request-Id header or generated.
+// The id is returned in the response header and added to all log records and audit events
+// of the request. Logs every request once it has been handled.
+func (h *Handler) RequestLogger(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		req := c.Request()
+
+		id := req.Header.Get(echo.HeaderXRequestID)
+		if !validRequestID(id) {
+			id = util.GenerateID()
+		}
+		c.Response().Header().Set(echo.HeaderXRequestID, id)
+
+		log := h.log.With("request_id", id)
+		if span := trace.SpanContextFromContext(req.Context()); span.IsValid() {
+			log = log.With("trace_id", span.TraceID().String())
+		}
+		ctx := contextWithRequestInfo(req.Context(), requestInfo{id: id, remote_ip: c.RealIP()})
+		c.SetRequest(req.WithContext(util.ContextWithLogger(ctx, log)))
+
+		// let the error handler write the response, so the status is known
+		if err := next(c); err != nil {
+			c.Error(err)
+		}
+
+		status := c.Response().Status
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		}
+		log.Log(req.Context(), level, "Request handled",
+			"method", req.Method,
+			"path", req.URL.Path,
+			"route", c.Path(),
+			"status", status,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"remote_ip", c.RealIP())
+		return nil
+	}
+}
+
+// Accepts client supplied request ids of reasonable length and without control characters.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		if r < 0x20 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// Middleware rejecting requests without the admin token as bearer token. Audit events of
+// accepted requests are recorded as caused by the admin.
+func (h *Handler) RequireAdminToken(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			auth := c.Request().Header.Get(echo.HeaderAuthorization)
+			given, ok := strings.CutPrefix(auth, "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				h.logger(c.Request().Context()).Warn("Unauthorized admin request")
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+				return h.handleErrorV2(c, errUnauthorized)
+			}
+			req := c.Request()
+			c.SetRequest(req.WithContext(ContextWithActor(req.Context(), AUDIT_ACTOR_ADMIN)))
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/labstack/echo/v4"
+)
+
+// Returns the JSON log records written by the handler after this call.
+func (s *testServer) captureLogs() *bytes.Buffer {
+	var buf bytes.Buffer
+	s.h.log = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	return &buf
+}
+
+// Decodes JSON log records.
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid log record %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestRequestIDs(t *testing.T) {
+	s := newTestServer(t)
+	rec := s.request(http.MethodGet, "/healthz", nil, echo.HeaderXRequestID, "client-id")
+	if id := rec.Header().Get(echo.HeaderXRequestID); id != "client-id" {
+		t.Errorf("client request id replaced by %q", id)
+	}
+
+	ids := make(map[string]bool)
+	for _, id := range []string{"", strings.Repeat("a", 129), "line\nbreak"} {
+		rec := s.request(http.MethodGet, "/healthz", nil, echo.HeaderXRequestID, id)
+		generated := rec.Header().Get(echo.HeaderXRequestID)
+		if generated == "" || generated == id || ids[generated] {
+			t.Errorf("request id %q answered with %q", id, generated)
+		}
+		ids[generated] = true
+	}
+}
+
+func TestLogsCarryRequestID(t *testing.T) {
+	s := newTestServer(t)
+	logs := s.captureLogs()
+	poll := s.createPoll(messages.CreatePollReq{})
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: s.choices(poll.PollID)[:1]}, echo.HeaderXRequestID, "vote-request"),
+		http.StatusNoContent)
+
+	var voted, handled bool
+	for _, record := range logRecords(t, logs) {
+		if record["request_id"] == nil {
+			t.Errorf("log record without request id %v", record)
+		}
+		if record["request_id"] != "vote-request" {
+			continue
+		}
+		switch record["msg"] {
+		case "Votes cast":
+			voted = record["poll_id"] == poll.PollID && record["user_id"] == "alice"
+		case "Request handled":
+			handled = record["status"] == float64(http.StatusNoContent) && record["route"] == "/api/v2/polls/:poll_id/votes"
+		}
+	}
+	if !voted || !handled {
+		t.Errorf("vote wasn't logged with poll and user: %s", logs)
+	}
+}
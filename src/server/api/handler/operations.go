@@ -0,0 +1,708 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/AdrianPrawda/movie-poll/api/util"
+	"github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Poll operations shared by all API versions. Errors are either one of the
+// poll operation errors or database errors.
+
+// Validates and creates a new poll. Returns the id, owner token and invites of the new poll.
+// Invite only polls need as many votes as there are invites by default.
+func (h *Handler) createPoll(ctx context.Context, req *messages.CreatePollReq) (messages.CreatePollResp, error) {
+	log := h.logger(ctx)
+
+	// validate user input
+	log.Debug("Validating input")
+	invites, invite_rows, err := newInvites(req.Invitees, req.Invites)
+	if err != nil {
+		log.Warn("Invalid request to create poll", "error", err)
+		return messages.CreatePollResp{}, err
+	}
+	target_votes := req.TargetVotes
+	if target_votes == 0 {
+		target_votes = uint(len(invites))
+	}
+	if err := validatePoll(req.Title, req.Choices, target_votes); err != nil {
+		log.Warn("Invalid request to create poll", "error", err, "choices", len(req.Choices))
+		return messages.CreatePollResp{}, err
+	}
+	if len(invites) > 0 && target_votes > uint(len(invites)) {
+		log.Warn("Invalid request to create poll", "target_votes", target_votes, "invites", len(invites))
+		return messages.CreatePollResp{}, errTooManyTargetVotes.WithDetails("invites", len(invites))
+	}
+	identity, err := h.validateIdentity(req.Identity)
+	if err != nil {
+		log.Warn("Invalid request to create poll", "error", err, "identity", req.Identity)
+		return messages.CreatePollResp{}, err
+	}
+	if len(invites) > 0 && identity != messages.IDENTITY_RAW {
+		log.Warn("Invalid request to create poll", "identity", identity, "invites", len(invites))
+		return messages.CreatePollResp{}, errMalformedRequest.WithDetails("reason", "invite only polls identify voters by their invites")
+	}
+	visibility, err := validateVisibility(req.Visibility)
+	if err != nil {
+		log.Warn("Invalid request to create poll", "error", err, "visibility", req.Visibility)
+		return messages.CreatePollResp{}, err
+	}
+	if err := h.validateAnonymous(req.Anonymous); err != nil {
+		log.Warn("Invalid request to create poll", "error", err)
+		return messages.CreatePollResp{}, err
+	}
+	voter_salt := ""
+	if req.Anonymous {
+		voter_salt = util.GenerateID()
+	}
+
+	// create new poll
+	poll_id := util.GenerateID()
+	owner_token := util.GenerateID()
+	log = log.With("poll_id", poll_id)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("poll_id", poll_id))
+	log.Debug("Inserting poll data")
+	err = h.retry(ctx, "inserting poll", func(ctx context.Context) error {
+		return h.queries.insertPoll(
+			ctx,
+			poll_id,
+			req.Title,
+			req.Type,
+			target_votes,
+			req.Choices,
+			req.AutoCreate,
+			identity,
+			visibility,
+			req.Anonymous,
+			voter_salt,
+			hashToken(owner_token),
+			invite_rows,
+			req.PrevPollID,
+			nil)
+	})
+
+	if err != nil {
+		if err == errPrevPollNotFound || h.isSQLiteErrNo(err, sqlite3.ErrConstraint) {
+			log.Warn("Invalid previous poll id", "prev_poll_id", req.PrevPollID)
+			return messages.CreatePollResp{}, errPrevPollNotFound
+		}
+		return messages.CreatePollResp{}, err
+	}
+	if req.PrevPollID != "" {
+		// latest poll of the entire chain changed
+		h.cache.purge()
+	}
+
+	h.metrics.PollsCreated.Inc()
+	h.audit(ctx, messages.AUDIT_CREATE, poll_id, map[string]any{
+		"title":        req.Title,
+		"type":         req.Type,
+		"target_votes": target_votes,
+		"choices":      req.Choices,
+		"auto_create":  req.AutoCreate,
+		"identity":     identity,
+		"visibility":   visibility,
+		"anonymous":    req.Anonymous,
+		"invites":      len(invites),
+		"prev_poll":    req.PrevPollID,
+	})
+	log.Info("Poll created", "poll_type", req.Type, "target_votes", target_votes, "identity", identity, "visibility", visibility,
+		"anonymous", req.Anonymous, "invites", len(invites))
+	return messages.CreatePollResp{PollID: poll_id, OwnerToken: owner_token, Invites: invites}, nil
+}
+
+// Checks a new poll. Shared by poll creation and imports.
+func validatePoll(title string, choices []string, target_votes uint) error {
+	switch {
+	case len(choices) < 2:
+		return errTooFewChoices
+	case title == "":
+		return errEmptyTitle
+	case target_votes < 1:
+		return errNoTargetVotes
+	}
+	return nil
+}
+
+// Checks votes independent of the poll. Shared by voting and imports.
+func validateVotes(votes []int) error {
+	switch {
+	case len(votes) == 0:
+		return errNoVotes
+	case util.HasDuplicates[int](votes):
+		return errDuplicateVotes
+	}
+	return nil
+}
+
+// Checks the number of votes allowed by the poll type.
+func validateVoteCount(poll_type messages.PollType, votes []int) error {
+	if poll_type == messages.SINGLE && len(votes) != 1 {
+		return errInvalidVoteCount.WithDetails("min", 1).WithDetails("max", 1)
+	}
+	return nil
+}
+
+// Validates and casts votes. Creates a successor poll if the poll concluded and auto creation is enabled.
+func (h *Handler) votePoll(ctx context.Context, req *messages.VotePollReq) (err error) {
+	defer func() {
+		var rejected *messages.Error
+		if errors.As(err, &rejected) {
+			h.metrics.VotesRejected.WithLabelValues(string(rejected.Code)).Inc()
+		}
+	}()
+
+	log := h.logger(ctx).With("poll_id", req.PollID)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("poll_id", req.PollID))
+	log.Debug("Voting on poll")
+
+	// validate input
+	if err := validateVotes(req.Votes); err != nil {
+		log.Warn("Invalid voting request", "error", err)
+		return err
+	}
+
+	// get votes and poll type
+	log.Debug("Fetching poll data")
+	data, err := h.queries.getPollData(ctx, req.PollID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.Warn("Can't vote, poll not found")
+			return errPollNotFound
+		}
+		return err
+	}
+
+	// identify voter
+	user, err := voterID(ctx, data.identity, req.UserID)
+	if err != nil {
+		log.Warn("Can't vote, voter not identified", "identity", data.identity)
+		return err
+	}
+	invite_hash := ""
+	if data.invite_only {
+		if req.Token == "" {
+			log.Warn("Can't vote, invite token missing")
+			return errInviteRequired
+		}
+		invite_hash = hashToken(req.Token)
+	}
+	voter_hash := ""
+	if data.anonymous && !data.invite_only {
+		if err := h.validateAnonymous(true); err != nil {
+			log.Error("Can't vote on anonymous poll without ballot secret")
+			return err
+		}
+		voter_hash = h.voterHash(data.voter_salt, user)
+	}
+
+	// validate voting limits
+	log.Debug("Validating voting limits")
+	if data.closed {
+		return errPollClosed
+	}
+	if data.cast_votes >= data.target_votes {
+		return errVoteLimitReached
+	}
+	if err := validateVoteCount(data.poll_type, req.Votes); err != nil {
+		return err
+	}
+
+	// webhooks only receive what the poll shows, votes of anonymous polls would be linked to
+	// their voters by the time they were delivered
+	var queued int64
+	queue := func(ctx context.Context, conn *sql.Conn, user string, cast uint) error {
+		event := map[string]any{"votes_cast": cast, "votes_required": data.target_votes}
+		if !data.anonymous {
+			event["user_id"] = user
+			if data.visibility == messages.RESULTS_LIVE {
+				event["votes"] = req.Votes
+			}
+		}
+		events := []webhookEvent{{messages.EVENT_VOTE_CAST, req.PollID, event}}
+		if cast >= data.target_votes {
+			concluded, err := h.concludedEvent(ctx, conn, req.PollID, cast, data.target_votes)
+			if err != nil {
+				return err
+			}
+			events = append(events, concluded)
+		}
+		var err error
+		queued, err = h.queueEvents(ctx, conn, events...)
+		return err
+	}
+
+	// try to insert votes
+	err = h.retry(ctx, "inserting votes", func(ctx context.Context) error {
+		var err error
+		user, _, err = h.queries.insertVotes(ctx, req.PollID, user, invite_hash, voter_hash, req.Votes, queue)
+		return err
+	})
+	// logs must not link voters of anonymous polls to their ballots
+	if !data.anonymous {
+		log = log.With("user_id", user)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.Warn("Can't insert votes, poll not found")
+			return errPollNotFound
+		}
+		if err == errPollClosed || err == errVoteLimitReached || err == errAlreadyVoted ||
+			err == errInvalidInvite || err == errInviteUsed {
+			log.Warn("Invalid voting request", "error", err)
+		}
+		if h.isSQLiteErrNo(err, sqlite3.ErrConstraint) {
+			log.Warn("Invalid choice in voting request")
+			return errInvalidChoice
+		}
+		return err
+	}
+	h.cache.invalidate(req.PollID)
+	h.metrics.VotesCast.WithLabelValues(string(data.poll_type)).Inc()
+	if data.anonymous {
+		log.Info("Votes cast")
+	} else {
+		h.audit(ctx, messages.AUDIT_VOTE, req.PollID, map[string]any{"user_id": user, "votes": req.Votes})
+		log.Info("Votes cast", "votes", req.Votes)
+	}
+	h.wakeWebhooks(ctx, queued)
+
+	if data.auto_create {
+		// update data and check if a new poll should be created
+		data, err = h.queries.getPollData(ctx, req.PollID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				log.Warn("Can't vote, poll not found")
+				return errPollNotFound
+			}
+			return err
+		}
+
+		// creating a new poll should extend timeout limits and must not be
+		// cancelled by a client disconnecting after its vote was counted. Its audit event
+		// keeps the request id of the concluding vote.
+		pctx, pcancel := context.WithTimeout(util.ContextWithLogger(
+			ContextWithActor(context.WithoutCancel(ctx), AUDIT_ACTOR_SYSTEM), log), h.timeouts.get("vote"))
+		defer pcancel()
+
+		// create new poll if voting target was met
+		if data.cast_votes >= data.target_votes {
+			old_choices, err := h.queries.getPollChoices(pctx, req.PollID)
+			if err != nil {
+				return err
+			}
+			new_choices := make([]string, 0, len(old_choices))
+			for _, choice := range old_choices {
+				new_choices = append(new_choices, choice)
+			}
+			// invitees keep their tokens for the successor
+			var invites []inviteRow
+			if data.invite_only {
+				if invites, err = h.queries.getInvites(pctx, req.PollID); err != nil {
+					return err
+				}
+			}
+			// voter hashes are scoped to the poll
+			voter_salt := ""
+			if data.anonymous {
+				voter_salt = util.GenerateID()
+			}
+
+			uuid := util.GenerateID()
+			var queued int64
+			queue := func(ctx context.Context, conn *sql.Conn) error {
+				// successors keep the webhooks of their predecessor
+				if err := h.queries.copyWebhooks(ctx, conn, req.PollID, uuid); err != nil {
+					return err
+				}
+				var err error
+				queued, err = h.queueEvents(ctx, conn, webhookEvent{messages.EVENT_AUTO_CREATED, uuid,
+					map[string]any{"prev_poll": req.PollID, "title": data.title}})
+				return err
+			}
+			err = h.retry(pctx, "inserting successor poll", func(ctx context.Context) error {
+				return h.queries.insertPoll(
+					ctx,
+					uuid,
+					data.title,
+					messages.SINGLE,
+					data.target_votes,
+					new_choices,
+					data.auto_create,
+					data.identity,
+					data.visibility,
+					data.anonymous,
+					voter_salt,
+					data.owner_hash,
+					invites,
+					req.PollID,
+					queue)
+			})
+			if err == errPrevPollNotFound {
+				// the poll was deleted after the vote was cast
+				log.Debug("Poll deleted, successor poll not created")
+			} else if err != nil {
+				// concurrent votes might both see the poll concluding
+				if !h.isSQLiteErrNo(err, sqlite3.ErrConstraint) {
+					return err
+				}
+				log.Debug("Successor poll already created")
+			} else {
+				h.metrics.SuccessorsCreated.Inc()
+				h.audit(pctx, messages.AUDIT_AUTO_CREATE, uuid, map[string]any{"prev_poll": req.PollID, "title": data.title})
+				log.Info("Successor poll created", "next_poll_id", uuid)
+				h.wakeWebhooks(pctx, queued)
+			}
+			h.cache.purge()
+		}
+	}
+
+	return nil
+}
+
+// Deletes a poll or every poll of its chain. Deleting a single poll splits its chain.
+func (h *Handler) deletePoll(ctx context.Context, id string, scope messages.DeleteScope, owner_token *string) error {
+	log := h.logger(ctx).With("poll_id", id)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("poll_id", id))
+	log.Debug("Deleting poll")
+
+	scope, err := validateScope(scope)
+	if err != nil {
+		log.Warn("Invalid request to delete poll", "error", err)
+		return err
+	}
+
+	// deleted polls are described by their audit events
+	data, err := h.queries.getPollData(ctx, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.Warn("Can't delete poll, poll not found")
+			return errPollNotFound
+		}
+		return err
+	}
+	prev_poll, _, err := h.queries.getPrevPoll(ctx, id)
+	if err != nil {
+		return err
+	}
+	next_poll, _, err := h.queries.getNextPoll(ctx, id)
+	if err != nil {
+		return err
+	}
+	polls := []string{id}
+	if scope == messages.SCOPE_CHAIN {
+		chain, err := h.pollChain(ctx, id)
+		if err != nil {
+			return err
+		}
+		polls = chain.Polls
+	}
+	if err := h.authorizeOwnerOf(ctx, polls, owner_token); err != nil {
+		return err
+	}
+
+	var queued int64
+	queue := func(ctx context.Context, conn *sql.Conn, deleted []string) error {
+		events := make([]webhookEvent, 0, len(deleted))
+		for _, poll := range deleted {
+			events = append(events, webhookEvent{messages.EVENT_POLL_DELETED, poll, map[string]any{"scope": scope, "requested": id}})
+		}
+		var err error
+		queued, err = h.queueEvents(ctx, conn, events...)
+		return err
+	}
+	var deleted []string
+	err = h.retry(ctx, "deleting poll", func(ctx context.Context) error {
+		var err error
+		deleted, err = h.queries.trashPolls(ctx, polls, queue)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(deleted) == 0 {
+		log.Warn("Can't delete poll, poll already deleted")
+		return errPollNotFound
+	}
+	// deleting a poll unlinks its predecessor and successor
+	h.cache.purge()
+	for _, poll := range deleted {
+		payload := map[string]any{"scope": scope, "requested": id}
+		if poll == id {
+			payload["title"] = data.title
+			payload["votes_cast"] = data.cast_votes
+			payload["prev_poll"] = prev_poll
+			payload["next_poll"] = next_poll
+		}
+		h.audit(ctx, messages.AUDIT_DELETE, poll, payload)
+	}
+	h.wakeWebhooks(ctx, queued)
+	log.Info("Poll deleted", "scope", scope, "polls", len(deleted))
+
+	return nil
+}
+
+// Returns an encoded response from the poll cache, calling load on cache misses.
+func (h *Handler) cached(id string, kind cacheKind, load func() (any, error)) (*cacheEntry, error) {
+	if entry, ok := h.cache.get(id, kind); ok {
+		return entry, nil
+	}
+	gen := h.cache.gen()
+
+	resp, err := load()
+	if err != nil {
+		return nil, err
+	}
+	return h.cache.put(id, kind, gen, resp)
+}
+
+// Returns poll data for the v1 API.
+func (h *Handler) pollData(ctx context.Context, id string) (messages.GetPollDataResp, error) {
+	log := h.logger(ctx).With("poll_id", id)
+	log.Debug("Getting poll data")
+
+	// get poll data
+	data, err := h.queries.getPollData(ctx, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.Warn("Can't get poll data, poll not found")
+			return messages.GetPollDataResp{}, errPollNotFound
+		}
+		return messages.GetPollDataResp{}, err
+	}
+
+	// find next and latest poll
+	next_poll, latest_poll, err := h.pollSuccessors(ctx, id)
+	if err != nil {
+		return messages.GetPollDataResp{}, err
+	}
+
+	// get poll choices
+	choices, err := h.queries.getPollChoices(ctx, id)
+	if err != nil {
+		return messages.GetPollDataResp{}, err
+	}
+
+	// get poll votes
+	votes, err := h.queries.getPollVotes(ctx, id)
+	if err != nil {
+		return messages.GetPollDataResp{}, err
+	}
+
+	// finish
+	resp := messages.GetPollDataResp{
+		VotesRequired: data.target_votes,
+		VotesCast:     data.cast_votes,
+		Type:          data.poll_type,
+		Choices:       choices,
+		Votes:         votes,
+		Visibility:    data.visibility,
+		NextPoll:      next_poll,
+		LatestPoll:    latest_poll,
+	}
+	return resp, nil
+}
+
+// Returns poll status for the v1 API.
+func (h *Handler) pollStatus(ctx context.Context, id string) (messages.GetPollStatusResp, error) {
+	log := h.logger(ctx).With("poll_id", id)
+	log.Debug("Getting poll status")
+
+	data, err := h.queries.getPollData(ctx, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.Warn("Can't get poll status, poll not found")
+			return messages.GetPollStatusResp{}, errPollNotFound
+		}
+		return messages.GetPollStatusResp{}, err
+	}
+
+	next_poll, _, err := h.queries.getNextPoll(ctx, id)
+	if err != nil {
+		return messages.GetPollStatusResp{}, err
+	}
+
+	resp := messages.GetPollStatusResp{
+		VotesRequired: data.target_votes,
+		VotesCast:     data.cast_votes,
+		NextPoll:      next_poll,
+	}
+	return resp, nil
+}
+
+// Returns next and latest poll of a chain. Both are empty if the poll has no successor.
+func (h *Handler) pollSuccessors(ctx context.Context, id string) (string, string, error) {
+	next_poll, ok, err := h.queries.getNextPoll(ctx, id)
+	if err != nil || !ok {
+		return "", "", err
+	}
+	latest_poll, _, err := h.queries.getLatestPoll(ctx, id)
+	if err != nil {
+		return "", "", err
+	}
+	return next_poll, latest_poll, nil
+}
+
+// Returns a poll resource for the v2 API.
+func (h *Handler) poll(ctx context.Context, id string) (messages.PollResp, error) {
+	log := h.logger(ctx).With("poll_id", id)
+	log.Debug("Getting poll")
+
+	data, err := h.queries.getPollData(ctx, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.Warn("Can't get poll, poll not found")
+			return messages.PollResp{}, errPollNotFound
+		}
+		return messages.PollResp{}, err
+	}
+
+	prev_poll, _, err := h.queries.getPrevPoll(ctx, id)
+	if err != nil {
+		return messages.PollResp{}, err
+	}
+	next_poll, latest_poll, err := h.pollSuccessors(ctx, id)
+	if err != nil {
+		return messages.PollResp{}, err
+	}
+
+	choices, err := h.queries.getPollChoices(ctx, id)
+	if err != nil {
+		return messages.PollResp{}, err
+	}
+
+	resp := messages.PollResp{
+		ID:            id,
+		Title:         data.title,
+		Type:          data.poll_type,
+		VotesRequired: data.target_votes,
+		VotesCast:     data.cast_votes,
+		AutoCreate:    data.auto_create,
+		Concluded:     data.cast_votes >= data.target_votes,
+		Closed:        data.closed,
+		Identity:      data.identity,
+		InviteOnly:    data.invite_only,
+		Visibility:    data.visibility,
+		Anonymous:     data.anonymous,
+		Choices:       make([]messages.Choice, 0, len(choices)),
+		PrevPoll:      prev_poll,
+		NextPoll:      next_poll,
+		LatestPoll:    latest_poll,
+	}
+	for cid, content := range choices {
+		resp.Choices = append(resp.Choices, messages.Choice{ID: cid, Content: content})
+	}
+	sort.Slice(resp.Choices, func(i, j int) bool {
+		return resp.Choices[i].ID < resp.Choices[j].ID
+	})
+	return resp, nil
+}
+
+// Returns per choice tallies and the current winners of a poll.
+func (h *Handler) pollResults(ctx context.Context, id string) (messages.PollResultsResp, error) {
+	log := h.logger(ctx).With("poll_id", id)
+	log.Debug("Getting poll results")
+
+	data, err := h.queries.getPollData(ctx, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.Warn("Can't get poll results, poll not found")
+			return messages.PollResultsResp{}, errPollNotFound
+		}
+		return messages.PollResultsResp{}, err
+	}
+
+	choices, err := h.queries.getPollChoices(ctx, id)
+	if err != nil {
+		return messages.PollResultsResp{}, err
+	}
+	votes, err := h.queries.getPollVotes(ctx, id)
+	if err != nil {
+		return messages.PollResultsResp{}, err
+	}
+
+	resp := messages.PollResultsResp{
+		PollID:        id,
+		VotesRequired: data.target_votes,
+		VotesCast:     data.cast_votes,
+		Concluded:     data.cast_votes >= data.target_votes,
+		Closed:        data.closed,
+		Visibility:    data.visibility,
+	}
+	resp.Results, resp.Winners = rankResults(choices, votes)
+	return resp, nil
+}
+
+// Orders the choices of a poll by their votes, most first. Returns the ids of the choices with
+// the most votes as winners, none if no votes were cast.
+func rankResults(choices map[int]string, votes map[int]uint) ([]messages.ChoiceResult, []int) {
+	results := make([]messages.ChoiceResult, 0, len(choices))
+	winners := make([]int, 0, 1)
+	var most uint
+	for cid, content := range choices {
+		results = append(results, messages.ChoiceResult{ID: cid, Content: content, Votes: votes[cid]})
+		if votes[cid] > most {
+			most = votes[cid]
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Votes != results[j].Votes {
+			return results[i].Votes > results[j].Votes
+		}
+		return results[i].ID < results[j].ID
+	})
+	for _, result := range results {
+		if most > 0 && result.Votes == most {
+			winners = append(winners, result.ID)
+		}
+	}
+	return results, winners
+}
+
+// Returns all polls of the chain the poll belongs to, oldest first.
+func (h *Handler) pollChain(ctx context.Context, id string) (messages.PollChainResp, error) {
+	log := h.logger(ctx).With("poll_id", id)
+	log.Debug("Getting poll chain")
+
+	if _, err := h.queries.getPollData(ctx, id); err != nil {
+		if err == sql.ErrNoRows {
+			log.Warn("Can't get poll chain, poll not found")
+			return messages.PollChainResp{}, errPollNotFound
+		}
+		return messages.PollChainResp{}, err
+	}
+
+	// walk back to the first poll of the chain
+	first := id
+	for {
+		prev, ok, err := h.queries.getPrevPoll(ctx, first)
+		if err != nil {
+			return messages.PollChainResp{}, err
+		}
+		if !ok {
+			break
+		}
+		first = prev
+	}
+
+	polls := []string{first}
+	for {
+		next, ok, err := h.queries.getNextPoll(ctx, polls[len(polls)-1])
+		if err != nil {
+			return messages.PollChainResp{}, err
+		}
+		if !ok {
+			break
+		}
+		polls = append(polls, next)
+	}
+
+	return messages.PollChainResp{Polls: polls}, nil
+}
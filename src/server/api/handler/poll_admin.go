@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/labstack/echo/v4"
+)
+
+// Handlers for the admin API under /api/admin/v1. Requires the admin token, see RequireAdminToken.
+
+func (h *Handler) AdminListPolls(c echo.Context) error {
+	req := messages.ListPollsReq{}
+	if err := (&echo.DefaultBinder{}).BindQueryParams(c, &req); err != nil {
+		h.logger(c.Request().Context()).Warn("Malformed request", "error", err)
+		return h.handleErrorV2(c, malformedRequest(err))
+	}
+
+	ctx, cancel := h.requestContext(c, "admin")
+	defer cancel()
+
+	resp, err := h.Admin().ListPolls(ctx, req)
+	if err != nil {
+		return h.handleErrorV2(c, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (h *Handler) AdminGetPoll(c echo.Context) error {
+	ctx, cancel := h.requestContext(c, "admin")
+	defer cancel()
+
+	resp, err := h.Admin().Poll(ctx, c.Param("poll_id"))
+	if err != nil {
+		return h.handleErrorV2(c, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (h *Handler) AdminClosePoll(c echo.Context) error {
+	return h.adminSetClosed(c, true)
+}
+
+func (h *Handler) AdminReopenPoll(c echo.Context) error {
+	return h.adminSetClosed(c, false)
+}
+
+func (h *Handler) adminSetClosed(c echo.Context, closed bool) error {
+	ctx, cancel := h.requestContext(c, "admin")
+	defer cancel()
+
+	if err := h.Admin().SetClosed(ctx, c.Param("poll_id"), closed); err != nil {
+		return h.handleErrorV2(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (h *Handler) AdminDeleteChain(c echo.Context) error {
+	ctx, cancel := h.requestContext(c, "admin")
+	defer cancel()
+
+	resp, err := h.Admin().DeleteChain(ctx, c.Param("poll_id"))
+	if err != nil {
+		return h.handleErrorV2(c, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (h *Handler) AdminPurge(c echo.Context) error {
+	req := messages.PurgeReq{}
+	if err := c.Bind(&req); err != nil {
+		h.logger(c.Request().Context()).Warn("Malformed request", "error", err)
+		return h.handleErrorV2(c, malformedRequest(err))
+	}
+
+	ctx, cancel := h.requestContext(c, "admin")
+	defer cancel()
+
+	resp, err := h.Admin().Purge(ctx, req)
+	if err != nil {
+		return h.handleErrorV2(c, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (h *Handler) AdminRecount(c echo.Context) error {
+	req := messages.RecountReq{}
+	if err := c.Bind(&req); err != nil {
+		h.logger(c.Request().Context()).Warn("Malformed request", "error", err)
+		return h.handleErrorV2(c, malformedRequest(err))
+	}
+
+	ctx, cancel := h.requestContext(c, "admin")
+	defer cancel()
+
+	resp, err := h.Admin().Recount(ctx, req)
+	if err != nil {
+		return h.handleErrorV2(c, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (h *Handler) AdminAudit(c echo.Context) error {
+	req := messages.AuditReq{}
+	if err := (&echo.DefaultBinder{}).BindQueryParams(c, &req); err != nil {
+		h.logger(c.Request().Context()).Warn("Malformed request", "error", err)
+		return h.handleErrorV2(c, malformedRequest(err))
+	}
+
+	ctx, cancel := h.requestContext(c, "admin")
+	defer cancel()
+
+	resp, err := h.Admin().Audit(ctx, req)
+	if err != nil {
+		return h.handleErrorV2(c, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (h *Handler) AdminExport(c echo.Context) error {
+	req := messages.ExportReq{}
+	if err := (&echo.DefaultBinder{}).BindQueryParams(c, &req); err != nil {
+		h.logger(c.Request().Context()).Warn("Malformed request", "error", err)
+		return h.handleErrorV2(c, malformedRequest(err))
+	}
+
+	ctx, cancel := h.requestContext(c, "admin")
+	defer cancel()
+
+	resp, err := h.Admin().Export(ctx, req)
+	if err != nil {
+		return h.handleErrorV2(c, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// Accepts exports as JSON or CSV documents, see ParseImportCSV.
+func (h *Handler) AdminImport(c echo.Context) error {
+	req := new(messages.PollsExport)
+	csv := strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), "text/csv")
+	if csv {
+		var err error
+		if req, err = ParseImportCSV(c.Request().Body); err != nil {
+			h.logger(c.Request().Context()).Warn("Malformed request", "error", err)
+			return h.handleErrorV2(c, err)
+		}
+	} else if err := c.Bind(req); err != nil {
+		h.logger(c.Request().Context()).Warn("Malformed request", "error", err)
+		return h.handleErrorV2(c, malformedRequest(err))
+	}
+
+	ctx, cancel := h.requestContext(c, "admin")
+	defer cancel()
+
+	resp, err := h.Admin().Import(ctx, req)
+	if err != nil {
+		return h.handleErrorV2(c, err)
+	}
+	if csv {
+		// choice ids of CSV documents are assigned while parsing and meaningless to the caller
+		resp.Choices = nil
+	}
+	return c.JSON(http.StatusCreated, resp)
+}
+
+func (h *Handler) AdminBackup(c echo.Context) error {
+	ctx, cancel := h.requestContext(c, "backup")
+	defer cancel()
+
+	resp, err := h.Admin().Backup(ctx)
+	if err != nil {
+		return h.handleErrorV2(c, err)
+	}
+	return c.JSON(http.StatusCreated, resp)
+}
+
+func (h *Handler) AdminListBackups(c echo.Context) error {
+	ctx, cancel := h.requestContext(c, "admin")
+	defer cancel()
+
+	resp, err := h.Admin().ListBackups(ctx)
+	if err != nil {
+		return h.handleErrorV2(c, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// Sends the backup file as download.
+func (h *Handler) AdminDownloadBackup(c echo.Context) error {
+	path, err := h.Admin().BackupPath(c.Param("name"))
+	if err != nil {
+		return h.handleErrorV2(c, err)
+	}
+	return c.Attachment(path, c.Param("name"))
+}
+
+func (h *Handler) AdminRestore(c echo.Context) error {
+	req := new(messages.RestoreReq)
+	if err := c.Bind(req); err != nil {
+		h.logger(c.Request().Context()).Warn("Malformed request", "error", err)
+		return h.handleErrorV2(c, malformedRequest(err))
+	}
+
+	ctx, cancel := h.requestContext(c, "backup")
+	defer cancel()
+
+	resp, err := h.Admin().Restore(ctx, req.Name)
+	if err != nil {
+		return h.handleErrorV2(c, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+)
+
+func TestV1PollIDParameters(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{})
+	body := messages.GetPollDataReq{PollID: poll.PollID}
+
+	for _, endpoint := range []string{"/api/poll/v1/data", "/api/poll/v1/status"} {
+		path := decode[map[string]any](t, s.request(http.MethodGet, endpoint+"/"+poll.PollID, nil), http.StatusOK)
+		query := decode[map[string]any](t, s.request(http.MethodGet, endpoint+"?poll_id="+poll.PollID, nil), http.StatusOK)
+		deprecated := decode[map[string]any](t, s.request(http.MethodGet, endpoint, body), http.StatusOK)
+		if path["votes_required"] != float64(2) || query["votes_required"] != float64(2) || deprecated["votes_required"] != float64(2) {
+			t.Errorf("%s: responses differ: %v, %v, %v", endpoint, path, query, deprecated)
+		}
+
+		expectError(t, s.request(http.MethodGet, endpoint+"/unknown", nil), http.StatusNotFound, messages.POLL_NOT_FOUND)
+		expectError(t, s.request(http.MethodGet, endpoint, nil), http.StatusNotFound, messages.POLL_NOT_FOUND)
+	}
+
+	expectStatus(t, s.request(http.MethodDelete, "/api/poll/v1/delete?poll_id="+poll.PollID, nil), http.StatusOK)
+	expectError(t, s.request(http.MethodGet, "/api/poll/v1/status/"+poll.PollID, nil), http.StatusNotFound, messages.POLL_NOT_FOUND)
+}
+
+func TestV1Voting(t *testing.T) {
+	s := newTestServer(t)
+	rec := s.request(http.MethodPost, "/api/poll/v1/create", messages.CreatePollReq{
+		Title:       "Movie night",
+		TargetVotes: 1,
+		Choices:     []string{"Alien", "Heat"},
+		Type:        messages.SINGLE,
+	})
+	poll := decode[messages.CreatePollResp](t, rec, http.StatusOK)
+	choices := s.choices(poll.PollID)
+
+	vote := messages.VotePollReq{PollID: poll.PollID, UserID: "alice", Votes: []int{choices[1]}}
+	expectStatus(t, s.request(http.MethodPost, "/api/poll/v1/vote", vote), http.StatusOK)
+	data := decode[messages.GetPollDataResp](t, s.request(http.MethodGet, "/api/poll/v1/data/"+poll.PollID, nil), http.StatusOK)
+	if data.VotesCast != 1 || data.Votes[choices[1]] != 1 || data.Choices[choices[1]] != "Heat" {
+		t.Errorf("unexpected poll data %+v", data)
+	}
+
+	// v1 reports concluded polls with 400
+	vote.UserID = "bob"
+	expectError(t, s.request(http.MethodPost, "/api/poll/v1/vote", vote), http.StatusBadRequest, messages.POLL_CONCLUDED)
+}
@@ -0,0 +1,237 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/labstack/echo/v4"
+)
+
+// Handlers for the resource oriented /api/v2 API. Polls are addressed by the poll_id path parameter.
+
+func (h *Handler) CreatePollV2(c echo.Context) error {
+	req := new(messages.CreatePollReq)
+	if err := c.Bind(req); err != nil {
+		h.logger(c.Request().Context()).Warn("Malformed request", "error", err)
+		return h.handleErrorV2(c, malformedRequest(err))
+	}
+
+	ctx, cancel := h.requestContext(c, "create")
+	defer cancel()
+
+	resp, err := h.createPoll(ctx, req)
+	if err != nil {
+		return h.handleErrorV2(c, err)
+	}
+
+	c.Response().Header().Set(echo.HeaderLocation, c.Path()+"/"+resp.PollID)
+	return c.JSON(http.StatusCreated, resp)
+}
+
+func (h *Handler) GetPollV2(c echo.Context) error {
+	ctx, cancel := h.requestContext(c, "data")
+	defer cancel()
+
+	id := c.Param("poll_id")
+	entry, err := h.cached(id, cachePoll, func() (any, error) {
+		return h.poll(ctx, id)
+	})
+	if err != nil {
+		return h.handleErrorV2(c, err)
+	}
+	return writeCached(c, entry)
+}
+
+// Deletes a poll, authorized by the owner token as bearer token.
+func (h *Handler) DeletePollV2(c echo.Context) error {
+	req := messages.DeletePollV2Req{}
+	if err := (&echo.DefaultBinder{}).BindQueryParams(c, &req); err != nil {
+		h.logger(c.Request().Context()).Warn("Malformed request", "error", err)
+		return h.handleErrorV2(c, malformedRequest(err))
+	}
+
+	ctx, cancel := h.requestContext(c, "delete")
+	defer cancel()
+
+	owner_token := ownerToken(c)
+	if err := h.deletePoll(ctx, c.Param("poll_id"), req.Scope, &owner_token); err != nil {
+		return h.handleOwnerErrorV2(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Restores a deleted poll, authorized by the owner token as bearer token.
+func (h *Handler) RestorePollV2(c echo.Context) error {
+	req := new(messages.RestorePollReq)
+	if err := c.Bind(req); err != nil {
+		h.logger(c.Request().Context()).Warn("Malformed request", "error", err)
+		return h.handleErrorV2(c, malformedRequest(err))
+	}
+
+	ctx, cancel := h.requestContext(c, "delete")
+	defer cancel()
+
+	owner_token := ownerToken(c)
+	resp, err := h.restorePoll(ctx, c.Param("poll_id"), req.Scope, &owner_token)
+	if err != nil {
+		return h.handleOwnerErrorV2(c, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (h *Handler) VotePollV2(c echo.Context) error {
+	body := new(messages.CastVotesReq)
+	if err := c.Bind(body); err != nil {
+		h.logger(c.Request().Context()).Warn("Malformed request", "error", err)
+		return h.handleErrorV2(c, malformedRequest(err))
+	}
+
+	ctx, cancel := h.requestContext(c, "vote")
+	defer cancel()
+
+	req := &messages.VotePollReq{
+		PollID: c.Param("poll_id"),
+		UserID: body.UserID,
+		Votes:  body.Votes,
+		Token:  body.Token,
+	}
+	if err := h.votePoll(ctx, req); err != nil {
+		return h.handleErrorV2(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (h *Handler) GetPollResultsV2(c echo.Context) error {
+	ctx, cancel := h.requestContext(c, "results")
+	defer cancel()
+
+	id := c.Param("poll_id")
+	req := messages.PollResultsReq{}
+	if err := (&echo.DefaultBinder{}).BindQueryParams(c, &req); err != nil {
+		h.logger(ctx).Warn("Malformed request", "error", err)
+		return h.handleErrorV2(c, malformedRequest(err))
+	}
+
+	entry, err := h.cached(id, cacheResults, func() (any, error) {
+		return h.pollResults(ctx, id)
+	})
+	if err != nil {
+		return h.handleErrorV2(c, err)
+	}
+	hidden, err := h.resultsHidden(ctx, id, entry.resp.(messages.PollResultsResp).Visibility, req.UserID, req.Token)
+	if err != nil {
+		return h.handleErrorV2(c, err)
+	}
+	if hidden {
+		entry, err = h.cached(id, cacheResultsHidden, func() (any, error) {
+			resp, err := h.pollResults(ctx, id)
+			return hidePollResults(resp), err
+		})
+		if err != nil {
+			return h.handleErrorV2(c, err)
+		}
+	}
+	return writeCached(c, entry)
+}
+
+// Lists the invites of a poll, authorized by the owner token as bearer token.
+func (h *Handler) GetPollInvitesV2(c echo.Context) error {
+	ctx, cancel := h.requestContext(c, "invites")
+	defer cancel()
+
+	resp, err := h.pollInvites(ctx, c.Param("poll_id"), ownerToken(c))
+	if err != nil {
+		return h.handleOwnerErrorV2(c, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// Returns the owner token sent as bearer token.
+func ownerToken(c echo.Context) string {
+	token, _ := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+	return token
+}
+
+// Writes errors of requests authorized by the owner token, challenging clients without valid token.
+func (h *Handler) handleOwnerErrorV2(c echo.Context, err error) error {
+	if errors.Is(err, errOwnerUnauthorized) {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+	}
+	return h.handleErrorV2(c, err)
+}
+
+// Registers a webhook, authorized by the owner token as bearer token.
+func (h *Handler) AddWebhookV2(c echo.Context) error {
+	req := new(messages.CreateWebhookReq)
+	if err := c.Bind(req); err != nil {
+		h.logger(c.Request().Context()).Warn("Malformed request", "error", err)
+		return h.handleErrorV2(c, malformedRequest(err))
+	}
+
+	ctx, cancel := h.requestContext(c, "webhooks")
+	defer cancel()
+
+	resp, err := h.addWebhook(ctx, c.Param("poll_id"), ownerToken(c), req)
+	if err != nil {
+		return h.handleOwnerErrorV2(c, err)
+	}
+	c.Response().Header().Set(echo.HeaderLocation, c.Request().URL.Path+"/"+resp.ID)
+	return c.JSON(http.StatusCreated, resp)
+}
+
+// Lists the webhooks of a poll, authorized by the owner token as bearer token.
+func (h *Handler) ListWebhooksV2(c echo.Context) error {
+	ctx, cancel := h.requestContext(c, "webhooks")
+	defer cancel()
+
+	resp, err := h.listWebhooks(ctx, c.Param("poll_id"), ownerToken(c))
+	if err != nil {
+		return h.handleOwnerErrorV2(c, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// Removes a webhook including its deliveries, authorized by the owner token as bearer token.
+func (h *Handler) RemoveWebhookV2(c echo.Context) error {
+	ctx, cancel := h.requestContext(c, "webhooks")
+	defer cancel()
+
+	if err := h.removeWebhook(ctx, c.Param("poll_id"), ownerToken(c), c.Param("webhook_id")); err != nil {
+		return h.handleOwnerErrorV2(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Lists recent deliveries of a webhook, authorized by the owner token as bearer token.
+func (h *Handler) GetWebhookDeliveriesV2(c echo.Context) error {
+	ctx, cancel := h.requestContext(c, "webhooks")
+	defer cancel()
+
+	req := messages.WebhookDeliveriesReq{}
+	if err := (&echo.DefaultBinder{}).BindQueryParams(c, &req); err != nil {
+		h.logger(ctx).Warn("Malformed request", "error", err)
+		return h.handleErrorV2(c, malformedRequest(err))
+	}
+
+	resp, err := h.webhookDeliveries(ctx, c.Param("poll_id"), ownerToken(c), c.Param("webhook_id"), req.Limit)
+	if err != nil {
+		return h.handleOwnerErrorV2(c, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (h *Handler) GetPollChainV2(c echo.Context) error {
+	ctx, cancel := h.requestContext(c, "chain")
+	defer cancel()
+
+	id := c.Param("poll_id")
+	entry, err := h.cached(id, cacheChain, func() (any, error) {
+		return h.pollChain(ctx, id)
+	})
+	if err != nil {
+		return h.handleErrorV2(c, err)
+	}
+	return writeCached(c, entry)
+}
@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+)
+
+func TestV2PollLifecycle(t *testing.T) {
+	s := newTestServer(t)
+	rec := s.request(http.MethodPost, "/api/v2/polls", messages.CreatePollReq{
+		Title:       "Movie night",
+		TargetVotes: 2,
+		Choices:     []string{"Alien", "Heat", "Ran"},
+		Type:        messages.MULTIPLE,
+	})
+	created := decode[messages.CreatePollResp](t, rec, http.StatusCreated)
+	if location := rec.Header().Get("Location"); location != "/api/v2/polls/"+created.PollID {
+		t.Errorf("unexpected location %q", location)
+	}
+
+	poll := s.poll(created.PollID)
+	if poll.ID != created.PollID || poll.Title != "Movie night" || poll.Type != messages.MULTIPLE || len(poll.Choices) != 3 {
+		t.Fatalf("unexpected poll %+v", poll)
+	}
+	alien, heat, ran := poll.Choices[0].ID, poll.Choices[1].ID, poll.Choices[2].ID
+
+	expectStatus(t, s.vote(created.PollID, messages.CastVotesReq{UserID: "alice", Votes: []int{alien, heat}}), http.StatusNoContent)
+	expectError(t, s.vote(created.PollID, messages.CastVotesReq{UserID: "alice", Votes: []int{ran}}), http.StatusConflict, messages.ALREADY_VOTED)
+	expectStatus(t, s.vote(created.PollID, messages.CastVotesReq{UserID: "bob", Votes: []int{heat}}), http.StatusNoContent)
+	expectError(t, s.vote(created.PollID, messages.CastVotesReq{UserID: "carol", Votes: []int{ran}}), http.StatusConflict, messages.POLL_CONCLUDED)
+
+	results := decode[messages.PollResultsResp](t, s.request(http.MethodGet, "/api/v2/polls/"+created.PollID+"/results", nil), http.StatusOK)
+	if !results.Concluded || results.VotesCast != 2 || !reflect.DeepEqual(results.Winners, []int{heat}) {
+		t.Errorf("unexpected results %+v", results)
+	}
+	if len(results.Results) != 3 || results.Results[0].ID != heat || results.Results[0].Votes != 2 {
+		t.Errorf("results aren't ordered by votes: %+v", results.Results)
+	}
+
+	chain := decode[messages.PollChainResp](t, s.request(http.MethodGet, "/api/v2/polls/"+created.PollID+"/chain", nil), http.StatusOK)
+	if !reflect.DeepEqual(chain.Polls, []string{created.PollID}) {
+		t.Errorf("unexpected chain %v", chain.Polls)
+	}
+
+	expectStatus(t, s.request(http.MethodDelete, "/api/v2/polls/"+created.PollID, nil, bearer(created.OwnerToken)...), http.StatusNoContent)
+	expectError(t, s.request(http.MethodGet, "/api/v2/polls/"+created.PollID, nil), http.StatusNotFound, messages.POLL_NOT_FOUND)
+}
+
+func TestV2Chain(t *testing.T) {
+	s := newTestServer(t)
+	first := s.createPoll(messages.CreatePollReq{TargetVotes: 1, AutoCreate: true})
+	expectStatus(t, s.vote(first.PollID, messages.CastVotesReq{UserID: "alice", Votes: s.choices(first.PollID)[:1]}), http.StatusNoContent)
+
+	second := s.poll(first.PollID).NextPoll
+	if second == "" {
+		t.Fatal("concluding vote didn't create a successor")
+	}
+	successor := s.poll(second)
+	if successor.PrevPoll != first.PollID || successor.Title != "Movie night" || len(successor.Choices) != 2 || successor.VotesCast != 0 {
+		t.Errorf("unexpected successor %+v", successor)
+	}
+	chain := decode[messages.PollChainResp](t, s.request(http.MethodGet, "/api/v2/polls/"+second+"/chain", nil), http.StatusOK)
+	if !reflect.DeepEqual(chain.Polls, []string{first.PollID, second}) {
+		t.Errorf("unexpected chain %v", chain.Polls)
+	}
+
+	rec := s.request(http.MethodPost, "/api/v2/polls", messages.CreatePollReq{
+		Title: "Movie night", TargetVotes: 1, Choices: []string{"Alien", "Heat"}, PrevPollID: "unknown"})
+	expectError(t, rec, http.StatusUnprocessableEntity, messages.PREVIOUS_POLL_NOT_FOUND)
+}
+
+func TestV2RejectsInvalidPolls(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		req  messages.CreatePollReq
+		code messages.ErrorCode
+	}{
+		{messages.CreatePollReq{Title: "Movie night", TargetVotes: 1, Choices: []string{"Alien"}}, messages.TOO_FEW_CHOICES},
+		{messages.CreatePollReq{TargetVotes: 1, Choices: []string{"Alien", "Heat"}}, messages.EMPTY_TITLE},
+		{messages.CreatePollReq{Title: "Movie night", Choices: []string{"Alien", "Heat"}}, messages.INVALID_TARGET_VOTES},
+	}
+	for _, test := range tests {
+		expectError(t, s.request(http.MethodPost, "/api/v2/polls", test.req), http.StatusBadRequest, test.code)
+	}
+
+	poll := s.createPoll(messages.CreatePollReq{})
+	choices := s.choices(poll.PollID)
+	votes := []struct {
+		votes []int
+		code  messages.ErrorCode
+	}{
+		{nil, messages.NO_VOTES},
+		{[]int{choices[0], choices[0]}, messages.DUPLICATE_VOTES},
+		{choices, messages.INVALID_VOTE_COUNT},
+	}
+	for _, test := range votes {
+		expectError(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: test.votes}), http.StatusBadRequest, test.code)
+	}
+	// single choice polls take exactly one vote
+	resp := expectError(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: choices}), http.StatusBadRequest, messages.INVALID_VOTE_COUNT)
+	if resp.Details["min"] != 1.0 || resp.Details["max"] != 1.0 {
+		t.Errorf("unexpected details %v", resp.Details)
+	}
+	expectError(t, s.vote("unknown", messages.CastVotesReq{UserID: "alice", Votes: choices[:1]}), http.StatusNotFound, messages.POLL_NOT_FOUND)
+}
+
+func TestVotesForChoicesOfOtherPolls(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{})
+	other := s.createPoll(messages.CreatePollReq{})
+	foreign := s.choices(other.PollID)[0]
+
+	resp := expectError(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: []int{foreign}}),
+		http.StatusBadRequest, messages.INVALID_CHOICE)
+	if !reflect.DeepEqual(resp.Details["invalid_choice_ids"], []any{float64(foreign)}) {
+		t.Errorf("unexpected details %+v", resp.Details)
+	}
+	expectError(t, s.request(http.MethodPost, "/api/poll/v1/vote", messages.VotePollReq{PollID: poll.PollID, UserID: "alice", Votes: []int{foreign}}),
+		http.StatusBadRequest, messages.INVALID_CHOICE)
+	if cast := s.poll(poll.PollID).VotesCast + s.poll(other.PollID).VotesCast; cast != 0 {
+		t.Errorf("%d votes cast for choices of other polls", cast)
+	}
+
+	// enforced by the database too
+	_, err := s.db.Exec("INSERT INTO vote(poll_id, choice_id, user) VALUES (?, ?, 'bob')", poll.PollID, foreign)
+	if err == nil || !strings.Contains(err.Error(), "choice does not belong to poll") {
+		t.Errorf("database accepted a vote for the choice of another poll: %v", err)
+	}
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: s.choices(poll.PollID)[:1]}), http.StatusNoContent)
+}
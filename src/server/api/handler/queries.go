@@ -3,18 +3,30 @@ package handler
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log/slog"
+	"time"
 
 	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/AdrianPrawda/movie-poll/api/metrics"
 	"github.com/AdrianPrawda/movie-poll/api/util"
-	"github.com/mattn/go-sqlite3"
 )
 
 type queryHandler struct {
-	_db  *sql.DB
-	_log *util.Logger
+	_db      *sql.DB
+	_log     *slog.Logger
+	_metrics *metrics.Metrics
 }
 
-// Inserts a new poll into the database, including all data dependencies.
+// Returns the request scoped logger carried by ctx, falling back to the query handler logger.
+func (q *queryHandler) logger(ctx context.Context) *slog.Logger {
+	return util.LoggerFromContext(ctx, q._log)
+}
+
+// Inserts a new poll into the database, including all data dependencies. queue runs inside
+// the transaction once the poll was inserted, e.g. to queue webhook deliveries. Nil skips it.
+// Returns errPrevPollNotFound if the previous poll doesn't exist or was deleted.
 func (q *queryHandler) insertPoll(
 	ctx context.Context,
 	id string,
@@ -23,171 +35,309 @@ func (q *queryHandler) insertPoll(
 	target_votes uint,
 	choices []string,
 	auto_create bool,
-	prev_poll string) error {
+	identity messages.Identity,
+	visibility messages.Visibility,
+	anonymous bool,
+	voter_salt string,
+	owner_hash string,
+	invites []inviteRow,
+	prev_poll string,
+	queue func(ctx context.Context, conn *sql.Conn) error) error {
+
+	ctx, end := q.trace(ctx, "insert_poll", id)
+	defer end()
 
 	const (
-		STMT_INSERT_POLL   = "INSERT INTO poll (id, title, poll_type, target_votes, auto_create) VALUES (?,?,?,?,?)"
-		STMT_INSERT_NEXT   = "INSERT INTO next_poll (poll_id, next_poll) VALUES (?,?)"
+		STMT_INSERT_POLL = `INSERT INTO poll (id, title, poll_type, target_votes, auto_create, identity, visibility, anonymous, voter_salt,
+			invite_only, owner_hash) VALUES (?,?,?,?,?,?,?,?,?,?,?)`
+		STMT_INSERT_NEXT   = "INSERT INTO next_poll (poll_id, next_poll) SELECT id, ? FROM poll WHERE id=? AND deleted_at IS NULL"
+		STMT_UNLINK_NEXT   = "DELETE FROM next_poll WHERE poll_id=? AND next_poll IN (SELECT id FROM poll WHERE deleted_at IS NOT NULL)"
 		STMT_INSERT_CHOICE = "INSERT INTO choice (poll_id, content) VALUES (?,?)"
+		STMT_INSERT_INVITE = "INSERT INTO invite (poll_id, name, token_hash) VALUES (?,?,?)"
 	)
 
-	debug := q._log.Debug
-	debug.Println("Inserting poll")
+	debug := q.logger(ctx).With("poll_id", id).Debug
+	debug("Inserting poll")
 
-	tx, err := q._db.BeginTx(ctx, nil)
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
+	return q.immediateTx(ctx, func(conn *sql.Conn) error {
+		// insert into poll
+		debug("Inserting into poll table")
+		if _, err := conn.ExecContext(ctx, STMT_INSERT_POLL, id, title, poll_type, target_votes, auto_create, identity, visibility,
+			anonymous, voter_salt, len(invites) > 0, owner_hash); err != nil {
+			return err
+		}
 
-	// insert into poll
-	debug.Println("Inserting into poll table")
-	if _, err := tx.Exec(STMT_INSERT_POLL, id, title, poll_type, target_votes, auto_create); err != nil {
-		return err
-	}
+		// insert into next_poll, a new successor replaces a deleted one
+		if prev_poll != "" {
+			debug("Inserting into next poll table")
+			if _, err := conn.ExecContext(ctx, STMT_UNLINK_NEXT, prev_poll); err != nil {
+				return err
+			}
+			res, err := conn.ExecContext(ctx, STMT_INSERT_NEXT, id, prev_poll)
+			if err != nil {
+				return err
+			}
+			if linked, err := res.RowsAffected(); err != nil {
+				return err
+			} else if linked == 0 {
+				return errPrevPollNotFound
+			}
+		}
 
-	// insert into next_poll
-	if prev_poll != "" {
-		debug.Println("Inserting into next poll table")
-		if _, err := tx.Exec(STMT_INSERT_NEXT, prev_poll, id); err != nil {
+		// insert into choice
+		debug("Insert into choice table")
+		stmt_insert_choice, err := conn.PrepareContext(ctx, STMT_INSERT_CHOICE)
+		if err != nil {
 			return err
 		}
-	}
+		defer stmt_insert_choice.Close()
+		for _, content := range choices {
+			if _, err := stmt_insert_choice.ExecContext(ctx, id, content); err != nil {
+				return err
+			}
+		}
+
+		// insert into invite
+		if len(invites) > 0 {
+			debug("Inserting into invite table", "invites", len(invites))
+			stmt_insert_invite, err := conn.PrepareContext(ctx, STMT_INSERT_INVITE)
+			if err != nil {
+				return err
+			}
+			defer stmt_insert_invite.Close()
+			for _, invite := range invites {
+				if _, err := stmt_insert_invite.ExecContext(ctx, id, invite.name, invite.token_hash); err != nil {
+					return err
+				}
+			}
+		}
+
+		if queue != nil {
+			if err := queue(ctx, conn); err != nil {
+				return err
+			}
+		}
+		debug("Commiting")
+		return nil
+	})
+}
 
-	// insert into choice
-	debug.Println("Insert into choice table")
-	stmt_insert_choice, err := tx.Prepare(STMT_INSERT_CHOICE)
+// Runs fn inside a transaction started with BEGIN IMMEDIATE. Acquires the write lock up front,
+// so concurrent writers wait for the busy timeout instead of failing on lock upgrades.
+func (q *queryHandler) immediateTx(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := q._db.Conn(ctx)
 	if err != nil {
 		return err
 	}
-	for _, content := range choices {
-		if _, err := stmt_insert_choice.Exec(id, content); err != nil {
-			return err
-		}
-	}
-	if err := stmt_insert_choice.Close(); err != nil {
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
 		return err
 	}
+	if err = fn(conn); err == nil {
+		if _, err = conn.ExecContext(ctx, "COMMIT"); err == nil {
+			return nil
+		}
+	}
 
-	debug.Println("Commiting")
-	if err := tx.Commit(); err != nil {
-		return err
+	// ctx might already be done, rollback regardless
+	if _, rerr := conn.ExecContext(context.Background(), "ROLLBACK"); rerr != nil {
+		q.logger(ctx).Error("Rollback failed, discarding connection", "error", rerr)
+		conn.Raw(func(any) error { return driver.ErrBadConn })
 	}
-	return nil
+	return err
 }
 
-// Tries to insert votes into the voting table if constraints are met.
+// Inserts votes into the voting table if constraints are met.
 // Will not check if number of votes are correct.
-// Returns if query can be retried and if insertion has been sucessfull
-// Caller should check for sql.ErrNoRows in err.
-func (q *queryHandler) tryInsertVotes(
+// Votes with an invite hash are cast as the invitee and use up the invite. Returns the user votes were cast as
+// and the number of ballots cast on the poll including this one, only the ballot reaching the target concludes it.
+// Ballots of anonymous polls are stored under a random id at random rows with the poll's creation time, their voters are
+// recorded by the voter hash or the used invite. No user is returned for them.
+// queue runs inside the transaction once the votes were inserted, e.g. to queue webhook deliveries.
+// Returns errPollClosed, errVoteLimitReached, errAlreadyVoted, errInvalidInvite, errInviteUsed or
+// errInvalidChoice if constraints are not met.
+// Caller should check for sql.ErrNoRows and busy database errors in err.
+func (q *queryHandler) insertVotes(
 	ctx context.Context,
 	poll string,
 	user string,
-	votes []int) (bool, bool, error) {
+	invite_hash string,
+	voter_hash string,
+	votes []int,
+	queue func(ctx context.Context, conn *sql.Conn, user string, cast uint) error) (string, uint, error) {
+
+	ctx, end := q.trace(ctx, "insert_votes", poll)
+	defer end()
 
 	const (
-		STMT_POLL_DATA   = "SELECT cast_votes, target_votes, auto_create, title FROM poll WHERE id=?"
+		STMT_POLL_DATA   = "SELECT cast_votes, target_votes, closed, anonymous FROM poll WHERE id=? AND deleted_at IS NULL"
 		STMT_USER_VOTES  = "SELECT COUNT(*) FROM vote WHERE poll_id=? AND user=?"
+		STMT_VOTER       = "SELECT EXISTS(SELECT 1 FROM voter WHERE poll_id=? AND voter_hash=?)"
+		STMT_CHOICES     = "SELECT id FROM choice WHERE poll_id=?"
 		STMT_UPDATE_POLL = "UPDATE poll SET cast_votes = cast_votes + 1 WHERE id=?"
 		STMT_INSERT_VOTE = "INSERT INTO vote (poll_id, choice_id, user) VALUES (?,?,?)"
-	)
-
-	debug := q._log.Debug
+		STMT_INVITE      = "SELECT id, name, used FROM invite WHERE poll_id=? AND token_hash=?"
+		STMT_USE_INVITE  = "UPDATE invite SET used = 1, used_at = current_timestamp WHERE id=?"
 
-	tx, err := q._db.BeginTx(ctx, nil)
-	if err != nil {
-		return false, false, err
-	}
-	defer tx.Rollback()
+		STMT_INSERT_VOTER          = "INSERT INTO voter (poll_id, voter_hash) VALUES (?,?)"
+		STMT_INSERT_ANONYMOUS_VOTE = `INSERT INTO vote (id, poll_id, choice_id, user, created_at)
+			SELECT ` + ANONYMOUS_VOTE_ID + `, id, ?, ?, created_at FROM poll WHERE id=?`
+		STMT_USE_ANONYMOUS_INVITE = "UPDATE invite SET used = 1 WHERE id=?"
+	)
 
-	// check if voting has already concluded
-	debug.Println("Fetching poll data")
-	var cast_votes, target_votes uint
-	var auto_create bool
-	var title string
-	if err := tx.QueryRow(STMT_POLL_DATA, poll).
-		Scan(&cast_votes, &target_votes, &auto_create, &title); err != nil {
-		return false, false, err
-	}
-	if cast_votes >= target_votes {
-		debug.Println("Target votes exceeded")
-		return false, false, nil
-	}
+	debug := q.logger(ctx).With("poll_id", poll).Debug
 
-	// check if user has already voted
-	debug.Println("Fetching number of user votes")
-	var user_votes int
-	if err := tx.QueryRow(STMT_USER_VOTES, poll, user).Scan(&user_votes); err != nil {
-		return false, false, err
-	}
-	if user_votes != 0 {
-		debug.Println("User already voted")
-		return false, false, nil
-	}
+	var cast uint
+	err := q.immediateTx(ctx, func(conn *sql.Conn) error {
+		// check if voting has already concluded
+		debug("Fetching poll data")
+		var cast_votes, target_votes uint
+		var closed, anonymous bool
+		if err := conn.QueryRowContext(ctx, STMT_POLL_DATA, poll).
+			Scan(&cast_votes, &target_votes, &closed, &anonymous); err != nil {
+			return err
+		}
+		if closed {
+			debug("Poll closed")
+			return errPollClosed
+		}
+		if cast_votes >= target_votes {
+			debug("Target votes exceeded")
+			return errVoteLimitReached
+		}
 
-	// insert votes
-	debug.Println("Inserting votes")
-	stmt_insert_vote, err := tx.Prepare(STMT_INSERT_VOTE)
-	if err != nil {
-		return false, false, err
-	}
-	for _, choice := range votes {
-		if _, err := tx.Stmt(stmt_insert_vote).Exec(poll, choice, user); err != nil {
-			if err == sqlite3.ErrBusySnapshot {
-				debug.Println("Snapshot busy")
-				return true, false, nil
+		// check if invite is valid and unused
+		if invite_hash != "" {
+			debug("Fetching invite")
+			var invite_id int
+			var used bool
+			if err := conn.QueryRowContext(ctx, STMT_INVITE, poll, invite_hash).Scan(&invite_id, &user, &used); err != nil {
+				if err == sql.ErrNoRows {
+					debug("Invite not found")
+					return errInvalidInvite
+				}
+				return err
+			}
+			if used {
+				debug("Invite already used")
+				return errInviteUsed
+			}
+			stmt_use_invite := STMT_USE_INVITE
+			if anonymous {
+				// when the invitee voted would date their ballot
+				stmt_use_invite = STMT_USE_ANONYMOUS_INVITE
+			}
+			if _, err := conn.ExecContext(ctx, stmt_use_invite, invite_id); err != nil {
+				return err
 			}
-			return false, false, err
 		}
-	}
-	err = stmt_insert_vote.Close()
-	if err != nil {
-		return false, false, err
-	}
 
-	// increase votes in poll table
-	debug.Println("Increasing poll votes")
-	if _, err := tx.Exec(STMT_UPDATE_POLL, poll); err != nil {
-		if err == sqlite3.ErrBusySnapshot {
-			debug.Println("Snapshot busy")
-			return true, false, nil
+		// check if user has already voted
+		switch {
+		case anonymous && invite_hash != "":
+			// the used invite records the voter
+		case anonymous:
+			if voter_hash == "" {
+				return errors.New("anonymous poll needs a voter hash")
+			}
+			debug("Fetching voter")
+			var voted bool
+			if err := conn.QueryRowContext(ctx, STMT_VOTER, poll, voter_hash).Scan(&voted); err != nil {
+				return err
+			}
+			if voted {
+				debug("User already voted")
+				return errAlreadyVoted
+			}
+			if _, err := conn.ExecContext(ctx, STMT_INSERT_VOTER, poll, voter_hash); err != nil {
+				return err
+			}
+		default:
+			debug("Fetching number of user votes", "user_id", user)
+			var user_votes int
+			if err := conn.QueryRowContext(ctx, STMT_USER_VOTES, poll, user).Scan(&user_votes); err != nil {
+				return err
+			}
+			if user_votes != 0 {
+				debug("User already voted")
+				return errAlreadyVoted
+			}
 		}
-		return false, false, err
-	}
 
-	// check if changes can be commited
-	debug.Println("Commiting changes")
-	if err := tx.Commit(); err != nil {
-		if err == sqlite3.ErrBusySnapshot {
-			debug.Println("Snapshot busy")
-			return true, false, nil
+		// check if all votes are choices of this poll
+		debug("Validating choices")
+		rows, err := conn.QueryContext(ctx, STMT_CHOICES, poll)
+		if err != nil {
+			return err
+		}
+		choices := make(map[int]bool, len(votes))
+		for rows.Next() {
+			var cid int
+			if err := rows.Scan(&cid); err != nil {
+				rows.Close()
+				return err
+			}
+			choices[cid] = true
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		invalid := make([]int, 0)
+		for _, choice := range votes {
+			if !choices[choice] {
+				invalid = append(invalid, choice)
+			}
+		}
+		if len(invalid) > 0 {
+			debug("Choices don't belong to poll", "choice_ids", invalid)
+			return errInvalidChoice.WithDetails("invalid_choice_ids", invalid)
 		}
-		return false, false, err
-	}
-
-	return false, true, nil
-}
-
-// Deletes the specified poll. Returns true if sucessfull.
-func (q *queryHandler) deletePoll(
-	ctx context.Context,
-	id string) (bool, error) {
 
-	res, err := q._db.ExecContext(ctx, "DELETE FROM poll WHERE id=?", id)
-	if err != nil {
-		return false, err
-	}
+		// insert votes
+		debug("Inserting votes")
+		if anonymous {
+			ballot := util.GenerateID()
+			user = ""
+			stmt_insert_vote, err := conn.PrepareContext(ctx, STMT_INSERT_ANONYMOUS_VOTE)
+			if err != nil {
+				return err
+			}
+			defer stmt_insert_vote.Close()
+			for _, choice := range votes {
+				if _, err := stmt_insert_vote.ExecContext(ctx, choice, ballot, poll); err != nil {
+					return err
+				}
+			}
+		} else {
+			stmt_insert_vote, err := conn.PrepareContext(ctx, STMT_INSERT_VOTE)
+			if err != nil {
+				return err
+			}
+			defer stmt_insert_vote.Close()
+			for _, choice := range votes {
+				if _, err := stmt_insert_vote.ExecContext(ctx, poll, choice, user); err != nil {
+					return err
+				}
+			}
+		}
 
-	changes, err := res.RowsAffected()
-	if err != nil {
-		return false, err
-	}
+		// increase votes in poll table
+		debug("Increasing poll votes")
+		if _, err := conn.ExecContext(ctx, STMT_UPDATE_POLL, poll); err != nil {
+			return err
+		}
+		cast = cast_votes + 1
 
-	if changes == 0 {
-		return false, nil
-	}
-	return true, nil
+		if queue != nil {
+			if err := queue(ctx, conn, user, cast); err != nil {
+				return err
+			}
+		}
+		debug("Commiting changes")
+		return nil
+	})
+	return user, cast, err
 }
 
 // Returns all available choices for a specified poll. Maps choice ids to textural representation.
@@ -195,6 +345,9 @@ func (q *queryHandler) getPollChoices(
 	ctx context.Context,
 	id string) (map[int]string, error) {
 
+	ctx, end := q.trace(ctx, "get_poll_choices", id)
+	defer end()
+
 	var cid int
 	var content string
 
@@ -219,6 +372,9 @@ func (q *queryHandler) getPollVotes(
 	ctx context.Context,
 	id string) (map[int]uint, error) {
 
+	ctx, end := q.trace(ctx, "get_poll_votes", id)
+	defer end()
+
 	choices, err := q.getPollChoices(ctx, id)
 	if err != nil {
 		return nil, err
@@ -237,38 +393,164 @@ func (q *queryHandler) getPollVotes(
 	return total_votes, nil
 }
 
+// Returns the invites of a poll in order of creation.
+func (q *queryHandler) getInvites(
+	ctx context.Context,
+	id string) ([]inviteRow, error) {
+
+	ctx, end := q.trace(ctx, "get_invites", id)
+	defer end()
+
+	rows, err := q._db.QueryContext(ctx, "SELECT name, token_hash FROM invite WHERE poll_id=? ORDER BY id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := make([]inviteRow, 0)
+	for rows.Next() {
+		var invite inviteRow
+		if err := rows.Scan(&invite.name, &invite.token_hash); err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+	return invites, rows.Err()
+}
+
+// Checks if a user voted in a poll.
+func (q *queryHandler) hasVoted(
+	ctx context.Context,
+	id string,
+	user string) (bool, error) {
+
+	ctx, end := q.trace(ctx, "has_voted", id)
+	defer end()
+
+	const STMT = "SELECT EXISTS(SELECT 1 FROM vote WHERE poll_id=? AND user=?)"
+	var voted bool
+	if err := q._db.QueryRowContext(ctx, STMT, id, user).Scan(&voted); err != nil {
+		return false, err
+	}
+	return voted, nil
+}
+
+// Checks if a voter hash was recorded for an anonymous poll.
+func (q *queryHandler) voterExists(
+	ctx context.Context,
+	id string,
+	voter_hash string) (bool, error) {
+
+	ctx, end := q.trace(ctx, "voter_exists", id)
+	defer end()
+
+	const STMT = "SELECT EXISTS(SELECT 1 FROM voter WHERE poll_id=? AND voter_hash=?)"
+	var voted bool
+	if err := q._db.QueryRowContext(ctx, STMT, id, voter_hash).Scan(&voted); err != nil {
+		return false, err
+	}
+	return voted, nil
+}
+
+// Checks if the invite with the token hash was used to vote in a poll.
+func (q *queryHandler) inviteUsed(
+	ctx context.Context,
+	id string,
+	token_hash string) (bool, error) {
+
+	ctx, end := q.trace(ctx, "invite_used", id)
+	defer end()
+
+	const STMT = "SELECT EXISTS(SELECT 1 FROM invite WHERE poll_id=? AND token_hash=? AND used)"
+	var used bool
+	if err := q._db.QueryRowContext(ctx, STMT, id, token_hash).Scan(&used); err != nil {
+		return false, err
+	}
+	return used, nil
+}
+
+// Returns invitees of a poll and when they voted in order of creation.
+func (q *queryHandler) getInviteStatus(
+	ctx context.Context,
+	id string) ([]messages.InviteStatus, error) {
+
+	ctx, end := q.trace(ctx, "get_invite_status", id)
+	defer end()
+
+	rows, err := q._db.QueryContext(ctx, "SELECT name, used, used_at FROM invite WHERE poll_id=? ORDER BY id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := make([]messages.InviteStatus, 0)
+	for rows.Next() {
+		var invite messages.InviteStatus
+		var used_at sql.NullTime
+		if err := rows.Scan(&invite.Name, &invite.Voted, &used_at); err != nil {
+			return nil, err
+		}
+		if used_at.Valid {
+			invite.VotedAt = &used_at.Time
+		}
+		invites = append(invites, invite)
+	}
+	return invites, rows.Err()
+}
+
 type pollData struct {
 	title        string
 	poll_type    messages.PollType
 	cast_votes   uint
 	target_votes uint
 	auto_create  bool
+	closed       bool
+	identity     messages.Identity
+	visibility   messages.Visibility
+	anonymous    bool
+	voter_salt   string
+	invite_only  bool
+	owner_hash   string
+	created_at   time.Time
 }
 
-// Returns most row values from the poll table.
+// Returns most row values from the poll table. Deleted polls aren't found.
 func (q *queryHandler) getPollData(
 	ctx context.Context,
 	id string) (pollData, error) {
 
-	const STMT = "SELECT title, poll_type, cast_votes, target_votes, auto_create FROM poll WHERE id=?"
-	var poll_type string
+	ctx, end := q.trace(ctx, "get_poll_data", id)
+	defer end()
+
+	const STMT = `SELECT title, poll_type, cast_votes, target_votes, auto_create, closed, identity, visibility, anonymous, voter_salt,
+		invite_only, owner_hash, created_at FROM poll WHERE id=? AND deleted_at IS NULL`
+	var poll_type, identity, visibility string
 	var auto_create bool
 	data := new(pollData)
 	if err := q._db.QueryRowContext(ctx, STMT, id).
-		Scan(&data.title, &poll_type, &data.cast_votes, &data.target_votes, &auto_create); err != nil {
+		Scan(&data.title, &poll_type, &data.cast_votes, &data.target_votes, &auto_create, &data.closed, &identity, &visibility,
+			&data.anonymous, &data.voter_salt, &data.invite_only, &data.owner_hash, &data.created_at); err != nil {
 		return pollData{}, err
 	}
 
 	data.poll_type = messages.PollType(poll_type)
+	data.auto_create = auto_create
+	data.identity = messages.Identity(identity)
+	data.visibility = messages.Visibility(visibility)
 	return *data, nil
 }
 
-// Returns next poll if it exists. Returns an empty string and false if no next poll exists
+// Returns next poll if it exists. Returns an empty string and false if no next poll exists.
+// Deleted polls split their chain, they are neither next nor previous poll.
 func (q *queryHandler) getNextPoll(
 	ctx context.Context,
 	id string) (string, bool, error) {
 
-	const STMT = "SELECT next_poll FROM next_poll WHERE poll_id=?"
+	ctx, end := q.trace(ctx, "get_next_poll", id)
+	defer end()
+
+	const STMT = `SELECT next_poll.next_poll FROM next_poll JOIN poll ON poll.id = next_poll.next_poll
+		WHERE next_poll.poll_id=? AND poll.deleted_at IS NULL`
 	var next_poll string
 	if err := q._db.QueryRowContext(ctx, STMT, id).Scan(&next_poll); err != nil {
 		if err == sql.ErrNoRows {
@@ -279,10 +561,33 @@ func (q *queryHandler) getNextPoll(
 	return next_poll, true, nil
 }
 
+// Returns previous poll if it exists. Returns an empty string and false if no previous poll exists
+func (q *queryHandler) getPrevPoll(
+	ctx context.Context,
+	id string) (string, bool, error) {
+
+	ctx, end := q.trace(ctx, "get_prev_poll", id)
+	defer end()
+
+	const STMT = `SELECT next_poll.poll_id FROM next_poll JOIN poll ON poll.id = next_poll.poll_id
+		WHERE next_poll.next_poll=? AND poll.deleted_at IS NULL`
+	var prev_poll string
+	if err := q._db.QueryRowContext(ctx, STMT, id).Scan(&prev_poll); err != nil {
+		if err == sql.ErrNoRows {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return prev_poll, true, nil
+}
+
 func (q *queryHandler) getLatestPoll(
 	ctx context.Context,
 	id string) (string, bool, error) {
 
+	ctx, end := q.trace(ctx, "get_latest_poll", id)
+	defer end()
+
 	next_poll, exists, err := q.getNextPoll(ctx, id)
 	if err != nil {
 		return "", false, err
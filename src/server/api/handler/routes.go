@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/AdrianPrawda/movie-poll/www"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
+)
+
+// Optional parts of the api registered by Routes.
+type RouteConfig struct {
+	AdminToken string                      // admin API is disabled without token
+	CORS       *middleware.CORSConfig      // cross-origin requests are refused if nil
+	RateLimit  middleware.RateLimiterStore // requests aren't limited if nil
+	Metrics    http.Handler                // served as /metrics unless nil
+}
+
+// Registers the middlewares and routes of the api and its web client. Identity, webhooks
+// and backups are configured on the handler before or after.
+func (h *Handler) Routes(e *echo.Echo, cfg RouteConfig) {
+	e.HTTPErrorHandler = h.HTTPErrorHandler
+	e.Use(otelecho.Middleware("moviepoll-api", otelecho.WithSkipper(h.TraceSkipper)))
+	e.Use(h.metrics.Middleware)
+	e.Use(h.RequestLogger)
+	// preflight requests are answered before readiness, rate limit and admin token checks
+	if cfg.CORS != nil {
+		e.Use(middleware.CORSWithConfig(*cfg.CORS))
+	}
+	e.Use(h.RequireReady)
+	if cfg.RateLimit != nil {
+		e.Use(middleware.RateLimiter(cfg.RateLimit))
+	}
+	e.Use(h.Identify)
+
+	e.POST("/api/poll/v1/create", h.CreatePoll)
+	e.GET("/api/poll/v1/data", h.GetPollData)
+	e.GET("/api/poll/v1/data/:poll_id", h.GetPollData)
+	e.DELETE("/api/poll/v1/delete", h.DeletePoll)
+	e.POST("/api/poll/v1/vote", h.VotePoll)
+	e.GET("/api/poll/v1/status", h.GetPollStatus)
+	e.GET("/api/poll/v1/status/:poll_id", h.GetPollStatus)
+	e.GET("/api/poll/v1/export", h.ExportPoll)
+	e.POST("/api/heartbeat", h.Heartbeat)
+	e.GET("/api/cache/stats", h.CacheStats)
+	e.GET("/healthz", h.Healthz)
+	e.GET("/readyz", h.Readyz)
+	if cfg.Metrics != nil {
+		e.GET("/metrics", echo.WrapHandler(cfg.Metrics))
+	}
+
+	// web client, its client side routes are answered with the single page
+	e.FileFS("/", "index.html", www.Public)
+	e.FileFS("/polls/*", "index.html", www.Public)
+	e.StaticFS("/static/", www.Static)
+
+	// owner routes are authorized by the owner token as bearer token, see ownerToken
+	v2 := e.Group("/api/v2")
+	v2.POST("/polls", h.CreatePollV2)
+	v2.GET("/polls/:poll_id", h.GetPollV2)
+	v2.DELETE("/polls/:poll_id", h.DeletePollV2)
+	v2.POST("/polls/:poll_id/restore", h.RestorePollV2)
+	v2.POST("/polls/:poll_id/votes", h.VotePollV2)
+	v2.GET("/polls/:poll_id/results", h.GetPollResultsV2)
+	v2.GET("/polls/:poll_id/chain", h.GetPollChainV2)
+	v2.GET("/polls/:poll_id/invites", h.GetPollInvitesV2)
+	v2.POST("/polls/:poll_id/webhooks", h.AddWebhookV2)
+	v2.GET("/polls/:poll_id/webhooks", h.ListWebhooksV2)
+	v2.DELETE("/polls/:poll_id/webhooks/:webhook_id", h.RemoveWebhookV2)
+	v2.GET("/polls/:poll_id/webhooks/:webhook_id/deliveries", h.GetWebhookDeliveriesV2)
+
+	if cfg.AdminToken == "" {
+		return
+	}
+	admin := e.Group("/api/admin/v1", h.RequireAdminToken(cfg.AdminToken))
+	admin.GET("/polls", h.AdminListPolls)
+	admin.GET("/polls/:poll_id", h.AdminGetPoll)
+	admin.POST("/polls/:poll_id/close", h.AdminClosePoll)
+	admin.POST("/polls/:poll_id/reopen", h.AdminReopenPoll)
+	admin.DELETE("/chains/:poll_id", h.AdminDeleteChain)
+	admin.POST("/purge", h.AdminPurge)
+	admin.POST("/recount", h.AdminRecount)
+	admin.GET("/export", h.AdminExport)
+	admin.POST("/import", h.AdminImport)
+	admin.GET("/backups", h.AdminListBackups)
+	admin.POST("/backups", h.AdminBackup)
+	admin.GET("/backups/:name", h.AdminDownloadBackup)
+	admin.POST("/restore", h.AdminRestore)
+	admin.GET("/audit", h.AdminAudit)
+}
@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+func TestRoutes(t *testing.T) {
+	s := newTestServer(t)
+	expectStatus(t, s.request(http.MethodGet, "/", nil), http.StatusOK)
+	expectStatus(t, s.request(http.MethodGet, "/polls/abc", nil), http.StatusOK)
+	expectStatus(t, s.request(http.MethodGet, "/api/admin/v1/polls", nil, bearer(TEST_ADMIN_TOKEN)...), http.StatusOK)
+	expectStatus(t, s.request(http.MethodGet, "/metrics", nil), http.StatusNotFound)
+
+	// the admin API isn't routed without token
+	e := echo.New()
+	s.h.Routes(e, RouteConfig{CORS: &middleware.CORSConfig{AllowOrigins: []string{"http://localhost:35556"}}})
+	s.e = e
+	expectError(t, s.request(http.MethodGet, "/api/admin/v1/polls", nil), http.StatusNotFound, messages.NOT_FOUND)
+
+	// preflights are answered before readiness checks
+	s.h.SetReady(false)
+	req := httptest.NewRequest(http.MethodOptions, "/api/v2/polls", nil)
+	req.Header.Set(echo.HeaderOrigin, "http://localhost:35556")
+	req.Header.Set(echo.HeaderAccessControlRequestMethod, http.MethodPost)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent || !strings.Contains(rec.Header().Get(echo.HeaderAccessControlAllowOrigin), "localhost") {
+		t.Errorf("preflight answered with %d %v", rec.Code, rec.Header())
+	}
+	expectStatus(t, s.request(http.MethodGet, "/api/v2/polls/unknown", nil), http.StatusServiceUnavailable)
+}
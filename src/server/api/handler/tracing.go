@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/AdrianPrawda/movie-poll/api/handler")
+
+// Starts a span for a database query and observes its duration. The returned function ends both.
+func (q *queryHandler) trace(ctx context.Context, query string, poll_id string) (context.Context, func()) {
+	observe := q._metrics.ObserveQuery(query)
+	ctx, span := tracer.Start(ctx, "db."+query,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemSqlite,
+			semconv.DBOperation(query),
+			attribute.String("poll_id", poll_id),
+		))
+	return ctx, func() {
+		span.End()
+		observe()
+	}
+}
+
+// Records a failed operation on the span.
+func recordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
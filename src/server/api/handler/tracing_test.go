@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	spansOnce sync.Once
+	spans     *tracetest.SpanRecorder
+)
+
+// Records the spans of all tests. The global tracer provider is installed once, tracers
+// created before keep delegating to the first provider.
+func recordSpans() *tracetest.SpanRecorder {
+	spansOnce.Do(func() {
+		spans = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	return spans
+}
+
+// Returns the value of a span attribute.
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestTracing(t *testing.T) {
+	recorder := recordSpans()
+	s := newTestServer(t)
+	e := s.e
+
+	poll := s.createPoll(messages.CreatePollReq{})
+	choices := s.choices(poll.PollID)
+	const TRACE_ID = "0af7651916cd43dd8448eb211c80319c"
+	body, err := json.Marshal(messages.CastVotesReq{UserID: "alice", Votes: choices[:1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/v2/polls/"+poll.PollID+"/votes", bytes.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("traceparent", "00-"+TRACE_ID+"-b7ad6b7169203331-01")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	expectStatus(t, rec, http.StatusNoContent)
+	// probes aren't traced
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	names := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() == TRACE_ID {
+			names[span.Name()] = span
+		}
+		if span.Name() == "/healthz" {
+			t.Error("probe was traced")
+		}
+	}
+
+	request, ok := names["/api/v2/polls/:poll_id/votes"]
+	if !ok {
+		t.Fatalf("request span missing, got %v", names)
+	}
+	if id, _ := spanAttribute(request, "poll_id"); id.AsString() != poll.PollID {
+		t.Errorf("request span with poll id %q", id.AsString())
+	}
+	insert, ok := names["inserting votes"]
+	if !ok {
+		t.Fatalf("transaction span missing, got %v", names)
+	}
+	if attempts, _ := spanAttribute(insert, "retry.attempts"); attempts.AsInt64() != 1 {
+		t.Errorf("transaction span with %d attempts", attempts.AsInt64())
+	}
+	if insert.Parent().SpanID() != request.SpanContext().SpanID() {
+		t.Error("transaction span isn't a child of the request span")
+	}
+
+	var queries int
+	for name, span := range names {
+		if strings.HasPrefix(name, "db.") {
+			queries++
+			if id, _ := spanAttribute(span, "poll_id"); id.AsString() != poll.PollID {
+				t.Errorf("query span %s with poll id %q", name, id.AsString())
+			}
+		}
+	}
+	if queries == 0 {
+		t.Errorf("no query spans, got %v", names)
+	}
+}
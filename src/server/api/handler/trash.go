@@ -0,0 +1,288 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Deleting a poll only sets its deleted_at column. Deleted polls are hidden from every read,
+// keep their choices, ballots and chain links and can be restored until they are purged
+// once the trash retention expired.
+
+// Checks the scope of deleting or restoring a poll. Empty scopes default to the poll.
+func validateScope(scope messages.DeleteScope) (messages.DeleteScope, error) {
+	switch scope {
+	case "", messages.SCOPE_POLL:
+		return messages.SCOPE_POLL, nil
+	case messages.SCOPE_CHAIN:
+		return scope, nil
+	default:
+		return "", errMalformedRequest.WithDetails("reason", "unknown scope "+string(scope))
+	}
+}
+
+// Restores a deleted poll or all deleted polls of its chain, including polls linked through
+// deleted polls. Restored polls rejoin their chain unless their predecessor got a new successor.
+func (h *Handler) restorePoll(ctx context.Context, id string, scope messages.DeleteScope, owner_token *string) (messages.RestorePollResp, error) {
+	log := h.logger(ctx).With("poll_id", id)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("poll_id", id))
+	log.Debug("Restoring poll")
+
+	scope, err := validateScope(scope)
+	if err != nil {
+		return messages.RestorePollResp{}, err
+	}
+	deleted, err := h.queries.pollDeleted(ctx, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.Warn("Can't restore poll, poll not found")
+			return messages.RestorePollResp{}, errPollNotFound
+		}
+		return messages.RestorePollResp{}, err
+	}
+	polls := []string{id}
+	if scope == messages.SCOPE_CHAIN {
+		if polls, err = h.queries.getDeletedChain(ctx, id); err != nil {
+			return messages.RestorePollResp{}, err
+		}
+	}
+	if len(polls) == 0 || scope == messages.SCOPE_POLL && !deleted {
+		log.Warn("Can't restore poll, poll not deleted", "scope", scope)
+		return messages.RestorePollResp{}, errPollNotDeleted
+	}
+	if err := h.authorizeOwnerOf(ctx, polls, owner_token); err != nil {
+		return messages.RestorePollResp{}, err
+	}
+
+	var restored []string
+	err = h.retry(ctx, "restoring polls", func(ctx context.Context) error {
+		var err error
+		restored, err = h.queries.restorePolls(ctx, polls)
+		return err
+	})
+	if err != nil {
+		return messages.RestorePollResp{}, err
+	}
+	// restored polls rejoin their chains
+	h.cache.purge()
+	for _, poll := range restored {
+		h.audit(ctx, messages.AUDIT_UNDELETE, poll, map[string]any{"scope": scope, "requested": id})
+	}
+	log.Info("Polls restored", "scope", scope, "polls", len(restored))
+	return messages.RestorePollResp{Restored: restored}, nil
+}
+
+// Checks that the owner token owns all polls, deleted or not. Nil tokens skip the check, v1
+// clients delete polls without owner token.
+func (h *Handler) authorizeOwnerOf(ctx context.Context, polls []string, owner_token *string) error {
+	if owner_token == nil {
+		return nil
+	}
+	for _, poll := range polls {
+		owner_hash, err := h.queries.getOwnerHash(ctx, poll)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return errPollNotFound
+			}
+			return err
+		}
+		if !ownerTokenValid(owner_hash, *owner_token) {
+			h.logger(ctx).Warn("Invalid owner token", "poll_id", poll)
+			return errOwnerUnauthorized
+		}
+	}
+	return nil
+}
+
+// Purges polls deleted longer than retention ago every interval until ctx is done.
+func (h *Handler) ScheduleTrashPurge(ctx context.Context, retention time.Duration, interval time.Duration) {
+	log := h.log.With("retention", retention)
+	log.Info("Scheduling purges of deleted polls", "interval", interval)
+	ctx = ContextWithActor(ctx, AUDIT_ACTOR_SYSTEM)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var purged []string
+		err := h.retry(ctx, "purging deleted polls", func(ctx context.Context) error {
+			var err error
+			purged, err = h.queries.purgeDeleted(ctx, time.Now().Add(-retention))
+			return err
+		})
+		if err != nil {
+			log.Error("Couldn't purge deleted polls", "error", err)
+		} else if len(purged) > 0 {
+			for _, poll := range purged {
+				h.audit(ctx, messages.AUDIT_EXPIRE, poll, map[string]any{"retention": retention.String()})
+			}
+			log.Info("Purged deleted polls", "polls", len(purged))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Marks the specified polls as deleted in a single transaction. queue runs inside the transaction
+// with the deleted polls, e.g. to queue webhook deliveries. Returns the polls which weren't
+// deleted before.
+func (q *queryHandler) trashPolls(
+	ctx context.Context,
+	ids []string,
+	queue func(ctx context.Context, conn *sql.Conn, deleted []string) error) ([]string, error) {
+
+	ctx, end := q.trace(ctx, "trash_polls", "")
+	defer end()
+
+	return q.setDeleted(ctx, ids, "UPDATE poll SET deleted_at = current_timestamp WHERE id=? AND deleted_at IS NULL", queue)
+}
+
+// Clears the deleted mark of the specified polls in a single transaction. Returns the polls
+// which were deleted before.
+func (q *queryHandler) restorePolls(
+	ctx context.Context,
+	ids []string) ([]string, error) {
+
+	ctx, end := q.trace(ctx, "restore_polls", "")
+	defer end()
+
+	return q.setDeleted(ctx, ids, "UPDATE poll SET deleted_at = NULL WHERE id=? AND deleted_at IS NOT NULL", nil)
+}
+
+func (q *queryHandler) setDeleted(
+	ctx context.Context,
+	ids []string,
+	stmt string,
+	queue func(ctx context.Context, conn *sql.Conn, changed []string) error) ([]string, error) {
+
+	changed := make([]string, 0, len(ids))
+	err := q.immediateTx(ctx, func(conn *sql.Conn) error {
+		changed = changed[:0]
+		for _, id := range ids {
+			res, err := conn.ExecContext(ctx, stmt, id)
+			if err != nil {
+				return err
+			}
+			changes, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if changes != 0 {
+				changed = append(changed, id)
+			}
+		}
+		if queue != nil {
+			return queue(ctx, conn, changed)
+		}
+		return nil
+	})
+	return changed, err
+}
+
+// Returns if a poll is deleted. Returns sql.ErrNoRows if the poll doesn't exist or was purged.
+func (q *queryHandler) pollDeleted(
+	ctx context.Context,
+	id string) (bool, error) {
+
+	ctx, end := q.trace(ctx, "poll_deleted", id)
+	defer end()
+
+	var deleted bool
+	err := q._db.QueryRowContext(ctx, "SELECT deleted_at IS NOT NULL FROM poll WHERE id=?", id).Scan(&deleted)
+	return deleted, err
+}
+
+// Returns the owner hash of a poll, deleted or not. Returns sql.ErrNoRows if the poll doesn't
+// exist or was purged.
+func (q *queryHandler) getOwnerHash(
+	ctx context.Context,
+	id string) (string, error) {
+
+	ctx, end := q.trace(ctx, "get_owner_hash", id)
+	defer end()
+
+	var owner_hash string
+	err := q._db.QueryRowContext(ctx, "SELECT owner_hash FROM poll WHERE id=?", id).Scan(&owner_hash)
+	return owner_hash, err
+}
+
+// Returns the deleted polls of the chain the poll belongs to, following links through
+// deleted polls, oldest first.
+func (q *queryHandler) getDeletedChain(
+	ctx context.Context,
+	id string) ([]string, error) {
+
+	ctx, end := q.trace(ctx, "get_deleted_chain", id)
+	defer end()
+
+	const STMT = `WITH RECURSIVE
+		prev(id) AS (SELECT ? UNION SELECT next_poll.poll_id FROM next_poll JOIN prev ON next_poll.next_poll = prev.id),
+		next(id) AS (SELECT ? UNION SELECT next_poll.next_poll FROM next_poll JOIN next ON next_poll.poll_id = next.id)
+		SELECT id FROM poll WHERE deleted_at IS NOT NULL AND (id IN prev OR id IN next) ORDER BY created_at, rowid`
+	rows, err := q._db.QueryContext(ctx, STMT, id, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	polls := make([]string, 0)
+	for rows.Next() {
+		var poll string
+		if err := rows.Scan(&poll); err != nil {
+			return nil, err
+		}
+		polls = append(polls, poll)
+	}
+	return polls, rows.Err()
+}
+
+// Deletes polls marked as deleted before cutoff, including their choices, ballots and links.
+func (q *queryHandler) purgeDeleted(
+	ctx context.Context,
+	cutoff time.Time) ([]string, error) {
+
+	ctx, end := q.trace(ctx, "purge_deleted", "")
+	defer end()
+
+	const (
+		STMT_SELECT = "SELECT id FROM poll WHERE deleted_at < ? ORDER BY deleted_at, rowid"
+		STMT_DELETE = "DELETE FROM poll WHERE id=?"
+	)
+
+	purged := make([]string, 0)
+	err := q.immediateTx(ctx, func(conn *sql.Conn) error {
+		purged = purged[:0]
+		rows, err := conn.QueryContext(ctx, STMT_SELECT, cutoff.UTC().Format(sqliteTime))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			purged = append(purged, id)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		for _, id := range purged {
+			if _, err := conn.ExecContext(ctx, STMT_DELETE, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return purged, err
+}
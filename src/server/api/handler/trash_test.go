@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/labstack/echo/v4"
+)
+
+// Restores a poll through the v2 API.
+func (s *testServer) restore(id string, req messages.RestorePollReq, token string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	return s.request(http.MethodPost, "/api/v2/polls/"+id+"/restore", req, bearer(token)...)
+}
+
+// Fails the test unless the response challenges the client for an owner token.
+func expectOwnerChallenge(t *testing.T, rec *httptest.ResponseRecorder) {
+	t.Helper()
+	expectError(t, rec, http.StatusUnauthorized, messages.UNAUTHORIZED)
+	if challenge := rec.Header().Get(echo.HeaderWWWAuthenticate); challenge != "Bearer" {
+		t.Errorf("unexpected challenge %q", challenge)
+	}
+}
+
+func TestDeleteAndRestoreNeedOwnerToken(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{})
+	other := s.createPoll(messages.CreatePollReq{})
+
+	expectOwnerChallenge(t, s.request(http.MethodDelete, "/api/v2/polls/"+poll.PollID, nil))
+	expectOwnerChallenge(t, s.request(http.MethodDelete, "/api/v2/polls/"+poll.PollID, nil, bearer(other.OwnerToken)...))
+	s.poll(poll.PollID)
+	expectError(t, s.request(http.MethodDelete, "/api/v2/polls/unknown", nil, bearer(poll.OwnerToken)...),
+		http.StatusNotFound, messages.POLL_NOT_FOUND)
+	expectStatus(t, s.request(http.MethodDelete, "/api/v2/polls/"+poll.PollID, nil, bearer(poll.OwnerToken)...), http.StatusNoContent)
+
+	expectOwnerChallenge(t, s.request(http.MethodPost, "/api/v2/polls/"+poll.PollID+"/restore", nil))
+	expectOwnerChallenge(t, s.restore(poll.PollID, messages.RestorePollReq{}, other.OwnerToken))
+	expectError(t, s.request(http.MethodGet, "/api/v2/polls/"+poll.PollID, nil), http.StatusNotFound, messages.POLL_NOT_FOUND)
+	restored := decode[messages.RestorePollResp](t, s.restore(poll.PollID, messages.RestorePollReq{}, poll.OwnerToken), http.StatusOK)
+	if !reflect.DeepEqual(restored.Restored, []string{poll.PollID}) {
+		t.Errorf("unexpected restored polls %v", restored.Restored)
+	}
+	expectError(t, s.restore(poll.PollID, messages.RestorePollReq{}, poll.OwnerToken), http.StatusConflict, messages.POLL_NOT_DELETED)
+	s.poll(poll.PollID)
+
+	// v1 clients never had owner tokens
+	expectStatus(t, s.request(http.MethodDelete, "/api/poll/v1/delete?poll_id="+poll.PollID, nil), http.StatusOK)
+	expectError(t, s.request(http.MethodGet, "/api/v2/polls/"+poll.PollID, nil), http.StatusNotFound, messages.POLL_NOT_FOUND)
+}
+
+func TestChainScopeNeedsOwnerOfEveryPoll(t *testing.T) {
+	s := newTestServer(t)
+	first := s.createPoll(messages.CreatePollReq{TargetVotes: 1, AutoCreate: true})
+	expectStatus(t, s.vote(first.PollID, messages.CastVotesReq{UserID: "alice", Votes: s.choices(first.PollID)[:1]}), http.StatusNoContent)
+	second := s.poll(first.PollID).NextPoll
+	third := s.createPoll(messages.CreatePollReq{PrevPollID: second})
+
+	// successors created by a concluding vote belong to the owner of the poll
+	expectOwnerChallenge(t, s.request(http.MethodDelete, "/api/v2/polls/"+first.PollID+"?scope=chain", nil, bearer(first.OwnerToken)...))
+	expectOwnerChallenge(t, s.request(http.MethodDelete, "/api/v2/polls/"+third.PollID+"?scope=chain", nil, bearer(third.OwnerToken)...))
+	chain := decode[messages.PollChainResp](t, s.request(http.MethodGet, "/api/v2/polls/"+first.PollID+"/chain", nil), http.StatusOK)
+	if !reflect.DeepEqual(chain.Polls, []string{first.PollID, second, third.PollID}) {
+		t.Fatalf("unexpected chain %v", chain.Polls)
+	}
+
+	expectStatus(t, s.request(http.MethodDelete, "/api/v2/polls/"+third.PollID, nil, bearer(third.OwnerToken)...), http.StatusNoContent)
+	expectStatus(t, s.request(http.MethodDelete, "/api/v2/polls/"+first.PollID+"?scope=chain", nil, bearer(first.OwnerToken)...),
+		http.StatusNoContent)
+	for _, id := range []string{first.PollID, second, third.PollID} {
+		expectError(t, s.request(http.MethodGet, "/api/v2/polls/"+id, nil), http.StatusNotFound, messages.POLL_NOT_FOUND)
+	}
+
+	expectOwnerChallenge(t, s.restore(second, messages.RestorePollReq{Scope: messages.SCOPE_CHAIN}, first.OwnerToken))
+	restored := decode[messages.RestorePollResp](t, s.restore(third.PollID, messages.RestorePollReq{}, third.OwnerToken), http.StatusOK)
+	if !reflect.DeepEqual(restored.Restored, []string{third.PollID}) {
+		t.Errorf("unexpected restored polls %v", restored.Restored)
+	}
+	restored = decode[messages.RestorePollResp](t, s.restore(second, messages.RestorePollReq{Scope: messages.SCOPE_CHAIN}, first.OwnerToken), http.StatusOK)
+	if !reflect.DeepEqual(restored.Restored, []string{first.PollID, second}) {
+		t.Errorf("unexpected restored polls %v", restored.Restored)
+	}
+}
+
+func TestPurgedPollsCantBeRestored(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{})
+	kept := s.createPoll(messages.CreatePollReq{})
+	for _, p := range []messages.CreatePollResp{poll, kept} {
+		expectStatus(t, s.request(http.MethodDelete, "/api/v2/polls/"+p.PollID, nil, bearer(p.OwnerToken)...), http.StatusNoContent)
+	}
+	if _, err := s.db.Exec("UPDATE poll SET deleted_at = datetime('now', '-2 days') WHERE id=?", poll.PollID); err != nil {
+		t.Fatal(err)
+	}
+
+	// purges right away, then every interval
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.h.ScheduleTrashPurge(ctx, 24*time.Hour, time.Hour)
+		close(done)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var polls int
+		if err := s.db.QueryRow("SELECT COUNT(*) FROM poll WHERE id=?", poll.PollID).Scan(&polls); err != nil {
+			t.Fatal(err)
+		}
+		if polls == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("poll deleted longer than the retention wasn't purged")
+		}
+	}
+	cancel()
+	<-done
+
+	expectError(t, s.restore(poll.PollID, messages.RestorePollReq{}, poll.OwnerToken), http.StatusNotFound, messages.POLL_NOT_FOUND)
+	expectStatus(t, s.restore(kept.PollID, messages.RestorePollReq{}, kept.OwnerToken), http.StatusOK)
+}
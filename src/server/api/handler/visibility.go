@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+)
+
+// Tallies of polls that don't show live results are redacted until the poll concludes or
+// is closed. Redacted responses are cached separately from the full ones.
+
+// Checks the visibility of a new poll. Empty visibilities default to live.
+func validateVisibility(visibility messages.Visibility) (messages.Visibility, error) {
+	switch visibility {
+	case "":
+		return messages.RESULTS_LIVE, nil
+	case messages.RESULTS_LIVE, messages.RESULTS_VOTED, messages.RESULTS_CLOSED:
+		return visibility, nil
+	default:
+		return "", errMalformedRequest.WithDetails("reason", "unknown visibility "+string(visibility))
+	}
+}
+
+// Checks if tallies are shown to everyone, which is the case for live polls and polls that
+// concluded or were closed.
+func resultsPublic(data pollData) bool {
+	return data.visibility == messages.RESULTS_LIVE || data.closed || data.cast_votes >= data.target_votes
+}
+
+// Checks if tallies of a poll are hidden from the caller. Callers identify themselves like
+// voters, invite only polls require the invite token.
+func (h *Handler) resultsHidden(ctx context.Context, id string, visibility messages.Visibility, user_id string, token string) (bool, error) {
+	if visibility == messages.RESULTS_LIVE {
+		return false, nil
+	}
+	data, err := h.queries.getPollData(ctx, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, errPollNotFound
+		}
+		return false, err
+	}
+	if resultsPublic(data) {
+		return false, nil
+	}
+	if data.visibility != messages.RESULTS_VOTED {
+		return true, nil
+	}
+
+	if data.invite_only {
+		if token == "" {
+			return true, nil
+		}
+		used, err := h.queries.inviteUsed(ctx, id, hashToken(token))
+		return !used, err
+	}
+	user, err := voterID(ctx, data.identity, user_id)
+	if err != nil || user == "" {
+		// unidentified callers can't have voted
+		return true, nil
+	}
+	if data.anonymous {
+		if h.validateAnonymous(true) != nil {
+			return true, nil
+		}
+		voted, err := h.queries.voterExists(ctx, id, h.voterHash(data.voter_salt, user))
+		return !voted, err
+	}
+	voted, err := h.queries.hasVoted(ctx, id, user)
+	return !voted, err
+}
+
+// Returns poll data without tallies.
+func hidePollData(resp messages.GetPollDataResp) messages.GetPollDataResp {
+	resp.Votes = make(map[int]uint)
+	resp.Hidden = true
+	return resp
+}
+
+// Returns poll results without tallies and winners.
+func hidePollResults(resp messages.PollResultsResp) messages.PollResultsResp {
+	resp.Results = make([]messages.ChoiceResult, 0)
+	resp.Winners = make([]int, 0)
+	resp.Hidden = true
+	return resp
+}
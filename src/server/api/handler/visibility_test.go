@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+)
+
+// Returns the v2 results of a poll as seen by a caller identified by user id or invite token.
+func (s *testServer) resultsAs(poll_id string, user_id string, token string) (messages.PollResultsResp, *httptest.ResponseRecorder) {
+	s.t.Helper()
+	query := url.Values{}
+	if user_id != "" {
+		query.Set("user_id", user_id)
+	}
+	if token != "" {
+		query.Set("token", token)
+	}
+	rec := s.request(http.MethodGet, "/api/v2/polls/"+poll_id+"/results?"+query.Encode(), nil)
+	return decode[messages.PollResultsResp](s.t, rec, http.StatusOK), rec
+}
+
+// Returns the v1 poll data as seen by a caller identified by user id.
+func (s *testServer) dataAs(poll_id string, user_id string) messages.GetPollDataResp {
+	s.t.Helper()
+	rec := s.request(http.MethodGet, "/api/poll/v1/data/"+poll_id+"?user_id="+url.QueryEscape(user_id), nil)
+	return decode[messages.GetPollDataResp](s.t, rec, http.StatusOK)
+}
+
+// Fails the test unless the results are hidden, only the number of votes is shown.
+func expectHidden(t *testing.T, who string, resp messages.PollResultsResp, cast uint) {
+	t.Helper()
+	if !resp.Hidden || len(resp.Results) != 0 || len(resp.Winners) != 0 || resp.VotesCast != cast {
+		t.Errorf("results shown to %s: %+v", who, resp)
+	}
+}
+
+// Fails the test unless the results are shown.
+func expectShown(t *testing.T, who string, resp messages.PollResultsResp) {
+	t.Helper()
+	if resp.Hidden || len(resp.Results) == 0 {
+		t.Errorf("results hidden from %s: %+v", who, resp)
+	}
+}
+
+func TestVotedVisibility(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{Visibility: messages.RESULTS_VOTED})
+	choices := s.choices(poll.PollID)
+	if visibility := s.poll(poll.PollID).Visibility; visibility != messages.RESULTS_VOTED {
+		t.Fatalf("poll with visibility %q", visibility)
+	}
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: choices[:1]}), http.StatusNoContent)
+
+	shown, _ := s.resultsAs(poll.PollID, "alice", "")
+	expectShown(t, "voter", shown)
+	hidden, _ := s.resultsAs(poll.PollID, "bob", "")
+	expectHidden(t, "other user", hidden, 1)
+	hidden, _ = s.resultsAs(poll.PollID, "", "")
+	expectHidden(t, "anonymous caller", hidden, 1)
+
+	if data := s.dataAs(poll.PollID, "alice"); data.Hidden || data.Votes[choices[0]] != 1 {
+		t.Errorf("v1 data hidden from voter: %+v", data)
+	}
+	if data := s.dataAs(poll.PollID, "bob"); !data.Hidden || len(data.Votes) != 0 {
+		t.Errorf("v1 data shown to other user: %+v", data)
+	}
+	expectError(t, s.request(http.MethodGet, "/api/poll/v1/export?poll_id="+poll.PollID, nil), http.StatusForbidden, messages.RESULTS_HIDDEN)
+
+	// concluded polls show their results to everyone
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "bob", Votes: choices[1:]}), http.StatusNoContent)
+	shown, _ = s.resultsAs(poll.PollID, "", "")
+	expectShown(t, "anonymous caller of a concluded poll", shown)
+	s.export("poll_id=" + poll.PollID)
+}
+
+func TestClosedVisibility(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{Visibility: messages.RESULTS_CLOSED})
+	choices := s.choices(poll.PollID)
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: choices[:1]}), http.StatusNoContent)
+
+	// not even voters see results before the poll is closed
+	hidden, _ := s.resultsAs(poll.PollID, "alice", "")
+	expectHidden(t, "voter", hidden, 1)
+	if data := s.dataAs(poll.PollID, "alice"); !data.Hidden {
+		t.Errorf("v1 data shown to voter: %+v", data)
+	}
+	expectError(t, s.request(http.MethodGet, "/api/poll/v1/export?poll_id="+poll.PollID, nil), http.StatusForbidden, messages.RESULTS_HIDDEN)
+	// chain exports are refused as a whole
+	next := s.createPoll(messages.CreatePollReq{PrevPollID: poll.PollID})
+	expectError(t, s.request(http.MethodGet, "/api/poll/v1/export?poll_id="+next.PollID+"&chain=true", nil), http.StatusForbidden, messages.RESULTS_HIDDEN)
+
+	expectStatus(t, s.admin(http.MethodPost, "/polls/"+poll.PollID+"/close", nil), http.StatusNoContent)
+	shown, _ := s.resultsAs(poll.PollID, "", "")
+	expectShown(t, "anonymous caller of a closed poll", shown)
+	s.export("poll_id=" + next.PollID + "&chain=true")
+}
+
+func TestHiddenResultsAreCachedSeparately(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{Visibility: messages.RESULTS_VOTED, TargetVotes: 3})
+	choices := s.choices(poll.PollID)
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: choices[:1]}), http.StatusNoContent)
+
+	_, full := s.resultsAs(poll.PollID, "alice", "")
+	hidden, redacted := s.resultsAs(poll.PollID, "bob", "")
+	expectHidden(t, "other user", hidden, 1)
+	if full.Header().Get("ETag") == redacted.Header().Get("ETag") {
+		t.Error("full and hidden results share an ETag")
+	}
+	// the full response is still served to voters after the hidden one was cached
+	shown, _ := s.resultsAs(poll.PollID, "alice", "")
+	expectShown(t, "voter", shown)
+
+	// the hidden response is invalidated by votes
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "carol", Votes: choices[1:]}), http.StatusNoContent)
+	rec := s.request(http.MethodGet, "/api/v2/polls/"+poll.PollID+"/results?user_id=bob", nil, "If-None-Match", redacted.Header().Get("ETag"))
+	hidden = decode[messages.PollResultsResp](t, rec, http.StatusOK)
+	expectHidden(t, "other user", hidden, 2)
+}
+
+func TestVotedVisibilityOfInvitees(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{Visibility: messages.RESULTS_VOTED, Invitees: []string{"alice", "bob"}})
+	alice, bob := poll.Invites[0].Token, poll.Invites[1].Token
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{Token: alice, Votes: s.choices(poll.PollID)[:1]}), http.StatusNoContent)
+
+	shown, _ := s.resultsAs(poll.PollID, "", alice)
+	expectShown(t, "invitee who voted", shown)
+	for who, token := range map[string]string{"invitee who didn't vote": bob, "unknown token": "unknown"} {
+		hidden, _ := s.resultsAs(poll.PollID, "", token)
+		expectHidden(t, who, hidden, 1)
+	}
+	// invitees are identified by their token only
+	hidden, _ := s.resultsAs(poll.PollID, "alice", "")
+	expectHidden(t, "user id of an invitee", hidden, 1)
+}
+
+func TestVotedVisibilityOfAnonymousPolls(t *testing.T) {
+	s := newTestServer(t)
+	s.allowAnonymous()
+	poll := s.createPoll(messages.CreatePollReq{Visibility: messages.RESULTS_VOTED, Anonymous: true})
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: s.choices(poll.PollID)[:1]}), http.StatusNoContent)
+
+	shown, _ := s.resultsAs(poll.PollID, "alice", "")
+	expectShown(t, "anonymous voter", shown)
+	hidden, _ := s.resultsAs(poll.PollID, "bob", "")
+	expectHidden(t, "other user", hidden, 1)
+}
+
+func TestInvalidVisibility(t *testing.T) {
+	s := newTestServer(t)
+	req := messages.CreatePollReq{Type: messages.SINGLE, Title: "Movie night", Choices: []string{"Alien", "Heat"}, TargetVotes: 2, Visibility: "never"}
+	expectError(t, s.request(http.MethodPost, "/api/v2/polls", req), http.StatusBadRequest, messages.MALFORMED_REQUEST)
+	if visibility := s.poll(s.createPoll(messages.CreatePollReq{}).PollID).Visibility; visibility != messages.RESULTS_LIVE {
+		t.Errorf("visibility defaults to %q", visibility)
+	}
+}
@@ -0,0 +1,903 @@
+package handler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+	"github.com/AdrianPrawda/movie-poll/api/util"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Poll owners register webhooks receiving signed JSON payloads of poll events. Events are
+// queued in the webhook_delivery outbox by the transaction of their mutation, so they are
+// delivered if and only if it committed, and sent by DeliverWebhooks. Failed attempts are
+// retried with exponential backoff and logged in webhook_attempt. Deliveries are at least once
+// and unordered, receivers should deduplicate them by event id.
+//
+// Secrets sign payloads, so they are stored in plaintext rather than hashed like owner tokens.
+// Anyone reading the database file can forge deliveries of its webhooks, it has to be kept
+// as private as the server's own secrets. Backups don't contain secrets and exports don't
+// contain webhooks, restored webhooks get the secret of the replaced database back.
+
+// Upper bounds for webhooks of a single poll and their urls
+const (
+	MAX_WEBHOOKS           = 10
+	MAX_WEBHOOK_URL_LENGTH = 2048
+)
+
+// Default and upper bound for the number of listed deliveries
+const (
+	WEBHOOK_DEFAULT_LIMIT = 50
+	WEBHOOK_MAX_LIMIT     = 200
+)
+
+// Deliveries are sent in batches by a fixed number of workers
+const (
+	WEBHOOK_BATCH   = 50
+	WEBHOOK_WORKERS = 4
+)
+
+// Backoff between attempts of a delivery, starting at the configured backoff
+const (
+	WEBHOOK_BACKOFF_MULTIPLIER = 2
+	WEBHOOK_JITTER             = 0.2
+)
+
+// Interval of removing finished deliveries after the retention
+const WEBHOOK_CLEANUP_INTERVAL = time.Hour
+
+// Upper bounds for logged errors and read response bodies
+const (
+	MAX_WEBHOOK_ERROR_LENGTH = 512
+	MAX_WEBHOOK_RESPONSE     = 64 << 10
+)
+
+// Headers of deliveries. The signature is the hex encoded HMAC-SHA256 of "<timestamp>.<body>"
+// keyed with the secret of the webhook, receivers should reject old timestamps.
+const (
+	WEBHOOK_HEADER_EVENT     = "X-MoviePoll-Event"
+	WEBHOOK_HEADER_DELIVERY  = "X-MoviePoll-Delivery"
+	WEBHOOK_HEADER_TIMESTAMP = "X-MoviePoll-Timestamp"
+	WEBHOOK_HEADER_SIGNATURE = "X-MoviePoll-Signature" // sha256=<signature>
+	WEBHOOK_USER_AGENT       = "MoviePoll-Webhooks"
+)
+
+var webhookEvents = []messages.WebhookEvent{
+	messages.EVENT_VOTE_CAST,
+	messages.EVENT_CONCLUDED,
+	messages.EVENT_AUTO_CREATED,
+	messages.EVENT_POLL_DELETED,
+}
+
+// Webhook deliveries, webhooks are disabled if no interval is set.
+type WebhookConfig struct {
+	Interval     time.Duration // of checking for due deliveries
+	Timeout      time.Duration // of a single attempt
+	Attempts     int           // per delivery, including the first one
+	Backoff      time.Duration // wait after the first failed attempt
+	Retention    time.Duration // of finished deliveries, 0 keeps them
+	AllowPrivate bool          // deliver to loopback and private addresses
+}
+
+type webhookSender struct {
+	cfg    WebhookConfig
+	client *http.Client
+	wake   chan struct{} // signalled when deliveries were queued
+}
+
+// Enables webhooks, they are disabled by default.
+func (h *Handler) SetWebhooks(cfg WebhookConfig) {
+	h.webhooks.cfg = cfg
+	h.webhooks.client = newWebhookClient(cfg)
+}
+
+func (h *Handler) webhooksEnabled() bool {
+	return h.webhooks.cfg.Interval > 0
+}
+
+// Returns a client not following redirects. Unless private addresses are allowed, connections
+// are only established to public addresses, checked after resolving the host.
+func newWebhookClient(cfg WebhookConfig) *http.Client {
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	if !cfg.AllowPrivate {
+		dialer.Control = dialPublic
+	}
+	return &http.Client{
+		// no proxy, it would be dialed instead of the receiver
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: cfg.Timeout,
+			MaxIdleConnsPerHost: WEBHOOK_WORKERS,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func dialPublic(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("address %s is not public", host)
+	}
+	return nil
+}
+
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// Checks the url of a new webhook. Hosts are only resolved when delivering.
+func (h *Handler) validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || len(raw) > MAX_WEBHOOK_URL_LENGTH || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errMalformedRequest.WithDetails("reason",
+			fmt.Sprintf("webhook url must be an absolute http or https url of at most %d characters", MAX_WEBHOOK_URL_LENGTH))
+	}
+	if h.webhooks.cfg.AllowPrivate {
+		return nil
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); host == "localhost" || ip != nil && !publicIP(ip) {
+		return errMalformedRequest.WithDetails("reason", "webhook url must not point to a private address")
+	}
+	return nil
+}
+
+// Checks the events of a new webhook. Webhooks without events subscribe to all events.
+func validateWebhookEvents(events []messages.WebhookEvent) ([]messages.WebhookEvent, error) {
+	if util.HasDuplicates(events) {
+		return nil, errMalformedRequest.WithDetails("reason", "duplicate webhook events")
+	}
+	for _, event := range events {
+		known := false
+		for _, e := range webhookEvents {
+			known = known || e == event
+		}
+		if !known {
+			return nil, errMalformedRequest.WithDetails("reason", "unknown webhook event "+string(event))
+		}
+	}
+	if events == nil {
+		events = make([]messages.WebhookEvent, 0)
+	}
+	return events, nil
+}
+
+// Registers a webhook of a poll. Requires the owner token. The secret is only returned once.
+func (h *Handler) addWebhook(
+	ctx context.Context,
+	id string,
+	owner_token string,
+	req *messages.CreateWebhookReq) (messages.CreateWebhookResp, error) {
+
+	log := h.logger(ctx).With("poll_id", id)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("poll_id", id))
+	log.Debug("Adding webhook")
+
+	if !h.webhooksEnabled() {
+		return messages.CreateWebhookResp{}, errWebhooksDisabled
+	}
+	if err := h.authorizeOwner(ctx, id, owner_token); err != nil {
+		return messages.CreateWebhookResp{}, err
+	}
+	if err := h.validateWebhookURL(req.URL); err != nil {
+		log.Warn("Invalid request to add webhook", "error", err)
+		return messages.CreateWebhookResp{}, err
+	}
+	events, err := validateWebhookEvents(req.Events)
+	if err != nil {
+		log.Warn("Invalid request to add webhook", "error", err)
+		return messages.CreateWebhookResp{}, err
+	}
+
+	resp := messages.CreateWebhookResp{
+		Webhook: messages.Webhook{ID: util.GenerateID(), PollID: id, URL: req.URL, Events: events},
+		Secret:  util.GenerateID() + util.GenerateID(),
+	}
+	err = h.retry(ctx, "inserting webhook", func(ctx context.Context) error {
+		var err error
+		resp.CreatedAt, err = h.queries.insertWebhook(ctx, resp.Webhook, resp.Secret)
+		return err
+	})
+	if err != nil {
+		if err == errTooManyWebhooks {
+			log.Warn("Can't add webhook, poll has too many webhooks")
+		}
+		return messages.CreateWebhookResp{}, err
+	}
+
+	h.audit(ctx, messages.AUDIT_ADD_WEBHOOK, id, map[string]any{"webhook_id": resp.ID, "url": resp.URL, "events": events})
+	log.Info("Webhook added", "webhook_id", resp.ID, "events", events)
+	return resp, nil
+}
+
+// Returns the webhooks of a poll. Requires the owner token.
+func (h *Handler) listWebhooks(ctx context.Context, id string, owner_token string) (messages.ListWebhooksResp, error) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("poll_id", id))
+	h.logger(ctx).Debug("Listing webhooks", "poll_id", id)
+
+	if err := h.authorizeOwner(ctx, id, owner_token); err != nil {
+		return messages.ListWebhooksResp{}, err
+	}
+	webhooks, err := h.queries.getWebhooks(ctx, id)
+	if err != nil {
+		return messages.ListWebhooksResp{}, err
+	}
+	return messages.ListWebhooksResp{Webhooks: webhooks}, nil
+}
+
+// Removes a webhook of a poll including its deliveries. Requires the owner token.
+func (h *Handler) removeWebhook(ctx context.Context, id string, owner_token string, webhook_id string) error {
+	log := h.logger(ctx).With("poll_id", id, "webhook_id", webhook_id)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("poll_id", id))
+	log.Debug("Removing webhook")
+
+	if err := h.authorizeOwner(ctx, id, owner_token); err != nil {
+		return err
+	}
+	var removed bool
+	err := h.retry(ctx, "deleting webhook", func(ctx context.Context) error {
+		var err error
+		removed, err = h.queries.deleteWebhook(ctx, id, webhook_id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !removed {
+		log.Warn("Can't remove webhook, webhook not found")
+		return errWebhookNotFound
+	}
+
+	h.audit(ctx, messages.AUDIT_REMOVE_WEBHOOK, id, map[string]any{"webhook_id": webhook_id})
+	log.Info("Webhook removed")
+	return nil
+}
+
+// Returns the latest deliveries of a webhook with their attempts. Requires the owner token.
+func (h *Handler) webhookDeliveries(
+	ctx context.Context,
+	id string,
+	owner_token string,
+	webhook_id string,
+	limit int) (messages.WebhookDeliveriesResp, error) {
+
+	log := h.logger(ctx).With("poll_id", id, "webhook_id", webhook_id)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("poll_id", id))
+	log.Debug("Listing webhook deliveries")
+
+	switch {
+	case limit < 0 || limit > WEBHOOK_MAX_LIMIT:
+		return messages.WebhookDeliveriesResp{}, errMalformedRequest.WithDetails("reason",
+			fmt.Sprintf("limit must be between 0 and %d", WEBHOOK_MAX_LIMIT))
+	case limit == 0:
+		limit = WEBHOOK_DEFAULT_LIMIT
+	}
+	if err := h.authorizeOwner(ctx, id, owner_token); err != nil {
+		return messages.WebhookDeliveriesResp{}, err
+	}
+	if ok, err := h.queries.webhookExists(ctx, id, webhook_id); err != nil {
+		return messages.WebhookDeliveriesResp{}, err
+	} else if !ok {
+		log.Warn("Can't list deliveries, webhook not found")
+		return messages.WebhookDeliveriesResp{}, errWebhookNotFound
+	}
+
+	deliveries, err := h.queries.getDeliveries(ctx, webhook_id, limit)
+	if err != nil {
+		return messages.WebhookDeliveriesResp{}, err
+	}
+	return messages.WebhookDeliveriesResp{Deliveries: deliveries}, nil
+}
+
+// Webhook event caused by a mutation
+type webhookEvent struct {
+	event   messages.WebhookEvent
+	poll_id string
+	data    any
+}
+
+// Queues deliveries of events to all webhooks of their polls subscribed to them. Runs inside the
+// transaction of the mutation causing the events, the delivery workers are woken by wakeWebhooks
+// once it committed. Returns the number of queued deliveries.
+func (h *Handler) queueEvents(ctx context.Context, conn *sql.Conn, events ...webhookEvent) (int64, error) {
+	if !h.webhooksEnabled() {
+		return 0, nil
+	}
+
+	var queued int64
+	for _, event := range events {
+		// most polls have no webhooks, checking is cheaper than encoding payloads
+		ok, err := h.queries.hasWebhooks(ctx, conn, event.poll_id)
+		if err != nil {
+			return queued, err
+		}
+		if !ok {
+			continue
+		}
+		payload := messages.WebhookPayload{
+			ID:        util.GenerateID(),
+			Event:     event.event,
+			PollID:    event.poll_id,
+			CreatedAt: time.Now().UTC(),
+			Data:      event.data,
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return queued, err
+		}
+		n, err := h.queries.queueDeliveries(ctx, conn, event.poll_id, event.event, payload.ID, body)
+		if err != nil {
+			return queued, err
+		}
+		queued += n
+	}
+	return queued, nil
+}
+
+// Wakes the delivery workers once deliveries queued by a mutation were committed.
+func (h *Handler) wakeWebhooks(ctx context.Context, queued int64) {
+	if queued == 0 {
+		return
+	}
+	h.logger(ctx).Debug("Webhook deliveries queued", "deliveries", queued)
+	select {
+	case h.webhooks.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Returns the event of a poll concluded by the ballot inserted on conn, including its results.
+func (h *Handler) concludedEvent(ctx context.Context, conn *sql.Conn, id string, cast uint, target uint) (webhookEvent, error) {
+	choices, votes, err := h.queries.tallyVotes(ctx, conn, id)
+	if err != nil {
+		return webhookEvent{}, err
+	}
+	results, winner_ids := rankResults(choices, votes)
+	winners := make([]messages.ChoiceResult, 0, len(winner_ids))
+	for _, result := range results {
+		for _, winner := range winner_ids {
+			if result.ID == winner {
+				winners = append(winners, result)
+			}
+		}
+	}
+	return webhookEvent{messages.EVENT_CONCLUDED, id, map[string]any{
+		"votes_cast":     cast,
+		"votes_required": target,
+		"winners":        winners,
+		"results":        results,
+	}}, nil
+}
+
+// Delivers queued events until ctx is done. Checks for due deliveries every interval and
+// whenever events were queued, finished deliveries are removed once the retention expired.
+func (h *Handler) DeliverWebhooks(ctx context.Context) {
+	cfg := h.webhooks.cfg
+	log := h.log.With("interval", cfg.Interval)
+	log.Info("Delivering webhooks", "attempts", cfg.Attempts, "backoff", cfg.Backoff, "allow_private", cfg.AllowPrivate)
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	cleanup := time.NewTicker(WEBHOOK_CLEANUP_INTERVAL)
+	defer cleanup.Stop()
+	h.removeFinishedDeliveries(ctx)
+	for {
+		h.deliverDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-h.webhooks.wake:
+		case <-cleanup.C:
+			h.removeFinishedDeliveries(ctx)
+		}
+	}
+}
+
+// Sends all due deliveries, batch by batch.
+func (h *Handler) deliverDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		due, err := h.queries.getDueDeliveries(ctx, time.Now(), WEBHOOK_BATCH)
+		if err != nil {
+			if ctx.Err() == nil {
+				h.log.Error("Couldn't get due webhook deliveries", "error", err)
+			}
+			return
+		}
+
+		var wg sync.WaitGroup
+		workers := make(chan struct{}, WEBHOOK_WORKERS)
+		for _, delivery := range due {
+			wg.Add(1)
+			workers <- struct{}{}
+			go func(delivery dueDelivery) {
+				defer wg.Done()
+				defer func() { <-workers }()
+				h.deliver(ctx, delivery)
+			}(delivery)
+		}
+		wg.Wait()
+
+		if len(due) < WEBHOOK_BATCH {
+			return
+		}
+	}
+}
+
+// Attempts a delivery and records the attempt. Failed deliveries are retried after the
+// backoff until all attempts are used up.
+func (h *Handler) deliver(ctx context.Context, delivery dueDelivery) {
+	cfg := h.webhooks.cfg
+	log := h.log.With("delivery_id", delivery.id, "webhook_id", delivery.webhook_id, "event", delivery.event)
+
+	start := time.Now()
+	status_code, err := h.sendWebhook(ctx, delivery)
+	if ctx.Err() != nil {
+		// shutting down, the delivery stays due
+		return
+	}
+	attempt := messages.DeliveryAttempt{StatusCode: status_code, DurationMS: time.Since(start).Milliseconds()}
+	if err != nil {
+		attempt.Error = err.Error()
+		if len(attempt.Error) > MAX_WEBHOOK_ERROR_LENGTH {
+			attempt.Error = attempt.Error[:MAX_WEBHOOK_ERROR_LENGTH]
+		}
+	}
+
+	attempts := delivery.attempts + 1
+	status, result := messages.DELIVERY_DELIVERED, "delivered"
+	var next time.Time
+	switch {
+	case err == nil:
+	case attempts >= cfg.Attempts:
+		status, result = messages.DELIVERY_FAILED, "failed"
+	default:
+		backoff := util.NewExpBackoffContext(ctx, cfg.Backoff, WEBHOOK_BACKOFF_MULTIPLIER)
+		backoff.Skip(uint(attempts - 1))
+		next = time.Now().Add(backoff.Delay(WEBHOOK_JITTER))
+		status, result = messages.DELIVERY_PENDING, "retry"
+	}
+
+	rerr := h.retry(ctx, "recording webhook attempt", func(ctx context.Context) error {
+		return h.queries.recordAttempt(ctx, delivery.id, status, next, attempt)
+	})
+	if rerr != nil {
+		log.Error("Couldn't record webhook attempt", "error", rerr)
+	}
+	h.metrics.WebhookAttempts.WithLabelValues(delivery.event, result).Inc()
+
+	switch status {
+	case messages.DELIVERY_DELIVERED:
+		log.Debug("Webhook delivered", "attempt", attempts, "status_code", status_code)
+	case messages.DELIVERY_FAILED:
+		log.Warn("Webhook delivery failed, giving up", "attempt", attempts, "status_code", status_code, "error", err)
+	default:
+		log.Info("Webhook delivery failed, retrying", "attempt", attempts, "status_code", status_code, "error", err,
+			"next_attempt", next)
+	}
+}
+
+// Posts the payload of a delivery. Fails unless the receiver responds with a 2xx status.
+// Returns the status code or 0 if no response was received.
+func (h *Handler) sendWebhook(ctx context.Context, delivery dueDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.webhooks.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.url, strings.NewReader(delivery.payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("User-Agent", WEBHOOK_USER_AGENT)
+	req.Header.Set(WEBHOOK_HEADER_EVENT, delivery.event)
+	req.Header.Set(WEBHOOK_HEADER_DELIVERY, delivery.id)
+	req.Header.Set(WEBHOOK_HEADER_TIMESTAMP, timestamp)
+	req.Header.Set(WEBHOOK_HEADER_SIGNATURE, "sha256="+signWebhook(delivery.secret, timestamp, delivery.payload))
+
+	resp, err := h.webhooks.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// drained bodies keep the connection reusable
+	io.Copy(io.Discard, io.LimitReader(resp.Body, MAX_WEBHOOK_RESPONSE))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Returns the signature of a payload sent at timestamp (unix seconds).
+func signWebhook(secret string, timestamp string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (h *Handler) removeFinishedDeliveries(ctx context.Context) {
+	retention := h.webhooks.cfg.Retention
+	if retention == 0 {
+		return
+	}
+	var removed int64
+	err := h.retry(ctx, "removing finished webhook deliveries", func(ctx context.Context) error {
+		var err error
+		removed, err = h.queries.deleteFinishedDeliveries(ctx, time.Now().Add(-retention))
+		return err
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			h.log.Error("Couldn't remove finished webhook deliveries", "error", err)
+		}
+		return
+	}
+	if removed > 0 {
+		h.log.Info("Removed finished webhook deliveries", "deliveries", removed, "retention", retention)
+	}
+}
+
+// Queued delivery with the url and secret of its webhook
+type dueDelivery struct {
+	id         string
+	webhook_id string
+	url        string
+	secret     string
+	event      string
+	payload    string
+	attempts   int
+}
+
+// Inserts a webhook. Returns errTooManyWebhooks if the poll already has MAX_WEBHOOKS webhooks.
+func (q *queryHandler) insertWebhook(
+	ctx context.Context,
+	webhook messages.Webhook,
+	secret string) (time.Time, error) {
+
+	ctx, end := q.trace(ctx, "insert_webhook", webhook.PollID)
+	defer end()
+
+	const (
+		STMT_COUNT   = "SELECT COUNT(*) FROM webhook WHERE poll_id=?"
+		STMT_INSERT  = "INSERT INTO webhook (id, poll_id, url, secret, events) VALUES (?,?,?,?,?)"
+		STMT_CREATED = "SELECT created_at FROM webhook WHERE id=?"
+	)
+
+	events, err := json.Marshal(webhook.Events)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var created_at time.Time
+	err = q.immediateTx(ctx, func(conn *sql.Conn) error {
+		var webhooks int
+		if err := conn.QueryRowContext(ctx, STMT_COUNT, webhook.PollID).Scan(&webhooks); err != nil {
+			return err
+		}
+		if webhooks >= MAX_WEBHOOKS {
+			return errTooManyWebhooks
+		}
+		if _, err := conn.ExecContext(ctx, STMT_INSERT, webhook.ID, webhook.PollID, webhook.URL, secret, string(events)); err != nil {
+			return err
+		}
+		return conn.QueryRowContext(ctx, STMT_CREATED, webhook.ID).Scan(&created_at)
+	})
+	return created_at, err
+}
+
+// Returns the webhooks of a poll in order of creation, without their secrets.
+func (q *queryHandler) getWebhooks(
+	ctx context.Context,
+	id string) ([]messages.Webhook, error) {
+
+	ctx, end := q.trace(ctx, "get_webhooks", id)
+	defer end()
+
+	const STMT = "SELECT id, url, events, created_at FROM webhook WHERE poll_id=? ORDER BY created_at, rowid"
+	rows, err := q._db.QueryContext(ctx, STMT, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := make([]messages.Webhook, 0)
+	for rows.Next() {
+		webhook := messages.Webhook{PollID: id}
+		var events string
+		if err := rows.Scan(&webhook.ID, &webhook.URL, &events, &webhook.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(events), &webhook.Events); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// Checks if the poll has any webhooks.
+func (q *queryHandler) hasWebhooks(
+	ctx context.Context,
+	conn *sql.Conn,
+	id string) (bool, error) {
+
+	ctx, end := q.trace(ctx, "has_webhooks", id)
+	defer end()
+
+	var exists bool
+	err := conn.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM webhook WHERE poll_id=?)", id).Scan(&exists)
+	return exists, err
+}
+
+// Checks if the webhook belongs to the poll.
+func (q *queryHandler) webhookExists(
+	ctx context.Context,
+	id string,
+	webhook_id string) (bool, error) {
+
+	ctx, end := q.trace(ctx, "webhook_exists", id)
+	defer end()
+
+	var exists bool
+	err := q._db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM webhook WHERE id=? AND poll_id=?)", webhook_id, id).Scan(&exists)
+	return exists, err
+}
+
+// Deletes a webhook of the poll. Returns false if the poll has no such webhook.
+func (q *queryHandler) deleteWebhook(
+	ctx context.Context,
+	id string,
+	webhook_id string) (bool, error) {
+
+	ctx, end := q.trace(ctx, "delete_webhook", id)
+	defer end()
+
+	res, err := q._db.ExecContext(ctx, "DELETE FROM webhook WHERE id=? AND poll_id=?", webhook_id, id)
+	if err != nil {
+		return false, err
+	}
+	changes, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return changes != 0, nil
+}
+
+// Registers the webhooks of a poll for its successor, keeping their urls, secrets and events.
+func (q *queryHandler) copyWebhooks(
+	ctx context.Context,
+	conn *sql.Conn,
+	from string,
+	to string) error {
+
+	ctx, end := q.trace(ctx, "copy_webhooks", to)
+	defer end()
+
+	const STMT = `INSERT INTO webhook (id, poll_id, url, secret, events)
+		SELECT lower(hex(randomblob(16))), ?, url, secret, events FROM webhook WHERE poll_id=? ORDER BY created_at, rowid`
+	_, err := conn.ExecContext(ctx, STMT, to, from)
+	return err
+}
+
+// Queues deliveries of an event to all webhooks of the poll subscribed to it. Returns the
+// number of queued deliveries.
+func (q *queryHandler) queueDeliveries(
+	ctx context.Context,
+	conn *sql.Conn,
+	id string,
+	event messages.WebhookEvent,
+	event_id string,
+	payload []byte) (int64, error) {
+
+	ctx, end := q.trace(ctx, "queue_deliveries", id)
+	defer end()
+
+	const STMT = `INSERT INTO webhook_delivery (id, webhook_id, event_id, event, payload)
+		SELECT lower(hex(randomblob(16))), id, ?, ?, ? FROM webhook
+		WHERE poll_id=? AND (json_array_length(events) = 0 OR EXISTS(SELECT 1 FROM json_each(webhook.events) WHERE value=?))`
+	res, err := conn.ExecContext(ctx, STMT, event_id, event, string(payload), id, event)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Returns the choices of a poll and their votes, including those not committed on conn yet.
+func (q *queryHandler) tallyVotes(
+	ctx context.Context,
+	conn *sql.Conn,
+	id string) (map[int]string, map[int]uint, error) {
+
+	ctx, end := q.trace(ctx, "tally_votes", id)
+	defer end()
+
+	const STMT = `SELECT choice.id, choice.content, COUNT(vote.id) FROM choice
+		LEFT JOIN vote ON vote.poll_id = choice.poll_id AND vote.choice_id = choice.id
+		WHERE choice.poll_id=? GROUP BY choice.id`
+	rows, err := conn.QueryContext(ctx, STMT, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	choices := make(map[int]string)
+	votes := make(map[int]uint)
+	for rows.Next() {
+		var cid int
+		var content string
+		var count uint
+		if err := rows.Scan(&cid, &content, &count); err != nil {
+			return nil, nil, err
+		}
+		choices[cid] = content
+		votes[cid] = count
+	}
+	return choices, votes, rows.Err()
+}
+
+// Returns pending deliveries due at now, longest due first.
+func (q *queryHandler) getDueDeliveries(
+	ctx context.Context,
+	now time.Time,
+	limit int) ([]dueDelivery, error) {
+
+	ctx, end := q.trace(ctx, "get_due_deliveries", "")
+	defer end()
+
+	const STMT = `SELECT webhook_delivery.id, webhook_id, url, secret, event, payload, attempts
+		FROM webhook_delivery JOIN webhook ON webhook.id = webhook_delivery.webhook_id
+		WHERE status = 'pending' AND next_attempt_at <= ? ORDER BY next_attempt_at, webhook_delivery.rowid LIMIT ?`
+	rows, err := q._db.QueryContext(ctx, STMT, now.UTC().Format(sqliteTime), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	due := make([]dueDelivery, 0)
+	for rows.Next() {
+		var d dueDelivery
+		if err := rows.Scan(&d.id, &d.webhook_id, &d.url, &d.secret, &d.event, &d.payload, &d.attempts); err != nil {
+			return nil, err
+		}
+		due = append(due, d)
+	}
+	return due, rows.Err()
+}
+
+// Logs an attempt of a delivery and updates its status. Pending deliveries are due again at
+// next. Deliveries of removed webhooks are ignored.
+func (q *queryHandler) recordAttempt(
+	ctx context.Context,
+	id string,
+	status messages.DeliveryStatus,
+	next time.Time,
+	attempt messages.DeliveryAttempt) error {
+
+	ctx, end := q.trace(ctx, "record_attempt", "")
+	defer end()
+
+	const (
+		STMT_UPDATE = `UPDATE webhook_delivery SET status=?, attempts = attempts + 1, next_attempt_at=?,
+			finished_at = CASE WHEN ? THEN current_timestamp END WHERE id=?`
+		STMT_INSERT = "INSERT INTO webhook_attempt (delivery_id, status_code, error, duration_ms) VALUES (?,?,?,?)"
+	)
+
+	var next_attempt_at any
+	if status == messages.DELIVERY_PENDING {
+		next_attempt_at = next.UTC().Format(sqliteTime)
+	}
+	return q.immediateTx(ctx, func(conn *sql.Conn) error {
+		res, err := conn.ExecContext(ctx, STMT_UPDATE, status, next_attempt_at, status != messages.DELIVERY_PENDING, id)
+		if err != nil {
+			return err
+		}
+		if changes, err := res.RowsAffected(); err != nil || changes == 0 {
+			return err
+		}
+		_, err = conn.ExecContext(ctx, STMT_INSERT, id, attempt.StatusCode, attempt.Error, attempt.DurationMS)
+		return err
+	})
+}
+
+// Returns the latest deliveries of a webhook with their attempts, newest delivery first.
+func (q *queryHandler) getDeliveries(
+	ctx context.Context,
+	webhook_id string,
+	limit int) ([]messages.WebhookDelivery, error) {
+
+	ctx, end := q.trace(ctx, "get_deliveries", "")
+	defer end()
+
+	const (
+		STMT_DELIVERIES = `SELECT id, event_id, event, status, created_at, next_attempt_at FROM webhook_delivery
+			WHERE webhook_id=? ORDER BY created_at DESC, rowid DESC LIMIT ?`
+		STMT_ATTEMPTS = `SELECT delivery_id, created_at, status_code, error, duration_ms FROM webhook_attempt
+			WHERE delivery_id IN (SELECT id FROM webhook_delivery WHERE webhook_id=? ORDER BY created_at DESC, rowid DESC LIMIT ?)
+			ORDER BY id`
+	)
+
+	rows, err := q._db.QueryContext(ctx, STMT_DELIVERIES, webhook_id, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := make([]messages.WebhookDelivery, 0)
+	index := make(map[string]int)
+	for rows.Next() {
+		delivery := messages.WebhookDelivery{Attempts: make([]messages.DeliveryAttempt, 0, 1)}
+		var next_attempt_at sql.NullTime
+		if err := rows.Scan(&delivery.ID, &delivery.EventID, &delivery.Event, &delivery.Status, &delivery.CreatedAt,
+			&next_attempt_at); err != nil {
+			return nil, err
+		}
+		if next_attempt_at.Valid {
+			delivery.NextAttemptAt = &next_attempt_at.Time
+		}
+		index[delivery.ID] = len(deliveries)
+		deliveries = append(deliveries, delivery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = q._db.QueryContext(ctx, STMT_ATTEMPTS, webhook_id, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var delivery_id string
+		var attempt messages.DeliveryAttempt
+		if err := rows.Scan(&delivery_id, &attempt.CreatedAt, &attempt.StatusCode, &attempt.Error, &attempt.DurationMS); err != nil {
+			return nil, err
+		}
+		// deliveries queued after the first query aren't listed
+		if i, ok := index[delivery_id]; ok {
+			deliveries[i].Attempts = append(deliveries[i].Attempts, attempt)
+		}
+	}
+	return deliveries, rows.Err()
+}
+
+// Deletes deliveries finished before cutoff including their attempts. Returns the number of
+// deleted deliveries.
+func (q *queryHandler) deleteFinishedDeliveries(
+	ctx context.Context,
+	cutoff time.Time) (int64, error) {
+
+	ctx, end := q.trace(ctx, "delete_finished_deliveries", "")
+	defer end()
+
+	res, err := q._db.ExecContext(ctx, "DELETE FROM webhook_delivery WHERE finished_at < ?", cutoff.UTC().Format(sqliteTime))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
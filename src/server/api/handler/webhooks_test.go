@@ -0,0 +1,362 @@
+package handler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdrianPrawda/movie-poll/api/messages"
+)
+
+// Webhook config of tests, deliveries are sent by calling deliverDue
+var testWebhookConfig = WebhookConfig{
+	Interval:     time.Hour,
+	Timeout:      5 * time.Second,
+	Attempts:     3,
+	Backoff:      time.Minute,
+	AllowPrivate: true,
+}
+
+// Records requests to a webhook and responds with the queued status codes, 200 once they
+// are used up.
+type testReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []receivedWebhook
+	statuses []int
+}
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+func newTestReceiver(t *testing.T, statuses ...int) *testReceiver {
+	r := &testReceiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.requests = append(r.requests, receivedWebhook{header: req.Header.Clone(), body: body})
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *testReceiver) received() []receivedWebhook {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]receivedWebhook(nil), r.requests...)
+}
+
+// Registers a webhook through the v2 API.
+func (s *testServer) addWebhook(poll messages.CreatePollResp, url string, events ...messages.WebhookEvent) messages.CreateWebhookResp {
+	s.t.Helper()
+	rec := s.request(http.MethodPost, "/api/v2/polls/"+poll.PollID+"/webhooks", messages.CreateWebhookReq{URL: url, Events: events},
+		bearer(poll.OwnerToken)...)
+	return decode[messages.CreateWebhookResp](s.t, rec, http.StatusCreated)
+}
+
+// Returns the deliveries of a webhook through the v2 API.
+func (s *testServer) deliveries(poll messages.CreatePollResp, webhook string) []messages.WebhookDelivery {
+	s.t.Helper()
+	rec := s.request(http.MethodGet, "/api/v2/polls/"+poll.PollID+"/webhooks/"+webhook+"/deliveries", nil, bearer(poll.OwnerToken)...)
+	return decode[messages.WebhookDeliveriesResp](s.t, rec, http.StatusOK).Deliveries
+}
+
+// Makes pending deliveries due and sends them.
+func (s *testServer) deliverNow() {
+	s.t.Helper()
+	if _, err := s.db.Exec("UPDATE webhook_delivery SET next_attempt_at = datetime('now', '-1 second') WHERE status = 'pending'"); err != nil {
+		s.t.Fatal(err)
+	}
+	s.h.deliverDue(context.Background())
+}
+
+func TestWebhooksAreSigned(t *testing.T) {
+	s := newTestServer(t)
+	s.h.SetWebhooks(testWebhookConfig)
+	receiver := newTestReceiver(t)
+	poll := s.createPoll(messages.CreatePollReq{})
+	webhook := s.addWebhook(poll, receiver.URL, messages.EVENT_VOTE_CAST)
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: s.choices(poll.PollID)[:1]}), http.StatusNoContent)
+	s.h.deliverDue(context.Background())
+
+	received := receiver.received()
+	if len(received) != 1 {
+		t.Fatalf("%d webhooks received, expected 1", len(received))
+	}
+	header, body := received[0].header, received[0].body
+	timestamp := header.Get(WEBHOOK_HEADER_TIMESTAMP)
+	if sent, err := strconv.ParseInt(timestamp, 10, 64); err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+		t.Errorf("unexpected timestamp %q", timestamp)
+	}
+	mac := hmac.New(sha256.New, []byte(webhook.Secret))
+	mac.Write([]byte(timestamp + "." + string(body)))
+	if signature := header.Get(WEBHOOK_HEADER_SIGNATURE); signature != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("invalid signature %q", signature)
+	}
+
+	var payload struct {
+		messages.WebhookPayload
+		Data map[string]any `json:"data"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != messages.EVENT_VOTE_CAST || payload.PollID != poll.PollID || header.Get(WEBHOOK_HEADER_EVENT) != string(payload.Event) {
+		t.Errorf("unexpected payload %s", body)
+	}
+	if payload.Data["user_id"] != "alice" || payload.Data["votes"] == nil || payload.Data["votes_cast"] != 1.0 {
+		t.Errorf("unexpected vote payload %s", body)
+	}
+
+	deliveries := s.deliveries(poll, webhook.ID)
+	if len(deliveries) != 1 || deliveries[0].ID != header.Get(WEBHOOK_HEADER_DELIVERY) || deliveries[0].EventID != payload.ID ||
+		deliveries[0].Status != messages.DELIVERY_DELIVERED || deliveries[0].NextAttemptAt != nil {
+		t.Errorf("unexpected deliveries %+v", deliveries)
+	}
+}
+
+func TestWebhooksAreRetriedWithBackoff(t *testing.T) {
+	s := newTestServer(t)
+	s.h.SetWebhooks(testWebhookConfig)
+	receiver := newTestReceiver(t, http.StatusInternalServerError, http.StatusServiceUnavailable)
+	poll := s.createPoll(messages.CreatePollReq{})
+	webhook := s.addWebhook(poll, receiver.URL, messages.EVENT_VOTE_CAST)
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: s.choices(poll.PollID)[:1]}), http.StatusNoContent)
+
+	// backoff doubles per attempt, with jitter
+	backoffs := []time.Duration{time.Minute, 2 * time.Minute}
+	for i, backoff := range backoffs {
+		s.h.deliverDue(context.Background())
+		if received := receiver.received(); len(received) != i+1 {
+			t.Fatalf("%d webhooks received, expected %d", len(received), i+1)
+		}
+		delivery := s.deliveries(poll, webhook.ID)[0]
+		if delivery.Status != messages.DELIVERY_PENDING || len(delivery.Attempts) != i+1 || delivery.NextAttemptAt == nil {
+			t.Fatalf("unexpected delivery %+v", delivery)
+		}
+		wait := time.Until(*delivery.NextAttemptAt)
+		min := time.Duration(float64(backoff)*(1-WEBHOOK_JITTER)) - 2*time.Second
+		max := time.Duration(float64(backoff)*(1+WEBHOOK_JITTER)) + time.Second
+		if wait < min || wait > max {
+			t.Errorf("attempt %d is retried in %s, expected %s to %s", i+1, wait, min, max)
+		}
+		// not yet due
+		s.h.deliverDue(context.Background())
+		if received := receiver.received(); len(received) != i+1 {
+			t.Fatalf("delivery retried before its backoff")
+		}
+		if _, err := s.db.Exec("UPDATE webhook_delivery SET next_attempt_at = datetime('now', '-1 second')"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.h.deliverDue(context.Background())
+
+	received := receiver.received()
+	if len(received) != 3 || received[0].header.Get(WEBHOOK_HEADER_DELIVERY) != received[2].header.Get(WEBHOOK_HEADER_DELIVERY) {
+		t.Fatalf("unexpected webhooks %+v", received)
+	}
+	delivery := s.deliveries(poll, webhook.ID)[0]
+	codes := []int{http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusOK}
+	if delivery.Status != messages.DELIVERY_DELIVERED || len(delivery.Attempts) != len(codes) {
+		t.Fatalf("unexpected delivery %+v", delivery)
+	}
+	for i, code := range codes {
+		if attempt := delivery.Attempts[i]; attempt.StatusCode != code || (code == http.StatusOK) != (attempt.Error == "") {
+			t.Errorf("unexpected attempt %+v", attempt)
+		}
+	}
+}
+
+func TestWebhooksFailAfterAllAttempts(t *testing.T) {
+	s := newTestServer(t)
+	cfg := testWebhookConfig
+	cfg.Attempts = 2
+	s.h.SetWebhooks(cfg)
+	receiver := newTestReceiver(t, http.StatusInternalServerError, http.StatusInternalServerError)
+	poll := s.createPoll(messages.CreatePollReq{})
+	webhook := s.addWebhook(poll, receiver.URL, messages.EVENT_VOTE_CAST)
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: s.choices(poll.PollID)[:1]}), http.StatusNoContent)
+
+	s.h.deliverDue(context.Background())
+	s.deliverNow()
+	s.deliverNow()
+	delivery := s.deliveries(poll, webhook.ID)[0]
+	if delivery.Status != messages.DELIVERY_FAILED || len(delivery.Attempts) != 2 || delivery.NextAttemptAt != nil {
+		t.Errorf("unexpected delivery %+v", delivery)
+	}
+	if received := receiver.received(); len(received) != 2 {
+		t.Errorf("%d webhooks received, expected 2", len(received))
+	}
+}
+
+func TestWebhooksDontFollowRedirects(t *testing.T) {
+	s := newTestServer(t)
+	s.h.SetWebhooks(testWebhookConfig)
+	target := newTestReceiver(t)
+	redirect := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	t.Cleanup(redirect.Close)
+	poll := s.createPoll(messages.CreatePollReq{})
+	webhook := s.addWebhook(poll, redirect.URL, messages.EVENT_VOTE_CAST)
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: s.choices(poll.PollID)[:1]}), http.StatusNoContent)
+	s.h.deliverDue(context.Background())
+
+	if received := target.received(); len(received) != 0 {
+		t.Errorf("redirect was followed")
+	}
+	delivery := s.deliveries(poll, webhook.ID)[0]
+	if delivery.Status != messages.DELIVERY_PENDING || len(delivery.Attempts) != 1 ||
+		delivery.Attempts[0].StatusCode != http.StatusTemporaryRedirect || delivery.Attempts[0].Error == "" {
+		t.Errorf("unexpected delivery %+v", delivery)
+	}
+}
+
+func TestWebhooksRefusePrivateAddresses(t *testing.T) {
+	s := newTestServer(t)
+	s.h.SetWebhooks(testWebhookConfig)
+	receiver := newTestReceiver(t)
+	poll := s.createPoll(messages.CreatePollReq{})
+	webhook := s.addWebhook(poll, receiver.URL, messages.EVENT_VOTE_CAST)
+
+	cfg := testWebhookConfig
+	cfg.AllowPrivate = false
+	s.h.SetWebhooks(cfg)
+	for _, url := range []string{"http://localhost/hook", "http://127.0.0.1/hook", "http://10.1.2.3/hook", "http://[::1]/hook",
+		"http://169.254.169.254/latest", "ftp://example.com/hook", "/hook"} {
+		rec := s.request(http.MethodPost, "/api/v2/polls/"+poll.PollID+"/webhooks", messages.CreateWebhookReq{URL: url},
+			bearer(poll.OwnerToken)...)
+		expectError(t, rec, http.StatusBadRequest, messages.MALFORMED_REQUEST)
+	}
+
+	// hosts are checked again after resolving them
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: s.choices(poll.PollID)[:1]}), http.StatusNoContent)
+	s.h.deliverDue(context.Background())
+	if received := receiver.received(); len(received) != 0 {
+		t.Errorf("webhook delivered to private address")
+	}
+	delivery := s.deliveries(poll, webhook.ID)[0]
+	if len(delivery.Attempts) != 1 || delivery.Attempts[0].StatusCode != 0 || !strings.Contains(delivery.Attempts[0].Error, "is not public") {
+		t.Errorf("unexpected delivery %+v", delivery)
+	}
+}
+
+func TestAnonymousVoteWebhooksOmitVotes(t *testing.T) {
+	s := newTestServer(t)
+	s.allowAnonymous()
+	s.h.SetWebhooks(testWebhookConfig)
+	receiver := newTestReceiver(t)
+	poll := s.createPoll(messages.CreatePollReq{Anonymous: true, Visibility: messages.RESULTS_LIVE})
+	s.addWebhook(poll, receiver.URL, messages.EVENT_VOTE_CAST)
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: s.choices(poll.PollID)[:1]}), http.StatusNoContent)
+	s.h.deliverDue(context.Background())
+
+	received := receiver.received()
+	if len(received) != 1 {
+		t.Fatalf("%d webhooks received, expected 1", len(received))
+	}
+	var payload struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.Unmarshal(received[0].body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := payload.Data["votes"]; ok {
+		t.Errorf("payload of anonymous poll has votes: %s", received[0].body)
+	}
+	if _, ok := payload.Data["user_id"]; ok {
+		t.Errorf("payload of anonymous poll has user: %s", received[0].body)
+	}
+	if payload.Data["votes_cast"] != 1.0 {
+		t.Errorf("unexpected payload %s", received[0].body)
+	}
+}
+
+func TestWebhooksNeedOwnerToken(t *testing.T) {
+	s := newTestServer(t)
+	poll := s.createPoll(messages.CreatePollReq{})
+	expectError(t, s.request(http.MethodPost, "/api/v2/polls/"+poll.PollID+"/webhooks", messages.CreateWebhookReq{URL: "https://example.com"},
+		bearer(poll.OwnerToken)...), http.StatusUnprocessableEntity, messages.WEBHOOKS_DISABLED)
+
+	s.h.SetWebhooks(testWebhookConfig)
+	expectOwnerChallenge(t, s.request(http.MethodPost, "/api/v2/polls/"+poll.PollID+"/webhooks",
+		messages.CreateWebhookReq{URL: "https://example.com"}))
+	webhook := s.addWebhook(poll, "https://example.com")
+	expectOwnerChallenge(t, s.request(http.MethodGet, "/api/v2/polls/"+poll.PollID+"/webhooks", nil))
+	expectOwnerChallenge(t, s.request(http.MethodDelete, "/api/v2/polls/"+poll.PollID+"/webhooks/"+webhook.ID, nil))
+	expectStatus(t, s.request(http.MethodDelete, "/api/v2/polls/"+poll.PollID+"/webhooks/"+webhook.ID, nil, bearer(poll.OwnerToken)...),
+		http.StatusNoContent)
+	expectError(t, s.request(http.MethodDelete, "/api/v2/polls/"+poll.PollID+"/webhooks/"+webhook.ID, nil, bearer(poll.OwnerToken)...),
+		http.StatusNotFound, messages.WEBHOOK_NOT_FOUND)
+}
+
+func TestWebhooksAreQueuedWithTheirMutation(t *testing.T) {
+	s := newTestServer(t)
+	s.h.SetWebhooks(testWebhookConfig)
+	receiver := newTestReceiver(t)
+	poll := s.createPoll(messages.CreatePollReq{})
+	webhook := s.addWebhook(poll, receiver.URL)
+	choices := s.choices(poll.PollID)
+
+	// rejected ballots queue nothing
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: choices[:1]}), http.StatusNoContent)
+	expectError(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "alice", Votes: choices[:1]}), http.StatusConflict, messages.ALREADY_VOTED)
+	if deliveries := s.deliveries(poll, webhook.ID); len(deliveries) != 1 {
+		t.Fatalf("%d deliveries queued, expected 1", len(deliveries))
+	}
+
+	// ballots aren't cast unless their deliveries are queued
+	if _, err := s.db.Exec("ALTER TABLE webhook_delivery RENAME TO webhook_delivery_gone"); err != nil {
+		t.Fatal(err)
+	}
+	expectError(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "bob", Votes: choices[1:]}), http.StatusInternalServerError, messages.INTERNAL_ERROR)
+	results := decode[messages.PollResultsResp](t, s.request(http.MethodGet, "/api/v2/polls/"+poll.PollID+"/results", nil), http.StatusOK)
+	if results.VotesCast != 1 {
+		t.Fatalf("%d votes cast, expected 1", results.VotesCast)
+	}
+	if _, err := s.db.Exec("ALTER TABLE webhook_delivery_gone RENAME TO webhook_delivery"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the results of concluded polls include the concluding ballot
+	expectStatus(t, s.vote(poll.PollID, messages.CastVotesReq{UserID: "bob", Votes: choices[:1]}), http.StatusNoContent)
+	s.h.deliverDue(context.Background())
+	received := receiver.received()
+	if len(received) != 3 {
+		t.Fatalf("%d webhooks received, expected 3", len(received))
+	}
+	var concluded *messages.WebhookPayload
+	for _, webhook := range received {
+		var payload messages.WebhookPayload
+		if err := json.Unmarshal(webhook.body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Event == messages.EVENT_CONCLUDED {
+			concluded = &payload
+		}
+	}
+	if concluded == nil {
+		t.Fatal("no concluded event received")
+	}
+	data := concluded.Data.(map[string]any)
+	winners := data["winners"].([]any)
+	if data["votes_cast"] != 2.0 || len(winners) != 1 || winners[0].(map[string]any)["votes"] != 2.0 {
+		t.Errorf("unexpected concluded payload %+v", data)
+	}
+}
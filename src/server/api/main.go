@@ -2,197 +2,260 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
-	"path"
-	"path/filepath"
-	"regexp"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/AdrianPrawda/movie-poll/api/database"
 	"github.com/AdrianPrawda/movie-poll/api/handler"
+	"github.com/AdrianPrawda/movie-poll/api/metrics"
 	"github.com/AdrianPrawda/movie-poll/api/util"
+	"github.com/AdrianPrawda/movie-poll/config"
+	"github.com/AdrianPrawda/movie-poll/telemetry"
 	"github.com/huandu/go-sqlbuilder"
 	"github.com/labstack/echo/v4"
-	"github.com/qustavo/dotsql"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/time/rate"
 )
 
-type ServerConfig struct {
-	port    int
-	poll_db string
-	debug   bool
-}
-
-// TODO: Implement API request limits on all handlers (echo middleware?)
 func main() {
 	// prepare config
-	cfg := new(ServerConfig)
-	flag.IntVar(&cfg.port, "port", 35555, "api port")
-	flag.StringVar(&cfg.poll_db, "polldb", "file::memory:?cache=shared", "sqlite connection string for the poll database")
-	flag.BoolVar(&cfg.debug, "debug", false, "debug flag")
-	flag.Parse()
-
-	// prepare logger
-	log := util.Logger{
-		Debug: log.New(os.Stdout, "DEBUG: ", log.Ldate|log.Ltime),
-		Info:  log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime),
-		Warn:  log.New(os.Stdout, "WARN: ", log.Ldate|log.Ltime),
-		Error: log.New(os.Stdout, "ERROR: ", log.Ldate|log.Ltime|log.Llongfile),
-		Fatal: log.New(os.Stdout, "FATAL: ", log.Ldate|log.Ltime|log.Llongfile),
+	cfg, err := config.Load("api", os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	if !cfg.debug {
-		log.Debug.SetOutput(io.Discard)
+	if cfg.PrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
-	log.Info.Println("Setting up databases")
-	poll_db, err := setup(cfg, &log)
+	// prepare logger
+	log, err := util.NewLogger(os.Stdout, cfg.Log.Level, cfg.Log.Format)
 	if err != nil {
-		log.Fatal.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(log)
+	if cfg.File != "" {
+		log.Info("Loaded config file", "file", cfg.File)
 	}
 
-	if err := serve(cfg, &log, poll_db); err != nil {
-		log.Fatal.Fatal(err)
+	// prepare tracing
+	shutdownTracing, err := telemetry.Setup(context.Background(), "moviepoll-api", cfg.Tracing)
+	if err != nil {
+		log.Error("Could not set up tracing", "error", err)
+		os.Exit(1)
 	}
-	os.Exit(0)
-}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			log.Error("Could not flush traces", "error", err)
+		}
+	}()
 
-func setup(cfg *ServerConfig, log *util.Logger) (*sql.DB, error) {
 	// Set global default for sql query builder
 	sqlbuilder.DefaultFlavor = sqlbuilder.SQLite
 
-	// prepare DB
-	r, err := regexp.Compile(":memory:")
-	if err != nil {
-		return nil, err
-	}
-
-	db, err := sql.Open("sqlite3", cfg.poll_db)
+	poll_db, err := database.Open(cfg.DB, log)
 	if err != nil {
-		return nil, err
+		log.Error("Could not open databases", "error", err)
+		os.Exit(1)
 	}
 
-	if r.MatchString(cfg.poll_db) {
-		log.Info.Println("In-Memory database detected, adjusting connection settings")
-		db.SetMaxIdleConns(2)
-		db.SetConnMaxLifetime(0)
+	if err := serve(cfg, log, poll_db); err != nil {
+		log.Error("Could not serve API", "error", err)
+		os.Exit(1)
 	}
+}
 
-	// check DB connection
-	attempts := 0
-	backoff := util.NewExpBackoffContext(context.Background(), 2*time.Second, 1.25)
-
-	for {
-		if attempts >= 5 {
-			log.Fatal.Println("Could not establish connection to poll database")
-			return nil, errors.New("could not establish connection to poll database")
+// Handler timeouts from the config. Fails on unknown endpoints.
+func handlerTimeouts(cfg *config.Config) (handler.Timeouts, error) {
+	for endpoint := range cfg.Timeouts.Endpoints {
+		known := false
+		for _, name := range handler.TimeoutEndpoints {
+			known = known || name == endpoint
 		}
-		ctx, cancel := backoff.Next()
-		defer cancel()
-		if err := db.PingContext(ctx); err == nil {
-			break
+		if !known {
+			return handler.Timeouts{}, fmt.Errorf("unknown endpoint %q in endpoint timeouts (endpoints: %s)",
+				endpoint, strings.Join(handler.TimeoutEndpoints, ", "))
 		}
-		attempts++
 	}
-	log.Info.Println("Successfully pinged poll DB")
+	return handler.Timeouts{Default: cfg.Timeouts.Handler, Endpoints: cfg.Timeouts.Endpoints}, nil
+}
 
-	// ensure foreign key constraints are enabled (can't be done with a transaction)
-	log.Debug.Println("Turning on foreign key constraints on DB")
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-	if _, err := db.ExecContext(ctx, "PRAGMA FOREIGN_KEYS = ON;", nil); err != nil {
-		log.Error.Println("Couldn't set FK pragma")
-		return nil, err
+// CORS middleware config. Preflight responses list the allowed methods and headers instead
+// of reflecting the requested ones.
+func corsConfig(cfg config.CORS) middleware.CORSConfig {
+	max_age := int(cfg.MaxAge.Seconds())
+	if max_age == 0 {
+		max_age = -1 // sent as 0, browsers would otherwise cache preflights for 5 seconds
 	}
-
-	// prepare DB
-	log.Debug.Println("Loading init sql file")
-	// init file should be next to executable
-	ex, err := os.Executable()
-	if err != nil {
-		return nil, err
+	return middleware.CORSConfig{
+		AllowOrigins:     cfg.AllowOrigins,
+		AllowMethods:     cfg.AllowMethods,
+		AllowHeaders:     cfg.AllowHeaders,
+		ExposeHeaders:    cfg.ExposeHeaders,
+		AllowCredentials: cfg.AllowCredentials,
+		MaxAge:           max_age,
 	}
-	fpath := path.Join(filepath.Dir(ex), "init.sql")
+}
 
-	ds, err := dotsql.LoadFromFile(fpath)
+func serve(cfg *config.Config, log *slog.Logger, poll_db *sql.DB) error {
+	timeouts, err := handlerTimeouts(cfg)
 	if err != nil {
-		log.Error.Println("Couldn't load init sql file")
-		return nil, err
+		return err
 	}
 
-	log.Debug.Println("Setting up init transcation")
-	ctx, tx_cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer tx_cancel()
-	tx, err := db.BeginTx(ctx, nil)
-	if err != nil {
-		log.Error.Print(err)
-		return nil, err
-	}
-	defer tx.Rollback()
+	e := echo.New()
+	// startup is logged by us, keep stdout parsable for json logs
+	e.HideBanner = true
+	e.HidePort = true
 
-	// create poll databse
-	log.Info.Println("Preparing poll table")
-	query, err := ds.Raw("create-poll-table")
-	if err != nil {
-		return nil, err
+	reg := prometheus.NewRegistry()
+	m := metrics.New(reg)
+	h := handler.NewHandler(poll_db, log, m, timeouts, handler.HealthConfig{
+		SchemaVersion:  database.SchemaVersion,
+		RenderURL:      cfg.Render.URL,
+		RenderRequired: cfg.Render.Required,
+	})
+	backups := database.Backups{Dir: cfg.Backup.Dir, Keep: cfg.Backup.Keep}
+	h.SetBackups(backups)
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewDBStatsCollector(poll_db, "poll"),
+	)
+	reg.MustRegister(h.Collectors()...)
+
+	routes := handler.RouteConfig{
+		AdminToken: cfg.Admin.Token,
+		Metrics:    promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}),
 	}
-	if _, err := tx.Exec(query, nil); err != nil {
-		return nil, err
+	if len(cfg.CORS.AllowOrigins) > 0 {
+		log.Info("Allowing cross-origin requests", "origins", cfg.CORS.AllowOrigins, "credentials", cfg.CORS.AllowCredentials)
+		cors := corsConfig(cfg.CORS)
+		routes.CORS = &cors
 	}
-
-	// create choice database
-	log.Info.Println("Preparing choice table")
-	query, err = ds.Raw("create-choice-table")
-	if err != nil {
-		return nil, err
+	if cfg.RateLimit.Rate > 0 {
+		log.Info("Limiting requests per client", "rate", cfg.RateLimit.Rate, "burst", cfg.RateLimit.Burst)
+		routes.RateLimit = middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
+			Rate:      rate.Limit(cfg.RateLimit.Rate),
+			Burst:     cfg.RateLimit.Burst,
+			ExpiresIn: cfg.RateLimit.Expires,
+		})
 	}
-	if _, err := tx.Exec(query, nil); err != nil {
-		return nil, err
+	if cfg.Admin.Token == "" {
+		log.Info("Admin API disabled, no admin token set")
 	}
 
-	// create vote database
-	log.Info.Println("Preparing vote table")
-	query, err = ds.Raw("create-vote-table")
-	if err != nil {
-		return nil, err
+	h.SetIdentity(handler.IdentityConfig{
+		Secret:       []byte(cfg.Identity.Secret),
+		Cookie:       cfg.Identity.Cookie,
+		MaxAge:       cfg.Identity.MaxAge,
+		Secure:       cfg.Identity.Secure,
+		UserHeader:   cfg.Identity.UserHeader,
+		BallotSecret: []byte(cfg.Identity.BallotSecret),
+	})
+	if cfg.Identity.Secret != "" || cfg.Identity.UserHeader != "" {
+		log.Info("Identifying voters", "signed", cfg.Identity.Secret != "", "user_header", cfg.Identity.UserHeader)
 	}
-	if _, err := tx.Exec(query, nil); err != nil {
-		return nil, err
+	if cfg.Identity.BallotSecret != "" {
+		log.Info("Allowing anonymous ballots")
 	}
+	h.SetWebhooks(handler.WebhookConfig{
+		Interval:     cfg.Webhooks.Interval,
+		Timeout:      cfg.Webhooks.Timeout,
+		Attempts:     cfg.Webhooks.Attempts,
+		Backoff:      cfg.Webhooks.Backoff,
+		Retention:    cfg.Webhooks.Retention,
+		AllowPrivate: cfg.Webhooks.AllowPrivate,
+	})
+	h.Routes(e, routes)
 
-	// create next poll database
-	log.Info.Println("Preparing next poll table")
-	query, err = ds.Raw("create-next-poll-table")
-	if err != nil {
-		return nil, err
+	if cfg.Timeouts.Write < timeouts.Max() {
+		log.Warn("Write timeout is shorter than handler timeouts, responses might get lost")
+	}
+	server := &http.Server{
+		Addr:         cfg.Addr(),
+		ReadTimeout:  cfg.Timeouts.Read,
+		WriteTimeout: cfg.Timeouts.Write,
+		IdleTimeout:  cfg.Timeouts.Idle,
+	}
+	if cfg.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
 	}
-	if _, err := tx.Exec(query, nil); err != nil {
-		return nil, err
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Info("Start serving API", "addr", server.Addr, "tls", server.TLSConfig != nil)
+	errs := make(chan error, 2)
+	go func() {
+		errs <- e.StartServer(server)
+	}()
+
+	// probes are answered while waiting for the database
+	go func() {
+		if err := database.Setup(cfg.DB, log, poll_db); err != nil {
+			errs <- fmt.Errorf("could not set up databases: %w", err)
+			return
+		}
+		h.SetReady(true)
+		log.Info("Ready to serve requests")
+
+		if cfg.Webhooks.Interval > 0 {
+			go h.DeliverWebhooks(ctx)
+		}
+		if cfg.Trash.Interval > 0 {
+			go h.ScheduleTrashPurge(ctx, cfg.Trash.Retention, cfg.Trash.Interval)
+		}
+		if cfg.Backup.Interval > 0 {
+			backups.Schedule(ctx, poll_db, cfg.Backup.Interval, log)
+		}
+	}()
+
+	select {
+	case err := <-errs:
+		poll_db.Close()
+		return err
+	case <-ctx.Done():
 	}
 
-	// try to commit
-	log.Debug.Println("Commiting transaction")
-	if err := tx.Commit(); err != nil {
-		return nil, err
+	// stop accepting new requests and wait for in-flight ones
+	log.Info("Shutting down, draining in-flight requests")
+	stop()
+	h.SetReady(false)
+	sctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Shutdown)
+	defer cancel()
+	// e.Shutdown only stops echo's own servers
+	if err := server.Shutdown(sctx); err != nil {
+		log.Error("Could not drain all requests", "error", err)
 	}
-	return db, nil
-}
 
-func serve(cfg *ServerConfig, log *util.Logger, poll_db *sql.DB) error {
-	e := echo.New()
-	h := handler.NewHandler(poll_db, log)
-
-	e.POST("/api/poll/v1/create", h.CreatePoll)
-	e.GET("/api/poll/v1/data", h.GetPollData)
-	e.DELETE("/api/poll/v1/delete", h.DeletePoll)
-	e.POST("/api/poll/v1/vote", h.VotePoll)
-	e.GET("/api/poll/v1/status", h.GetPollStatus)
-	e.POST("/api/heartbeat", h.Heartbeat)
-
-	log.Info.Printf("Start serving API on port %d\n", cfg.port)
-	defer poll_db.Close()
-	return e.Start(fmt.Sprintf(":%d", cfg.port))
+	log.Info("Closing poll database")
+	return poll_db.Close()
 }
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/AdrianPrawda/movie-poll/api/database"
+	"github.com/AdrianPrawda/movie-poll/config"
+	"github.com/huandu/go-sqlbuilder"
+)
+
+func TestMain(m *testing.M) {
+	sqlbuilder.DefaultFlavor = sqlbuilder.SQLite
+	os.Exit(m.Run())
+}
+
+func TestHandlerTimeouts(t *testing.T) {
+	cfg := config.Default()
+	cfg.Timeouts.Endpoints = map[string]time.Duration{"vote": time.Second, "export": time.Minute}
+	timeouts, err := handlerTimeouts(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeouts.Default != cfg.Timeouts.Handler || timeouts.Max() != time.Minute {
+		t.Errorf("unexpected timeouts %+v", timeouts)
+	}
+
+	cfg.Timeouts.Endpoints["unknown"] = time.Second
+	if _, err := handlerTimeouts(cfg); err == nil {
+		t.Error("timeout of unknown endpoint was accepted")
+	}
+}
+
+// Returns a port nothing listens on.
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// Serves the api on a free port until the test sends SIGTERM. Returns the base url once
+// the server is ready and the channel receiving the result of serve.
+func startServer(t *testing.T, cfg *config.Config, poll_db *sql.DB) (string, <-chan error) {
+	t.Helper()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg.Server.Host = "127.0.0.1"
+	cfg.Server.Port = freePort(t)
+	cfg.Webhooks.Interval = 0
+	cfg.Trash.Interval = 0
+
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(cfg, log, poll_db)
+	}()
+	base := "http://127.0.0.1:" + strconv.Itoa(cfg.Server.Port)
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if resp, err := http.Get(base + "/readyz"); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return base, served
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server didn't get ready")
+		}
+	}
+}
+
+// Opens a new poll database file in a temporary directory.
+func openTestDB(t *testing.T, cfg *config.Config) *sql.DB {
+	t.Helper()
+	cfg.DB.DSN = "file:" + filepath.Join(t.TempDir(), "poll.db")
+	poll_db, err := database.Open(cfg.DB, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return poll_db
+}
+
+// Stops a server started by startServer.
+func stopServer(t *testing.T, served <-chan error) {
+	t.Helper()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("server didn't shut down")
+	}
+}
+
+func TestServeShutsDownOnSignal(t *testing.T) {
+	cfg := config.Default()
+	poll_db := openTestDB(t, cfg)
+	base, served := startServer(t, cfg, poll_db)
+
+	stopServer(t, served)
+	if err := poll_db.Ping(); err == nil {
+		t.Error("poll database wasn't closed")
+	}
+	if _, err := http.Get(base + "/readyz"); err == nil {
+		t.Error("server still accepts requests")
+	}
+}
+
+func TestServesWebClient(t *testing.T) {
+	cfg := config.Default()
+	base, served := startServer(t, cfg, openTestDB(t, cfg))
+	defer stopServer(t, served)
+
+	tests := []struct {
+		path         string
+		content_type string
+		contains     string
+	}{
+		{"/", "text/html", `<main id="app"`},
+		// client side routes get the single page
+		{"/polls/abc", "text/html", `<main id="app"`},
+		{"/static/index.js", "javascript", "/api/v2"},
+		{"/static/style.css", "text/css", "{"},
+	}
+	for _, test := range tests {
+		resp, err := http.Get(base + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Type"), test.content_type) ||
+			!strings.Contains(string(body), test.contains) {
+			t.Errorf("%s answered with %d, %q: %.100s", test.path, resp.StatusCode, resp.Header.Get("Content-Type"), body)
+		}
+	}
+
+	resp, err := http.Get(base + "/static/missing.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing asset answered with %d", resp.StatusCode)
+	}
+}
+
+// Sends a request with an Origin header and returns the response without its body.
+func crossOrigin(t *testing.T, method string, url string, origin string, headers ...string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", origin)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestCORS(t *testing.T) {
+	cfg := config.Default()
+	cfg.CORS.AllowOrigins = []string{"http://localhost:35556"}
+	cfg.CORS.AllowCredentials = true
+	cfg.Admin.Token = "admin-token"
+	base, served := startServer(t, cfg, openTestDB(t, cfg))
+	defer stopServer(t, served)
+
+	// v1 deletes send a JSON body and need a preflight
+	resp := crossOrigin(t, http.MethodOptions, base+"/api/poll/v1/delete", "http://localhost:35556",
+		"Access-Control-Request-Method", http.MethodDelete,
+		"Access-Control-Request-Headers", "content-type")
+	if resp.StatusCode != http.StatusNoContent ||
+		resp.Header.Get("Access-Control-Allow-Origin") != "http://localhost:35556" ||
+		resp.Header.Get("Access-Control-Allow-Methods") != "GET,HEAD,POST,DELETE" ||
+		resp.Header.Get("Access-Control-Allow-Headers") != "Content-Type,X-Request-Id" ||
+		resp.Header.Get("Access-Control-Allow-Credentials") != "true" ||
+		resp.Header.Get("Access-Control-Max-Age") != "600" {
+		t.Errorf("unexpected preflight response %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// preflights don't carry the admin token
+	resp = crossOrigin(t, http.MethodOptions, base+"/api/admin/v1/polls", "http://localhost:35556",
+		"Access-Control-Request-Method", http.MethodGet)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("admin preflight answered with %d", resp.StatusCode)
+	}
+
+	resp = crossOrigin(t, http.MethodGet, base+"/api/v2/polls/unknown", "http://localhost:35556")
+	if resp.Header.Get("Access-Control-Allow-Origin") != "http://localhost:35556" ||
+		resp.Header.Get("Access-Control-Expose-Headers") != "X-Request-Id,Content-Disposition" {
+		t.Errorf("unexpected response headers %v", resp.Header)
+	}
+
+	for _, method := range []string{http.MethodOptions, http.MethodGet} {
+		resp = crossOrigin(t, method, base+"/api/v2/polls/unknown", "https://example.com",
+			"Access-Control-Request-Method", http.MethodGet)
+		if origin := resp.Header.Get("Access-Control-Allow-Origin"); origin != "" {
+			t.Errorf("%s of other origin allowed for %q", method, origin)
+		}
+	}
+}
+
+func TestCORSConfig(t *testing.T) {
+	cors := config.Default().CORS
+	cors.MaxAge = 0
+	if max_age := corsConfig(cors).MaxAge; max_age != -1 {
+		t.Errorf("disabled preflight caching sent as max age %d", max_age)
+	}
+}
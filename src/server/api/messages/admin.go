@@ -0,0 +1,204 @@
+package messages
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Messages and types for the admin API under /api/admin/v1, shared with the moviepoll CLI
+
+type PollStatus string
+
+const (
+	OPEN      PollStatus = "open"
+	CLOSED    PollStatus = "closed"    // closed by an admin, rejects votes until reopened
+	CONCLUDED PollStatus = "concluded" // target votes reached
+	DELETED   PollStatus = "deleted"   // restorable until the trash retention expired
+)
+
+// Messages and types for GET /api/admin/v1/polls
+
+// Lists all polls except deleted ones if status is empty
+type ListPollsReq struct {
+	Status PollStatus `query:"status"`
+	Limit  int        `query:"limit"` // 0 is unlimited
+}
+
+type ListPollsResp struct {
+	Polls []PollSummary `json:"polls"` // newest poll first
+}
+
+type PollSummary struct {
+	ID            string     `json:"id"`
+	Title         string     `json:"title"`
+	Type          PollType   `json:"type"`
+	Status        PollStatus `json:"status"`
+	VotesRequired uint       `json:"votes_required"`
+	VotesCast     uint       `json:"votes_cast"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DeletedAt     *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Messages and types for GET /api/admin/v1/polls/{poll_id}
+
+type AdminPollResp struct {
+	PollResp
+	Status    PollStatus     `json:"status"`
+	CreatedAt time.Time      `json:"created_at"`
+	Results   []ChoiceResult `json:"results"` // ordered by number of votes
+	Winners   []int          `json:"winners"` // choice ids with the most votes
+}
+
+// Messages and types for DELETE /api/admin/v1/chains/{poll_id}
+
+type DeleteChainResp struct {
+	Deleted []string `json:"deleted"` // oldest poll first
+}
+
+// Messages and types for POST /api/admin/v1/purge
+
+// Purges closed and concluded polls created before now - older_than
+type PurgeReq struct {
+	OlderThan string `json:"older_than"` // duration, e.g. 720h
+	DryRun    bool   `json:"dry_run"`
+}
+
+type PurgeResp struct {
+	Purged []string `json:"purged"`
+	DryRun bool     `json:"dry_run"`
+}
+
+// Messages and types for POST /api/admin/v1/recount
+
+type RecountReq struct {
+	DryRun bool `json:"dry_run"`
+}
+
+type RecountResp struct {
+	Fixed  []RecountedPoll `json:"fixed"` // polls whose cast votes didn't match their ballots
+	DryRun bool            `json:"dry_run"`
+}
+
+type RecountedPoll struct {
+	PollID  string `json:"poll_id"`
+	Stored  uint   `json:"stored_votes"`
+	Counted uint   `json:"counted_votes"`
+}
+
+// Messages and types for GET /api/admin/v1/export and POST /api/admin/v1/import
+
+// Exports all polls or the chain of poll_id
+type ExportReq struct {
+	PollID string `query:"poll_id"`
+}
+
+// Version of the export format
+const EXPORT_VERSION = 1
+
+type PollsExport struct {
+	Version    int          `json:"version"`
+	ExportedAt time.Time    `json:"exported_at"`
+	Polls      []PollExport `json:"polls"` // predecessors are listed before their successors
+}
+
+type PollExport struct {
+	ID          string         `json:"id"`
+	Title       string         `json:"title"`
+	Type        PollType       `json:"type"`
+	TargetVotes uint           `json:"target_votes"`
+	AutoCreate  bool           `json:"auto_create"`
+	Closed      bool           `json:"closed"`
+	Identity    Identity       `json:"identity,omitempty"`   // defaults to raw
+	Visibility  Visibility     `json:"visibility,omitempty"` // defaults to live
+	Anonymous   bool           `json:"anonymous,omitempty"`
+	VoterSalt   string         `json:"voter_salt,omitempty"` // scopes voter hashes of anonymous polls
+	Voters      []string       `json:"voters,omitempty"`     // voter hashes of anonymous polls, one per ballot
+	CreatedAt   time.Time      `json:"created_at"`
+	PrevPoll    string         `json:"previous_poll,omitempty"`
+	Choices     []Choice       `json:"choices"`
+	Ballots     []BallotExport `json:"ballots"`
+}
+
+type BallotExport struct {
+	UserID string    `json:"user_id"`
+	Votes  []int     `json:"votes"` // mapped to choice ids of the export
+	CastAt time.Time `json:"cast_at"`
+}
+
+// Imported polls get new ids, choice ids are remapped as well
+type ImportResp struct {
+	Polls   map[string]string `json:"polls"`             // exported id -> new id
+	Choices map[int]int       `json:"choices,omitempty"` // exported id -> new id, omitted for CSV
+}
+
+// Messages and types for /api/admin/v1/backups
+
+type BackupInfo struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"` // bytes
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ListBackupsResp struct {
+	Backups []BackupInfo `json:"backups"` // newest backup first
+}
+
+// Messages and types for POST /api/admin/v1/restore
+
+type RestoreReq struct {
+	Name string `json:"name"` // backup name as listed by GET /api/admin/v1/backups
+}
+
+type RestoreResp struct {
+	Restored        string `json:"restored"`
+	Previous        string `json:"previous"`         // backup of the replaced database
+	WebhooksRemoved int64  `json:"webhooks_removed"` // restored webhooks without secret
+}
+
+// Messages and types for GET /api/admin/v1/audit
+
+type AuditAction string
+
+const (
+	AUDIT_CREATE         AuditAction = "create"
+	AUDIT_VOTE           AuditAction = "vote"
+	AUDIT_DELETE         AuditAction = "delete"
+	AUDIT_AUTO_CREATE    AuditAction = "auto_create" // successor created by the concluding vote
+	AUDIT_CLOSE          AuditAction = "close"
+	AUDIT_REOPEN         AuditAction = "reopen"
+	AUDIT_DELETE_CHAIN   AuditAction = "delete_chain" // one event per deleted poll
+	AUDIT_PURGE          AuditAction = "purge"        // one event per purged poll
+	AUDIT_RECOUNT        AuditAction = "recount"      // one event per fixed poll
+	AUDIT_IMPORT         AuditAction = "import"       // one event per imported poll
+	AUDIT_RESTORE        AuditAction = "restore"      // recorded in the restored database, without poll
+	AUDIT_UNDELETE       AuditAction = "undelete"     // deleted poll restored, one event per restored poll
+	AUDIT_EXPIRE         AuditAction = "expire"       // deleted poll purged after the trash retention
+	AUDIT_ADD_WEBHOOK    AuditAction = "add_webhook"
+	AUDIT_REMOVE_WEBHOOK AuditAction = "remove_webhook"
+)
+
+// Lists audit events matching all specified filters, newest event first
+type AuditReq struct {
+	PollID string      `query:"poll_id"`
+	Action AuditAction `query:"action"`
+	Actor  string      `query:"actor"`
+	Since  time.Time   `query:"since"`  // RFC 3339, inclusive
+	Until  time.Time   `query:"until"`  // RFC 3339, exclusive
+	Before int64       `query:"before"` // only events with smaller ids, for paging
+	Limit  int         `query:"limit"`  // 0 is the default of 100, at most 1000
+}
+
+type AuditResp struct {
+	Events []AuditEvent `json:"events"`         // newest event first
+	Next   int64        `json:"next,omitempty"` // before of the next page, omitted on the last page
+}
+
+type AuditEvent struct {
+	ID        int64           `json:"id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Action    AuditAction     `json:"action"`
+	PollID    string          `json:"poll_id,omitempty"`
+	Actor     string          `json:"actor"`
+	RequestID string          `json:"request_id,omitempty"`
+	Payload   json.RawMessage `json:"payload"`
+}
@@ -0,0 +1,9 @@
+package messages
+
+// Messages and types for /api/cache/stats
+
+type CacheStatsResp struct {
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Entries int    `json:"entries"`
+}
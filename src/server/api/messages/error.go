@@ -0,0 +1,80 @@
+package messages
+
+// Error body returned by all endpoints
+
+type ErrorCode string
+
+const (
+	// request errors
+	MALFORMED_REQUEST    ErrorCode = "malformed_request"
+	NOT_FOUND            ErrorCode = "not_found"
+	METHOD_NOT_ALLOWED   ErrorCode = "method_not_allowed"
+	UNAUTHORIZED         ErrorCode = "unauthorized"
+	TOO_FEW_CHOICES      ErrorCode = "too_few_choices"
+	EMPTY_TITLE          ErrorCode = "empty_title"
+	INVALID_TARGET_VOTES ErrorCode = "invalid_target_votes"
+	NO_VOTES             ErrorCode = "no_votes"
+	DUPLICATE_VOTES      ErrorCode = "duplicate_votes"
+	INVALID_VOTE_COUNT   ErrorCode = "invalid_vote_count"
+	INVALID_CHOICE       ErrorCode = "invalid_choice"
+
+	// poll state errors
+	POLL_NOT_FOUND          ErrorCode = "poll_not_found"
+	PREVIOUS_POLL_NOT_FOUND ErrorCode = "previous_poll_not_found"
+	POLL_CLOSED             ErrorCode = "poll_closed"
+	POLL_CONCLUDED          ErrorCode = "poll_concluded"
+	ALREADY_VOTED           ErrorCode = "already_voted"
+	POLL_NOT_DELETED        ErrorCode = "poll_not_deleted"
+
+	// identity errors
+	IDENTITY_REQUIRED  ErrorCode = "identity_required"
+	IDENTITY_DISABLED  ErrorCode = "identity_disabled"
+	INVITE_REQUIRED    ErrorCode = "invite_required"
+	INVALID_INVITE     ErrorCode = "invalid_invite"
+	INVITE_USED        ErrorCode = "invite_used"
+	RESULTS_HIDDEN     ErrorCode = "results_hidden"
+	ANONYMITY_DISABLED ErrorCode = "anonymity_disabled"
+
+	// webhook errors
+	WEBHOOKS_DISABLED ErrorCode = "webhooks_disabled"
+	WEBHOOK_NOT_FOUND ErrorCode = "webhook_not_found"
+
+	// backup errors
+	BACKUPS_DISABLED ErrorCode = "backups_disabled"
+	BACKUP_NOT_FOUND ErrorCode = "backup_not_found"
+	INVALID_BACKUP   ErrorCode = "invalid_backup"
+
+	// server errors
+	CONSTRAINT_VIOLATION ErrorCode = "constraint_violation"
+	BUSY                 ErrorCode = "busy"
+	TIMEOUT              ErrorCode = "timeout"
+	RATE_LIMITED         ErrorCode = "rate_limited"
+	UNAVAILABLE          ErrorCode = "unavailable"
+	INTERNAL_ERROR       ErrorCode = "internal_error"
+)
+
+type Error struct {
+	Code    ErrorCode      `json:"code"`
+	Message string         `json:"message"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Errors match if their codes are equal, details are ignored.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Returns a copy of the error with additional details.
+func (e *Error) WithDetails(key string, value any) *Error {
+	details := make(map[string]any, len(e.Details)+1)
+	for k, v := range e.Details {
+		details[k] = v
+	}
+	details[key] = value
+	return &Error{Code: e.Code, Message: e.Message, Details: details}
+}
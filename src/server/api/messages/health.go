@@ -0,0 +1,29 @@
+package messages
+
+// Messages and types for /healthz and /readyz
+
+type HealthStatus string
+
+const (
+	HEALTH_OK        HealthStatus = "ok"
+	HEALTH_FAILED    HealthStatus = "failed"
+	HEALTH_SKIPPED   HealthStatus = "skipped"
+	HEALTH_READY     HealthStatus = "ready"
+	HEALTH_NOT_READY HealthStatus = "not_ready"
+	HEALTH_DEGRADED  HealthStatus = "degraded"
+)
+
+type LivenessResp struct {
+	Status HealthStatus `json:"status"`
+}
+
+type ReadinessResp struct {
+	Status HealthStatus           `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+type CheckResult struct {
+	Status     HealthStatus `json:"status"`
+	DurationMs float64      `json:"duration_ms"`
+	Message    string       `json:"message,omitempty"`
+}
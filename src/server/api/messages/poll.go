@@ -1,17 +1,32 @@
 package messages
 
+import "time"
+
 // Messages and types for /api/poll/v1/create
 type CreatePollReq struct {
-	Title       string   `json:"title"`
-	TargetVotes uint     `json:"votes"`
-	Choices     []string `json:"choices"`
-	Type        PollType `json:"type"`
-	PrevPollID  string   `json:"previous_poll_id"`
-	AutoCreate  bool     `json:"auto_create"`
+	Title       string     `json:"title"`
+	TargetVotes uint       `json:"votes"`
+	Choices     []string   `json:"choices"`
+	Type        PollType   `json:"type"`
+	PrevPollID  string     `json:"previous_poll_id"`
+	AutoCreate  bool       `json:"auto_create"`
+	Identity    Identity   `json:"identity"`   // defaults to raw
+	Invitees    []string   `json:"invitees"`   // makes the poll invite only, one token per invitee
+	Invites     uint       `json:"invites"`    // makes the poll invite only with unnamed tokens
+	Visibility  Visibility `json:"visibility"` // defaults to live
+	Anonymous   bool       `json:"anonymous"`  // ballots can't be traced back to voters
 }
 
+// Tokens are only returned once, the server stores their hashes
 type CreatePollResp struct {
-	PollID string `json:"poll_id"`
+	PollID     string   `json:"poll_id"`
+	OwnerToken string   `json:"owner_token"` // lists the invites of the poll and its successors
+	Invites    []Invite `json:"invites,omitempty"`
+}
+
+type Invite struct {
+	Name  string `json:"name"` // votes are cast as this user
+	Token string `json:"token"`
 }
 
 type PollType string
@@ -21,24 +36,58 @@ const (
 	SINGLE   PollType = "single"
 )
 
+// How voters of a poll are identified. Each voter can vote once per poll.
+type Identity string
+
+const (
+	IDENTITY_RAW           Identity = "raw"           // user id supplied by the client
+	IDENTITY_SIGNED        Identity = "signed"        // anonymous id of the signed identity cookie
+	IDENTITY_AUTHENTICATED Identity = "authenticated" // user authenticated by a reverse proxy
+)
+
+// When tallies of a poll are shown. Concluded and closed polls always show their tallies.
+type Visibility string
+
+const (
+	RESULTS_LIVE   Visibility = "live"   // while voting
+	RESULTS_VOTED  Visibility = "voted"  // to callers who voted
+	RESULTS_CLOSED Visibility = "closed" // once the poll concluded or was closed
+)
+
 // Messages and types for /api/poll/v1/vote
 
 type VotePollReq struct {
 	PollID string `json:"poll_id"`
-	UserID string `json:"user_id"`
-	Votes  []int  `json:"votes"` // mapped to choice_id
+	UserID string `json:"user_id"` // ignored unless the poll identifies voters by raw ids
+	Votes  []int  `json:"votes"`   // mapped to choice_id
+	Token  string `json:"token"`   // invite token of invite only polls
 }
 
 // Messages and types for /api/poll/v1/delete
 
+// Poll id and scope can be passed as query parameters or JSON body
 type DeletePollReq struct {
-	PollID string `json:"poll_id"`
+	PollID string      `json:"poll_id" query:"poll_id"`
+	Scope  DeleteScope `json:"scope" query:"scope"` // defaults to poll
 }
 
+// Polls affected by deleting or restoring a poll. Deleted polls can be restored until
+// they are purged after the trash retention.
+type DeleteScope string
+
+const (
+	SCOPE_POLL  DeleteScope = "poll"  // only the poll, deleting it splits its chain
+	SCOPE_CHAIN DeleteScope = "chain" // every poll of the poll's chain
+)
+
 // Messages and types for /api/poll/v1/data
 
+// Poll id can be passed as path parameter, query parameter or (deprecated) JSON body.
+// Callers identify themselves like voters to see tallies of polls showing them to voters.
 type GetPollDataReq struct {
-	PollID string `json:"poll_id"`
+	PollID string `json:"poll_id" query:"poll_id" param:"poll_id"`
+	UserID string `query:"user_id"`
+	Token  string `query:"token"` // invite token
 }
 
 type GetPollDataResp struct {
@@ -46,15 +95,18 @@ type GetPollDataResp struct {
 	VotesCast     uint           `json:"votes_cast"`
 	Type          PollType       `json:"type"`
 	Choices       map[int]string `json:"choices"` // id -> text
-	Votes         map[int]uint   `json:"votes"`   // id -> number of votes
+	Votes         map[int]uint   `json:"votes"`   // id -> number of votes, empty if hidden
+	Visibility    Visibility     `json:"visibility"`
+	Hidden        bool           `json:"hidden"` // tallies are hidden from the caller
 	NextPoll      string         `json:"next_poll"`
 	LatestPoll    string         `json:"latest_poll"`
 }
 
 // Messages and types for /api/poll/v1/status
 
+// Poll id can be passed as path parameter, query parameter or (deprecated) JSON body
 type GetPollStatusReq struct {
-	PollID string `json:"poll_id"`
+	PollID string `json:"poll_id" query:"poll_id" param:"poll_id"`
 }
 
 type GetPollStatusResp struct {
@@ -62,3 +114,44 @@ type GetPollStatusResp struct {
 	VotesCast     uint   `json:"votes_cast"`
 	NextPoll      string `json:"next_poll"`
 }
+
+// Messages and types for /api/poll/v1/export
+
+type ExportFormat string
+
+const (
+	EXPORT_JSON     ExportFormat = "json"
+	EXPORT_CSV      ExportFormat = "csv"
+	EXPORT_MARKDOWN ExportFormat = "md"
+)
+
+type ExportPollReq struct {
+	PollID  string       `query:"poll_id"`
+	Format  ExportFormat `query:"format"`  // defaults to json
+	Ballots bool         `query:"ballots"` // include anonymized ballots
+	Chain   bool         `query:"chain"`   // include all polls of the chain
+}
+
+type ExportPollResp struct {
+	Polls []PollResultExport `json:"polls"` // oldest poll first
+}
+
+type PollResultExport struct {
+	PollID        string         `json:"poll_id"`
+	Title         string         `json:"title"`
+	Type          PollType       `json:"type"`
+	VotesRequired uint           `json:"votes_required"`
+	VotesCast     uint           `json:"votes_cast"`
+	Concluded     bool           `json:"concluded"`
+	Closed        bool           `json:"closed"`
+	CreatedAt     time.Time      `json:"created_at"`
+	Results       []ChoiceResult `json:"results"` // ordered by number of votes
+	Winners       []Choice       `json:"winners"` // choices with the most votes
+	Ballots       []Ballot       `json:"ballots,omitempty"`
+}
+
+// Voters are numbered in the order they voted, user ids aren't exported
+type Ballot struct {
+	Voter int   `json:"voter"`
+	Votes []int `json:"votes"` // mapped to choice_id
+}
@@ -0,0 +1,180 @@
+package messages
+
+import "time"
+
+// Messages and types for POST /api/v2/polls use CreatePollReq and CreatePollResp
+
+// Messages and types for GET /api/v2/polls/{poll_id}
+
+type PollResp struct {
+	ID            string     `json:"id"`
+	Title         string     `json:"title"`
+	Type          PollType   `json:"type"`
+	VotesRequired uint       `json:"votes_required"`
+	VotesCast     uint       `json:"votes_cast"`
+	AutoCreate    bool       `json:"auto_create"`
+	Concluded     bool       `json:"concluded"`
+	Closed        bool       `json:"closed"` // closed by an admin
+	Identity      Identity   `json:"identity"`
+	InviteOnly    bool       `json:"invite_only"`
+	Visibility    Visibility `json:"visibility"`
+	Anonymous     bool       `json:"anonymous"`
+	Choices       []Choice   `json:"choices"`
+	PrevPoll      string     `json:"previous_poll"`
+	NextPoll      string     `json:"next_poll"`
+	LatestPoll    string     `json:"latest_poll"`
+}
+
+type Choice struct {
+	ID      int    `json:"id"`
+	Content string `json:"content"`
+}
+
+// Messages and types for DELETE /api/v2/polls/{poll_id}
+
+type DeletePollV2Req struct {
+	Scope DeleteScope `query:"scope"` // defaults to poll
+}
+
+// Messages and types for POST /api/v2/polls/{poll_id}/restore
+
+// Body is optional
+type RestorePollReq struct {
+	Scope DeleteScope `json:"scope"` // defaults to poll, chain restores all deleted polls of the chain
+}
+
+type RestorePollResp struct {
+	Restored []string `json:"restored"` // oldest poll first
+}
+
+// Messages and types for POST /api/v2/polls/{poll_id}/votes
+
+type CastVotesReq struct {
+	UserID string `json:"user_id"` // ignored unless the poll identifies voters by raw ids
+	Votes  []int  `json:"votes"`   // mapped to choice_id
+	Token  string `json:"token"`   // invite token of invite only polls
+}
+
+// Messages and types for GET /api/v2/polls/{poll_id}/results
+
+// Callers identify themselves like voters to see tallies of polls showing them to voters
+type PollResultsReq struct {
+	UserID string `query:"user_id"`
+	Token  string `query:"token"` // invite token
+}
+
+type PollResultsResp struct {
+	PollID        string         `json:"poll_id"`
+	VotesRequired uint           `json:"votes_required"`
+	VotesCast     uint           `json:"votes_cast"`
+	Concluded     bool           `json:"concluded"`
+	Closed        bool           `json:"closed"` // closed by an admin
+	Visibility    Visibility     `json:"visibility"`
+	Hidden        bool           `json:"hidden"`  // tallies are hidden from the caller
+	Results       []ChoiceResult `json:"results"` // ordered by number of votes, empty if hidden
+	Winners       []int          `json:"winners"` // choice ids with the most votes, empty if hidden
+}
+
+type ChoiceResult struct {
+	ID      int    `json:"id"`
+	Content string `json:"content"`
+	Votes   uint   `json:"votes"`
+}
+
+// Messages and types for GET /api/v2/polls/{poll_id}/invites, requires the owner token
+
+type PollInvitesResp struct {
+	PollID  string         `json:"poll_id"`
+	Invites []InviteStatus `json:"invites"` // in order of creation
+	Pending []string       `json:"pending"` // invitees who haven't voted yet
+}
+
+type InviteStatus struct {
+	Name    string     `json:"name"`
+	Voted   bool       `json:"voted"`
+	VotedAt *time.Time `json:"voted_at"` // null until the invitee voted, always null for anonymous polls
+}
+
+// Messages and types for GET /api/v2/polls/{poll_id}/chain
+
+type PollChainResp struct {
+	Polls []string `json:"polls"` // oldest poll first
+}
+
+// Messages and types for /api/v2/polls/{poll_id}/webhooks, require the owner token
+
+type WebhookEvent string
+
+const (
+	EVENT_VOTE_CAST    WebhookEvent = "vote.cast"
+	EVENT_CONCLUDED    WebhookEvent = "poll.concluded"
+	EVENT_AUTO_CREATED WebhookEvent = "poll.auto_created"
+	EVENT_POLL_DELETED WebhookEvent = "poll.deleted"
+)
+
+type CreateWebhookReq struct {
+	URL    string         `json:"url"`
+	Events []WebhookEvent `json:"events"` // subscribes to all events if empty
+}
+
+// Secret is only returned once
+type CreateWebhookResp struct {
+	Webhook
+	Secret string `json:"secret"` // HMAC-SHA256 key of the payload signatures
+}
+
+type Webhook struct {
+	ID        string         `json:"id"`
+	PollID    string         `json:"poll_id"`
+	URL       string         `json:"url"`
+	Events    []WebhookEvent `json:"events"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+type ListWebhooksResp struct {
+	Webhooks []Webhook `json:"webhooks"` // in order of creation
+}
+
+// Messages and types for GET /api/v2/polls/{poll_id}/webhooks/{webhook_id}/deliveries
+
+type WebhookDeliveriesReq struct {
+	Limit int `query:"limit"` // defaults to 50
+}
+
+type WebhookDeliveriesResp struct {
+	Deliveries []WebhookDelivery `json:"deliveries"` // newest delivery first
+}
+
+type DeliveryStatus string
+
+const (
+	DELIVERY_PENDING   DeliveryStatus = "pending"
+	DELIVERY_DELIVERED DeliveryStatus = "delivered"
+	DELIVERY_FAILED    DeliveryStatus = "failed" // all attempts failed
+)
+
+type WebhookDelivery struct {
+	ID            string            `json:"id"`
+	EventID       string            `json:"event_id"`
+	Event         WebhookEvent      `json:"event"`
+	Status        DeliveryStatus    `json:"status"`
+	CreatedAt     time.Time         `json:"created_at"`
+	NextAttemptAt *time.Time        `json:"next_attempt_at"` // null once the delivery finished
+	Attempts      []DeliveryAttempt `json:"attempts"`        // oldest attempt first
+}
+
+type DeliveryAttempt struct {
+	CreatedAt  time.Time `json:"created_at"`
+	StatusCode int       `json:"status_code"` // 0 if no response was received
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// Body of webhook deliveries, signed with the secret of the webhook
+type WebhookPayload struct {
+	ID        string       `json:"id"` // event id, shared by deliveries of the event to all webhooks of the poll
+	Event     WebhookEvent `json:"event"`
+	PollID    string       `json:"poll_id"`
+	CreatedAt time.Time    `json:"created_at"`
+	Data      any          `json:"data"`
+}
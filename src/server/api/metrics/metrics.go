@@ -0,0 +1,110 @@
+// Prometheus metrics of the api server.
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "moviepoll"
+
+type Metrics struct {
+	PollsCreated      prometheus.Counter
+	SuccessorsCreated prometheus.Counter
+	VotesCast         *prometheus.CounterVec // by poll type
+	VotesRejected     *prometheus.CounterVec // by error code
+	Errors            *prometheus.CounterVec // error responses by error code and sqlite error code
+	WebhookAttempts   *prometheus.CounterVec // by event and result
+
+	HandlerDuration *prometheus.HistogramVec // by method, route and status
+	QueryDuration   *prometheus.HistogramVec // by query
+}
+
+// Creates all metrics and registers them with reg.
+func New(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		PollsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "polls_created_total",
+			Help:      "Number of polls created by clients.",
+		}),
+		SuccessorsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "successor_polls_created_total",
+			Help:      "Number of polls created automatically after their predecessor concluded.",
+		}),
+		VotesCast: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "votes_cast_total",
+			Help:      "Number of accepted ballots by poll type.",
+		}, []string{"poll_type"}),
+		VotesRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "votes_rejected_total",
+			Help:      "Number of rejected ballots by reason.",
+		}, []string{"reason"}),
+		Errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "error_responses_total",
+			Help:      "Number of error responses by error code and underlying SQLite error code (none if not caused by SQLite).",
+		}, []string{"code", "sqlite_code"}),
+		WebhookAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "webhook_attempts_total",
+			Help:      "Number of webhook delivery attempts by event and result (delivered, retry or failed).",
+		}, []string{"event", "result"}),
+		HandlerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Duration of handled requests by method, route and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		QueryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "db_query_duration_seconds",
+			Help:      "Duration of database queries and transactions by query.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"query"}),
+	}
+
+	reg.MustRegister(
+		m.PollsCreated,
+		m.SuccessorsCreated,
+		m.VotesCast,
+		m.VotesRejected,
+		m.Errors,
+		m.WebhookAttempts,
+		m.HandlerDuration,
+		m.QueryDuration,
+	)
+	return m
+}
+
+// Returns a function observing the time passed since calling ObserveQuery, meant to be deferred.
+func (m *Metrics) ObserveQuery(query string) func() {
+	start := time.Now()
+	return func() {
+		m.QueryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Middleware observing the duration of all requests. Unknown routes are grouped by echo
+// under the same route to keep cardinality low.
+func (m *Metrics) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+
+		// let the error handler write the response, so the status is known
+		if err := next(c); err != nil {
+			c.Error(err)
+		}
+
+		status := strconv.Itoa(c.Response().Status)
+		m.HandlerDuration.WithLabelValues(c.Request().Method, c.Path(), status).
+			Observe(time.Since(start).Seconds())
+		return nil
+	}
+}
@@ -2,20 +2,49 @@ package util
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"io"
+	"log/slog"
 	"math"
+	"math/rand"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
-type Logger struct {
-	Debug *log.Logger
-	Info  *log.Logger
-	Warn  *log.Logger
-	Error *log.Logger
-	Fatal *log.Logger
+// Creates a logger writing to w. Records below level (debug, info, warn or error) are discarded.
+// Format is either text (key=value pairs) or json (one JSON object per line).
+func NewLogger(w io.Writer, level string, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+type loggerKey struct{}
+
+// Returns a copy of ctx carrying the logger.
+func ContextWithLogger(ctx context.Context, log *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, log)
+}
+
+// Returns the logger carried by ctx or fallback if there is none.
+func LoggerFromContext(ctx context.Context, fallback *slog.Logger) *slog.Logger {
+	if log, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return log
+	}
+	return fallback
 }
 
 type ExpBackoffContext struct {
@@ -49,6 +78,59 @@ func (c *ExpBackoffContext) Reset() {
 	c.retries = 0
 }
 
+// Skips the next retries backoff durations, e.g. to continue backing off after a restart.
+func (c *ExpBackoffContext) Skip(retries uint) {
+	c.retries += retries
+}
+
+// Returns the current backoff duration, randomly deviating by up to jitter (0 to 1) of it.
+func (c *ExpBackoffContext) Delay(jitter float64) time.Duration {
+	delay := c.base.Seconds() * math.Pow(c.mult, float64(c.retries))
+	delay *= 1 + jitter*(2*rand.Float64()-1)
+	return time.Duration(delay * float64(time.Second))
+}
+
+// Waits for the current backoff duration and advances to the next one.
+// Returns the context error if the context is done before.
+func (c *ExpBackoffContext) Wait(jitter float64) error {
+	timer := time.NewTimer(c.Delay(jitter))
+	defer timer.Stop()
+	c.retries++
+
+	select {
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type RetryPolicy struct {
+	Attempts   int           // maximum number of attempts, including the first one
+	Base       time.Duration // wait time after the first attempt
+	Multiplier float64
+	Jitter     float64 // relative random deviation of wait times (0 to 1)
+}
+
+// Calls fn until it succeeds, fails with an error that is not retryable or all attempts are used up.
+// Waits with exponential backoff between attempts. Returns the number of attempts and the last error.
+func (p RetryPolicy) Do(
+	ctx context.Context,
+	retryable func(error) bool,
+	fn func(context.Context) error) (int, error) {
+
+	backoff := NewExpBackoffContext(ctx, p.Base, p.Multiplier)
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || !retryable(err) || attempt >= p.Attempts {
+			return attempt, err
+		}
+		if err := backoff.Wait(p.Jitter); err != nil {
+			return attempt, err
+		}
+	}
+}
+
 func HasDuplicates[T comparable](values []T) bool {
 	visited := make(map[T]bool, len(values))
 	for _, val := range values {
@@ -0,0 +1,54 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log, err := NewLogger(&buf, "warn", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Info("Discarded")
+	log.Warn("Poll not found", "poll_id", "p1")
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("invalid record %q: %v", buf.String(), err)
+	}
+	if record["level"] != "WARN" || record["msg"] != "Poll not found" || record["poll_id"] != "p1" {
+		t.Errorf("unexpected record %v", record)
+	}
+
+	buf.Reset()
+	if log, err = NewLogger(&buf, "debug", "text"); err != nil {
+		t.Fatal(err)
+	}
+	log.Debug("Creating poll", "poll_id", "p1")
+	if !strings.Contains(buf.String(), "level=DEBUG") || !strings.Contains(buf.String(), "poll_id=p1") {
+		t.Errorf("unexpected record %q", buf.String())
+	}
+
+	if _, err := NewLogger(&buf, "verbose", "text"); err == nil {
+		t.Error("unknown level was accepted")
+	}
+	if _, err := NewLogger(&buf, "info", "xml"); err == nil {
+		t.Error("unknown format was accepted")
+	}
+}
+
+func TestLoggerFromContext(t *testing.T) {
+	fallback, log := slog.Default(), slog.Default().With("request_id", "r1")
+	if LoggerFromContext(context.Background(), fallback) != fallback {
+		t.Error("context without logger didn't return the fallback")
+	}
+	if LoggerFromContext(ContextWithLogger(context.Background(), log), fallback) != log {
+		t.Error("context didn't return its logger")
+	}
+}
@@ -0,0 +1,553 @@
+// Configuration shared by the api and render servers.
+//
+// Settings are layered, later layers override earlier ones:
+// defaults < config file (YAML or TOML) < environment variables < command line flags.
+// Every flag can be set with an environment variable named MOVIEPOLL_<FLAG>,
+// e.g. MOVIEPOLL_POLLDB for -polldb.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const envPrefix = "MOVIEPOLL_"
+
+type Config struct {
+	Server    Server    `yaml:"server" toml:"server"`
+	DB        DB        `yaml:"db" toml:"db"`
+	Timeouts  Timeouts  `yaml:"timeouts" toml:"timeouts"`
+	RateLimit RateLimit `yaml:"rate_limit" toml:"rate_limit"`
+	CORS      CORS      `yaml:"cors" toml:"cors"`
+	TLS       TLS       `yaml:"tls" toml:"tls"`
+	Log       Log       `yaml:"log" toml:"log"`
+	Tracing   Tracing   `yaml:"tracing" toml:"tracing"`
+	Render    Render    `yaml:"render" toml:"render"`
+	Admin     Admin     `yaml:"admin" toml:"admin"`
+	Backup    Backup    `yaml:"backup" toml:"backup"`
+	Trash     Trash     `yaml:"trash" toml:"trash"`
+	Webhooks  Webhooks  `yaml:"webhooks" toml:"webhooks"`
+	Identity  Identity  `yaml:"identity" toml:"identity"`
+
+	File        string `yaml:"-" toml:"-"` // config file the settings were loaded from
+	PrintConfig bool   `yaml:"-" toml:"-"` // print effective config and exit
+}
+
+type Server struct {
+	Host string `yaml:"host" toml:"host"`
+	Port int    `yaml:"port" toml:"port"`
+}
+
+type DB struct {
+	DSN             string        `yaml:"dsn" toml:"dsn"`
+	MaxOpenConns    int           `yaml:"max_open_conns" toml:"max_open_conns"` // 0 is unlimited
+	MaxIdleConns    int           `yaml:"max_idle_conns" toml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" toml:"conn_max_lifetime"` // 0 is unlimited
+	BusyTimeout     time.Duration `yaml:"busy_timeout" toml:"busy_timeout"`
+}
+
+type Timeouts struct {
+	Read      time.Duration            `yaml:"read" toml:"read"`
+	Write     time.Duration            `yaml:"write" toml:"write"`
+	Idle      time.Duration            `yaml:"idle" toml:"idle"`
+	Shutdown  time.Duration            `yaml:"shutdown" toml:"shutdown"`
+	Handler   time.Duration            `yaml:"handler" toml:"handler"`
+	Endpoints map[string]time.Duration `yaml:"endpoints" toml:"endpoints"` // endpoint specific handler timeouts
+}
+
+// Per client request rate limits. Disabled if rate is 0.
+type RateLimit struct {
+	Rate    float64       `yaml:"rate" toml:"rate"` // requests per second
+	Burst   int           `yaml:"burst" toml:"burst"`
+	Expires time.Duration `yaml:"expires" toml:"expires"` // forget clients after inactivity
+}
+
+// Cross-origin requests of browser clients, disabled if no origins are allowed.
+type CORS struct {
+	AllowOrigins     []string      `yaml:"allow_origins" toml:"allow_origins"` // * allows all origins
+	AllowMethods     []string      `yaml:"allow_methods" toml:"allow_methods"`
+	AllowHeaders     []string      `yaml:"allow_headers" toml:"allow_headers"`   // request headers
+	ExposeHeaders    []string      `yaml:"expose_headers" toml:"expose_headers"` // response headers readable by clients
+	AllowCredentials bool          `yaml:"allow_credentials" toml:"allow_credentials"`
+	MaxAge           time.Duration `yaml:"max_age" toml:"max_age"` // how long browsers cache preflight responses, 0 disables caching
+}
+
+// Serves HTTPS if both files are set.
+type TLS struct {
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+}
+
+type Log struct {
+	Level  string `yaml:"level" toml:"level"`   // debug, info, warn or error
+	Format string `yaml:"format" toml:"format"` // text or json
+}
+
+// Trace export, disabled if exporter is none.
+type Tracing struct {
+	Exporter    string  `yaml:"exporter" toml:"exporter"`         // none, stdout or otlp
+	Endpoint    string  `yaml:"endpoint" toml:"endpoint"`         // OTLP/HTTP collector, e.g. localhost:4318
+	Insecure    bool    `yaml:"insecure" toml:"insecure"`         // use plain HTTP for OTLP
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio"` // ratio of sampled root spans (0 to 1)
+}
+
+type Render struct {
+	Host     string `yaml:"host" toml:"host"`
+	Port     int    `yaml:"port" toml:"port"`
+	URL      string `yaml:"url" toml:"url"`           // base url the api reaches the render service at, checked for readiness if set
+	Required bool   `yaml:"required" toml:"required"` // api isn't ready while the render service fails, only degraded otherwise
+}
+
+// Admin API under /api/admin/v1, disabled if no token is set.
+type Admin struct {
+	Token string `yaml:"token" toml:"token"` // bearer token required by admin requests
+}
+
+// Backups of the poll database, disabled if no directory is set.
+type Backup struct {
+	Dir      string        `yaml:"dir" toml:"dir"`
+	Interval time.Duration `yaml:"interval" toml:"interval"` // 0 disables scheduled backups
+	Keep     int           `yaml:"keep" toml:"keep"`         // number of backups to keep, 0 keeps all
+}
+
+// Deleted polls can be restored until they are purged after the retention period.
+type Trash struct {
+	Retention time.Duration `yaml:"retention" toml:"retention"`
+	Interval  time.Duration `yaml:"interval" toml:"interval"` // of purging expired polls, 0 disables purging
+}
+
+// Webhooks registered by poll owners. Deliveries are retried with exponential backoff,
+// webhooks are disabled if no interval is set.
+type Webhooks struct {
+	Interval     time.Duration `yaml:"interval" toml:"interval"`           // of checking for due deliveries, 0 disables webhooks
+	Timeout      time.Duration `yaml:"timeout" toml:"timeout"`             // of a single delivery attempt
+	Attempts     int           `yaml:"attempts" toml:"attempts"`           // per delivery, including the first one
+	Backoff      time.Duration `yaml:"backoff" toml:"backoff"`             // wait after the first failed attempt, doubles after every further one
+	Retention    time.Duration `yaml:"retention" toml:"retention"`         // of finished deliveries and their attempts
+	AllowPrivate bool          `yaml:"allow_private" toml:"allow_private"` // deliver to loopback and private addresses
+}
+
+// Voter identities. Signed anonymous identities are disabled if no secret is set,
+// authenticated identities are disabled if no user header is set and anonymous ballots
+// are disabled if no ballot secret is set.
+type Identity struct {
+	Secret     string        `yaml:"secret" toml:"secret"` // HMAC key signing identity cookies, at least 32 bytes
+	Cookie     string        `yaml:"cookie" toml:"cookie"` // name of the identity cookie
+	MaxAge     time.Duration `yaml:"max_age" toml:"max_age"`
+	Secure     bool          `yaml:"secure" toml:"secure"`           // only send the cookie via HTTPS
+	UserHeader string        `yaml:"user_header" toml:"user_header"` // user set by an authenticating proxy, e.g. X-Forwarded-User
+	// HMAC key hashing voters of anonymous polls, at least 32 bytes. Changing it lets voters
+	// of open anonymous polls vote again.
+	BallotSecret string `yaml:"ballot_secret" toml:"ballot_secret"`
+}
+
+func Default() *Config {
+	return &Config{
+		Server: Server{Port: 35555},
+		DB: DB{
+			DSN:          "file::memory:?cache=shared",
+			MaxIdleConns: 2,
+			BusyTimeout:  5 * time.Second,
+		},
+		Timeouts: Timeouts{
+			Read:      15 * time.Second,
+			Write:     30 * time.Second,
+			Idle:      120 * time.Second,
+			Shutdown:  30 * time.Second,
+			Handler:   10 * time.Second,
+			Endpoints: map[string]time.Duration{},
+		},
+		RateLimit: RateLimit{Burst: 20, Expires: 3 * time.Minute},
+		CORS: CORS{
+			AllowOrigins:  []string{},
+			AllowMethods:  []string{"GET", "HEAD", "POST", "DELETE"},
+			AllowHeaders:  []string{"Content-Type", "X-Request-Id"},
+			ExposeHeaders: []string{"X-Request-Id", "Content-Disposition"},
+			MaxAge:        10 * time.Minute,
+		},
+		Log:     Log{Level: "info", Format: "text"},
+		Tracing: Tracing{Exporter: "none", SampleRatio: 1},
+		Render:  Render{Port: 35556},
+		Backup:  Backup{Keep: 7},
+		Trash:   Trash{Retention: 30 * 24 * time.Hour, Interval: time.Hour},
+		Webhooks: Webhooks{
+			Interval:  5 * time.Second,
+			Timeout:   10 * time.Second,
+			Attempts:  8,
+			Backoff:   30 * time.Second,
+			Retention: 7 * 24 * time.Hour,
+		},
+		Identity: Identity{
+			Cookie: "moviepoll_id",
+			MaxAge: 365 * 24 * time.Hour,
+		},
+	}
+}
+
+// Loads the effective config for the named program from all layers.
+func Load(name string, args []string) (*Config, error) {
+	// first pass only looks for the config file, but reports invalid flags early
+	scratch := Default()
+	fs := scratch.flagSet(name)
+	if err := fs.Parse(args); err != nil {
+		fs.SetOutput(os.Stderr)
+		fs.Usage()
+		return nil, err
+	}
+	if scratch.File == "" {
+		scratch.File = os.Getenv(envPrefix + "CONFIG")
+	}
+
+	cfg := Default()
+	if scratch.File != "" {
+		if err := cfg.loadFile(scratch.File); err != nil {
+			return nil, err
+		}
+	}
+
+	// flags are defined with the current values as defaults, so only
+	// variables and arguments that are actually set override them
+	fs = cfg.flagSet(name)
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		env := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(env); ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Errorf("invalid value %q for %s: %w", value, env, err))
+			}
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	fs.StringVar(&c.File, "config", c.File, "config file (.yaml, .yml or .toml)")
+	fs.BoolVar(&c.PrintConfig, "print-config", c.PrintConfig, "print effective config and exit")
+
+	fs.StringVar(&c.Server.Host, "host", c.Server.Host, "api bind address (empty for all interfaces)")
+	fs.IntVar(&c.Server.Port, "port", c.Server.Port, "api port")
+
+	fs.StringVar(&c.DB.DSN, "polldb", c.DB.DSN, "sqlite connection string for the poll database")
+	fs.IntVar(&c.DB.MaxOpenConns, "dbmaxopen", c.DB.MaxOpenConns, "maximum number of open database connections (0 is unlimited)")
+	fs.IntVar(&c.DB.MaxIdleConns, "dbmaxidle", c.DB.MaxIdleConns, "maximum number of idle database connections")
+	fs.DurationVar(&c.DB.ConnMaxLifetime, "dbconnlifetime", c.DB.ConnMaxLifetime, "maximum lifetime of database connections (0 is unlimited)")
+	fs.DurationVar(&c.DB.BusyTimeout, "busytimeout", c.DB.BusyTimeout, "how long to wait for database locks before failing")
+
+	fs.DurationVar(&c.Timeouts.Read, "readtimeout", c.Timeouts.Read, "maximum duration for reading entire requests")
+	fs.DurationVar(&c.Timeouts.Write, "writetimeout", c.Timeouts.Write, "maximum duration before timing out writes of responses")
+	fs.DurationVar(&c.Timeouts.Idle, "idletimeout", c.Timeouts.Idle, "how long to keep idle keep-alive connections open")
+	fs.DurationVar(&c.Timeouts.Shutdown, "shutdowntimeout", c.Timeouts.Shutdown, "how long to wait for in-flight requests on shutdown")
+	fs.DurationVar(&c.Timeouts.Handler, "handlertimeout", c.Timeouts.Handler, "default timeout for handling requests")
+	fs.Var((*durationMap)(&c.Timeouts.Endpoints), "endpointtimeouts", "comma separated endpoint specific handler timeouts, e.g. vote=15s,data=5s")
+
+	fs.Float64Var(&c.RateLimit.Rate, "ratelimit", c.RateLimit.Rate, "requests per second and client (0 disables rate limiting)")
+	fs.IntVar(&c.RateLimit.Burst, "rateburst", c.RateLimit.Burst, "number of requests a client may send at once")
+	fs.DurationVar(&c.RateLimit.Expires, "rateexpires", c.RateLimit.Expires, "how long to remember inactive clients")
+
+	fs.Var((*stringList)(&c.CORS.AllowOrigins), "corsorigins", "comma separated origins allowed to call the api from browsers (* allows all origins)")
+	fs.Var((*stringList)(&c.CORS.AllowMethods), "corsmethods", "comma separated methods allowed in cross-origin requests")
+	fs.Var((*stringList)(&c.CORS.AllowHeaders), "corsheaders", "comma separated request headers allowed in cross-origin requests")
+	fs.Var((*stringList)(&c.CORS.ExposeHeaders), "corsexpose", "comma separated response headers exposed to cross-origin clients")
+	fs.BoolVar(&c.CORS.AllowCredentials, "corscredentials", c.CORS.AllowCredentials, "allow cross-origin requests with cookies and authorization headers")
+	fs.DurationVar(&c.CORS.MaxAge, "corsmaxage", c.CORS.MaxAge, "how long browsers may cache preflight responses (0 disables caching)")
+
+	fs.StringVar(&c.TLS.CertFile, "tlscert", c.TLS.CertFile, "TLS certificate file")
+	fs.StringVar(&c.TLS.KeyFile, "tlskey", c.TLS.KeyFile, "TLS private key file")
+
+	fs.StringVar(&c.Log.Level, "loglevel", c.Log.Level, "log level (debug, info, warn or error)")
+	fs.StringVar(&c.Log.Format, "logformat", c.Log.Format, "log format (text or json)")
+	fs.Var(boolFunc(func() { c.Log.Level = "debug" }), "debug", "debug flag, same as -loglevel=debug")
+
+	fs.StringVar(&c.Tracing.Exporter, "tracing", c.Tracing.Exporter, "trace exporter (none, stdout or otlp)")
+	fs.StringVar(&c.Tracing.Endpoint, "otlpendpoint", c.Tracing.Endpoint, "OTLP/HTTP collector endpoint, e.g. localhost:4318 (defaults to OTEL_EXPORTER_OTLP_ENDPOINT)")
+	fs.BoolVar(&c.Tracing.Insecure, "otlpinsecure", c.Tracing.Insecure, "send traces to the OTLP collector via plain HTTP")
+	fs.Float64Var(&c.Tracing.SampleRatio, "tracesample", c.Tracing.SampleRatio, "ratio of sampled traces (0 to 1)")
+
+	fs.StringVar(&c.Render.Host, "renderhost", c.Render.Host, "render service bind address (empty for all interfaces)")
+	fs.IntVar(&c.Render.Port, "renderport", c.Render.Port, "render service port")
+	fs.StringVar(&c.Render.URL, "renderurl", c.Render.URL, "base url of the render service used by the api, e.g. http://localhost:35556")
+	fs.BoolVar(&c.Render.Required, "renderrequired", c.Render.Required, "report the api as not ready instead of degraded while the render service fails")
+
+	fs.StringVar(&c.Admin.Token, "admintoken", c.Admin.Token, "bearer token for the admin api (empty disables the admin api)")
+
+	fs.StringVar(&c.Backup.Dir, "backupdir", c.Backup.Dir, "directory for poll database backups (empty disables backups)")
+	fs.DurationVar(&c.Backup.Interval, "backupinterval", c.Backup.Interval, "interval of scheduled backups (0 disables scheduled backups)")
+	fs.IntVar(&c.Backup.Keep, "backupkeep", c.Backup.Keep, "number of backups to keep (0 keeps all)")
+
+	fs.DurationVar(&c.Trash.Retention, "trashretention", c.Trash.Retention, "how long deleted polls can be restored before they are purged")
+	fs.DurationVar(&c.Trash.Interval, "trashinterval", c.Trash.Interval, "interval of purging expired deleted polls (0 disables purging)")
+
+	fs.DurationVar(&c.Webhooks.Interval, "webhookinterval", c.Webhooks.Interval, "interval of checking for due webhook deliveries (0 disables webhooks)")
+	fs.DurationVar(&c.Webhooks.Timeout, "webhooktimeout", c.Webhooks.Timeout, "timeout of a single webhook delivery attempt")
+	fs.IntVar(&c.Webhooks.Attempts, "webhookattempts", c.Webhooks.Attempts, "attempts per webhook delivery, including the first one")
+	fs.DurationVar(&c.Webhooks.Backoff, "webhookbackoff", c.Webhooks.Backoff, "wait after the first failed webhook delivery attempt, doubles after every further one")
+	fs.DurationVar(&c.Webhooks.Retention, "webhookretention", c.Webhooks.Retention, "how long finished webhook deliveries are kept")
+	fs.BoolVar(&c.Webhooks.AllowPrivate, "webhookallowprivate", c.Webhooks.AllowPrivate, "deliver webhooks to loopback and private addresses")
+
+	fs.StringVar(&c.Identity.Secret, "identitysecret", c.Identity.Secret, "secret signing anonymous voter cookies, at least 32 bytes (empty disables signed identities)")
+	fs.StringVar(&c.Identity.Cookie, "identitycookie", c.Identity.Cookie, "name of the voter identity cookie")
+	fs.DurationVar(&c.Identity.MaxAge, "identitymaxage", c.Identity.MaxAge, "lifetime of voter identity cookies")
+	fs.BoolVar(&c.Identity.Secure, "identitysecure", c.Identity.Secure, "only send voter identity cookies via HTTPS")
+	fs.StringVar(&c.Identity.UserHeader, "userheader", c.Identity.UserHeader, "header carrying users authenticated by a reverse proxy (empty disables authenticated identities)")
+	fs.StringVar(&c.Identity.BallotSecret, "ballotsecret", c.Identity.BallotSecret, "secret hashing voters of anonymous polls, at least 32 bytes (empty disables anonymous ballots)")
+
+	return fs
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, c)
+	case ".toml":
+		err = toml.Unmarshal(data, c)
+	default:
+		return fmt.Errorf("unsupported config file type %q", ext)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	c.File = path
+	return nil
+}
+
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Server.Port < 0 || c.Server.Port > 65535 {
+		errs = append(errs, fmt.Errorf("invalid api port %d", c.Server.Port))
+	}
+	if c.Render.Port < 0 || c.Render.Port > 65535 {
+		errs = append(errs, fmt.Errorf("invalid render port %d", c.Render.Port))
+	}
+	if c.Render.URL != "" {
+		if u, err := url.Parse(c.Render.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid render url %q", c.Render.URL))
+		}
+	}
+	if c.DB.DSN == "" {
+		errs = append(errs, errors.New("poll database connection string must not be empty"))
+	}
+	if c.DB.MaxOpenConns < 0 || c.DB.MaxIdleConns < 0 {
+		errs = append(errs, errors.New("database pool sizes must not be negative"))
+	}
+	if c.Backup.Interval < 0 || c.Backup.Keep < 0 {
+		errs = append(errs, errors.New("backup interval and retention must not be negative"))
+	}
+	if c.Backup.Interval > 0 && c.Backup.Dir == "" {
+		errs = append(errs, errors.New("scheduled backups need a backup directory"))
+	}
+	if c.Trash.Retention < 0 || c.Trash.Interval < 0 {
+		errs = append(errs, errors.New("trash retention and interval must not be negative"))
+	}
+	if c.Webhooks.Interval < 0 || c.Webhooks.Retention < 0 {
+		errs = append(errs, errors.New("webhook interval and retention must not be negative"))
+	}
+	if c.Webhooks.Interval > 0 && (c.Webhooks.Timeout <= 0 || c.Webhooks.Attempts < 1 || c.Webhooks.Backoff <= 0) {
+		errs = append(errs, errors.New("webhooks need a positive timeout and backoff and at least one attempt"))
+	}
+	errs = append(errs, c.CORS.validate()...)
+	errs = append(errs, c.Identity.validate()...)
+	if c.RateLimit.Rate < 0 || c.RateLimit.Burst < 0 {
+		errs = append(errs, errors.New("rate limits must not be negative"))
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, errors.New("TLS needs both certificate and key file"))
+	}
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("invalid log level %q", c.Log.Level))
+	}
+	switch c.Tracing.Exporter {
+	case "none", "stdout", "otlp":
+	default:
+		errs = append(errs, fmt.Errorf("invalid trace exporter %q", c.Tracing.Exporter))
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("invalid trace sample ratio %g", c.Tracing.SampleRatio))
+	}
+	switch c.Log.Format {
+	case "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("invalid log format %q", c.Log.Format))
+	}
+	return errors.Join(errs...)
+}
+
+func (c *CORS) validate() []error {
+	var errs []error
+	for _, origin := range c.AllowOrigins {
+		if origin == "*" {
+			if c.AllowCredentials {
+				errs = append(errs, errors.New("CORS credentials can't be allowed for all origins"))
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			errs = append(errs, fmt.Errorf("invalid CORS origin %q, expected scheme://host[:port]", origin))
+		}
+	}
+	for _, method := range c.AllowMethods {
+		switch method {
+		case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+		default:
+			errs = append(errs, fmt.Errorf("invalid CORS method %q", method))
+		}
+	}
+	if len(c.AllowOrigins) > 0 && len(c.AllowMethods) == 0 {
+		errs = append(errs, errors.New("CORS needs at least one allowed method"))
+	}
+	if c.MaxAge < 0 {
+		errs = append(errs, errors.New("CORS max age must not be negative"))
+	}
+	return errs
+}
+
+func (c *Identity) validate() []error {
+	var errs []error
+	if c.Secret != "" && len(c.Secret) < 32 {
+		errs = append(errs, errors.New("identity secret must be at least 32 bytes long"))
+	}
+	if c.Cookie == "" || strings.ContainsAny(c.Cookie, " \t\r\n\"(),/:;<=>?@[\\]{}") {
+		errs = append(errs, fmt.Errorf("invalid identity cookie name %q", c.Cookie))
+	}
+	if c.MaxAge <= 0 {
+		errs = append(errs, errors.New("identity cookie max age must be positive"))
+	}
+	if strings.ContainsAny(c.UserHeader, " \t\r\n:") {
+		errs = append(errs, fmt.Errorf("invalid user header %q", c.UserHeader))
+	}
+	if c.BallotSecret != "" && len(c.BallotSecret) < 32 {
+		errs = append(errs, errors.New("ballot secret must be at least 32 bytes long"))
+	}
+	return errs
+}
+
+// Address the api server binds to.
+func (c *Config) Addr() string {
+	return fmt.Sprintf("%s:%d", c.Server.Host, c.Server.Port)
+}
+
+// Address the render server binds to.
+func (c *Config) RenderAddr() string {
+	return fmt.Sprintf("%s:%d", c.Render.Host, c.Render.Port)
+}
+
+// Writes the config as YAML. Secrets are redacted.
+func (c *Config) Print(w io.Writer) error {
+	redacted := *c
+	if redacted.Admin.Token != "" {
+		redacted.Admin.Token = "<redacted>"
+	}
+	if redacted.Identity.Secret != "" {
+		redacted.Identity.Secret = "<redacted>"
+	}
+	if redacted.Identity.BallotSecret != "" {
+		redacted.Identity.BallotSecret = "<redacted>"
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if c.File != "" {
+		fmt.Fprintf(w, "# loaded from %s\n", c.File)
+	}
+	if err := enc.Encode(&redacted); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// Comma separated list flag
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = []string{}
+	for _, elem := range strings.Split(value, ",") {
+		if elem = strings.TrimSpace(elem); elem != "" {
+			*l = append(*l, elem)
+		}
+	}
+	return nil
+}
+
+// Comma separated key=duration flag
+type durationMap map[string]time.Duration
+
+func (m *durationMap) String() string {
+	if m == nil {
+		return ""
+	}
+	entries := make([]string, 0, len(*m))
+	for key, value := range *m {
+		entries = append(entries, key+"="+value.String())
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+func (m *durationMap) Set(value string) error {
+	*m = make(durationMap)
+	for _, entry := range strings.Split(value, ",") {
+		key, duration, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return fmt.Errorf("invalid entry %q, expected key=duration", entry)
+		}
+		d, err := time.ParseDuration(duration)
+		if err != nil {
+			return err
+		}
+		(*m)[key] = d
+	}
+	return nil
+}
+
+// Boolean flag calling a function when set to true
+type boolFunc func()
+
+func (f boolFunc) IsBoolFlag() bool { return true }
+func (f boolFunc) String() string   { return "false" }
+
+func (f boolFunc) Set(value string) error {
+	enabled, err := strconv.ParseBool(value)
+	if err == nil && enabled {
+		f()
+	}
+	return err
+}
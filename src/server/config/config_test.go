@@ -0,0 +1,198 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Writes a config file to a temporary directory.
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDefaultsAreValid(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load("api", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, Default()) {
+		t.Errorf("config without file, variables and flags differs from the defaults:\n%+v", cfg)
+	}
+}
+
+func TestExampleShowsDefaults(t *testing.T) {
+	cfg := Default()
+	if err := cfg.loadFile("moviepoll.example.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	cfg.File = ""
+	if !reflect.DeepEqual(cfg, Default()) {
+		t.Errorf("example config differs from the defaults:\n%+v", cfg)
+	}
+}
+
+func TestLoadLayers(t *testing.T) {
+	file := writeFile(t, "moviepoll.yaml", `
+server:
+  port: 1000
+db:
+  dsn: file:file.db
+log:
+  level: warn
+timeouts:
+  endpoints: {vote: 15s}
+`)
+	t.Setenv("MOVIEPOLL_CONFIG", file)
+	t.Setenv("MOVIEPOLL_PORT", "2000")
+	t.Setenv("MOVIEPOLL_CORSORIGINS", "http://localhost:35556, https://example.com")
+	cfg, err := Load("api", []string{"-polldb", "file:flag.db", "-endpointtimeouts", "data=5s,vote=20s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.File != file || cfg.Server.Port != 2000 || cfg.DB.DSN != "file:flag.db" || cfg.Log.Level != "warn" {
+		t.Errorf("layers weren't applied in order: %+v", cfg)
+	}
+	if !reflect.DeepEqual(cfg.CORS.AllowOrigins, []string{"http://localhost:35556", "https://example.com"}) {
+		t.Errorf("unexpected origins %v", cfg.CORS.AllowOrigins)
+	}
+	if !reflect.DeepEqual(cfg.Timeouts.Endpoints, map[string]time.Duration{"data": 5 * time.Second, "vote": 20 * time.Second}) {
+		t.Errorf("unexpected endpoint timeouts %v", cfg.Timeouts.Endpoints)
+	}
+	// settings of no layer keep their defaults
+	if cfg.Timeouts.Handler != Default().Timeouts.Handler || cfg.DB.BusyTimeout != Default().DB.BusyTimeout {
+		t.Errorf("defaults were overridden: %+v", cfg.Timeouts)
+	}
+}
+
+func TestLoadTOML(t *testing.T) {
+	file := writeFile(t, "moviepoll.toml", `
+[server]
+host = "127.0.0.1"
+
+[timeouts]
+write = "45s"
+
+[render]
+port = 8080
+
+[webhooks]
+allow_private = true
+`)
+	cfg, err := Load("render", []string{"-config", file, "-debug"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr() != "127.0.0.1:35555" || cfg.Timeouts.Write != 45*time.Second || cfg.RenderAddr() != ":8080" || !cfg.Webhooks.AllowPrivate || cfg.Log.Level != "debug" {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+}
+
+func TestLoadFailures(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+	}{
+		{"unknown flag", nil, []string{"-unknown"}},
+		{"invalid flag", nil, []string{"-port", "port"}},
+		{"invalid variable", map[string]string{"MOVIEPOLL_BUSYTIMEOUT": "long"}, nil},
+		{"invalid setting", nil, []string{"-loglevel", "verbose"}},
+		{"missing file", nil, []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}},
+		{"unsupported file", nil, []string{"-config", writeFile(t, "moviepoll.json", "{}")}},
+		{"invalid file", nil, []string{"-config", writeFile(t, "moviepoll.yaml", "server: [")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			if _, err := Load("api", test.args); err == nil {
+				t.Error("config was loaded")
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*Config)
+	}{
+		{"port", func(c *Config) { c.Server.Port = 70000 }},
+		{"render port", func(c *Config) { c.Render.Port = -1 }},
+		{"render url", func(c *Config) { c.Render.URL = "localhost:35556" }},
+		{"dsn", func(c *Config) { c.DB.DSN = "" }},
+		{"pool size", func(c *Config) { c.DB.MaxOpenConns = -1 }},
+		{"backup dir", func(c *Config) { c.Backup.Interval = time.Hour }},
+		{"trash retention", func(c *Config) { c.Trash.Retention = -time.Hour }},
+		{"webhook attempts", func(c *Config) { c.Webhooks.Attempts = 0 }},
+		{"cors origin", func(c *Config) { c.CORS.AllowOrigins = []string{"http://example.com/path"} }},
+		{"cors credentials", func(c *Config) { c.CORS.AllowOrigins, c.CORS.AllowCredentials = []string{"*"}, true }},
+		{"cors method", func(c *Config) { c.CORS.AllowMethods = []string{"FETCH"} }},
+		{"identity secret", func(c *Config) { c.Identity.Secret = "short" }},
+		{"identity cookie", func(c *Config) { c.Identity.Cookie = "voter id" }},
+		{"ballot secret", func(c *Config) { c.Identity.BallotSecret = "short" }},
+		{"rate limit", func(c *Config) { c.RateLimit.Rate = -1 }},
+		{"tls", func(c *Config) { c.TLS.CertFile = "cert.pem" }},
+		{"log level", func(c *Config) { c.Log.Level = "verbose" }},
+		{"log format", func(c *Config) { c.Log.Format = "xml" }},
+		{"trace exporter", func(c *Config) { c.Tracing.Exporter = "jaeger" }},
+		{"trace sample ratio", func(c *Config) { c.Tracing.SampleRatio = 2 }},
+	}
+	for _, test := range tests {
+		cfg := Default()
+		test.change(cfg)
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("invalid %s was accepted", test.name)
+		}
+	}
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	cfg := Default()
+	cfg.File = "moviepoll.yaml"
+	cfg.Admin.Token = "admin-token"
+	cfg.Identity.Secret = strings.Repeat("s", 32)
+	cfg.Identity.BallotSecret = strings.Repeat("b", 32)
+	cfg.Timeouts.Endpoints = map[string]time.Duration{"vote": 15 * time.Second}
+
+	var out bytes.Buffer
+	if err := cfg.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "# loaded from moviepoll.yaml\n") {
+		t.Errorf("printed config doesn't name its file:\n%s", out.String())
+	}
+	for _, secret := range []string{cfg.Admin.Token, cfg.Identity.Secret, cfg.Identity.BallotSecret} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("printed config contains secret %q", secret)
+		}
+	}
+
+	// printed configs can be loaded again
+	printed := Default()
+	if err := yaml.Unmarshal(out.Bytes(), printed); err != nil {
+		t.Fatal(err)
+	}
+	printed.File = cfg.File
+	printed.Admin.Token, printed.Identity.Secret, printed.Identity.BallotSecret = cfg.Admin.Token, cfg.Identity.Secret, cfg.Identity.BallotSecret
+	if !reflect.DeepEqual(printed, cfg) {
+		t.Errorf("printed config differs:\n%s", out.String())
+	}
+}
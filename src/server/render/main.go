@@ -1,7 +1,40 @@
 package main
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/AdrianPrawda/movie-poll/config"
+	"github.com/AdrianPrawda/movie-poll/telemetry"
+)
 
 func main() {
+	cfg, err := config.Load("render", os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if cfg.PrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// calls to the api should use telemetry.HTTPClient to propagate trace context
+	shutdownTracing, err := telemetry.Setup(context.Background(), "moviepoll-render", cfg.Tracing)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
 	fmt.Println("Not yet implemented")
 }
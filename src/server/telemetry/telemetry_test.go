@@ -0,0 +1,65 @@
+package telemetry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AdrianPrawda/movie-poll/config"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestSetup(t *testing.T) {
+	for _, exporter := range []string{"none", "stdout"} {
+		cfg := config.Default().Tracing
+		cfg.Exporter = exporter
+		shutdown, err := Setup(context.Background(), "test", cfg)
+		if err != nil {
+			t.Fatalf("%s exporter: %v", exporter, err)
+		}
+		if err := shutdown(context.Background()); err != nil {
+			t.Errorf("%s exporter: %v", exporter, err)
+		}
+	}
+
+	cfg := config.Default().Tracing
+	cfg.Exporter = "jaeger"
+	if _, err := Setup(context.Background(), "test", cfg); err == nil {
+		t.Error("unknown exporter was accepted")
+	}
+}
+
+func TestHTTPClientPropagatesTraceContext(t *testing.T) {
+	cfg := config.Default().Tracing
+	cfg.Exporter = "none"
+	if _, err := Setup(context.Background(), "test", cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer server.Close()
+
+	trace_id := trace.TraceID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace_id,
+		SpanID:     trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+		TraceFlags: trace.FlagsSampled,
+	}))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !strings.HasPrefix(traceparent, "00-"+trace_id.String()+"-") {
+		t.Errorf("trace context wasn't propagated: traceparent %q", traceparent)
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/AdrianPrawda/movie-poll/www
+
+go 1.21
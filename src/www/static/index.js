@@ -0,0 +1,642 @@
+"use strict";
+
+// Single page client of movie poll, talks to the /api/v2 endpoints of the api serving it.
+// Routes: / creates a poll (?previous=<poll_id> for follow-ups), /polls/<poll_id> votes
+// (?token=<invite token> for invite only polls), /polls/<poll_id>/results shows the results
+// and /polls/<poll_id>/invites shows the invites of a poll created in this browser.
+
+const REFRESH_INTERVAL = 3000; // ms between result updates
+const MIN_CHOICES = 2;
+
+const app = document.getElementById("app");
+let stopRefresh = null;
+
+// API
+
+class ApiError extends Error {
+  constructor(status, body) {
+    super((body && body.message) || `request failed with status ${status}`);
+    this.status = status;
+    this.code = body && body.code;
+    this.details = body && body.details;
+  }
+}
+
+async function api(method, path, body, headers) {
+  const options = { method, headers: { Accept: "application/json", ...headers } };
+  if (body !== undefined) {
+    options.headers["Content-Type"] = "application/json";
+    options.body = JSON.stringify(body);
+  }
+  const res = await fetch("/api/v2" + path, options);
+  const data = res.status === 204 ? null : await res.json().catch(() => null);
+  if (!res.ok) {
+    throw new ApiError(res.status, data);
+  }
+  return data;
+}
+
+// Voters of raw identity polls are identified by a random id kept in the browser. Polls with
+// signed identities use the identity cookie issued by the server instead.
+function userID() {
+  let id = localStorage.getItem("moviepoll.user_id");
+  if (!id) {
+    const bytes = crypto.getRandomValues(new Uint8Array(16));
+    id = Array.from(bytes, (b) => b.toString(16).padStart(2, "0")).join("");
+    localStorage.setItem("moviepoll.user_id", id);
+  }
+  return id;
+}
+
+function hasVoted(pollID) {
+  return localStorage.getItem("moviepoll.voted." + pollID) !== null;
+}
+
+function markVoted(pollID) {
+  localStorage.setItem("moviepoll.voted." + pollID, "1");
+}
+
+// Owner tokens of polls created in this browser, they list the invites of a poll chain.
+function ownerToken(pollID) {
+  return localStorage.getItem("moviepoll.owner." + pollID);
+}
+
+async function pollInvites(pollID) {
+  return api("GET", pollPath(pollID) + "/invites", undefined, { Authorization: "Bearer " + ownerToken(pollID) });
+}
+
+// Invite tokens from invite links. Successors of invite only polls accept the same tokens.
+async function inviteToken(poll) {
+  const token = localStorage.getItem("moviepoll.invite." + poll.id);
+  if (token || !poll.previous_poll) {
+    return token;
+  }
+  const chain = await api("GET", `/polls/${encodeURIComponent(poll.id)}/chain`).catch(() => ({ polls: [] }));
+  for (const id of chain.polls.reverse()) {
+    const token = localStorage.getItem("moviepoll.invite." + id);
+    if (token) {
+      return token;
+    }
+  }
+  return null;
+}
+
+// Results of polls hiding them until callers voted need the caller's user id or invite token.
+async function pollResults(poll) {
+  const params = new URLSearchParams({ user_id: userID() });
+  const token = poll.invite_only ? await inviteToken(poll) : null;
+  if (token) {
+    params.set("token", token);
+  }
+  return api("GET", pollPath(poll.id) + "/results?" + params);
+}
+
+// DOM
+
+// Creates an element. Attributes starting with "on" are event listeners, children may be
+// strings, nodes, arrays or null.
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  for (const [key, value] of Object.entries(attrs || {})) {
+    if (value === null || value === undefined || value === false) {
+      continue;
+    }
+    if (key.startsWith("on")) {
+      node.addEventListener(key.slice(2), value);
+    } else if (key === "class") {
+      node.className = value;
+    } else if (key in node && typeof value !== "string") {
+      node[key] = value;
+    } else {
+      node.setAttribute(key, value === true ? "" : value);
+    }
+  }
+  append(node, children);
+  return node;
+}
+
+function append(node, children) {
+  for (const child of children) {
+    if (child === null || child === undefined || child === false) {
+      continue;
+    }
+    if (Array.isArray(child)) {
+      append(node, child);
+    } else {
+      node.append(child);
+    }
+  }
+}
+
+function link(href, text, attrs) {
+  return el("a", { href, "data-link": true, ...attrs }, text);
+}
+
+function show(...children) {
+  app.replaceChildren(...children.filter(Boolean));
+}
+
+function showError(err) {
+  const message = err instanceof ApiError ? err.message : "Could not reach the server, try again later.";
+  show(el("div", { class: "card" }, el("p", { class: "error" }, message), link("/", "Create a new poll")));
+}
+
+function pluralize(count, word) {
+  return `${count} ${word}${count === 1 ? "" : "s"}`;
+}
+
+// Routing
+
+const routes = [
+  [/^\/$/, renderCreate],
+  [/^\/polls\/([^/]+)\/?$/, renderVote],
+  [/^\/polls\/([^/]+)\/results\/?$/, renderResults],
+  [/^\/polls\/([^/]+)\/invites\/?$/, renderInvites],
+];
+
+function navigate(path, replace) {
+  history[replace ? "replaceState" : "pushState"](null, "", path);
+  render();
+}
+
+function render() {
+  if (stopRefresh) {
+    stopRefresh();
+    stopRefresh = null;
+  }
+  for (const [pattern, view] of routes) {
+    const match = location.pathname.match(pattern);
+    if (match) {
+      const params = match.slice(1).map(decodeURIComponent);
+      view(...params).catch(showError);
+      return;
+    }
+  }
+  show(el("div", { class: "card" }, el("p", {}, "Page not found."), link("/", "Create a new poll")));
+}
+
+window.addEventListener("popstate", render);
+document.addEventListener("click", (event) => {
+  const a = event.target.closest("a[data-link]");
+  if (!a || event.button !== 0 || event.ctrlKey || event.metaKey || event.shiftKey || event.altKey) {
+    return;
+  }
+  event.preventDefault();
+  navigate(a.getAttribute("href"));
+});
+
+// Shared components
+
+function pollPath(id) {
+  return "/polls/" + encodeURIComponent(id);
+}
+
+// Links to the previous, next and latest poll of the chain.
+async function chainNav(poll) {
+  const links = [];
+  if (poll.previous_poll) {
+    links.push(link(pollPath(poll.previous_poll) + "/results", "← Previous poll"));
+  }
+  if (poll.next_poll) {
+    links.push(link(pollPath(poll.next_poll), "Next poll →"));
+  }
+  if (poll.latest_poll && poll.latest_poll !== poll.id && poll.latest_poll !== poll.next_poll) {
+    links.push(link(pollPath(poll.latest_poll), "Latest poll ⇥"));
+  }
+
+  if (poll.previous_poll || poll.next_poll) {
+    try {
+      const chain = await api("GET", `/polls/${encodeURIComponent(poll.id)}/chain`);
+      const position = chain.polls.indexOf(poll.id) + 1;
+      links.unshift(el("span", { class: "muted" }, `Round ${position} of ${chain.polls.length}`));
+    } catch (err) {
+      // the position is optional, links work without it
+    }
+  }
+  return links.length ? el("nav", { class: "chain" }, links) : null;
+}
+
+function pollHeader(poll, nav) {
+  const kind = poll.type === "multiple" ? "multiple choice" : "single choice";
+  return [
+    el("h1", {}, poll.title),
+    el("p", { class: "muted" }, `${kind} · ${poll.votes_cast} of ${pluralize(poll.votes_required, "vote")} cast`),
+    nav,
+  ];
+}
+
+function shareBox(id) {
+  const url = location.origin + pollPath(id);
+  const input = el("input", { type: "text", value: url, readonly: true, "aria-label": "Poll link" });
+  const copy = el("button", {
+    type: "button",
+    class: "secondary",
+    onclick: async () => {
+      try {
+        await navigator.clipboard.writeText(url);
+        copy.textContent = "Copied";
+      } catch (err) {
+        input.select();
+      }
+    },
+  }, "Copy");
+  return el("div", { class: "card" }, el("label", {}, "Share this poll"), el("div", { class: "share" }, input, copy));
+}
+
+// Create view
+
+async function renderCreate() {
+  const previousID = new URLSearchParams(location.search).get("previous");
+  let previous = null;
+  let initialChoices = [];
+  if (previousID) {
+    previous = await api("GET", pollPath(previousID));
+    initialChoices = previous.choices.map((choice) => choice.content);
+    // follow-ups of concluded polls only keep the tied winners
+    if (previous.concluded || previous.closed) {
+      const results = await api("GET", pollPath(previousID) + "/results");
+      if (results.winners.length > 1) {
+        initialChoices = results.results.filter((r) => results.winners.includes(r.id)).map((r) => r.content);
+      }
+    }
+  }
+
+  const choices = el("div", {});
+  const error = el("p", { class: "error", role: "alert" });
+
+  function choiceInputs() {
+    return Array.from(choices.querySelectorAll("input"));
+  }
+
+  function updateChoices() {
+    const inputs = choiceInputs();
+    // keep one empty input at the end to add further choices
+    if (inputs[inputs.length - 1].value.trim() !== "") {
+      addChoice("");
+    }
+    const removable = choiceInputs().length > MIN_CHOICES;
+    choices.querySelectorAll("button").forEach((button) => (button.disabled = !removable));
+  }
+
+  function addChoice(value) {
+    const n = choiceInputs().length + 1;
+    const input = el("input", { type: "text", value, placeholder: `Movie ${n}`, "aria-label": `Choice ${n}`, oninput: updateChoices });
+    const row = el("div", { class: "choice-row" }, input, el("button", {
+      type: "button",
+      class: "icon",
+      title: "Remove choice",
+      "aria-label": "Remove choice",
+      onclick: () => {
+        row.remove();
+        updateChoices();
+      },
+    }, "✕"));
+    choices.append(row);
+  }
+
+  for (const value of initialChoices) {
+    addChoice(value);
+  }
+  while (choiceInputs().length < MIN_CHOICES) {
+    addChoice("");
+  }
+  updateChoices();
+
+  const title = el("input", { type: "text", id: "title", required: true, value: previous ? previous.title : "", placeholder: "Movie night" });
+  const votes = el("input", { type: "number", id: "votes", min: "1", required: true, value: String(previous ? previous.votes_required : 3) });
+  const single = el("input", { type: "radio", name: "type", value: "single", checked: !previous || previous.type === "single" });
+  const multiple = el("input", { type: "radio", name: "type", value: "multiple", checked: !!previous && previous.type === "multiple" });
+  const autoCreate = el("input", { type: "checkbox", checked: !!previous && previous.auto_create });
+  const anonymous = el("input", { type: "checkbox", checked: !!previous && previous.anonymous });
+  // invite only polls need a vote of every invitee unless the votes were changed by hand
+  let votesChanged = false;
+  votes.addEventListener("input", () => (votesChanged = true));
+  const invitees = el("textarea", {
+    id: "invitees",
+    rows: "3",
+    placeholder: "Leave empty to let anyone with the link vote",
+    oninput: () => {
+      const count = inviteeNames().length;
+      if (count > 0 && !votesChanged) {
+        votes.value = String(count);
+      }
+    },
+  });
+  function inviteeNames() {
+    return invitees.value.split("\n").map((name) => name.trim()).filter((name) => name !== "");
+  }
+  if (previous && previous.invite_only && ownerToken(previous.id)) {
+    try {
+      invitees.value = (await pollInvites(previous.id)).invites.map((invite) => invite.name).join("\n");
+    } catch (err) {
+      // invitees are optional, they can be entered again
+    }
+  }
+  const identity = previous ? previous.identity : "raw";
+  const identities = [
+    ["raw", "an id kept in their browser"],
+    ["signed", "a cookie signed by the server"],
+    ["authenticated", "their login"],
+  ].map(([value, text]) => el("label", { class: "option" },
+    el("input", { type: "radio", name: "identity", value, checked: value === identity }), text));
+  const visibility = previous ? previous.visibility : "live";
+  const visibilities = [
+    ["live", "while voting"],
+    ["voted", "to voters once they voted"],
+    ["closed", "once all votes are in"],
+  ].map(([value, text]) => el("label", { class: "option" },
+    el("input", { type: "radio", name: "visibility", value, checked: value === visibility }), text));
+  const submit = el("button", { type: "submit" }, "Create poll");
+
+  const form = el("form", {
+    class: "card",
+    onsubmit: async (event) => {
+      event.preventDefault();
+      error.textContent = "";
+      const req = {
+        title: title.value.trim(),
+        votes: parseInt(votes.value, 10),
+        choices: choiceInputs().map((input) => input.value.trim()).filter((value) => value !== ""),
+        type: multiple.checked ? "multiple" : "single",
+        auto_create: autoCreate.checked,
+        anonymous: anonymous.checked,
+        identity: form.querySelector("input[name=identity]:checked").value,
+        visibility: form.querySelector("input[name=visibility]:checked").value,
+      };
+      if (inviteeNames().length > 0) {
+        req.invitees = inviteeNames();
+      }
+      if (previous) {
+        req.previous_poll_id = previous.id;
+      }
+      if (req.choices.length < MIN_CHOICES) {
+        error.textContent = `Add at least ${MIN_CHOICES} choices.`;
+        return;
+      }
+      submit.disabled = true;
+      try {
+        const resp = await api("POST", "/polls", req);
+        localStorage.setItem("moviepoll.owner." + resp.poll_id, resp.owner_token);
+        if (resp.invites) {
+          // invite tokens are only returned once, keep them to show the invite links
+          localStorage.setItem("moviepoll.invites." + resp.poll_id, JSON.stringify(resp.invites));
+          navigate(pollPath(resp.poll_id) + "/invites");
+          return;
+        }
+        navigate(pollPath(resp.poll_id) + "?created");
+      } catch (err) {
+        if (err.code === "identity_disabled") {
+          error.textContent = "This server can't identify voters that way, pick another option.";
+        } else if (err.code === "anonymity_disabled") {
+          error.textContent = "This server doesn't support anonymous ballots.";
+        } else {
+          error.textContent = err instanceof ApiError ? err.message : "Could not reach the server, try again later.";
+        }
+        submit.disabled = false;
+      }
+    },
+  },
+    el("h1", {}, previous ? "Create a follow-up poll" : "Create a poll"),
+    previous && el("p", { class: "muted" }, "Follows ", link(pollPath(previous.id) + "/results", previous.title)),
+    el("label", { for: "title" }, "Title"),
+    title,
+    el("label", {}, "Choices"),
+    choices,
+    el("label", {}, "Voters pick"),
+    el("label", { class: "option" }, single, "one choice"),
+    el("label", { class: "option" }, multiple, "any number of choices"),
+    el("label", {}, "Voters are identified by"),
+    identities,
+    el("label", {}, "Results are shown"),
+    visibilities,
+    el("label", { for: "invitees" }, "Invitees, one per line"),
+    invitees,
+    el("label", { for: "votes" }, "Votes needed to conclude the poll"),
+    votes,
+    el("label", { class: "check" }, autoCreate, "Start the next poll automatically once all votes are in"),
+    el("label", { class: "check" }, anonymous, "Keep ballots anonymous, nobody can see who voted for what"),
+    error,
+    el("div", { class: "row" }, submit),
+  );
+  show(form);
+  title.focus();
+}
+
+// Vote view
+
+async function renderVote(id) {
+  // invite links carry the token, keep it out of the address bar and history
+  const params = new URLSearchParams(location.search);
+  if (params.has("token")) {
+    localStorage.setItem("moviepoll.invite." + id, params.get("token"));
+    params.delete("token");
+    history.replaceState(null, "", pollPath(id) + (params.toString() ? "?" + params : ""));
+  }
+
+  const poll = await api("GET", pollPath(id));
+  if (poll.concluded || poll.closed || hasVoted(id)) {
+    navigate(pollPath(id) + "/results", true);
+    return;
+  }
+  const token = poll.invite_only ? await inviteToken(poll) : null;
+  if (poll.invite_only && !token) {
+    show(el("div", { class: "card" },
+      pollHeader(poll, await chainNav(poll)),
+      el("p", {}, "This poll is invite only, open the invite link you were sent to vote."),
+      el("div", { class: "row" }, link(pollPath(id) + "/results", "Show results")),
+    ));
+    return;
+  }
+
+  const created = params.has("created");
+  const error = el("p", { class: "error", role: "alert" });
+  const kind = poll.type === "multiple" ? "checkbox" : "radio";
+  const options = poll.choices.map((choice) =>
+    el("label", { class: "option" }, el("input", { type: kind, name: "choice", value: String(choice.id) }), choice.content),
+  );
+  const submit = el("button", { type: "submit" }, "Vote");
+
+  const form = el("form", {
+    class: "card",
+    onsubmit: async (event) => {
+      event.preventDefault();
+      error.textContent = "";
+      const votes = Array.from(form.querySelectorAll("input[name=choice]:checked"), (input) => parseInt(input.value, 10));
+      if (votes.length === 0) {
+        error.textContent = "Pick a choice first.";
+        return;
+      }
+      submit.disabled = true;
+      try {
+        await api("POST", pollPath(id) + "/votes", { user_id: userID(), votes, token: token || undefined });
+        markVoted(id);
+        navigate(pollPath(id) + "/results");
+      } catch (err) {
+        if (err.code === "already_voted" || err.code === "invite_used") {
+          markVoted(id);
+        }
+        if (["already_voted", "invite_used", "poll_closed", "poll_concluded"].includes(err.code)) {
+          navigate(pollPath(id) + "/results", true);
+          return;
+        }
+        if (err.code === "invalid_invite") {
+          error.textContent = "Your invite link isn't valid for this poll.";
+        } else if (err.code === "identity_required") {
+          // the server answers with a new identity cookie, voting again uses it
+          error.textContent = poll.identity === "authenticated"
+            ? "Sign in to vote on this poll."
+            : "Your browser has no voter cookie yet, allow cookies and vote again.";
+        } else {
+          error.textContent = err instanceof ApiError ? err.message : "Could not reach the server, try again later.";
+        }
+        submit.disabled = false;
+      }
+    },
+  },
+    pollHeader(poll, await chainNav(poll)),
+    el("p", {}, poll.type === "multiple" ? "Pick every movie you'd watch." : "Pick one movie."),
+    options,
+    error,
+    el("div", { class: "row" }, submit, el("span", { class: "spacer" }), link(pollPath(id) + "/results", "Show results")),
+  );
+  show(form, created && shareBox(id));
+}
+
+// Results view
+
+async function renderResults(id) {
+  let poll = await api("GET", pollPath(id));
+  let results = await pollResults(poll);
+  let nav = await chainNav(poll);
+
+  const view = el("div", {});
+  function update() {
+    const finished = results.concluded || results.closed;
+    const maxVotes = Math.max(1, ...results.results.map((r) => r.votes));
+    const share = Math.min(100, (100 * results.votes_cast) / Math.max(1, results.votes_required));
+
+    let status;
+    if (results.closed) {
+      status = "This poll was closed.";
+    } else if (results.concluded) {
+      status = "All votes are in.";
+    } else if (results.hidden) {
+      status = `Waiting for ${pluralize(results.votes_required - results.votes_cast, "more vote")}.`;
+    } else {
+      status = `Waiting for ${pluralize(results.votes_required - results.votes_cast, "more vote")}, results update live.`;
+    }
+    const hidden = results.hidden && el("p", {}, results.visibility === "voted"
+      ? "Results are shown once you voted."
+      : "Results are shown once all votes are in.");
+
+    const winners = results.results.filter((r) => results.winners.includes(r.id));
+    let outcome = null;
+    if (finished && results.votes_cast > 0) {
+      outcome = winners.length === 1
+        ? el("p", {}, "Winner: ", el("strong", {}, winners[0].content))
+        : el("p", {}, "Tie between ", el("strong", {}, winners.map((w) => w.content).join(", ")));
+    }
+
+    let next = null;
+    if (poll.next_poll) {
+      next = link(pollPath(poll.next_poll), "Continue to the next poll", { class: "button" });
+    } else if (finished && !poll.auto_create) {
+      next = link("/?previous=" + encodeURIComponent(id), "Start a follow-up poll", { class: "button" });
+    }
+    const canVote = !finished && !hasVoted(id);
+    const invites = poll.invite_only && ownerToken(id) && link(pollPath(id) + "/invites", "Invites", { class: "button secondary" });
+
+    view.replaceChildren(el("div", { class: "card" },
+      pollHeader({ ...poll, votes_cast: results.votes_cast }, nav),
+      el("p", { class: "muted" }, status),
+      el("div", { class: "progress", role: "progressbar", "aria-valuenow": String(Math.round(share)), "aria-valuemin": "0", "aria-valuemax": "100" },
+        el("div", { style: `width: ${share}%` })),
+      hidden,
+      el("ul", { class: "results" }, results.results.map((r) =>
+        el("li", { class: results.votes_cast > 0 && results.winners.includes(r.id) ? "winner" : null },
+          el("div", { class: "bar", style: `width: ${(100 * r.votes) / maxVotes}%` }),
+          el("div", { class: "label" }, el("span", {}, r.content), el("span", {}, String(r.votes)))),
+      )),
+      outcome,
+      (next || canVote || invites) && el("div", { class: "row" }, next, invites, el("span", { class: "spacer" }), canVote && link(pollPath(id), "Vote")),
+    ), !poll.invite_only && shareBox(id));
+  }
+  update();
+  show(view);
+
+  // refresh until the poll is finished and its successor, if any, is known
+  let timer = null;
+  let cancelled = false;
+  async function refresh() {
+    if (!document.hidden) {
+      try {
+        const [p, r] = await Promise.all([api("GET", pollPath(id)), pollResults(poll)]);
+        if (cancelled) {
+          return;
+        }
+        if (p.next_poll !== poll.next_poll) {
+          nav = await chainNav(p);
+        }
+        poll = p;
+        results = r;
+        update();
+      } catch (err) {
+        // keep showing the last results, the next refresh may succeed
+      }
+    }
+    const finished = results.concluded || results.closed;
+    if (!cancelled && !(finished && (poll.next_poll || !poll.auto_create))) {
+      timer = setTimeout(refresh, REFRESH_INTERVAL);
+    }
+  }
+  timer = setTimeout(refresh, REFRESH_INTERVAL);
+  stopRefresh = () => {
+    cancelled = true;
+    clearTimeout(timer);
+  };
+}
+
+// Invites view, only for polls created in this browser
+
+async function renderInvites(id) {
+  const poll = await api("GET", pollPath(id));
+  if (!ownerToken(id)) {
+    show(el("div", { class: "card" },
+      el("p", {}, "Only the browser that created this poll can see its invites."),
+      link(pollPath(id) + "/results", "Show results")));
+    return;
+  }
+  const status = await pollInvites(id);
+  // tokens are kept for the poll they were created with, its successors accept them as well
+  let stored = localStorage.getItem("moviepoll.invites." + id);
+  if (!stored && poll.previous_poll) {
+    const chain = await api("GET", `/polls/${encodeURIComponent(id)}/chain`).catch(() => ({ polls: [] }));
+    stored = chain.polls.map((pollID) => localStorage.getItem("moviepoll.invites." + pollID)).find(Boolean);
+  }
+  const tokens = new Map();
+  for (const invite of JSON.parse(stored || "[]")) {
+    tokens.set(invite.name, invite.token);
+  }
+
+  const rows = status.invites.map((invite) => {
+    const token = tokens.get(invite.name);
+    const url = token && location.origin + pollPath(id) + "?token=" + encodeURIComponent(token);
+    return el("li", {},
+      el("div", { class: "label" },
+        el("span", {}, invite.name),
+        el("span", { class: "muted" }, invite.voted ? "voted" : "pending")),
+      url && el("div", { class: "share" },
+        el("input", { type: "text", value: url, readonly: true, "aria-label": `Invite link of ${invite.name}` })));
+  });
+  show(el("div", { class: "card" },
+    pollHeader(poll, await chainNav(poll)),
+    el("p", { class: "muted" }, status.pending.length
+      ? `Waiting for ${status.pending.join(", ")}.`
+      : "Every invitee voted."),
+    tokens.size > 0 && el("p", {}, "Send every invitee their own link, each link can vote once per poll."),
+    el("ul", { class: "invites" }, rows),
+    el("div", { class: "row" }, link(pollPath(id) + "/results", "Show results", { class: "button" })),
+  ));
+}
+
+render();
@@ -0,0 +1,25 @@
+// Web client of movie poll, embedded into the api so one binary serves both.
+package www
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed public static
+var files embed.FS
+
+var (
+	// Pages served at the root, index.html is the single page of the client.
+	Public = sub("public")
+	// Scripts and styles served under /static.
+	Static = sub("static")
+)
+
+func sub(dir string) fs.FS {
+	f, err := fs.Sub(files, dir)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
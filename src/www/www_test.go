@@ -0,0 +1,31 @@
+package www
+
+import (
+	"io/fs"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAssets(t *testing.T) {
+	index, err := fs.ReadFile(Public, "index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// everything linked by the page is embedded
+	links := regexp.MustCompile(`(?:href|src)="/static/([^"]+)"`).FindAllStringSubmatch(string(index), -1)
+	if len(links) == 0 {
+		t.Fatal("index.html links no assets")
+	}
+	for _, link := range links {
+		asset, err := fs.ReadFile(Static, link[1])
+		if err != nil {
+			t.Errorf("linked asset %s: %v", link[1], err)
+			continue
+		}
+		if len(strings.TrimSpace(string(asset))) == 0 {
+			t.Errorf("linked asset %s is empty", link[1])
+		}
+	}
+}